@@ -1,244 +1,252 @@
-package main
+package distrochya
 
 import (
 	"fmt"
-	"math/rand"
-	"sync"
 	"sync/atomic"
 	"time"
 )
 
-var leaderID uint64
-var oldLeaderID uint64
-var chatParticipation uint32 = 1
-var chatNameMutex = &sync.Mutex{}
-var chatName = "User"
-
-var leaderElectionMutex = &sync.Mutex{}
-var leaderElectionTimer *time.Timer
-var electionParticipated uint32
-var electionStartTriggerFlag uint32
-
-func startElectionTimer(t uint8) {
-	if getNetworkState() == singleNode {
-		log("Attempt to start election timer with networkState==singleNode, assuming leader role")
-		updateLeaderID(nodeID)
+func (inst *Instance) startElectionTimer(t uint8) {
+	if inst.NetworkState() == singleNode {
+		inst.log("Attempt to start election timer with networkState==singleNode, assuming leader role")
+		inst.updateLeaderID(inst.getNodeID())
 		return
 	}
 
-	leaderElectionMutex.Lock()
-	defer leaderElectionMutex.Unlock()
+	inst.leaderElectionMutex.Lock()
+	defer inst.leaderElectionMutex.Unlock()
 
-	if leaderElectionTimer != nil {
+	if inst.leaderElectionTimer != nil {
 		return
 	}
 
-	log(fmt.Sprintf("startElectionTimer timeout=%ds", t))
-	leaderElectionTimer := time.NewTimer(time.Duration(t) * time.Second)
+	inst.log(fmt.Sprintf("startElectionTimer timeout=%ds", t))
+	inst.getClock().AfterFunc(time.Duration(t)*time.Second, func() {
+		if inst.LeaderID() == 0 {
+			inst.log("Absence of leader detected")
+			inst.setElectionParticipated()
 
-	go func() {
-		<-leaderElectionTimer.C
-
-		if getLeaderID() == 0 {
-			log("Absence of leader detected")
-			setElectionParticipated()
-
-			nextNode := findNodeByRelation(next)
+			nextNode := inst.findNodeByRelation(next)
 			if nextNode == nil {
-				log("Absence of leader detected without having next node")
+				inst.log("Absence of leader detected without having next node")
 
-				prevNode := findNodeByRelation(prev)
+				prevNode := inst.findNodeByRelation(prev)
 
 				if prevNode == nil {
-					log("Absence of leader detected without having next or prev node, falling back to singleNode")
-					updateNetworkState(singleNode)
+					inst.log("Absence of leader detected without having next or prev node, falling back to singleNode")
+					inst.updateNetworkState(singleNode)
 				} else {
-					log("Absence of leader detected without having next node: Awaiting ring repair")
+					inst.log("Absence of leader detected without having next node: Awaiting ring repair")
 				}
 			} else {
-				log(fmt.Sprintf("Absence of leader detected: sending election, target_id=0x%X, candidate_id=0x%X", nextNode.id, nodeID))
-				nextNode.sendMessage(election, idToString(nodeID))
+				inst.log(fmt.Sprintf("Absence of leader detected: sending election, target_id=0x%X, candidate_id=0x%X", nextNode.id, inst.getNodeID()))
+				nextNode.sendMessage(election, idToString(inst.getNodeID()))
+				atomic.AddUint64(&inst.metrics.electionsStarted, 1)
 			}
-			resetElectionTimer()
+			inst.resetElectionTimer()
 		}
-	}()
+	})
 }
 
-func updateLeaderID(id uint64) {
-	atomic.StoreUint64(&oldLeaderID, getLeaderID())
-	atomic.StoreUint64(&leaderID, id)
+func (inst *Instance) updateLeaderID(id uint64) {
+	old := inst.LeaderID()
+	atomic.StoreUint64(&inst.oldLeaderID, old)
+	atomic.StoreUint64(&inst.leaderID, id)
+
+	if old != id {
+		inst.emit(Event{Type: LeaderChanged, Leader: id})
+	}
 
-	if server == nil {
+	if inst.server == nil {
 		return
 	}
 
 	if id == 0 {
-		resetElectionParticipated()
-		resetElectionStartTriggerFlag()
-		stopElectionTimer()
+		inst.resetElectionParticipated()
+		inst.resetElectionStartTriggerFlag()
+		inst.stopElectionTimer()
 
-		startElectionTimer(uint8(leaderElectionMinimumWaitSeconds + (rand.Uint32() % (leaderElectionMaximumWaitSeconds - leaderElectionMinimumWaitSeconds))))
+		c := inst.Config()
+		inst.startElectionTimer(uint8(c.LeaderElectionMinimumWaitSeconds + inst.randomIntn(c.LeaderElectionMaximumWaitSeconds-c.LeaderElectionMinimumWaitSeconds)))
 	} else {
-		resetElectionParticipated()
-		resetElectionStartTriggerFlag()
-		stopElectionTimer()
+		inst.resetElectionParticipated()
+		inst.resetElectionStartTriggerFlag()
+		inst.stopElectionTimer()
 	}
 }
 
-func hasElectionParticipated() bool {
-	return atomic.LoadUint32(&electionParticipated) != 0
+func (inst *Instance) hasElectionParticipated() bool {
+	return atomic.LoadUint32(&inst.electionParticipated) != 0
 }
 
-func resetElectionParticipated() {
-	atomic.StoreUint32(&electionParticipated, 0)
+func (inst *Instance) resetElectionParticipated() {
+	atomic.StoreUint32(&inst.electionParticipated, 0)
 }
 
-func setElectionParticipated() {
-	atomic.StoreUint32(&electionParticipated, 1)
+func (inst *Instance) setElectionParticipated() {
+	atomic.StoreUint32(&inst.electionParticipated, 1)
 }
 
-func getLeaderID() uint64 {
-	return atomic.LoadUint64(&leaderID)
+func (inst *Instance) LeaderID() uint64 {
+	return atomic.LoadUint64(&inst.leaderID)
 }
 
-func getOldLeaderID() uint64 {
-	return atomic.LoadUint64(&oldLeaderID)
+func (inst *Instance) getOldLeaderID() uint64 {
+	return atomic.LoadUint64(&inst.oldLeaderID)
 }
 
-func isElectionStartTriggerFlagSet() bool {
-	return atomic.LoadUint32(&electionStartTriggerFlag) != 0
+func (inst *Instance) isElectionStartTriggerFlagSet() bool {
+	return atomic.LoadUint32(&inst.electionStartTriggerFlag) != 0
 }
 
-func setElectionStartTriggerFlag() {
-	atomic.StoreUint32(&electionStartTriggerFlag, 1)
+func (inst *Instance) setElectionStartTriggerFlag() {
+	atomic.StoreUint32(&inst.electionStartTriggerFlag, 1)
 }
 
-func resetElectionStartTriggerFlag() {
-	atomic.StoreUint32(&electionStartTriggerFlag, 0)
+func (inst *Instance) resetElectionStartTriggerFlag() {
+	atomic.StoreUint32(&inst.electionStartTriggerFlag, 0)
 }
 
-func setChatParticipation() {
-	atomic.StoreUint32(&chatParticipation, 1)
+func (inst *Instance) JoinChat() {
+	atomic.StoreUint32(&inst.chatParticipation, 1)
 
-	if isNetworkRunning() {
-		connectToLeader()
-		appendChatView(fmt.Sprintf("\x1b[33mYou have joined the chat\x1b[0m"))
+	if inst.IsRunning() {
+		inst.connectToLeader()
+		inst.userEvent("you have joined the chat")
 	}
 }
 
-func getChatParticipation() uint32 {
-	return atomic.LoadUint32(&chatParticipation)
+func (inst *Instance) getChatParticipation() uint32 {
+	return atomic.LoadUint32(&inst.chatParticipation)
 }
 
-func resetChatParticipation() {
-	atomic.StoreUint32(&chatParticipation, 0)
+func (inst *Instance) IsChatParticipant() bool {
+	return inst.getChatParticipation() == 1
+}
+
+func (inst *Instance) LeaveChat() {
+	atomic.StoreUint32(&inst.chatParticipation, 0)
 
-	if isNetworkRunning() {
-		disconnectFromLeader()
-		updateUsers(nil)
-		appendChatView(fmt.Sprintf("\x1b[33mYou have left the chat\x1b[0m"))
+	if inst.IsRunning() {
+		inst.disconnectFromLeader()
+		inst.updateUsers(nil)
+		inst.userEvent("you have left the chat")
 	}
 }
 
-func stopElectionTimer() {
-	leaderElectionMutex.Lock()
-	defer leaderElectionMutex.Unlock()
+func (inst *Instance) stopElectionTimer() {
+	inst.leaderElectionMutex.Lock()
+	defer inst.leaderElectionMutex.Unlock()
 
-	if leaderElectionTimer != nil {
-		leaderElectionTimer.Stop()
-		log("Election timer stopped")
+	if inst.leaderElectionTimer != nil {
+		inst.leaderElectionTimer.Stop()
+		inst.log("Election timer stopped")
 	}
 
-	leaderElectionTimer = nil
+	inst.leaderElectionTimer = nil
 }
 
-func resetElectionTimer() {
-	stopElectionTimer()
-	startElectionTimer(leaderElectionTimeoutSeconds)
+func (inst *Instance) resetElectionTimer() {
+	inst.stopElectionTimer()
+	inst.startElectionTimer(uint8(inst.Config().LeaderElectionTimeoutSeconds))
 }
 
-func setChatName(n string) {
-	chatNameMutex.Lock()
-	chatName = n
-	chatNameMutex.Unlock()
+func (inst *Instance) SetChatName(n string) {
+	inst.chatNameMutex.Lock()
+	inst.chatName = n
+	inst.chatNameMutex.Unlock()
+
+	inst.scheduleStateSave()
 }
 
-func getChatName() string {
-	chatNameMutex.Lock()
-	rtn := chatName
-	chatNameMutex.Unlock()
+func (inst *Instance) ChatName() string {
+	inst.chatNameMutex.Lock()
+	rtn := inst.chatName
+	inst.chatNameMutex.Unlock()
 
 	return rtn
 }
 
-func connectToLeader() {
-	if len(getChatName()) < 1 {
-		userError("Unable to connect: no chat nickname set")
+func (inst *Instance) connectToLeader() {
+	if len(inst.ChatName()) < 1 {
+		inst.userError("Unable to connect: no chat nickname set")
 		return
 	}
 
-	disconnectFromLeader()
+	inst.disconnectFromLeader()
 
-	newLeaderID := getLeaderID()
-	newLeader := connectToNode(idToEndpoint(newLeaderID))
+	newLeaderID := inst.LeaderID()
+	newLeader := inst.connectToNodeID(newLeaderID)
 
 	if newLeader == nil {
-		updateLeaderID(0)
-		log("Connection to a new leader failed")
+		inst.updateLeaderID(0)
+		inst.warnLog("Connection to a new leader failed")
 		return
 	}
 
 	newLeader.lock.Lock()
-	newLeader.id = newLeaderID
-	newLeader.r = leader
+	newLeader.setID(newLeaderID)
+	newLeader.setRelation(leader)
 	newLeader.lock.Unlock()
-	newLeader.sendMessage(connect, idToString(nodeID), string(follower), getChatName())
+	newLeader.sendMessage(newLeader.connectMessage(follower, inst.ChatName())...)
 
-	setConnectedName(getChatName())
+	inst.setConnectedName(inst.ChatName())
 }
 
-func disconnectFromLeader() {
-	resetConnectedName()
+func (inst *Instance) disconnectFromLeader() {
+	inst.resetConnectedName()
 
-	existingLeader := findNodeByRelation(leader)
+	existingLeader := inst.findNodeByRelation(leader)
 
 	if existingLeader != nil {
 		existingLeader.lock.Lock()
-		existingLeader.r = none
+		existingLeader.setRelation(none)
 		existingLeader.lock.Unlock()
 
 		existingLeader.disconnect()
 	}
 }
 
-func handleNewLeader(id uint64) {
-	defer updateStatus()
+func (inst *Instance) handleNewLeader(id uint64) {
+	defer inst.updateStatus()
 
-	resetChatConnections()
-	updateLeaderID(id)
+	inst.resetChatConnections()
+
+	if inst.LeaderID() != id {
+		inst.countLeaderChange()
+	}
+
+	inst.updateLeaderID(id)
+
+	inst.log(fmt.Sprintf("New leader elected, nodeID=0x%X", id))
+
+	// make sure the whole ring shares the moderation state of the new leader
+	if id == inst.getNodeID() {
+		inst.replicateModeration()
+	}
 
-	log(fmt.Sprintf("New leader elected, nodeID=0x%X", id))
+	inst.scheduleStateSave()
 
-	if getChatParticipation() == 1 {
-		connectToLeader()
+	if inst.getChatParticipation() == 1 {
+		inst.connectToLeader()
 	}
 }
 
-func chatMessage(m string) {
-	if isNetworkRunning() {
-		if getChatParticipation() > 0 {
-			leader := findNodeByRelation(leader)
+func (inst *Instance) SendChat(m string) {
+	if inst.IsRunning() {
+		if inst.getChatParticipation() > 0 {
+			leader := inst.findNodeByRelation(leader)
 
 			if leader != nil {
-				log(fmt.Sprintf("Sending chatmessagesend, target_id=0x%X", leader.id))
+				inst.log(fmt.Sprintf("Sending chatmessagesend, target_id=0x%X", leader.id))
 				leader.sendMessage(chatmessagesend, m)
 			} else {
-				userError("cannot send your message because there is no leader on the network, please wait a few moments and then try again")
+				inst.userError("cannot send your message because there is no leader on the network, please wait a few moments and then try again")
 			}
 		} else {
-			userError("you are not participating in the chat")
+			inst.userError("you are not participating in the chat")
 		}
 	} else {
-		userError("you are not connected to any network")
+		inst.userError("you are not connected to any network")
 	}
 }
@@ -1,49 +1,58 @@
-package main
-
-import "sync"
-
-var chatConnectionsLock = &sync.Mutex{}
-var chatConnections = make(map[*Node]string)
-
-func addChatConnection(n *Node, u string) {
-	chatConnectionsLock.Lock()
-	defer chatConnectionsLock.Unlock()
-
-	chatConnections[n] = u
-}
-
-func getConnectedNames() []string {
-	chatConnectionsLock.Lock()
-	defer chatConnectionsLock.Unlock()
-
-	rtn := make([]string, len(chatConnections))
-	i := 0
-
-	for _, n := range chatConnections {
-		rtn[i] = n
-		i++
-	}
-
-	return rtn
-}
-
-func getUsername(n *Node) string {
-	chatConnectionsLock.Lock()
-	defer chatConnectionsLock.Unlock()
-
-	return chatConnections[n]
-}
-
-func removeChatConnection(n *Node) {
-	chatConnectionsLock.Lock()
-	defer chatConnectionsLock.Unlock()
-
-	delete(chatConnections, n)
-}
-
-func resetChatConnections() {
-	chatConnectionsLock.Lock()
-	defer chatConnectionsLock.Unlock()
-
-	chatConnections = make(map[*Node]string)
-}
+package distrochya
+
+func (inst *Instance) addChatConnection(n *Node, u string) {
+	inst.chatConnectionsLock.Lock()
+	defer inst.chatConnectionsLock.Unlock()
+
+	inst.chatConnections[n] = u
+}
+
+func (inst *Instance) getConnectedNames() []string {
+	inst.chatConnectionsLock.Lock()
+	defer inst.chatConnectionsLock.Unlock()
+
+	rtn := make([]string, len(inst.chatConnections))
+	i := 0
+
+	for _, n := range inst.chatConnections {
+		rtn[i] = n
+		i++
+	}
+
+	return rtn
+}
+
+func (inst *Instance) getUsername(n *Node) string {
+	inst.chatConnectionsLock.Lock()
+	defer inst.chatConnectionsLock.Unlock()
+
+	return inst.chatConnections[n]
+}
+
+func (inst *Instance) removeChatConnection(n *Node) {
+	inst.chatConnectionsLock.Lock()
+	defer inst.chatConnectionsLock.Unlock()
+
+	delete(inst.chatConnections, n)
+}
+
+func (inst *Instance) resetChatConnections() {
+	inst.chatConnectionsLock.Lock()
+	defer inst.chatConnectionsLock.Unlock()
+
+	inst.chatConnections = make(map[*Node]string)
+}
+
+// finds a chat connection either by node id, by key fingerprint or by username
+func (inst *Instance) findChatConnection(id uint64, u string, key string) *Node {
+	inst.chatConnectionsLock.Lock()
+	defer inst.chatConnectionsLock.Unlock()
+
+	for n, name := range inst.chatConnections {
+		if (id != 0 && n.id == id) || (len(key) > 0 && n.keyFingerprint() == key) || (id == 0 && len(key) == 0 && name == u) {
+			return n
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package distrochya
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// source of time for timers, sleeps and deadlines of an instance, replaced by a virtual clock in simulations
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Timer interface {
+	// returns false if the timer already fired or was stopped
+	Stop() bool
+}
+
+// implemented by virtual clocks which only move the time once every goroutine they know of is blocked,
+// instances report the goroutines they start and every wait for work from another goroutine
+type Scheduler interface {
+	Ready()   // a goroutine was started or handed work
+	Blocked() // a goroutine returned or waits for work
+}
+
+type SystemClock struct {
+}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (SystemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// has to be called before the instance starts or joins a network
+func (inst *Instance) SetClock(c Clock) {
+	inst.clockMutex.Lock()
+	inst.clock = c
+	inst.clockMutex.Unlock()
+}
+
+func (inst *Instance) getClock() Clock {
+	inst.clockMutex.Lock()
+	defer inst.clockMutex.Unlock()
+
+	return inst.clock
+}
+
+func ready(c Clock) {
+	if s, ok := c.(Scheduler); ok {
+		s.Ready()
+	}
+}
+
+func blocked(c Clock) {
+	if s, ok := c.(Scheduler); ok {
+		s.Blocked()
+	}
+}
+
+// runs f in a new goroutine the clock knows of
+func spawn(c Clock, f func()) {
+	ready(c)
+
+	go func() {
+		defer blocked(c)
+		f()
+	}()
+}
+
+func (inst *Instance) spawn(f func()) {
+	spawn(inst.getClock(), f)
+}
+
+// a goroutine waiting for others to hand it work, the clock counts it as blocked until woken
+type waiter struct {
+	clock   Clock
+	lock    *sync.Mutex
+	waiting bool
+}
+
+func newWaiter(c Clock) *waiter {
+	return &waiter{clock: c, lock: &sync.Mutex{}}
+}
+
+// called right before waiting, pending reports work handed over already, in which case the wait won't block
+func (w *waiter) block(pending func() bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if pending() {
+		return
+	}
+
+	w.waiting = true
+	blocked(w.clock)
+}
+
+// called after handing work to the waiting goroutine
+func (w *waiter) wake() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.waiting {
+		w.waiting = false
+		ready(w.clock)
+	}
+}
+
+func nothingPending() bool {
+	return false
+}
+
+// unpredictable numbers, used for node IDs etc. unless a simulation seeds the instance
+type cryptoSource struct {
+}
+
+func (s cryptoSource) Int63() int64 {
+	return int64(s.Uint64() & (1<<63 - 1))
+}
+
+func (cryptoSource) Uint64() uint64 {
+	var b [8]byte
+	crand.Read(b[:])
+
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+func (cryptoSource) Seed(int64) {
+}
+
+// tokens that grant something, like taking over a relayed connection, must not be guessable even in simulations
+func randomToken() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// node IDs, election waits etc. are drawn from seed, used to make simulations reproducible
+func (inst *Instance) SetSeed(seed int64) {
+	inst.randomMutex.Lock()
+	inst.random = rand.New(rand.NewSource(seed))
+	inst.randomMutex.Unlock()
+}
+
+func (inst *Instance) randomUint64() uint64 {
+	inst.randomMutex.Lock()
+	defer inst.randomMutex.Unlock()
+
+	return inst.random.Uint64()
+}
+
+func (inst *Instance) randomIntn(n int) int {
+	inst.randomMutex.Lock()
+	defer inst.randomMutex.Unlock()
+
+	return inst.random.Intn(n)
+}
+
+func (inst *Instance) randomInt63n(n int64) int64 {
+	inst.randomMutex.Lock()
+	defer inst.randomMutex.Unlock()
+
+	return inst.random.Int63n(n)
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// address of the local admin API, disabled if empty
+var adminAddress string
+
+// the token sits next to the state file, only its owner can read it
+const (
+	adminTokenFileName    = "admin-token"
+	adminTokenPermissions = 0600
+	adminTokenDirectory   = 0700
+)
+
+// users last reported by the instance, the library only passes them in events
+var chatUsersLock = &sync.Mutex{}
+var chatUsers = []string{}
+
+func setChatUsers(us []string) {
+	chatUsersLock.Lock()
+	defer chatUsersLock.Unlock()
+
+	chatUsers = append([]string{}, us...)
+}
+
+func getChatUsers() []string {
+	chatUsersLock.Lock()
+	defer chatUsersLock.Unlock()
+
+	return append([]string{}, chatUsers...)
+}
+
+type adminNode struct {
+	ID        string   `json:"id"`
+	Relation  string   `json:"relation"`
+	Endpoints []string `json:"endpoints"`
+	Key       string   `json:"key,omitempty"`
+	RTT       float64  `json:"rtt_ms,omitempty"`
+	Phi       float64  `json:"phi,omitempty"`
+}
+
+type adminStatus struct {
+	NodeID      string      `json:"node_id"`
+	Key         string      `json:"key"`
+	State       string      `json:"state"`
+	JoinAttempt int         `json:"join_attempt,omitempty"`
+	Running     bool        `json:"running"`
+	LogicalTime uint64      `json:"logical_time"`
+	LeaderID    string      `json:"leader_id"`
+	TwiceNextID string      `json:"twice_next_id"`
+	Endpoints   []string    `json:"endpoints"`
+	ChatName    string      `json:"chat_name"`
+	Chatting    bool        `json:"chatting"`
+	Users       []string    `json:"users"`
+	Nodes       []adminNode `json:"nodes"`
+}
+
+func getAdminStatus() adminStatus {
+	s := instance.Snapshot()
+	status := adminStatus{
+		NodeID:      idField(s.NodeID),
+		Key:         instance.Fingerprint(),
+		State:       s.State,
+		JoinAttempt: s.JoinAttempt,
+		Running:     instance.IsRunning(),
+		LogicalTime: s.LogicalTime,
+		LeaderID:    idField(s.LeaderID),
+		TwiceNextID: idField(s.TwiceNextNodeID),
+		Endpoints:   instance.Endpoints(s.NodeID),
+		ChatName:    instance.ChatName(),
+		Chatting:    instance.IsChatParticipant(),
+		Users:       getChatUsers(),
+		Nodes:       []adminNode{},
+	}
+
+	if status.Endpoints == nil {
+		status.Endpoints = []string{}
+	}
+
+	for _, p := range s.Peers {
+		eps := p.Endpoints
+
+		if eps == nil {
+			eps = []string{}
+		}
+
+		status.Nodes = append(status.Nodes, adminNode{idField(p.ID), p.Relation, eps, p.Key, float64(p.RTT) / float64(time.Millisecond), p.Phi})
+	}
+
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, e string) {
+	writeJSON(w, code, map[string]string{"error": e})
+}
+
+// checks that the request is a JSON POST and decodes its body into req if it isn't nil, writes the error otherwise
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAdminError(w, http.StatusMethodNotAllowed, "use POST")
+		return false
+	}
+
+	// a form can't set this content type, so a page can't post to the API without a preflight
+	if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || t != "application/json" {
+		writeAdminError(w, http.StatusUnsupportedMediaType, "use Content-Type: application/json")
+		return false
+	}
+
+	if req != nil {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(req); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+			return false
+		}
+	}
+
+	return true
+}
+
+// messages are single lines, a line break would end the protocol message carrying the text
+var lineBreaks = strings.NewReplacer("\r", " ", "\n", " ")
+
+type adminChatRequest struct {
+	Text string `json:"text"`
+}
+
+type adminNickRequest struct {
+	Nick string `json:"nick"`
+}
+
+type adminStartRequest struct {
+	Port      uint16 `json:"port"`
+	Bind      string `json:"bind"`
+	Advertise string `json:"advertise"`
+}
+
+type adminJoinRequest struct {
+	Seeds     []string `json:"seeds"`
+	Port      uint16   `json:"port"`
+	Bind      string   `json:"bind"`
+	Advertise string   `json:"advertise"`
+}
+
+// bind and advertised address of the request, defaults are used for empty ones
+func requestAddresses(bind string, advertise string) (string, string) {
+	defaultBind, defaultAdvertise := instance.DefaultAddresses()
+
+	if len(bind) == 0 {
+		bind = defaultBind
+	}
+
+	if len(advertise) == 0 {
+		advertise = defaultAdvertise
+	}
+
+	return bind, advertise
+}
+
+// requests are handled in their own goroutines, like commands they only call the instance,
+// which reports failures as events as well
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeAdminError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, getAdminStatus())
+	})
+
+	mux.HandleFunc("/api/chat", func(w http.ResponseWriter, r *http.Request) {
+		var chat adminChatRequest
+
+		if !decodeAdminRequest(w, r, &chat) {
+			return
+		}
+
+		text := strings.TrimSpace(lineBreaks.Replace(chat.Text))
+
+		if len(text) == 0 {
+			writeAdminError(w, http.StatusBadRequest, "empty message")
+		} else if !instance.IsRunning() {
+			writeAdminError(w, http.StatusConflict, "not connected to any network")
+		} else if !instance.IsChatParticipant() {
+			writeAdminError(w, http.StatusConflict, "not participating in the chat")
+		} else if instance.LeaderID() == 0 {
+			writeAdminError(w, http.StatusConflict, "there is no leader on the network")
+		} else {
+			instance.SendChat(text)
+			writeJSON(w, http.StatusOK, map[string]bool{"sent": true})
+		}
+	})
+
+	mux.HandleFunc("/api/nick", func(w http.ResponseWriter, r *http.Request) {
+		var nick adminNickRequest
+
+		if !decodeAdminRequest(w, r, &nick) {
+			return
+		}
+
+		n := strings.TrimSpace(strings.Replace(lineBreaks.Replace(nick.Nick), ";", "", -1))
+
+		if len(n) == 0 {
+			writeAdminError(w, http.StatusBadRequest, "empty nickname")
+			return
+		}
+
+		instance.SetChatName(n)
+		writeJSON(w, http.StatusOK, map[string]string{"nick": instance.ChatName()})
+	})
+
+	mux.HandleFunc("/api/start", func(w http.ResponseWriter, r *http.Request) {
+		var start adminStartRequest
+
+		if !decodeAdminRequest(w, r, &start) {
+			return
+		}
+
+		if instance.IsRunning() {
+			writeAdminError(w, http.StatusConflict, "already connected to a network")
+			return
+		}
+
+		bind, advertise := requestAddresses(start.Bind, start.Advertise)
+		instance.Start(start.Port, bind, advertise)
+
+		if !instance.IsRunning() {
+			writeAdminError(w, http.StatusInternalServerError, "failed to start the network")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, getAdminStatus())
+	})
+
+	mux.HandleFunc("/api/join", func(w http.ResponseWriter, r *http.Request) {
+		var join adminJoinRequest
+
+		if !decodeAdminRequest(w, r, &join) {
+			return
+		}
+
+		if len(join.Seeds) == 0 {
+			writeAdminError(w, http.StatusBadRequest, "no seeds given")
+			return
+		}
+
+		if instance.IsRunning() {
+			writeAdminError(w, http.StatusConflict, "already connected to a network")
+			return
+		}
+
+		// joining retries for a while, the state shows how it went
+		bind, advertise := requestAddresses(join.Bind, join.Advertise)
+		go instance.Join(join.Seeds, join.Port, bind, advertise)
+
+		writeJSON(w, http.StatusAccepted, map[string]bool{"joining": true})
+	})
+
+	mux.HandleFunc("/api/leave", func(w http.ResponseWriter, r *http.Request) {
+		if !decodeAdminRequest(w, r, nil) {
+			return
+		}
+
+		instance.Disconnect()
+		writeJSON(w, http.StatusOK, getAdminStatus())
+	})
+
+	return mux
+}
+
+// only served on loopback addresses, a token keeps other local users and web pages out
+func checkAdminAddress(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(host) == 0 {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+
+	if !isLoopbackHost(host) {
+		return "", fmt.Errorf("admin API can only listen on a loopback address, not %s", host)
+	}
+
+	return addr, nil
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// every request needs the token, browsers are kept out by the Host (DNS rebinding) and Origin checks
+func guardAdmin(h http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+
+		if err != nil {
+			host = r.Host
+		}
+
+		if !isLoopbackHost(strings.Trim(host, "[]")) {
+			writeAdminError(w, http.StatusForbidden, "the admin API is only served to localhost")
+			return
+		}
+
+		if len(r.Header.Get("Origin")) > 0 {
+			writeAdminError(w, http.StatusForbidden, "the admin API can't be used from web pages")
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminError(w, http.StatusUnauthorized, "missing or wrong token, it is in "+adminTokenFile())
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func adminTokenFile() string {
+	return filepath.Join(filepath.Dir(instance.StateFile()), adminTokenFileName)
+}
+
+// reads the token from p, a new one is created if there is none
+func loadAdminToken(p string) (string, error) {
+	b, err := ioutil.ReadFile(p)
+
+	if err == nil {
+		if token := strings.TrimSpace(string(b)); len(token) > 0 {
+			return token, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	raw := make([]byte, 32)
+
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	token := hex.EncodeToString(raw)
+
+	if err := os.MkdirAll(filepath.Dir(p), adminTokenDirectory); err != nil {
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(p, []byte(token+"\n"), adminTokenPermissions); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func startAdminServer(addr string) error {
+	addr, err := checkAdminAddress(addr)
+
+	if err != nil {
+		return err
+	}
+
+	token, err := loadAdminToken(adminTokenFile())
+
+	if err != nil {
+		return errors.New("unable to load the admin API token: " + err.Error())
+	}
+
+	return startHTTPServer(addr, guardAdmin(adminHandler(), token))
+}
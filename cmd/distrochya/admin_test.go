@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Silaedru/distrochya"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method string, path string, body string, v interface{}) int {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+
+	if method == http.MethodPost {
+		r.Header.Set("Content-Type", "application/json")
+	}
+
+	h.ServeHTTP(w, r)
+
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v in %q", method, path, err, w.Body.String())
+		}
+	}
+
+	return w.Code
+}
+
+func TestAdminAPI(t *testing.T) {
+	instance = distrochya.New(nil, distrochya.DefaultConfig())
+	instance.SetTransport(distrochya.NewMemoryNetwork(1).Transport("local"))
+	instance.SetAnnounce(false)
+	defer instance.Disconnect()
+
+	h := adminHandler()
+	var status adminStatus
+
+	if code := adminRequest(t, h, "GET", "/api/status", "", &status); code != http.StatusOK || status.Running || len(status.Nodes) != 0 {
+		t.Fatalf("status of an idle node: %d %+v", code, status)
+	}
+
+	var rtn map[string]interface{}
+
+	if code := adminRequest(t, h, "POST", "/api/chat", `{"text":"hi"}`, &rtn); code != http.StatusConflict {
+		t.Errorf("chat without a network: %d %v", code, rtn)
+	}
+
+	if code := adminRequest(t, h, "POST", "/api/nick", `{"nick":"a;b\nc"}`, &rtn); code != http.StatusOK || rtn["nick"] != "ab c" {
+		t.Errorf("nick: %d %v", code, rtn)
+	}
+
+	if code := adminRequest(t, h, "POST", "/api/start", `{"port":9999}`, &status); code != http.StatusOK || !status.Running || status.LeaderID != status.NodeID {
+		t.Fatalf("start: %d %+v", code, status)
+	}
+
+	if code := adminRequest(t, h, "POST", "/api/start", `{"port":9999}`, nil); code != http.StatusConflict {
+		t.Errorf("second start: %d", code)
+	}
+
+	if code := adminRequest(t, h, "POST", "/api/join", `{"seeds":[]}`, nil); code != http.StatusBadRequest {
+		t.Errorf("join without seeds: %d", code)
+	}
+
+	if code := adminRequest(t, h, "GET", "/api/leave", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET of an action: %d", code)
+	}
+
+	if code := adminRequest(t, h, "POST", "/api/chat", `{"text":`, nil); code != http.StatusBadRequest {
+		t.Errorf("invalid JSON: %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/api/chat", strings.NewReader("text=hi")))
+
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("form post: %d", w.Code)
+	}
+
+	if code := adminRequest(t, h, "POST", "/api/leave", "", &status); code != http.StatusOK || status.Running {
+		t.Errorf("leave: %d %+v", code, status)
+	}
+}
+
+func TestCheckAdminAddress(t *testing.T) {
+	for addr, want := range map[string]string{":9200": "127.0.0.1:9200", "localhost:9200": "localhost:9200", "[::1]:9200": "[::1]:9200", "127.0.0.2:9200": "127.0.0.2:9200"} {
+		if got, err := checkAdminAddress(addr); err != nil || got != want {
+			t.Errorf("%s: %s, %v, want %s", addr, got, err, want)
+		}
+	}
+
+	for _, addr := range []string{"0.0.0.0:9200", "10.0.0.1:9200", "example.com:9200", "9200"} {
+		if _, err := checkAdminAddress(addr); err == nil {
+			t.Errorf("%s accepted", addr)
+		}
+	}
+}
+
+func TestGuardAdmin(t *testing.T) {
+	instance = distrochya.New(nil, distrochya.DefaultConfig())
+	instance.SetStateFile(filepath.Join(t.TempDir(), "state.json"))
+	h := guardAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "secret")
+
+	request := func(host string, header map[string]string) int {
+		r := httptest.NewRequest("GET", "/api/status", nil)
+		r.Host = host
+
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		return w.Code
+	}
+
+	auth := map[string]string{"Authorization": "Bearer secret"}
+
+	for _, host := range []string{"localhost:9200", "127.0.0.1:9200", "[::1]:9200", "localhost"} {
+		if code := request(host, auth); code != http.StatusOK {
+			t.Errorf("host %s: %d", host, code)
+		}
+	}
+
+	// a name rebound to 127.0.0.1 by a web page
+	if code := request("evil.example:9200", auth); code != http.StatusForbidden {
+		t.Errorf("foreign host: %d", code)
+	}
+
+	if code := request("localhost:9200", map[string]string{"Authorization": "Bearer secret", "Origin": "http://evil.example"}); code != http.StatusForbidden {
+		t.Errorf("request with origin: %d", code)
+	}
+
+	for _, a := range []string{"", "Bearer", "Bearer wrong", "secret"} {
+		if code := request("localhost:9200", map[string]string{"Authorization": a}); code != http.StatusUnauthorized {
+			t.Errorf("authorization %q: %d", a, code)
+		}
+	}
+}
+
+func TestLoadAdminToken(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "dir", adminTokenFileName)
+	token, err := loadAdminToken(p)
+
+	if err != nil || len(token) != 64 {
+		t.Fatalf("new token %q, %v", token, err)
+	}
+
+	if fi, err := os.Stat(p); err != nil || fi.Mode().Perm() != adminTokenPermissions {
+		t.Errorf("token file %v, %v", fi, err)
+	}
+
+	if again, err := loadAdminToken(p); err != nil || again != token {
+		t.Errorf("token %q, %v after a restart, want %q", again, err, token)
+	}
+}
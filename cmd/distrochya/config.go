@@ -0,0 +1,637 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/Silaedru/distrochya"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const configFileName = "config.toml"
+
+type optionKind int
+
+const (
+	stringOption optionKind = iota
+	intOption
+	floatOption
+	boolOption
+)
+
+// shown in --help, bool options don't take a value
+func (k optionKind) String() string {
+	switch k {
+	case intOption:
+		return "int"
+	case floatOption:
+		return "float"
+	case boolOption:
+		return ""
+	}
+
+	return "string"
+}
+
+// a single tunable, available as --<section>-<key> on the command line
+// and as <key> in the [<section>] table of the config file
+type option struct {
+	section string
+	key     string
+	usage   string
+	kind    optionKind
+	get     func() string
+	set     func(string) error
+}
+
+func (o *option) String() string {
+	if o.get == nil {
+		return ""
+	}
+
+	return o.get()
+}
+
+func (o *option) Set(v string) error {
+	return o.set(v)
+}
+
+func (o *option) IsBoolFlag() bool {
+	return o.kind == boolOption
+}
+
+func (o *option) name() string {
+	if len(o.section) == 0 {
+		return o.key
+	}
+
+	return o.section + "-" + o.key
+}
+
+// options that only make sense at startup, they are not used after main
+var configFile string
+var logFile string
+var launchHeadless bool
+var launchStdio bool
+var launchChat bool
+var launchRejoin bool
+var launchStartPort = -1
+var launchSeeds string
+var launchPort = 0
+var launchSimulation string
+var simulationSeed int
+
+// tunables of the instance, given to it once the options are parsed
+var config = distrochya.DefaultConfig()
+
+var options []*option
+
+func addOption(section string, key string, kind optionKind, usage string, get func() string, set func(string) error) {
+	options = append(options, &option{section, key, usage, kind, get, set})
+}
+
+func addStringOption(section string, key string, p *string, usage string) {
+	addOption(section, key, stringOption, usage, func() string {
+		return *p
+	}, func(v string) error {
+		*p = v
+		return nil
+	})
+}
+
+func addIntOption(section string, key string, p *int, min int, max int, usage string) {
+	addOption(section, key, intOption, usage, func() string {
+		return strconv.Itoa(*p)
+	}, func(v string) error {
+		n, err := strconv.Atoi(v)
+
+		if err != nil {
+			return err
+		}
+
+		if n < min || n > max {
+			return fmt.Errorf("must be between %d and %d", min, max)
+		}
+
+		*p = n
+		return nil
+	})
+}
+
+func addFloatOption(section string, key string, p *float64, min float64, max float64, usage string) {
+	addOption(section, key, floatOption, usage, func() string {
+		return strconv.FormatFloat(*p, 'f', -1, 64)
+	}, func(v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+
+		if err != nil {
+			return err
+		}
+
+		if f < min || f > max {
+			return fmt.Errorf("must be between %g and %g", min, max)
+		}
+
+		*p = f
+		return nil
+	})
+}
+
+func addBoolOption(section string, key string, p *bool, usage string) {
+	addOption(section, key, boolOption, usage, func() string {
+		return strconv.FormatBool(*p)
+	}, func(v string) error {
+		b, err := strconv.ParseBool(v)
+
+		if err != nil {
+			return err
+		}
+
+		*p = b
+		return nil
+	})
+}
+
+func findOption(name string) *option {
+	for _, o := range options {
+		if o.name() == name {
+			return o
+		}
+	}
+
+	return nil
+}
+
+func initOptions() {
+	addOption("", "nick", stringOption, "nickname", func() string {
+		return instance.ChatName()
+	}, func(v string) error {
+		instance.SetChatName(strings.Replace(v, ";", "", -1))
+		return nil
+	})
+
+	addOption("", "nodebug", boolOption, "hide log and status views and debug commands", func() string {
+		return strconv.FormatBool(!debugEnabled)
+	}, func(v string) error {
+		b, err := strconv.ParseBool(v)
+
+		if err != nil {
+			return err
+		}
+
+		debugEnabled = !b
+		return nil
+	})
+
+	addStringOption("", "logfile", &logFile, "write the log to a file, rotated by size (the simulation writes its own log there)")
+	addOption("log", "level", stringOption, "log verbosity: debug, info, warn or error", func() string {
+		return instance.LogLevel().String()
+	}, func(v string) error {
+		l, err := distrochya.ParseLogLevel(v)
+
+		if err != nil {
+			return err
+		}
+
+		instance.SetLogLevel(l)
+		return nil
+	})
+	addOption("log", "format", stringOption, "text or json, json is used for --logfile and text for stderr by default", func() string {
+		return logFormat
+	}, func(v string) error {
+		if len(v) > 0 && v != textLogFormat && v != jsonLogFormat {
+			return fmt.Errorf("unknown log format \"%s\", use text or json", v)
+		}
+
+		logFormat = v
+		return nil
+	})
+	addIntOption("log", "max-size", &logMaxSizeMB, 0, 1<<20, "size in MB at which the log file is rotated, 0 never rotates it")
+	addIntOption("log", "max-files", &logMaxFiles, 0, 1000, "how many rotated log files are kept")
+	addStringOption("", "admin", &adminAddress, "loopback address of the admin HTTP/JSON API, e.g. localhost:9200")
+	addStringOption("", "metrics", &metricsAddress, "address of an HTTP listener serving Prometheus metrics at /metrics, e.g. localhost:9100")
+	addOption("", "state", stringOption, "state file used by --rejoin", func() string {
+		return instance.StateFile()
+	}, func(v string) error {
+		instance.SetStateFile(v)
+		return nil
+	})
+
+	addBoolOption("", "headless", &launchHeadless, "run without UI")
+	addBoolOption("", "stdio", &launchStdio, "read commands from stdin and write JSON events to stdout")
+	addBoolOption("", "chat", &launchChat, "join the chat in headless mode")
+	addBoolOption("", "rejoin", &launchRejoin, "rejoin the network from the state file on startup")
+	addIntOption("", "start", &launchStartPort, -1, 65535, "start a new network on this port on startup")
+	addStringOption("", "connect", &launchSeeds, "comma separated addresses to join on startup")
+	addIntOption("", "port", &launchPort, 0, 65535, "port used with --connect")
+	addStringOption("", "simulate", &launchSimulation, "run a simulation scenario (name, all or list) and exit")
+	addIntOption("", "seed", &simulationSeed, 0, math.MaxInt32, "seed of the simulation, random if 0")
+
+	addOption("", "bind", stringOption, "address to listen on", func() string {
+		bind, _ := instance.DefaultAddresses()
+		return bind
+	}, func(v string) error {
+		_, advertise := instance.DefaultAddresses()
+		instance.SetDefaultAddresses(v, advertise)
+		return nil
+	})
+	addOption("", "advertise", stringOption, "address other nodes should use to reach this node", func() string {
+		_, advertise := instance.DefaultAddresses()
+		return advertise
+	}, func(v string) error {
+		bind, _ := instance.DefaultAddresses()
+		instance.SetDefaultAddresses(bind, v)
+		return nil
+	})
+	addOption("", "relay", stringOption, "relay node used when not reachable directly", func() string {
+		return instance.RelayAddress()
+	}, func(v string) error {
+		instance.SetRelayAddress(v)
+		return nil
+	})
+	addOption("", "relayserver", boolOption, "relay connections for other nodes", func() string {
+		return strconv.FormatBool(instance.IsRelayServer())
+	}, func(v string) error {
+		b, err := strconv.ParseBool(v)
+
+		if err != nil {
+			return err
+		}
+
+		instance.SetRelayServer(b)
+		return nil
+	})
+	addOption("", "noannounce", boolOption, "don't announce the network on the local segment", func() string {
+		return strconv.FormatBool(!instance.IsAnnounceEnabled())
+	}, func(v string) error {
+		b, err := strconv.ParseBool(v)
+
+		if err != nil {
+			return err
+		}
+
+		instance.SetAnnounce(!b)
+		return nil
+	})
+	addOption("", "netname", stringOption, "name of networks started by this node", func() string {
+		return instance.DefaultNetworkName()
+	}, func(v string) error {
+		instance.SetDefaultNetworkName(strings.Replace(v, ";", "", -1))
+		return nil
+	})
+
+	addIntOption("timeout", "connection", &config.ConnectionTimeoutSeconds, 2, 3600, "seconds without keep-alive before a connection is dropped")
+	addIntOption("timeout", "connection-grace", &config.ConnectionTimeoutGraceSeconds, 0, 3600, "extra seconds allowed for late keep-alives")
+	addIntOption("timeout", "send", &config.SendMessageTimeoutSeconds, 1, 3600, "seconds allowed for sending a message")
+	addIntOption("timeout", "dial", &config.DialTimeoutSeconds, 1, 3600, "seconds allowed for opening a connection")
+	addIntOption("timeout", "ring-repair", &config.RingRepairTimeoutSeconds, 1, 3600, "seconds to wait before repairing a broken ring")
+	addIntOption("timeout", "election", &config.LeaderElectionTimeoutSeconds, 1, 255, "seconds before a stalled election is restarted")
+
+	addIntOption("keepalive", "interval", &config.KeepaliveIntervalMilliseconds, 50, 3600000, "milliseconds between keep-alives, at most half of timeout-connection is used")
+	addFloatOption("keepalive", "phi-threshold", &config.FailureDetectorPhiThreshold, 1, 100, "suspicion at which a silent next or leader is declared dead, higher detects later but with fewer mistakes")
+
+	addIntOption("election", "min-wait", &config.LeaderElectionMinimumWaitSeconds, 0, 254, "minimum seconds to wait before starting an election")
+	addIntOption("election", "max-wait", &config.LeaderElectionMaximumWaitSeconds, 1, 255, "maximum seconds to wait before starting an election")
+
+	addOption("retry", "attempts", intOption, "how many times joining is attempted", func() string {
+		return strconv.Itoa(instance.JoinRetryAttempts())
+	}, func(v string) error {
+		n, err := strconv.Atoi(v)
+
+		if err != nil {
+			return err
+		}
+
+		if n < 1 {
+			return fmt.Errorf("must be at least 1")
+		}
+
+		initial, max := instance.JoinRetryDelays()
+		instance.SetJoinRetryPolicy(n, initial, max)
+		return nil
+	})
+	addOption("retry", "initial-delay", intOption, "milliseconds before the first retry", func() string {
+		initial, _ := instance.JoinRetryDelays()
+		return strconv.FormatInt(int64(initial/time.Millisecond), 10)
+	}, func(v string) error {
+		n, err := strconv.Atoi(v)
+
+		if err != nil {
+			return err
+		}
+
+		if n < 0 {
+			return fmt.Errorf("must not be negative")
+		}
+
+		_, max := instance.JoinRetryDelays()
+		instance.SetJoinRetryPolicy(instance.JoinRetryAttempts(), time.Duration(n)*time.Millisecond, max)
+		return nil
+	})
+	addOption("retry", "max-delay", intOption, "maximum milliseconds between retries", func() string {
+		_, max := instance.JoinRetryDelays()
+		return strconv.FormatInt(int64(max/time.Millisecond), 10)
+	}, func(v string) error {
+		n, err := strconv.Atoi(v)
+
+		if err != nil {
+			return err
+		}
+
+		if n < 0 {
+			return fmt.Errorf("must not be negative")
+		}
+
+		initial, _ := instance.JoinRetryDelays()
+		instance.SetJoinRetryPolicy(instance.JoinRetryAttempts(), initial, time.Duration(n)*time.Millisecond)
+		return nil
+	})
+
+	addIntOption("limit", "message-length", &config.MaxMessageLength, 256, 1<<20, "maximum length of a protocol message in bytes")
+	addIntOption("limit", "chat-rate", &config.ChatRateLimitPerSecond, 1, 1000, "chat messages per second allowed from a peer")
+	addIntOption("limit", "chat-burst", &config.ChatRateLimitBurst, 1, 10000, "chat messages a peer may send at once")
+	addIntOption("limit", "control-rate", &config.ControlRateLimitPerSecond, 1, 10000, "control messages per second allowed from a peer")
+	addIntOption("limit", "control-burst", &config.ControlRateLimitBurst, 1, 100000, "control messages a peer may send at once")
+	addIntOption("limit", "outbound-queue", &config.OutboundQueueLength, 1, 1<<20, "messages waiting to be written to a peer before it counts as slow")
+	addOption("limit", "slow-follower", stringOption, "what happens to a slow follower whose queue is full: disconnect or drop (its messages)", func() string {
+		return config.SlowFollowerPolicy
+	}, func(v string) error {
+		if v != distrochya.SlowFollowerDisconnect && v != distrochya.SlowFollowerDrop {
+			return fmt.Errorf("unknown policy \"%s\", use disconnect or drop", v)
+		}
+
+		config.SlowFollowerPolicy = v
+		return nil
+	})
+
+	addStringOption("discovery", "address", &config.DiscoveryAddress, "multicast group used for network announcements")
+	addIntOption("discovery", "interval", &config.DiscoveryIntervalSeconds, 1, 3600, "seconds between network announcements")
+
+	addIntOption("ui", "log-width", &logViewWidthPercent, 10, 90, "width of the log view in percent")
+	addIntOption("ui", "log-height", &logViewHeightPercent, 10, 90, "height of the log and status views in percent")
+	addIntOption("ui", "chat-width", &chatViewWidthPercent, 10, 90, "width of the chat view in percent")
+}
+
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+
+	if err != nil {
+		dir = "."
+	}
+
+	return filepath.Join(dir, "distrochya", configFileName)
+}
+
+// converts a value decoded from the config file into the form the command line uses,
+// arrays of strings are joined with commas
+func configValueToString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []interface{}:
+		items := make([]string, len(v))
+
+		for i, item := range v {
+			s, ok := item.(string)
+
+			if !ok {
+				return "", fmt.Errorf("only arrays of strings are supported")
+			}
+
+			items[i] = s
+		}
+
+		return strings.Join(items, ","), nil
+	}
+
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// reads a TOML config file, [section] tables hold the options of the section;
+// options in skip were given on the command line and take precedence
+func loadConfig(r io.Reader, name string, skip map[string]bool) error {
+	var values map[string]interface{}
+	md, err := toml.NewDecoder(r).Decode(&values)
+
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err.Error())
+	}
+
+	// keys in the order of the file, so the first bad option is reported
+	for _, k := range md.Keys() {
+		var v interface{}
+
+		switch len(k) {
+		case 1:
+			v = values[k[0]]
+
+			// tables are handled through their keys
+			if _, ok := v.(map[string]interface{}); ok {
+				continue
+			}
+		case 2:
+			v = values[k[0]].(map[string]interface{})[k[1]]
+		default:
+			return fmt.Errorf("%s: unknown option \"%s\"", name, k.String())
+		}
+
+		key := strings.Join(k, "-")
+		o := findOption(key)
+
+		if o == nil {
+			return fmt.Errorf("%s: unknown option \"%s\"", name, k.String())
+		}
+
+		s, err := configValueToString(v)
+
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s", name, key, err.Error())
+		}
+
+		if skip[key] {
+			continue
+		}
+
+		if err := o.Set(s); err != nil {
+			return fmt.Errorf("%s: %s: %s", name, key, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func validateConfig() error {
+	if config.LeaderElectionMaximumWaitSeconds <= config.LeaderElectionMinimumWaitSeconds {
+		return fmt.Errorf("election-max-wait must be greater than election-min-wait")
+	}
+
+	if initial, max := instance.JoinRetryDelays(); max < initial {
+		return fmt.Errorf("retry-max-delay must not be less than retry-initial-delay")
+	}
+
+	if launchHeadless && launchStdio {
+		return fmt.Errorf("--headless and --stdio can't be used together")
+	}
+
+	return nil
+}
+
+// same as the flag package's usage, but with the kind of each option instead of "value"
+func printUsage(fs *flag.FlagSet) {
+	fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+
+	fs.VisitAll(func(f *flag.Flag) {
+		kind := "string"
+
+		if o, ok := f.Value.(*option); ok {
+			kind = o.kind.String()
+		}
+
+		line := "  -" + f.Name
+
+		if len(kind) > 0 {
+			line += " " + kind
+		}
+
+		line += "\n    \t" + f.Usage
+
+		if len(f.DefValue) > 0 {
+			line += " (default " + f.DefValue + ")"
+		}
+
+		fmt.Fprintln(fs.Output(), line)
+	})
+}
+
+// command line takes precedence over the config file, which takes precedence over the defaults
+func parseConfig(args []string) error {
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "config file (default "+defaultConfigFile()+")")
+
+	for _, o := range options {
+		fs.Var(o, o.name(), o.usage)
+	}
+
+	fs.Usage = func() { printUsage(fs) }
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument \"%s\"", fs.Arg(0))
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	p := configFile
+
+	if len(p) == 0 {
+		p = defaultConfigFile()
+	}
+
+	f, err := os.Open(p)
+
+	if err == nil {
+		defer f.Close()
+
+		if err := loadConfig(f, p, given); err != nil {
+			return err
+		}
+
+		configFile = p
+	} else if len(configFile) > 0 {
+		// only a missing default config file is fine
+		return err
+	}
+
+	if err := validateConfig(); err != nil {
+		return err
+	}
+
+	instance.SetConfig(config)
+	return nil
+}
+
+// TOML basic string
+func quoteConfigString(v string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+
+	for _, c := range v {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c == '\n':
+			b.WriteString("\\n")
+		case c == '\t':
+			b.WriteString("\\t")
+		case c < 0x20 || c == 0x7f:
+			b.WriteString(fmt.Sprintf("\\u%04X", c))
+		default:
+			b.WriteRune(c)
+		}
+	}
+
+	b.WriteByte('"')
+	return b.String()
+}
+
+// effective values in the config file format, options without a section have to come before all tables
+func configToString() string {
+	var b strings.Builder
+
+	if len(configFile) > 0 {
+		b.WriteString("# " + configFile + "\n")
+	} else {
+		b.WriteString("# no config file, defaults and command line\n")
+	}
+
+	sections := []string{""}
+	bySection := make(map[string][]*option)
+
+	for _, o := range options {
+		if _, ok := bySection[o.section]; !ok && len(o.section) > 0 {
+			sections = append(sections, o.section)
+		}
+
+		bySection[o.section] = append(bySection[o.section], o)
+	}
+
+	for _, section := range sections {
+		if len(section) > 0 {
+			b.WriteString("\n[" + section + "]\n")
+		}
+
+		for _, o := range bySection[section] {
+			v := o.String()
+
+			if o.kind == stringOption {
+				v = quoteConfigString(v)
+			} else if o.kind == floatOption && !strings.ContainsAny(v, ".eEn") {
+				// keeps it a float when read back
+				v += ".0"
+			}
+
+			b.WriteString(fmt.Sprintf("%s = %s\n", o.key, v))
+		}
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
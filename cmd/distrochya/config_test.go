@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/Silaedru/distrochya"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	config = distrochya.DefaultConfig()
+	instance = distrochya.New(nil, config)
+	options = nil
+	initOptions()
+	defer func(seeds string, port int) { launchSeeds, launchPort = seeds, port }(launchSeeds, launchPort)
+
+	file := `
+netname = "lobby, [main] # 1" # comment
+connect = ["a:1", "b]:2"]
+
+[keepalive]
+phi-threshold = 8.5
+
+[limit]
+slow-follower = 'drop'
+`
+
+	if err := loadConfig(strings.NewReader(file), "test.toml", map[string]bool{"limit-slow-follower": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := instance.DefaultNetworkName(); n != "lobby, [main] # 1" {
+		t.Errorf("netname %q", n)
+	}
+
+	if launchSeeds != "a:1,b]:2" {
+		t.Errorf("connect %q", launchSeeds)
+	}
+
+	if config.SlowFollowerPolicy != distrochya.SlowFollowerDisconnect {
+		t.Error("option given on the command line overwritten by the config file")
+	}
+
+	if config.FailureDetectorPhiThreshold != 8.5 {
+		t.Errorf("phi threshold %v", config.FailureDetectorPhiThreshold)
+	}
+
+	config.FailureDetectorPhiThreshold = 9
+
+	if !strings.Contains(configToString(), "phi-threshold = 9.0\n") {
+		t.Error("float option written as an integer")
+	}
+
+	launchPort = 1234
+
+	if err := loadConfig(strings.NewReader(configToString()), "config", nil); err != nil {
+		t.Fatalf("effective config can't be loaded: %v", err)
+	}
+
+	if launchPort != 1234 || instance.DefaultNetworkName() != "lobby, [main] # 1" {
+		t.Error("effective config doesn't round trip")
+	}
+
+	for _, bad := range []string{"nick = ", "unknown = 1", "[timeout]\nconnection = \"x\"", "[a.b]\nc = 1", "port = 1.5"} {
+		if err := loadConfig(strings.NewReader(bad), "bad.toml", nil); err == nil {
+			t.Errorf("config %q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Silaedru/distrochya"
+	"strings"
+	"sync"
+	"time"
+)
+
+var discoveryListMutex = &sync.Mutex{}
+var lastDiscoveryList []*distrochya.DiscoveredNetwork
+
+// returns currently visible networks, the list is remembered for joinDiscoveredNetwork
+func listDiscoveredNetworks() []*distrochya.DiscoveredNetwork {
+	networks := instance.DiscoveredNetworks()
+
+	discoveryListMutex.Lock()
+	lastDiscoveryList = networks
+	discoveryListMutex.Unlock()
+
+	return networks
+}
+
+func discoveredNetworksToString(networks []*distrochya.DiscoveredNetwork) string {
+	if len(networks) == 0 {
+		return "no networks found"
+	}
+
+	var b strings.Builder
+
+	for i, dn := range networks {
+		b.WriteString(fmt.Sprintf("%d) %s (0x%X) via %s", i+1, dn.Name, dn.ID, strings.Join(dn.Endpoints, ", ")))
+
+		if i+1 < len(networks) {
+			b.WriteString("\n")
+		}
+	}
+
+	return b.String()
+}
+
+func discoverNetworks() {
+	if instance.StartDiscovery() {
+		userEvent("looking for networks on the local network...")
+		time.Sleep(time.Duration(instance.Config().DiscoveryIntervalSeconds+1) * time.Second)
+	}
+
+	appendChatView(fmt.Sprintf("\x1b[35m%s\x1b[0m", discoveredNetworksToString(listDiscoveredNetworks())))
+}
+
+// i is 1-based index into the last listed networks
+func joinDiscoveredNetwork(i int, p uint16) {
+	discoveryListMutex.Lock()
+
+	if i < 1 || i > len(lastDiscoveryList) {
+		discoveryListMutex.Unlock()
+		userError("no such network, use /discover to list networks")
+		return
+	}
+
+	dn := lastDiscoveryList[i-1]
+	discoveryListMutex.Unlock()
+
+	bind, advertise := addressArgs(nil)
+	userEvent(fmt.Sprintf("joining %s", dn.Name))
+
+	instance.Join(dn.Endpoints, p, bind, advertise)
+}
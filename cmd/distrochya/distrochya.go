@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Silaedru/distrochya"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type command struct {
+	helpString string
+	usage      string
+	callback   func([]string)
+}
+
+var debugEnabled = true
+var commands = make(map[string]*command)
+
+// node controlled by the user interface
+var instance *distrochya.Instance
+
+func processCommand(name string, args []string) {
+	command := commands[name]
+
+	if command == nil {
+		userError(fmt.Sprintf("unknown command \"%s\"", name))
+		return
+	}
+
+	command.callback(args)
+}
+
+func formatUserError(e string) string {
+	return fmt.Sprintf("<\x1b[31mError\x1b[0m>: %s", e)
+}
+
+func formatUserEvent(m string) string {
+	return fmt.Sprintf("<\x1b[35mInfo\x1b[0m>: %s", m)
+}
+
+func formatChatMessage(u string, s string) string {
+	return fmt.Sprintf("<\x1b[32m%s\x1b[0m>: %s", u, s)
+}
+
+// command or chat message entered by the user
+func processInput(input string) {
+	input = strings.TrimSpace(input)
+
+	if len(input) > 0 {
+		if input[0] == '/' {
+			args := strings.Split(input, " ")
+			processCommand(args[0], args[1:])
+		} else {
+			instance.SendChat(input)
+		}
+	}
+}
+
+// optional [bind addr] [advertised addr] command arguments, "-" keeps the default
+func addressArgs(args []string) (string, string) {
+	bind, advertise := instance.DefaultAddresses()
+
+	if len(args) > 0 && args[0] != "-" {
+		bind = args[0]
+	}
+
+	if len(args) > 1 && args[1] != "-" {
+		advertise = args[1]
+	}
+
+	return bind, advertise
+}
+
+func initCommands() {
+	commands["/help"] = &command{"Prints this message.", "                       ", func(args []string) {
+		msg := "\nAvailable commands:"
+
+		for n, c := range commands {
+			msg = fmt.Sprintf("%s\n%s %s          %s", msg, n, c.usage, c.helpString)
+		}
+
+		appendChatView(msg + "\n")
+	}}
+
+	commands["/start"] = &command{"Starts a new network. Node will listen for incoming connections on specified <port>.",
+		"<port> [bind addr] [advertised addr]", func(args []string) {
+			if args == nil || len(args) < 1 || len(args) > 3 {
+				userError("invalid usage")
+				return
+			}
+
+			port, err := strconv.ParseUint(args[0], 10, 16)
+
+			if err != nil {
+				userError("failed to parse port number")
+				return
+			}
+
+			bind, advertise := addressArgs(args[1:])
+			instance.Start(uint16(port), bind, advertise)
+		}}
+
+	commands["/disconnect"] = &command{"Disconnects from a network.", "                 ", func(args []string) {
+		instance.Disconnect()
+	}}
+
+	commands["/connect"] = &command{"Connects to an existing network, several comma separated destinations can be given", "<dest>[,dest...] <server port> [bind addr] [advertised addr]", func(args []string) {
+		if args == nil || len(args) < 2 || len(args) > 4 {
+			userError("invalid usage")
+			return
+		}
+
+		port, err := strconv.ParseUint(args[1], 10, 16)
+
+		if err != nil {
+			userError("failed to parse port number")
+			return
+		}
+
+		bind, advertise := addressArgs(args[2:])
+		go instance.Join(strings.Split(args[0], ","), uint16(port), bind, advertise)
+	}}
+
+	commands["/retry"] = &command{"Sets how many times and how often /connect retries", "[attempts] [initial delay ms] [max delay ms]", func(args []string) {
+		if len(args) > 0 {
+			if len(args) != 3 {
+				userError("invalid usage")
+				return
+			}
+
+			attempts, err := strconv.Atoi(args[0])
+			initial, err2 := strconv.Atoi(args[1])
+			max, err3 := strconv.Atoi(args[2])
+
+			if err != nil || err2 != nil || err3 != nil || attempts < 1 || initial < 0 || max < initial {
+				userError("invalid retry policy")
+				return
+			}
+
+			instance.SetJoinRetryPolicy(attempts, time.Duration(initial)*time.Millisecond, time.Duration(max)*time.Millisecond)
+		}
+
+		initial, max := instance.JoinRetryDelays()
+		appendChatView(fmt.Sprintf("\x1b[35mRetry: %d attempts, initial delay %s, max delay %s\x1b[0m", instance.JoinRetryAttempts(), initial, max))
+	}}
+
+	commands["/config"] = &command{"Shows effective configuration", "                   ", func(args []string) {
+		appendChatView(fmt.Sprintf("\x1b[35m%s\x1b[0m", configToString()))
+	}}
+
+	commands["/loglevel"] = &command{"Sets log verbosity", "[debug|info|warn|error]", func(args []string) {
+		if len(args) > 0 {
+			l, err := distrochya.ParseLogLevel(args[0])
+
+			if err != nil {
+				userError(err.Error())
+				return
+			}
+
+			instance.SetLogLevel(l)
+		}
+
+		appendChatView(fmt.Sprintf("\x1b[35mLog level: %s\x1b[0m", instance.LogLevel()))
+	}}
+
+	commands["/trace"] = &command{"Writes protocol events of this node to a file or clears them", "export <path>|clear  ", func(args []string) {
+		if len(args) == 1 && args[0] == "clear" {
+			instance.ClearTrace()
+			userEvent("trace cleared")
+			return
+		}
+
+		if len(args) != 2 || args[0] != "export" {
+			userError("usage: /trace export <path> or /trace clear")
+			return
+		}
+
+		count, err := exportTrace(args[1])
+
+		if err != nil {
+			userError(err.Error())
+			return
+		}
+
+		userEvent(fmt.Sprintf("%d trace entries written to %s", count, args[1]))
+	}}
+
+	commands["/topology"] = &command{"Walks the ring and writes what the nodes on it see as Graphviz and JSON", "[path]              ", func(args []string) {
+		path := "topology"
+
+		if len(args) > 0 {
+			path = args[0]
+		}
+
+		if !instance.IsRunning() {
+			userError("you are not connected to any network")
+			return
+		}
+
+		go exportTopology(path)
+	}}
+
+	commands["/nick"] = &command{"Sets a new nickname", "[new nickname]         ", func(args []string) {
+		if len(args) > 0 {
+			var nick bytes.Buffer
+
+			for i, s := range args {
+				nick.WriteString(s)
+
+				if i+1 < len(args) {
+					nick.WriteString(" ")
+				}
+			}
+
+			nickStr := strings.Replace(nick.String(), ";", "", -1)
+
+			if len(nickStr) > 0 {
+				instance.SetChatName(nickStr)
+			}
+		}
+
+		appendChatView(fmt.Sprintf("\x1b[35mNickname: %s\x1b[0m", instance.ChatName()))
+	}}
+
+	commands["/clear"] = &command{"Clears chat", "                      ", func(args []string) {
+		ui.clearChat()
+	}}
+
+	commands["/setpart"] = &command{"Sets chat participation", "[new value]         ", func(args []string) {
+		if len(args) > 0 {
+			if value, err := strconv.Atoi(args[0]); err == nil {
+				if value > 0 {
+					instance.JoinChat()
+				} else {
+					instance.LeaveChat()
+				}
+			}
+		}
+
+		participation := 0
+
+		if instance.IsChatParticipant() {
+			participation = 1
+		}
+
+		appendChatView(fmt.Sprintf("\x1b[35mChat participation: %d\x1b[0m", participation))
+	}}
+
+	commands["/relay"] = &command{"Sets a relay used by other nodes to reach this node (for nodes behind NAT), applies to next /start or /connect", "[relay addr|off]     ", func(args []string) {
+		if len(args) > 0 {
+			if args[0] == "off" {
+				instance.SetRelayAddress("")
+			} else {
+				instance.SetRelayAddress(args[0])
+			}
+		}
+
+		if len(instance.RelayAddress()) > 0 {
+			appendChatView(fmt.Sprintf("\x1b[35mRelay: %s\x1b[0m", instance.RelayAddress()))
+		} else {
+			appendChatView("\x1b[35mRelay: none\x1b[0m")
+		}
+	}}
+
+	commands["/relayserver"] = &command{"Allows nodes behind NAT to use this node as their relay", "[on|off]       ", func(args []string) {
+		if len(args) > 0 {
+			instance.SetRelayServer(args[0] == "on")
+		}
+
+		if instance.IsRelayServer() {
+			appendChatView("\x1b[35mRelay server: on\x1b[0m")
+		} else {
+			appendChatView("\x1b[35mRelay server: off\x1b[0m")
+		}
+	}}
+
+	commands["/netname"] = &command{"Sets name of networks started by this node", "[name]             ", func(args []string) {
+		if len(args) > 0 {
+			instance.SetDefaultNetworkName(strings.Replace(strings.Join(args, " "), ";", "", -1))
+		}
+
+		if _, name := instance.NetworkInfo(); len(name) > 0 {
+			appendChatView(fmt.Sprintf("\x1b[35mCurrent network: %s\x1b[0m", name))
+		}
+		appendChatView(fmt.Sprintf("\x1b[35mNew network name: %s\x1b[0m", instance.DefaultNetworkName()))
+	}}
+
+	commands["/discover"] = &command{"Lists networks on the local network, joins the n-th listed network if specified", "[n] [server port]", func(args []string) {
+		if len(args) == 0 {
+			go discoverNetworks()
+			return
+		}
+
+		i, err := strconv.Atoi(args[0])
+
+		if err != nil {
+			userError("failed to parse network number")
+			return
+		}
+
+		var port uint64
+
+		if len(args) > 1 {
+			port, err = strconv.ParseUint(args[1], 10, 16)
+
+			if err != nil {
+				userError("failed to parse port number")
+				return
+			}
+		}
+
+		go joinDiscoveredNetwork(i, uint16(port))
+	}}
+
+	commands["/announce"] = &command{"Announces networks this node is part of on the local network", "[on|off]          ", func(args []string) {
+		if len(args) > 0 {
+			instance.SetAnnounce(args[0] == "on")
+		}
+
+		if instance.IsAnnounceEnabled() {
+			appendChatView("\x1b[35mAnnounce: on\x1b[0m")
+		} else {
+			appendChatView("\x1b[35mAnnounce: off\x1b[0m")
+		}
+	}}
+
+	moderationCommand := func(action string) func([]string) {
+		return func(args []string) {
+			if len(args) < 1 {
+				userError("invalid usage")
+				return
+			}
+
+			instance.Moderate(action, strings.Join(args, " "))
+		}
+	}
+
+	commands["/kick"] = &command{"Removes a user from the chat (operators only)", "<nick|0xID|key:FP>    ", moderationCommand(distrochya.ModKick)}
+	commands["/ban"] = &command{"Bans a user from the chat (operators only)", "<nick|0xID|key:FP>     ", moderationCommand(distrochya.ModBan)}
+	commands["/unban"] = &command{"Lifts a ban (operators only)", "<nick|0xID|key:FP>   ", moderationCommand(distrochya.ModUnban)}
+	commands["/mute"] = &command{"Prevents a user from sending messages (operators only)", "<nick|0xID|key:FP>    ", moderationCommand(distrochya.ModMute)}
+	commands["/unmute"] = &command{"Lifts a mute (operators only)", "<nick|0xID|key:FP>  ", moderationCommand(distrochya.ModUnmute)}
+	commands["/op"] = &command{"Grants operator role (network creator only)", "<nick|0xID|key:FP>      ", moderationCommand(distrochya.ModOp)}
+	commands["/deop"] = &command{"Revokes operator role (network creator only)", "<nick|0xID|key:FP>    ", moderationCommand(distrochya.ModDeop)}
+
+	commands["/modlist"] = &command{"Shows operators, bans and mutes", "                   ", func(args []string) {
+		appendChatView(fmt.Sprintf("\x1b[35m%s\x1b[0m", instance.ModerationSummary()))
+	}}
+
+	if debugEnabled {
+		commands["/us"] = &command{"Update status", "                         ", func(args []string) {
+			updateStatus()
+		}}
+
+		commands["/cl"] = &command{"Clears log", "                         ", func(args []string) {
+			ui.clearLog()
+		}}
+
+		commands["/a"] = &command{"/start 9999", "                          ", func(args []string) {
+			processCommand("/start", []string{"9999"})
+		}}
+		commands["/b"] = &command{"/connect localhost:9999 9998", "                          ", func(args []string) {
+			processCommand("/connect", []string{"localhost:9999", "9998"})
+		}}
+		commands["/c"] = &command{"/connect localhost:9999 9997", "                          ", func(args []string) {
+			processCommand("/connect", []string{"localhost:9999", "9997"})
+		}}
+		commands["/d"] = &command{"/connect localhost:9999 9996", "                          ", func(args []string) {
+			processCommand("/connect", []string{"localhost:9999", "9996"})
+		}}
+		commands["/e"] = &command{"/connect localhost:9999 9995", "                          ", func(args []string) {
+			processCommand("/connect", []string{"localhost:9999", "9995"})
+		}}
+
+		commands["/m"] = &command{"mark", "                          ", func(args []string) {
+			appendChatView("========= MARK ==========")
+			appendLogView("========= MARK ==========")
+		}}
+
+		// fault injection, target is a relation or a node ID
+		faultTarget := "<next|prev|leader|0xID>"
+
+		commands["/drop"] = &command{"Drops a connection as if it failed", faultTarget, func(args []string) {
+			if len(args) != 1 {
+				userError("invalid usage")
+				return
+			}
+
+			instance.DropConnection(args[0])
+		}}
+
+		commands["/delay"] = &command{"Delays messages received from a connection, 0 removes the delay", faultTarget + " <ms>", func(args []string) {
+			if len(args) != 2 {
+				userError("invalid usage")
+				return
+			}
+
+			ms, err := strconv.Atoi(args[1])
+
+			if err != nil || ms < 0 {
+				userError("invalid delay")
+				return
+			}
+
+			instance.DelayConnection(args[0], time.Duration(ms)*time.Millisecond)
+		}}
+
+		commands["/blackhole"] = &command{"Silently discards everything sent over a connection without closing it", faultTarget + " [on|off]", func(args []string) {
+			if len(args) < 1 || len(args) > 2 {
+				userError("invalid usage")
+				return
+			}
+
+			instance.BlackholeConnection(args[0], len(args) < 2 || args[1] == "on")
+		}}
+
+		commands["/pause"] = &command{"Stops answering alivecheck so that peers consider this node dead", "[on|off]             ", func(args []string) {
+			instance.SetPaused(len(args) < 1 || args[0] == "on")
+
+			if instance.IsPaused() {
+				appendChatView("\x1b[35mPaused: on\x1b[0m")
+			} else {
+				appendChatView("\x1b[35mPaused: off\x1b[0m")
+			}
+		}}
+	}
+}
+
+// returns startup action based on command line options, nodes without UI exit if it fails
+func launchStartup(startPort int, seeds []string, port uint16, exitOnFailure bool) func() {
+	return func() {
+		bind, advertise := addressArgs(nil)
+		ok := true
+
+		if startPort >= 0 {
+			instance.Start(uint16(startPort), bind, advertise)
+			ok = instance.IsRunning()
+		} else if len(seeds) > 0 {
+			ok = instance.Join(seeds, port, bind, advertise)
+		}
+
+		if !ok && exitOnFailure {
+			os.Exit(1)
+		}
+	}
+}
+
+func main() {
+	var startup func()
+
+	rand.Seed(time.Now().UnixNano())
+
+	// frontend is picked once the options are known
+	instance = distrochya.New(handleEvent, config)
+	initOptions()
+
+	if len(os.Args) > 1 && os.Args[1] == "trace" {
+		os.Exit(runTraceCommand(os.Args[2:]))
+	}
+
+	if err := parseConfig(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+
+	initCommands()
+
+	if len(launchSimulation) > 0 {
+		os.Exit(runSimulation(launchSimulation, int64(simulationSeed), logFile))
+	}
+
+	// a new key would change the fingerprint others know this user by
+	if err := instance.LoadIdentity(); err != nil {
+		fmt.Fprintln(os.Stderr, "warning: unable to load the identity key, a new one is used: "+err.Error())
+	}
+
+	// without a log file, log entries of nodes without UI go to stderr
+	var logFallback io.Writer
+
+	if launchHeadless || launchStdio {
+		logFallback = os.Stderr
+	}
+
+	logCloser, err := initLogger(logFallback)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	if logCloser != nil {
+		defer logCloser.Close()
+	}
+
+	if len(metricsAddress) > 0 {
+		if err := startMetricsServer(metricsAddress); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if len(adminAddress) > 0 {
+		if err := startAdminServer(adminAddress); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if launchHeadless || launchStdio {
+		logOutput := os.Stderr
+
+		if launchStdio {
+			ui = newStdioFrontend(os.Stdin, os.Stdout, logOutput)
+		} else {
+			ui = newHeadlessFrontend(os.Stdout, logOutput)
+
+			// anchor nodes keep the network running, they don't chat unless asked to
+			if !launchChat {
+				instance.LeaveChat()
+			}
+		}
+	} else {
+		ui = &tuiFrontend{}
+	}
+
+	if launchRejoin {
+		startup = instance.Rejoin
+	} else if launchStartPort >= 0 || len(launchSeeds) > 0 {
+		var seeds []string
+
+		if len(launchSeeds) > 0 {
+			seeds = strings.Split(launchSeeds, ",")
+		}
+
+		startup = launchStartup(launchStartPort, seeds, uint16(launchPort), launchHeadless || launchStdio)
+	}
+
+	ui.run(startup)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Silaedru/distrochya"
+	"strings"
+	"time"
+)
+
+// user interface the node reports to
+type frontend interface {
+	appendChat(s string)
+	appendLog(s string)
+	appendLogEntry(e distrochya.Event) // frontends without a log view leave entries to the logger
+	chatMessage(u string, s string)
+	userError(e string)
+	userEvent(m string)
+	clearChat()
+	clearLog()
+	setUsers(us []string)
+	setStatus(s string)
+	setConnectedName(n string)
+	run(startup func()) // blocks until the user quits, startup is run once the frontend is ready
+}
+
+var ui frontend
+
+// passes events of the instance to the frontend
+func handleEvent(e distrochya.Event) {
+	switch e.Type {
+	case distrochya.ChatReceived:
+		ui.chatMessage(e.User, e.Text)
+	case distrochya.UsersChanged:
+		setChatUsers(e.Users)
+		ui.setUsers(e.Users)
+	case distrochya.ChatNameChanged:
+		ui.setConnectedName(e.User)
+	case distrochya.Notice:
+		userEvent(e.Text)
+	case distrochya.Error:
+		userError(e.Text)
+	case distrochya.Log:
+		if logger != nil {
+			logger.write(e)
+		}
+
+		ui.appendLogEntry(e)
+	case distrochya.LeaderChanged, distrochya.StateChanged, distrochya.StatusChanged:
+		updateStatus()
+	}
+}
+
+func userError(e string) {
+	ui.userError(e)
+}
+
+func userEvent(m string) {
+	ui.userEvent(m)
+}
+
+func endpointsToString(eps []string) string {
+	if len(eps) == 0 {
+		return "unknown"
+	}
+
+	return strings.Join(eps, ", ")
+}
+
+func updateStatus() {
+	if !debugEnabled {
+		return
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+
+		s := instance.Snapshot()
+		var nodesStr string
+
+		for _, p := range s.Peers {
+			nodesStr = fmt.Sprintf("%s\n    -> \x1b[32m0x%X\x1b[0m (listening on %s): \x1b[33m%s\x1b[0m", nodesStr,
+				p.ID, endpointsToString(p.Endpoints), p.Relation)
+
+			if len(p.Key) > 0 {
+				nodesStr += ", key " + p.Key
+			}
+
+			if p.RTT > 0 {
+				nodesStr += fmt.Sprintf(", rtt %s, phi %.1f", p.RTT.Round(10*time.Microsecond), p.Phi)
+			}
+		}
+
+		state := s.State
+
+		if s.JoinAttempt > 0 {
+			state = fmt.Sprintf("%s (attempt %d)", state, s.JoinAttempt)
+		}
+
+		ui.setStatus(fmt.Sprintf(""+
+			"  Logical time: \x1b[33;1m%d\x1b[0m\n"+
+			" Network state: \x1b[33;1m%s\x1b[0m\n"+
+			"            Node ID: \x1b[33;1m0x%X\x1b[0m (%s)\n"+
+			"                Key: \x1b[33;1m%s\x1b[0m\n"+
+			" Twice Next Node ID: \x1b[33;1m0x%X\x1b[0m (%s)\n"+
+			"          Leader ID: \x1b[33;1m0x%X\x1b[0m (%s)\n"+
+			"\n"+
+			" Connected nodes:\n%s\n\n   ----- END -----", s.LogicalTime,
+			state, s.NodeID, endpointsToString(instance.Endpoints(s.NodeID)), instance.Fingerprint(), s.TwiceNextNodeID,
+			endpointsToString(instance.Endpoints(s.TwiceNextNodeID)), s.LeaderID,
+			endpointsToString(instance.Endpoints(s.LeaderID)), nodesStr))
+	}()
+}
+
+func appendLogView(s string) {
+	if !debugEnabled {
+		return
+	}
+
+	ui.appendLog(s)
+}
+
+func appendChatView(s string) {
+	ui.appendChat(s)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Silaedru/distrochya"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ansiEscapeRegexp = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// frontend without any UI, chat goes to chatOutput and log to logOutput
+type headlessFrontend struct {
+	chatOutput io.Writer
+	logOutput  io.Writer
+	lock       *sync.Mutex
+}
+
+func newHeadlessFrontend(chatOutput io.Writer, logOutput io.Writer) *headlessFrontend {
+	return &headlessFrontend{chatOutput, logOutput, &sync.Mutex{}}
+}
+
+func stripANSI(s string) string {
+	return ansiEscapeRegexp.ReplaceAllString(s, "")
+}
+
+func (h *headlessFrontend) write(w io.Writer, s string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "%s %s\n", time.Now().Format(time.RFC3339), stripANSI(s))
+}
+
+func (h *headlessFrontend) appendChat(s string) {
+	h.write(h.chatOutput, s)
+}
+
+func (h *headlessFrontend) appendLog(s string) {
+	h.write(h.logOutput, s)
+}
+
+func (h *headlessFrontend) appendLogEntry(e distrochya.Event) {
+}
+
+func (h *headlessFrontend) chatMessage(u string, s string) {
+	h.appendChat(formatChatMessage(u, s))
+}
+
+func (h *headlessFrontend) userError(e string) {
+	h.appendChat(formatUserError(e))
+}
+
+func (h *headlessFrontend) userEvent(m string) {
+	h.appendChat(formatUserEvent(m))
+}
+
+func (h *headlessFrontend) clearChat() {
+}
+
+func (h *headlessFrontend) clearLog() {
+}
+
+func (h *headlessFrontend) setUsers(us []string) {
+	h.write(h.logOutput, "Users: "+strings.Join(us, ", "))
+}
+
+// there is nobody to look at the status
+func (h *headlessFrontend) setStatus(s string) {
+}
+
+func (h *headlessFrontend) setConnectedName(n string) {
+	if len(n) > 0 {
+		h.write(h.logOutput, "Chatting as: "+n)
+	}
+}
+
+// runs until interrupted or terminated
+func (h *headlessFrontend) run(startup func()) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	if startup != nil {
+		go startup()
+	}
+
+	s := <-sig
+	h.appendLog(fmt.Sprintf("Received %s, shutting down", s))
+
+	if instance.IsRunning() {
+		instance.Disconnect()
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Silaedru/distrochya"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	textLogFormat = "text"
+	jsonLogFormat = "json"
+)
+
+var logFormat string
+var logMaxSizeMB = 10
+var logMaxFiles = 5
+
+// log entries go here besides the log view, nil if they don't go anywhere else
+var logger *logWriter
+
+// writes log entries of the instance as text or as one JSON object per line
+type logWriter struct {
+	lock   *sync.Mutex
+	output io.Writer
+	json   bool
+}
+
+func newLogWriter(output io.Writer, format string) *logWriter {
+	return &logWriter{&sync.Mutex{}, output, format == jsonLogFormat}
+}
+
+func idField(id uint64) string {
+	return fmt.Sprintf("0x%X", id)
+}
+
+func (l *logWriter) write(e distrochya.Event) {
+	var line []byte
+
+	if l.json {
+		fields := map[string]interface{}{
+			"time":    time.Now().Format(time.RFC3339Nano),
+			"level":   e.Level.String(),
+			"lamport": e.Time,
+			"node_id": idField(e.NodeID),
+			"text":    e.Text,
+		}
+
+		if e.PeerID != 0 {
+			fields["peer_id"] = idField(e.PeerID)
+		}
+
+		if len(e.Relation) > 0 {
+			fields["relation"] = e.Relation
+		}
+
+		if len(e.Message) > 0 {
+			fields["message"] = e.Message
+		}
+
+		b, err := json.Marshal(fields)
+
+		if err != nil {
+			return
+		}
+
+		line = append(b, '\n')
+	} else {
+		line = []byte(fmt.Sprintf("%s %s\n", time.Now().Format(time.RFC3339), formatLogEntry(e)))
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.output.Write(line)
+}
+
+// single line of the entry without time and colors
+func formatLogEntry(e distrochya.Event) string {
+	s := fmt.Sprintf("(%8d) %-5s %s", e.Time, e.Level.String(), e.Text)
+
+	if e.PeerID != 0 || len(e.Relation) > 0 {
+		s += fmt.Sprintf(" [peer=0x%X r=%s", e.PeerID, e.Relation)
+
+		if len(e.Message) > 0 {
+			s += " msg=" + e.Message
+		}
+
+		s += "]"
+	}
+
+	return s
+}
+
+// log entry as shown in the log view
+func formatLogView(e distrochya.Event) string {
+	text := e.Text
+
+	switch e.Level {
+	case distrochya.LogDebug:
+		text = "\x1b[90m" + text + "\x1b[0m"
+	case distrochya.LogWarn:
+		text = "\x1b[33m" + text + "\x1b[0m"
+	case distrochya.LogError:
+		text = "\x1b[31m" + text + "\x1b[0m"
+	}
+
+	return fmt.Sprintf("\x1b[37;1m(%8d)\x1b[0m  %s", e.Time, text)
+}
+
+// log file which is rotated once it grows over maxSize, the last maxFiles files are kept as path.1, path.2, ...
+type rotatingFile struct {
+	lock     *sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// maxSize 0 never rotates the file
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{lock: &sync.Mutex{}, path: path, maxSize: maxSize, maxFiles: maxFiles}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+
+	if f.maxFiles < 1 {
+		os.Remove(f.path)
+	} else {
+		os.Remove(f.path + "." + strconv.Itoa(f.maxFiles))
+
+		for i := f.maxFiles - 1; i > 0; i-- {
+			os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+		}
+
+		os.Rename(f.path, f.path+".1")
+	}
+
+	return f.open()
+}
+
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			f.file = nil
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
+
+// log entries go to the log file if there is one, otherwise to fallback which may be nil
+func initLogger(fallback io.Writer) (io.Closer, error) {
+	if len(logFile) > 0 {
+		f, err := openRotatingFile(logFile, int64(logMaxSizeMB)*1024*1024, logMaxFiles)
+
+		if err != nil {
+			return nil, err
+		}
+
+		format := logFormat
+
+		if len(format) == 0 {
+			format = jsonLogFormat
+		}
+
+		logger = newLogWriter(f, format)
+		return f, nil
+	}
+
+	if fallback != nil {
+		format := logFormat
+
+		if len(format) == 0 {
+			format = textLogFormat
+		}
+
+		logger = newLogWriter(fallback, format)
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Silaedru/distrochya"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.log")
+	f, err := openRotatingFile(path, 10, 2)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.Close()
+
+	want := map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"}
+
+	for p, content := range want {
+		b, err := ioutil.ReadFile(p)
+
+		if err != nil || string(b) != content {
+			t.Errorf("%s contains %q (%v), want %q", filepath.Base(p), b, err, content)
+		}
+	}
+
+	if _, err := ioutil.ReadFile(path + ".3"); err == nil {
+		t.Error("more rotated files kept than asked for")
+	}
+}
+
+func TestJSONLogEntry(t *testing.T) {
+	var out bytes.Buffer
+	w := newLogWriter(&out, jsonLogFormat)
+
+	w.write(distrochya.Event{Type: distrochya.Log, Time: 42, Level: distrochya.LogWarn, Text: "hello", NodeID: 0xA, PeerID: 0xB, Relation: "next", Message: "election"})
+
+	var fields map[string]interface{}
+
+	if err := json.Unmarshal(out.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{"level": "warn", "lamport": 42.0, "node_id": "0xA", "peer_id": "0xB", "relation": "next", "message": "election", "text": "hello"}
+
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("%s is %v, want %v", k, fields[k], v)
+		}
+	}
+}
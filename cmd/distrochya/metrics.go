@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Silaedru/distrochya"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+)
+
+// address of the HTTP listener serving /metrics, disabled if empty
+var metricsAddress string
+
+func sortedKeys(m map[string]uint64) []string {
+	var keys []string
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCounter(w io.Writer, name string, help string, v uint64) {
+	writeMetric(w, name, "counter", help)
+	fmt.Fprintf(w, "%s %d\n", name, v)
+}
+
+func writeCounterByLabel(w io.Writer, name string, help string, label string, values map[string]uint64) {
+	writeMetric(w, name, "counter", help)
+
+	for _, k := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, values[k])
+	}
+}
+
+// metrics in the Prometheus text exposition format
+func writeMetrics(w io.Writer, m distrochya.Metrics) {
+	writeMetric(w, "distrochya_nodes", "gauge", "Connections of this node by relation.")
+	relations := make(map[string]uint64)
+
+	for r, c := range m.NodesByRelation {
+		relations[r] = uint64(c)
+	}
+
+	for _, r := range sortedKeys(relations) {
+		fmt.Fprintf(w, "distrochya_nodes{relation=%q} %d\n", r, relations[r])
+	}
+
+	writeCounterByLabel(w, "distrochya_messages_sent_total", "Protocol messages sent by type.", "type", m.MessagesSent)
+	writeCounterByLabel(w, "distrochya_messages_received_total", "Protocol messages received by type.", "type", m.MessagesReceived)
+	writeCounter(w, "distrochya_elections_started_total", "Elections started by this node.", m.ElectionsStarted)
+	writeCounter(w, "distrochya_elections_won_total", "Elections won by this node.", m.ElectionsWon)
+	writeCounter(w, "distrochya_ring_repairs_total", "Broken rings detected by this node.", m.RingRepairs)
+	writeCounter(w, "distrochya_closering_hops_total", "Closering messages handled by this node.", m.CloseringHops)
+	writeCounter(w, "distrochya_chat_messages_relayed_total", "Chat messages broadcast by this node as the leader.", m.ChatMessagesRelayed)
+	writeCounter(w, "distrochya_leader_changes_total", "Leader changes seen by this node.", m.LeaderChanges)
+	writeCounter(w, "distrochya_outbound_dropped_total", "Messages to slow followers dropped because their outbound queue was full.", m.OutboundDropped)
+	writeCounter(w, "distrochya_slow_peer_disconnects_total", "Connections closed because their outbound queue was full.", m.SlowPeerDisconnects)
+
+	writeMetric(w, "distrochya_keepalive_rtt_seconds", "histogram", "Round trip times of answered alivechecks.")
+	h := m.KeepaliveRTT
+
+	for i, b := range h.Buckets {
+		fmt.Fprintf(w, "distrochya_keepalive_rtt_seconds_bucket{le=\"%g\"} %d\n", b.Seconds(), h.Counts[i])
+	}
+
+	count := h.Counts[len(h.Counts)-1]
+	fmt.Fprintf(w, "distrochya_keepalive_rtt_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(w, "distrochya_keepalive_rtt_seconds_sum %g\n", h.Sum.Seconds())
+	fmt.Fprintf(w, "distrochya_keepalive_rtt_seconds_count %d\n", count)
+
+	if m.LeaderChanges > 0 {
+		writeMetric(w, "distrochya_seconds_since_leader_change", "gauge", "Time since the leader last changed.")
+		fmt.Fprintf(w, "distrochya_seconds_since_leader_change %g\n", m.SinceLeaderChange.Seconds())
+	}
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, instance.Metrics())
+}
+
+// listens on addr and serves requests until the process exits
+func startHTTPServer(addr string, handler http.Handler) error {
+	l, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	go http.Serve(l, handler)
+
+	return nil
+}
+
+func startMetricsServer(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+
+	return startHTTPServer(addr, mux)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"github.com/Silaedru/distrochya"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	m := distrochya.Metrics{
+		NodesByRelation:  map[string]int{"next": 1, "prev": 0},
+		MessagesSent:     map[string]uint64{"election": 2},
+		MessagesReceived: map[string]uint64{},
+		ElectionsWon:     1,
+		KeepaliveRTT:     distrochya.RTTHistogram{Buckets: []time.Duration{time.Millisecond, time.Second}, Counts: []uint64{1, 3, 4}, Sum: 5 * time.Second},
+	}
+
+	var out bytes.Buffer
+	writeMetrics(&out, m)
+	s := out.String()
+
+	for _, line := range []string{
+		`distrochya_nodes{relation="next"} 1`,
+		`distrochya_nodes{relation="prev"} 0`,
+		`distrochya_messages_sent_total{type="election"} 2`,
+		"# TYPE distrochya_messages_received_total counter",
+		"distrochya_elections_won_total 1",
+		`distrochya_keepalive_rtt_seconds_bucket{le="0.001"} 1`,
+		`distrochya_keepalive_rtt_seconds_bucket{le="1"} 3`,
+		`distrochya_keepalive_rtt_seconds_bucket{le="+Inf"} 4`,
+		"distrochya_keepalive_rtt_seconds_sum 5",
+		"distrochya_keepalive_rtt_seconds_count 4",
+	} {
+		if !strings.Contains(s, line+"\n") {
+			t.Errorf("missing %q", line)
+		}
+	}
+
+	if strings.Contains(s, "since_leader_change") {
+		t.Error("time since leader change without any change")
+	}
+}
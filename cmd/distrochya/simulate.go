@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Silaedru/distrochya/sim"
+	"io"
+	"math/rand"
+	"os"
+)
+
+// runs the scenario given by --simulate, returns the exit code
+func runSimulation(name string, seed int64, logFile string) int {
+	if name == "list" {
+		for _, sc := range sim.Scenarios {
+			fmt.Printf("%-16s %s\n", sc.Name, sc.Description)
+		}
+
+		return 0
+	}
+
+	var scenarios []*sim.Scenario
+
+	if name == "all" {
+		for i := range sim.Scenarios {
+			scenarios = append(scenarios, &sim.Scenarios[i])
+		}
+	} else if sc := sim.FindScenario(name); sc != nil {
+		scenarios = append(scenarios, sc)
+	} else {
+		fmt.Fprintf(os.Stderr, "unknown scenario %s, --simulate=list shows all of them\n", name)
+		return 2
+	}
+
+	var log io.Writer
+
+	if len(logFile) > 0 {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+
+		defer f.Close()
+		log = f
+	}
+
+	// printed with every scenario so a failure can be replayed using --seed
+	if seed == 0 {
+		seed = rand.Int63n(1<<31-1) + 1
+	}
+
+	rtn := 0
+
+	for _, sc := range scenarios {
+		if err := sim.RunScenario(sc, seed, config, os.Stdout, log); err != nil {
+			fmt.Printf("FAIL %s: %s\n", sc.Name, err.Error())
+			rtn = 1
+		} else {
+			fmt.Printf("ok   %s\n", sc.Name)
+		}
+	}
+
+	return rtn
+}
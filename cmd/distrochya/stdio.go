@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/Silaedru/distrochya"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// frontend for scripts and bots: input lines are processed like in the chat input,
+// every event is written as a single JSON object per line
+type stdioFrontend struct {
+	input     io.Reader
+	output    io.Writer
+	logOutput io.Writer
+	lock      *sync.Mutex
+}
+
+func newStdioFrontend(input io.Reader, output io.Writer, logOutput io.Writer) *stdioFrontend {
+	return &stdioFrontend{input, output, logOutput, &sync.Mutex{}}
+}
+
+func (s *stdioFrontend) emit(eventType string, fields map[string]interface{}) {
+	fields["type"] = eventType
+	fields["time"] = time.Now().Format(time.RFC3339Nano)
+
+	b, err := json.Marshal(fields)
+
+	if err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.output.Write(append(b, '\n'))
+}
+
+func (s *stdioFrontend) appendChat(m string) {
+	s.emit("output", map[string]interface{}{"text": stripANSI(m)})
+}
+
+func (s *stdioFrontend) appendLog(m string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	io.WriteString(s.logOutput, time.Now().Format(time.RFC3339)+" "+stripANSI(m)+"\n")
+}
+
+func (s *stdioFrontend) appendLogEntry(e distrochya.Event) {
+}
+
+func (s *stdioFrontend) chatMessage(u string, m string) {
+	s.emit("chat", map[string]interface{}{"user": u, "text": m})
+}
+
+func (s *stdioFrontend) userError(e string) {
+	s.emit("error", map[string]interface{}{"text": e})
+}
+
+func (s *stdioFrontend) userEvent(m string) {
+	s.emit("info", map[string]interface{}{"text": m})
+}
+
+func (s *stdioFrontend) clearChat() {
+}
+
+func (s *stdioFrontend) clearLog() {
+}
+
+func (s *stdioFrontend) setUsers(us []string) {
+	if us == nil {
+		us = []string{}
+	}
+
+	s.emit("users", map[string]interface{}{"users": us})
+}
+
+func (s *stdioFrontend) setStatus(m string) {
+}
+
+// empty name means we are not in the chat
+func (s *stdioFrontend) setConnectedName(n string) {
+	s.emit("chatting", map[string]interface{}{"user": n})
+}
+
+// runs until the input is closed
+func (s *stdioFrontend) run(startup func()) {
+	if startup != nil {
+		go startup()
+	}
+
+	max := instance.Config().MaxMessageLength
+	r := bufio.NewReaderSize(s.input, max)
+
+	for {
+		line, err := r.ReadSlice('\n')
+
+		// an over-long line is skipped as a whole, the lines after it are still read
+		if err == bufio.ErrBufferFull {
+			for err == bufio.ErrBufferFull {
+				_, err = r.ReadSlice('\n')
+			}
+
+			s.userError(fmt.Sprintf("input line longer than %d bytes ignored", max))
+		} else if len(line) > 0 {
+			processInput(strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"))
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			s.userError("reading input failed: " + err.Error())
+			break
+		}
+	}
+
+	if instance.IsRunning() {
+		instance.Disconnect()
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Silaedru/distrochya"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestStdioSkipsLongLines(t *testing.T) {
+	instance = distrochya.New(nil, distrochya.DefaultConfig())
+	initCommands()
+
+	input := strings.Repeat("x", 3*instance.Config().MaxMessageLength) + "\n/nick bob\n/nick carol"
+	var output bytes.Buffer
+
+	s := newStdioFrontend(strings.NewReader(input), &output, ioutil.Discard)
+	defer func(f frontend) { ui = f }(ui)
+	ui = s
+	s.run(nil)
+
+	var event map[string]interface{}
+
+	if err := json.Unmarshal(bytes.SplitN(output.Bytes(), []byte("\n"), 2)[0], &event); err != nil || event["type"] != "error" {
+		t.Errorf("first event %v (%v), want an error for the long line", event, err)
+	}
+
+	// the last line has no newline
+	if n := instance.ChatName(); n != "carol" {
+		t.Errorf("nick %q, lines after the long one weren't read", n)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Silaedru/distrochya"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// how long /topology waits for the ring walk to come back
+var topologyTimeout = 10 * time.Second
+
+type topologyNode struct {
+	ID        string `json:"id"`
+	Next      string `json:"next"`
+	Prev      string `json:"prev"`
+	Leader    string `json:"leader"`
+	TwiceNext string `json:"twice_next"`
+}
+
+type topologyProblem struct {
+	NodeID string `json:"node_id,omitempty"`
+	Text   string `json:"text"`
+}
+
+type topology struct {
+	Closed   bool              `json:"closed"`
+	Nodes    []topologyNode    `json:"nodes"`
+	Problems []topologyProblem `json:"problems"`
+}
+
+func writeTopologyJSON(w io.Writer, walk distrochya.RingWalk) error {
+	t := topology{Closed: walk.Closed, Nodes: []topologyNode{}, Problems: []topologyProblem{}}
+
+	for _, rn := range walk.Nodes {
+		t.Nodes = append(t.Nodes, topologyNode{idField(rn.ID), idField(rn.Next), idField(rn.Prev), idField(rn.Leader), idField(rn.TwiceNext)})
+	}
+
+	for _, p := range walk.Problems {
+		tp := topologyProblem{Text: p.Text}
+
+		if p.NodeID != 0 {
+			tp.NodeID = idField(p.NodeID)
+		}
+
+		t.Problems = append(t.Problems, tp)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(t)
+}
+
+// next edges are solid, prev edges dashed, the leader seen by most nodes has a double circle
+// and nodes with problems are red, nodes the walk only heard of are dotted
+func writeTopologyDOT(w io.Writer, walk distrochya.RingWalk) {
+	onRing := make(map[uint64]bool)
+	leaders := make(map[uint64]int)
+	broken := make(map[uint64]bool)
+
+	for _, rn := range walk.Nodes {
+		onRing[rn.ID] = true
+
+		if rn.Leader != 0 {
+			leaders[rn.Leader]++
+		}
+	}
+
+	for _, p := range walk.Problems {
+		broken[p.NodeID] = true
+	}
+
+	var leaderID uint64
+
+	for id, c := range leaders {
+		if c > leaders[leaderID] || (c == leaders[leaderID] && id < leaderID) {
+			leaderID = id
+		}
+	}
+
+	fmt.Fprintln(w, "digraph ring {")
+
+	if !walk.Closed {
+		fmt.Fprintln(w, "\tlabel=\"ring isn't closed\";")
+	}
+
+	for _, rn := range walk.Nodes {
+		attrs := []string{fmt.Sprintf("label=\"0x%X\\nleader 0x%X\"", rn.ID, rn.Leader)}
+
+		if rn.ID == leaderID {
+			attrs = append(attrs, "shape=doublecircle")
+		}
+
+		if broken[rn.ID] {
+			attrs = append(attrs, "color=red")
+		}
+
+		fmt.Fprintf(w, "\t\"0x%X\" [%s];\n", rn.ID, strings.Join(attrs, ", "))
+	}
+
+	for _, rn := range walk.Nodes {
+		for _, id := range []uint64{rn.Next, rn.Prev} {
+			if id != 0 && !onRing[id] {
+				onRing[id] = true
+				fmt.Fprintf(w, "\t\"0x%X\" [style=dotted];\n", id)
+			}
+		}
+	}
+
+	for _, rn := range walk.Nodes {
+		if rn.Next != 0 {
+			fmt.Fprintf(w, "\t\"0x%X\" -> \"0x%X\" [label=\"next\"];\n", rn.ID, rn.Next)
+		}
+
+		if rn.Prev != 0 {
+			fmt.Fprintf(w, "\t\"0x%X\" -> \"0x%X\" [label=\"prev\", style=dashed];\n", rn.ID, rn.Prev)
+		}
+	}
+
+	fmt.Fprintln(w, "}")
+}
+
+// walks the ring and writes the result to path.dot and path.json
+func exportTopology(path string) {
+	walk := instance.WalkRing(topologyTimeout)
+
+	var dot strings.Builder
+	writeTopologyDOT(&dot, walk)
+
+	if err := ioutil.WriteFile(path+".dot", []byte(dot.String()), 0644); err != nil {
+		userError(err.Error())
+		return
+	}
+
+	var js strings.Builder
+	writeTopologyJSON(&js, walk)
+
+	if err := ioutil.WriteFile(path+".json", []byte(js.String()), 0644); err != nil {
+		userError(err.Error())
+		return
+	}
+
+	closed := "closed"
+
+	if !walk.Closed {
+		closed = "not closed"
+	}
+
+	userEvent(fmt.Sprintf("ring of %d nodes (%s) written to %s.dot and %s.json", len(walk.Nodes), closed, path, path))
+
+	for _, p := range walk.Problems {
+		userError(p.Text)
+	}
+}
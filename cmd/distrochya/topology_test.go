@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Silaedru/distrochya"
+	"strings"
+	"testing"
+)
+
+func TestTopologyExport(t *testing.T) {
+	walk := distrochya.RingWalk{
+		Nodes: []distrochya.RingNode{{ID: 0xA, Next: 0xB, Leader: 0xA}, {ID: 0xB, Next: 0xC, Prev: 0xA, Leader: 0xA}},
+		Problems: []distrochya.RingProblem{
+			{Text: "ring isn't closed"},
+			{NodeID: 0xA, Text: "0xA has no prev"},
+		},
+	}
+
+	var dot bytes.Buffer
+	writeTopologyDOT(&dot, walk)
+
+	for _, line := range []string{
+		`"0xA" [label="0xA\nleader 0xA", shape=doublecircle, color=red];`,
+		`"0xB" [label="0xB\nleader 0xA"];`,
+		`"0xC" [style=dotted];`,
+		`"0xA" -> "0xB" [label="next"];`,
+		`"0xB" -> "0xA" [label="prev", style=dashed];`,
+		`label="ring isn't closed";`,
+	} {
+		if !strings.Contains(dot.String(), line) {
+			t.Errorf("DOT misses %s in\n%s", line, dot.String())
+		}
+	}
+
+	var js bytes.Buffer
+
+	if err := writeTopologyJSON(&js, walk); err != nil {
+		t.Fatal(err)
+	}
+
+	var got topology
+
+	if err := json.Unmarshal(js.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Closed || len(got.Nodes) != 2 || got.Nodes[1].Prev != "0xA" || got.Nodes[0].Prev != "0x0" || len(got.Problems) != 2 || got.Problems[1].NodeID != "0xA" || got.Problems[0].NodeID != "" {
+		t.Errorf("JSON %+v", got)
+	}
+}
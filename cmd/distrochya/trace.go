@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Silaedru/distrochya"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// trace entry as written by /trace export, one JSON object per line
+type traceRecord struct {
+	Time     uint64 `json:"lamport"`
+	Wall     string `json:"time"`
+	NodeID   string `json:"node_id"`
+	Kind     string `json:"kind"`
+	PeerID   string `json:"peer_id,omitempty"`
+	Relation string `json:"relation,omitempty"`
+	Message  string `json:"message,omitempty"`
+	SentAt   uint64 `json:"sent_at,omitempty"`
+	Params   string `json:"params,omitempty"`
+	Text     string `json:"text,omitempty"`
+
+	node uint64
+	peer uint64
+}
+
+func newTraceRecord(e distrochya.TraceEntry) traceRecord {
+	r := traceRecord{
+		Time:     e.Time,
+		Wall:     e.Wall.Format(time.RFC3339Nano),
+		NodeID:   idField(e.NodeID),
+		Kind:     e.Kind,
+		Relation: e.Relation,
+		Message:  e.Message,
+		SentAt:   e.SentAt,
+		Params:   e.Params,
+		Text:     e.Text,
+		node:     e.NodeID,
+		peer:     e.PeerID,
+	}
+
+	if e.PeerID != 0 {
+		r.PeerID = idField(e.PeerID)
+	}
+
+	return r
+}
+
+func parseIDField(s string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 64)
+}
+
+func writeTrace(w io.Writer, records []traceRecord) error {
+	enc := json.NewEncoder(w)
+
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writes the trace of the instance to path, returns the number of entries written
+func exportTrace(path string) (int, error) {
+	f, err := os.Create(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var records []traceRecord
+
+	for _, e := range instance.Trace() {
+		records = append(records, newTraceRecord(e))
+	}
+
+	if err := writeTrace(f, records); err != nil {
+		f.Close()
+		return 0, err
+	}
+
+	return len(records), f.Close()
+}
+
+func readTrace(r io.Reader, name string) ([]traceRecord, error) {
+	var records []traceRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var rec traceRecord
+		err := json.Unmarshal(scanner.Bytes(), &rec)
+
+		if err == nil {
+			rec.node, err = parseIDField(rec.NodeID)
+		}
+
+		if err == nil && len(rec.PeerID) > 0 {
+			rec.peer, err = parseIDField(rec.PeerID)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", name, line, err.Error())
+		}
+
+		records = append(records, rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err.Error())
+	}
+
+	return records, nil
+}
+
+// single timeline ordered by logical time, which follows causality: a message is always received
+// after it was sent and everything a node did before sending it comes before the receive,
+// entries with the same time happened concurrently and are ordered by node ID
+func mergeTraces(traces ...[]traceRecord) []traceRecord {
+	var rtn []traceRecord
+
+	for _, t := range traces {
+		rtn = append(rtn, t...)
+	}
+
+	sort.SliceStable(rtn, func(i, j int) bool {
+		if rtn[i].Time != rtn[j].Time {
+			return rtn[i].Time < rtn[j].Time
+		}
+
+		return rtn[i].node < rtn[j].node
+	})
+
+	return rtn
+}
+
+// only entries about the given message types
+func filterTrace(records []traceRecord, messages []string) []traceRecord {
+	if len(messages) == 0 {
+		return records
+	}
+
+	keep := make(map[string]bool)
+
+	for _, m := range messages {
+		keep[m] = true
+	}
+
+	var rtn []traceRecord
+
+	for _, r := range records {
+		if keep[r.Message] {
+			rtn = append(rtn, r)
+		}
+	}
+
+	return rtn
+}
+
+type traceSend struct {
+	node uint64
+	time uint64
+}
+
+func formatTimeline(w io.Writer, records []traceRecord) {
+	sends := make(map[traceSend]bool)
+
+	for _, r := range records {
+		if r.Kind == distrochya.TraceSend {
+			sends[traceSend{r.node, r.Time}] = true
+		}
+	}
+
+	for _, r := range records {
+		s := fmt.Sprintf("%8d 0x%016X ", r.Time, r.node)
+
+		switch r.Kind {
+		case distrochya.TraceSend:
+			s += fmt.Sprintf("send %-15s -> 0x%016X (%s)", r.Message, r.peer, r.Relation)
+		case distrochya.TraceReceive:
+			s += fmt.Sprintf("recv %-15s <- 0x%016X (%s)", r.Message, r.peer, r.Relation)
+
+			if sends[traceSend{r.peer, r.SentAt}] {
+				s += fmt.Sprintf(" sent at %d", r.SentAt)
+			} else {
+				s += fmt.Sprintf(" sent at %d, not in the traces", r.SentAt)
+			}
+		default:
+			s += "log  " + r.Text
+		}
+
+		if r.Kind != distrochya.TraceLog {
+			if len(r.Params) > 0 {
+				s += " " + r.Params
+			}
+
+			if len(r.Text) > 0 {
+				s += " [" + r.Text + "]"
+			}
+		}
+
+		fmt.Fprintln(w, s)
+	}
+}
+
+// distrochya trace merge [--json] [--messages=type,...] <trace file>..., returns the exit code
+func runTraceCommand(args []string) int {
+	if len(args) < 1 || args[0] != "merge" {
+		fmt.Fprintln(os.Stderr, "usage: distrochya trace merge [--json] [--messages=type,...] <trace file>...")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("trace merge", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "write the merged trace as JSON lines instead of a timeline")
+	messages := fs.String("messages", "", "comma separated message types to keep, e.g. election,elected,closering")
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "no trace files given")
+		return 2
+	}
+
+	var traces [][]traceRecord
+
+	for _, p := range fs.Args() {
+		f, err := os.Open(p)
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+
+		t, err := readTrace(f, p)
+		f.Close()
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+
+		traces = append(traces, t)
+	}
+
+	var filter []string
+
+	if len(*messages) > 0 {
+		filter = strings.Split(*messages, ",")
+	}
+
+	merged := filterTrace(mergeTraces(traces...), filter)
+
+	if *asJSON {
+		if err := writeTrace(os.Stdout, merged); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+	} else {
+		formatTimeline(os.Stdout, merged)
+	}
+
+	return 0
+}
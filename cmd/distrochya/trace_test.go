@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"github.com/Silaedru/distrochya"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testTrace(t *testing.T, entries ...distrochya.TraceEntry) []traceRecord {
+	var records []traceRecord
+
+	for _, e := range entries {
+		records = append(records, newTraceRecord(e))
+	}
+
+	var b bytes.Buffer
+
+	if err := writeTrace(&b, records); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := readTrace(&b, "trace")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(read, records) {
+		t.Fatalf("read %+v, wrote %+v", read, records)
+	}
+
+	return read
+}
+
+func TestMergeTraces(t *testing.T) {
+	// A starts an election, B receives it and passes it on to C, whose trace is missing
+	a := testTrace(t,
+		distrochya.TraceEntry{Time: 5, NodeID: 0xA, Kind: distrochya.TraceLog, Text: "starting election"},
+		distrochya.TraceEntry{Time: 6, NodeID: 0xA, Kind: distrochya.TraceSend, PeerID: 0xB, Relation: "next", Message: "election", SentAt: 6, Params: "a"},
+		distrochya.TraceEntry{Time: 9, NodeID: 0xA, Kind: distrochya.TraceReceive, PeerID: 0xC, Relation: "prev", Message: "election", SentAt: 8, Params: "c"},
+	)
+	b := testTrace(t,
+		distrochya.TraceEntry{Time: 2, NodeID: 0xB, Kind: distrochya.TraceSend, PeerID: 0xC, Relation: "next", Message: "alivecheck", SentAt: 2},
+		distrochya.TraceEntry{Time: 7, NodeID: 0xB, Kind: distrochya.TraceReceive, PeerID: 0xA, Relation: "prev", Message: "election", SentAt: 6, Params: "a"},
+		distrochya.TraceEntry{Time: 8, NodeID: 0xB, Kind: distrochya.TraceLog, Text: "forwarding"},
+		distrochya.TraceEntry{Time: 9, NodeID: 0xB, Kind: distrochya.TraceSend, PeerID: 0xC, Relation: "next", Message: "election", SentAt: 9, Params: "c"},
+	)
+
+	merged := mergeTraces(a, b)
+	var order []uint64
+
+	for _, r := range merged {
+		order = append(order, r.Time<<8|r.node)
+	}
+
+	want := []uint64{2<<8 | 0xB, 5<<8 | 0xA, 6<<8 | 0xA, 7<<8 | 0xB, 8<<8 | 0xB, 9<<8 | 0xA, 9<<8 | 0xB}
+
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("merged order %x, want %x", order, want)
+	}
+
+	filtered := filterTrace(merged, []string{"election"})
+
+	if len(filtered) != 4 {
+		t.Errorf("filtered to %d entries, want 4", len(filtered))
+	}
+
+	var out bytes.Buffer
+	formatTimeline(&out, filtered)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+
+	if !strings.Contains(lines[1], "recv election") || !strings.HasSuffix(lines[1], "sent at 6 a") {
+		t.Errorf("receive of a traced send: %q", lines[1])
+	}
+
+	if !strings.Contains(lines[2], "sent at 8, not in the traces") {
+		t.Errorf("receive of a send missing from the traces: %q", lines[2])
+	}
+}
+
+func TestReadTraceErrors(t *testing.T) {
+	for _, s := range []string{"{", `{"lamport":1,"node_id":"xyz"}`, `{"lamport":1,"node_id":"0xA","peer_id":"?"}`} {
+		if _, err := readTrace(strings.NewReader(s), "trace"); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
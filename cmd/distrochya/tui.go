@@ -3,8 +3,10 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"github.com/Silaedru/distrochya"
 	"github.com/jroimartin/gocui"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,11 +17,13 @@ const (
 	usersViewName     = "users"
 	chatInputViewName = "chatInput"
 	controlsViewName  = "controls"
+	discoveryViewName = "discovery"
 
 	logViewTitle    = "Log"
 	statusViewTitle = "Status"
 	chatViewTitle   = "Chat"
 	usersViewTitle  = "Users"
+	discoveryTitle  = "Networks (Enter: join, Esc: close)"
 )
 
 type chatInput struct {
@@ -27,21 +31,20 @@ type chatInput struct {
 
 var gui *gocui.Gui
 
+// layout proportions in percent of the terminal size
+var logViewWidthPercent = 60
+var logViewHeightPercent = 50
+var chatViewWidthPercent = 80
+var discoveryPickerVisible uint32 // atomic, not guarded by mutex
+
 func (e *chatInput) onEnter(v *gocui.View) {
-	input := strings.TrimSpace(v.Buffer())
+	input := v.Buffer()
 
 	clearView(chatInputViewName)
 	v.SetCursor(0, 0)
 	v.SetOrigin(0, 0)
 
-	if len(input) > 0 {
-		if input[0] == '/' {
-			args := strings.Split(input, " ")
-			processCommand(args[0], args[1:])
-		} else {
-			chatMessage(input)
-		}
-	}
+	processInput(input)
 }
 
 func (e *chatInput) Edit(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
@@ -136,67 +139,56 @@ func overwriteView(n string, s string) {
 	})
 }
 
-func updateUsers(us []string) {
-	var b bytes.Buffer
+type tuiFrontend struct {
+}
 
-	for _, u := range us {
-		b.WriteString(fmt.Sprintf("%s\n", u))
-	}
+func (t *tuiFrontend) appendChat(s string) {
+	appendView(chatViewName, s+"\n")
+}
 
-	overwriteView(usersViewName, b.String())
+func (t *tuiFrontend) appendLog(s string) {
+	appendView(logViewName, s+"\n")
 }
 
-func updateStatus() {
-	if !debugEnabled {
-		return
-	}
+func (t *tuiFrontend) appendLogEntry(e distrochya.Event) {
+	appendLogView(formatLogView(e))
+}
 
-	go func() {
-		debugLog("updateStatus")
-
-		time.Sleep(100 * time.Millisecond)
-
-		networkGlobalsMutex.Lock()
-		var nodesStr string
-		if nodes != nil {
-			nodes.lock.Lock()
-			cn := nodes.head
-			for cn != nil {
-				cn.data.lock.Lock()
-				nID := cn.data.id
-				nodesStr = fmt.Sprintf("%s\n    -> \x1b[32m0x%X\x1b[0m (listening on %s): \x1b[33m%s\x1b[0m", nodesStr,
-					nID, idToEndpoint(nID), cn.data.r)
-				cn.data.lock.Unlock()
-				cn = cn.next
-			}
-			nodes.lock.Unlock()
-		}
+func (t *tuiFrontend) chatMessage(u string, s string) {
+	t.appendChat(formatChatMessage(u, s))
+}
 
-		overwriteView(statusViewName, fmt.Sprintf(""+
-			"  Logical time: \x1b[33;1m%d\x1b[0m\n"+
-			" Network state: \x1b[33;1m%s\x1b[0m\n"+
-			"            Node ID: \x1b[33;1m0x%X\x1b[0m (%s)\n"+
-			" Twice Next Node ID: \x1b[33;1m0x%X\x1b[0m (%s)\n"+
-			"          Leader ID: \x1b[33;1m0x%X\x1b[0m (%s)\n"+
-			"\n"+
-			" Connected nodes:\n%s\n\n   ----- END -----", getTime(),
-			getNetworkState(), nodeID, idToEndpoint(nodeID), getTwiceNextNodeID(),
-			idToEndpoint(getTwiceNextNodeID()), getLeaderID(),
-			idToEndpoint(getLeaderID()), nodesStr))
-
-		networkGlobalsMutex.Unlock()
-	}()
+func (t *tuiFrontend) userError(e string) {
+	t.appendChat(formatUserError(e))
 }
 
-func appendLogView(s string) {
-	if !debugEnabled {
-		return
+func (t *tuiFrontend) userEvent(m string) {
+	t.appendChat(formatUserEvent(m))
+}
+
+func (t *tuiFrontend) clearChat() {
+	clearView(chatViewName)
+}
+
+func (t *tuiFrontend) clearLog() {
+	clearView(logViewName)
+}
+
+func (t *tuiFrontend) setUsers(us []string) {
+	var b bytes.Buffer
+
+	for _, u := range us {
+		b.WriteString(fmt.Sprintf("%s\n", u))
 	}
 
-	appendView(logViewName, s+"\n")
+	overwriteView(usersViewName, b.String())
+}
+
+func (t *tuiFrontend) setStatus(s string) {
+	overwriteView(statusViewName, s)
 }
 
-func setConnectedName(n string) {
+func (t *tuiFrontend) setConnectedName(n string) {
 	gui.Update(func(g *gocui.Gui) error {
 		v, _ := gui.View(chatInputViewName)
 		if len(n) == 0 {
@@ -208,12 +200,8 @@ func setConnectedName(n string) {
 	})
 }
 
-func resetConnectedName() {
-	setConnectedName("")
-}
-
-func appendChatView(s string) {
-	appendView(chatViewName, s+"\n")
+func (t *tuiFrontend) run(startup func()) {
+	initTUI(startup)
 }
 
 func layout(g *gocui.Gui) error {
@@ -225,8 +213,8 @@ func layout(g *gocui.Gui) error {
 	curY := 0
 
 	if debugEnabled {
-		logViewWidth := maxW * 3 / 5
-		logViewHeight := maxH / 2
+		logViewWidth := maxW * logViewWidthPercent / 100
+		logViewHeight := maxH * logViewHeightPercent / 100
 
 		logView, err := g.SetView(logViewName, 0, curY, logViewWidth, logViewHeight)
 
@@ -249,7 +237,7 @@ func layout(g *gocui.Gui) error {
 		curY = logViewHeight + 1
 	}
 
-	chatViewWidth := maxW * 4 / 5
+	chatViewWidth := maxW * chatViewWidthPercent / 100
 
 	chatView, err := g.SetView(chatViewName, 0, curY, chatViewWidth, maxH-3)
 
@@ -288,11 +276,101 @@ func layout(g *gocui.Gui) error {
 	controlsView.Wrap = true
 	controlsView.Frame = false
 
+	if atomic.LoadUint32(&discoveryPickerVisible) == 1 {
+		discoveryView, err := g.SetView(discoveryViewName, maxW/6, maxH/4, maxW*5/6, maxH*3/4)
+
+		if err != nil && err != gocui.ErrUnknownView {
+			panic(err)
+		}
+
+		discoveryView.Title = discoveryTitle
+		discoveryView.Highlight = true
+		discoveryView.SelBgColor = gocui.ColorCyan
+		discoveryView.SelFgColor = gocui.ColorBlack
+
+		_, err = g.SetCurrentView(discoveryViewName)
+
+		return err
+	}
+
+	g.DeleteView(discoveryViewName)
 	_, err = g.SetCurrentView(chatInputViewName)
 
 	return err
 }
 
+func showDiscoveryPicker() {
+	if !atomic.CompareAndSwapUint32(&discoveryPickerVisible, 0, 1) {
+		return
+	}
+
+	go func() {
+		// a listener started by /discover keeps running after the picker is closed
+		if instance.StartDiscovery() {
+			defer instance.StopDiscovery()
+		}
+
+		for atomic.LoadUint32(&discoveryPickerVisible) == 1 {
+			networks := listDiscoveredNetworks()
+
+			gui.Update(func(g *gocui.Gui) error {
+				view, err := g.View(discoveryViewName)
+
+				if err != nil {
+					return nil
+				}
+
+				view.Clear()
+
+				if len(networks) == 0 {
+					fmt.Fprint(view, "looking for networks...")
+				}
+
+				for _, dn := range networks {
+					fmt.Fprintf(view, "%s (0x%X) via %s\n", dn.Name, dn.ID, strings.Join(dn.Endpoints, ", "))
+				}
+
+				return nil
+			})
+
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+func hideDiscoveryPicker() {
+	atomic.StoreUint32(&discoveryPickerVisible, 0)
+
+	// trigger layout
+	gui.Update(func(g *gocui.Gui) error {
+		return nil
+	})
+}
+
+func discoveryPickerMove(v *gocui.View, dy int) {
+	_, cy := v.Cursor()
+	_, oy := v.Origin()
+	lines := len(v.BufferLines()) - 1
+
+	if cy+oy+dy < 0 || cy+oy+dy >= lines {
+		return
+	}
+
+	v.MoveCursor(0, dy, false)
+}
+
+func discoveryPickerJoin(v *gocui.View) {
+	_, cy := v.Cursor()
+	_, oy := v.Origin()
+
+	hideDiscoveryPicker()
+
+	// last line is always empty, "looking for networks" has no newline
+	if cy+oy < len(v.BufferLines())-1 {
+		go joinDiscoveredNetwork(cy+oy+1, 0)
+	}
+}
+
 func scrollView(vn string, dy int) {
 	// thanks to https://github.com/jroimartin/gocui/issues/84
 	v, _ := gui.View(vn)
@@ -344,6 +422,45 @@ func setupKeyBindings(g *gocui.Gui) error {
 		return err
 	}
 
+	if err := g.SetKeybinding("", gocui.KeyF2, gocui.ModNone, func(g *gocui.Gui, v *gocui.View) error {
+		if atomic.LoadUint32(&discoveryPickerVisible) == 1 {
+			hideDiscoveryPicker()
+		} else {
+			showDiscoveryPicker()
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := g.SetKeybinding(discoveryViewName, gocui.KeyArrowUp, gocui.ModNone, func(g *gocui.Gui, v *gocui.View) error {
+		discoveryPickerMove(v, -1)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := g.SetKeybinding(discoveryViewName, gocui.KeyArrowDown, gocui.ModNone, func(g *gocui.Gui, v *gocui.View) error {
+		discoveryPickerMove(v, 1)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := g.SetKeybinding(discoveryViewName, gocui.KeyEnter, gocui.ModNone, func(g *gocui.Gui, v *gocui.View) error {
+		discoveryPickerJoin(v)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := g.SetKeybinding(discoveryViewName, gocui.KeyEsc, gocui.ModNone, func(g *gocui.Gui, v *gocui.View) error {
+		hideDiscoveryPicker()
+		return nil
+	}); err != nil {
+		return err
+	}
+
 	if err := g.SetKeybinding("", gocui.KeyF5, gocui.ModNone, func(g *gocui.Gui, v *gocui.View) error {
 		updateStatus()
 		return nil
@@ -390,7 +507,8 @@ func setupKeyBindings(g *gocui.Gui) error {
 	return nil
 }
 
-func initTUI() {
+// startup is run once the UI is ready
+func initTUI(startup func()) {
 	var err error
 	gui, err = gocui.NewGui(gocui.OutputNormal)
 
@@ -414,6 +532,7 @@ func initTUI() {
 	if debugEnabled {
 		overwriteView(controlsViewName, ""+
 			"\x1b[30;46m F1: Help \x1b[0m "+
+			"\x1b[30;46m F2: Discover \x1b[0m "+
 			"\x1b[30;46m F5: Refresh status \x1b[0m "+
 			"\x1b[30;46m F6/F7: Scroll chat \x1b[0m "+
 			"\x1b[30;46m F8/F9: Scroll log \x1b[0m "+
@@ -423,6 +542,7 @@ func initTUI() {
 	} else {
 		overwriteView(controlsViewName, ""+
 			"\x1b[30;46m F1: Help \x1b[0m "+
+			"\x1b[30;46m F2: Discover \x1b[0m "+
 			"\x1b[30;46m F5: Refresh status \x1b[0m "+
 			"\x1b[30;46m F6/F7: Scroll chat \x1b[0m "+
 			"\x1b[30;46m F10: Quit \x1b[0m "+
@@ -438,9 +558,13 @@ func initTUI() {
 		return nil
 	})
 
-	userEvent(fmt.Sprintf("using default nickname \"%s\"", getChatName()))
+	userEvent(fmt.Sprintf("using default nickname \"%s\"", instance.ChatName()))
 
 	updateStatus()
 
+	if startup != nil {
+		go startup()
+	}
+
 	gui.MainLoop()
 }
@@ -0,0 +1,257 @@
+package distrochya
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	discoveryExpirationIntervals = 3
+	discoveryMaxDatagramSize     = 1024
+)
+
+type DiscoveredNetwork struct {
+	ID        uint64
+	Name      string
+	Endpoints []string
+	LastSeen  time.Time
+}
+
+func (inst *Instance) setNetworkInfo(id uint64, name string) {
+	inst.networkInfoMutex.Lock()
+	inst.networkID = id
+	inst.networkName = name
+	inst.networkInfoMutex.Unlock()
+}
+
+func (inst *Instance) NetworkInfo() (uint64, string) {
+	inst.networkInfoMutex.Lock()
+	defer inst.networkInfoMutex.Unlock()
+
+	return inst.networkID, inst.networkName
+}
+
+func (inst *Instance) SetDefaultNetworkName(n string) {
+	inst.networkInfoMutex.Lock()
+	inst.defaultNetworkName = n
+	inst.networkInfoMutex.Unlock()
+}
+
+// name used for networks started by this node
+func (inst *Instance) DefaultNetworkName() string {
+	inst.networkInfoMutex.Lock()
+	rtn := inst.defaultNetworkName
+	inst.networkInfoMutex.Unlock()
+
+	if len(rtn) == 0 {
+		rtn = inst.ChatName() + "'s network"
+	}
+
+	return rtn
+}
+
+func (inst *Instance) SetAnnounce(enabled bool) {
+	if enabled {
+		atomic.StoreUint32(&inst.announceEnabled, 1)
+	} else {
+		atomic.StoreUint32(&inst.announceEnabled, 0)
+	}
+}
+
+func (inst *Instance) IsAnnounceEnabled() bool {
+	return atomic.LoadUint32(&inst.announceEnabled) != 0
+}
+
+// periodically announces the network on the local segment while l is the running server
+func (inst *Instance) announceNetwork(l net.Listener) {
+	groupAddr, err := net.ResolveUDPAddr("udp4", inst.Config().DiscoveryAddress)
+
+	if err != nil {
+		inst.warnLog("Network announcement disabled: " + err.Error())
+		return
+	}
+
+	c, err := net.DialUDP("udp4", nil, groupAddr)
+
+	if err != nil {
+		inst.warnLog("Network announcement disabled: " + err.Error())
+		return
+	}
+
+	defer c.Close()
+
+	for {
+		inst.networkGlobalsMutex.Lock()
+		running := inst.server == l
+		inst.networkGlobalsMutex.Unlock()
+
+		if !running {
+			return
+		}
+
+		id, name := inst.NetworkInfo()
+		state := inst.NetworkState()
+
+		if inst.IsAnnounceEnabled() && id != 0 && (state == singleNode || state == ring) {
+			inst.debugLog("Announcing network " + name)
+			c.Write([]byte(inst.formatMessage(announce, idToString(id), name, inst.peerToString(inst.getNodeID()))))
+		}
+
+		inst.getClock().Sleep(time.Duration(inst.Config().DiscoveryIntervalSeconds) * time.Second)
+	}
+}
+
+// returns false if the listener was already running
+func (inst *Instance) StartDiscovery() bool {
+	inst.discoveryMutex.Lock()
+	defer inst.discoveryMutex.Unlock()
+
+	if inst.discoveryConn != nil {
+		return false
+	}
+
+	groupAddr, err := net.ResolveUDPAddr("udp4", inst.Config().DiscoveryAddress)
+
+	if err != nil {
+		inst.userError(err.Error())
+		return false
+	}
+
+	c, err := net.ListenMulticastUDP("udp4", nil, groupAddr)
+
+	if err != nil {
+		inst.userError(err.Error())
+		return false
+	}
+
+	inst.discoveryConn = c
+
+	go func() {
+		b := make([]byte, discoveryMaxDatagramSize)
+
+		for {
+			l, _, err := c.ReadFromUDP(b)
+
+			if err != nil {
+				c.Close()
+
+				inst.discoveryMutex.Lock()
+				stopped := inst.discoveryConn != c
+				if !stopped {
+					inst.discoveryConn = nil
+				}
+				inst.discoveryMutex.Unlock()
+
+				if stopped {
+					inst.debugLog("Discovery listener stopped")
+				} else {
+					inst.warnLog("Discovery listener stopped: " + err.Error())
+				}
+				return
+			}
+
+			inst.processAnnouncement(strings.TrimSpace(string(b[:l])))
+		}
+	}()
+
+	return true
+}
+
+// stops listening for announcements, networks seen so far are kept until they expire
+func (inst *Instance) StopDiscovery() {
+	inst.discoveryMutex.Lock()
+	c := inst.discoveryConn
+	inst.discoveryConn = nil
+	inst.discoveryMutex.Unlock()
+
+	if c != nil {
+		c.Close()
+	}
+}
+
+func (inst *Instance) processAnnouncement(m string) {
+	msg, err := decodeMessage(m)
+	a, ok := msg.body.(announceMessage)
+
+	if err != nil || !ok {
+		inst.debugLog("Invalid announcement: " + m)
+		return
+	}
+
+	id := a.networkID
+
+	// announcements don't go through the endpoint directory, they come from outside of our network
+	var eps []string
+
+	for _, ep := range a.peer.endpoints {
+		if !strings.HasPrefix(ep, relayEndpointPrefix) {
+			eps = append(eps, ep)
+		}
+	}
+
+	if len(eps) == 0 {
+		return
+	}
+
+	inst.discoveryMutex.Lock()
+	defer inst.discoveryMutex.Unlock()
+
+	dn := inst.discoveredNetworks[id]
+
+	if dn == nil {
+		dn = &DiscoveredNetwork{ID: id}
+		inst.discoveredNetworks[id] = dn
+	}
+
+	dn.Name = a.networkName
+	dn.LastSeen = inst.getClock().Now()
+
+	for _, ep := range eps {
+		known := false
+
+		for _, kep := range dn.Endpoints {
+			if kep == ep {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			dn.Endpoints = append(dn.Endpoints, ep)
+		}
+	}
+}
+
+// returns currently visible networks ordered by name
+func (inst *Instance) DiscoveredNetworks() []*DiscoveredNetwork {
+	inst.discoveryMutex.Lock()
+	defer inst.discoveryMutex.Unlock()
+
+	ownID, _ := inst.NetworkInfo()
+	now := inst.getClock().Now()
+	var rtn []*DiscoveredNetwork
+
+	for id, dn := range inst.discoveredNetworks {
+		if now.Sub(dn.LastSeen) > time.Duration(discoveryExpirationIntervals*inst.Config().DiscoveryIntervalSeconds)*time.Second {
+			delete(inst.discoveredNetworks, id)
+			continue
+		}
+
+		if id != ownID {
+			c := *dn
+			rtn = append(rtn, &c)
+		}
+	}
+
+	sort.Slice(rtn, func(i, j int) bool {
+		if rtn[i].Name == rtn[j].Name {
+			return rtn[i].ID < rtn[j].ID
+		}
+		return rtn[i].Name < rtn[j].Name
+	})
+
+	return rtn
+}
@@ -0,0 +1,204 @@
+package distrochya
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// peer = node_id@endpoint,endpoint,...
+	peerIDSeparator       = "@"
+	peerEndpointSeparator = ","
+)
+
+func (inst *Instance) setEndpoints(id uint64, eps []string) {
+	if id == 0 || len(eps) == 0 {
+		return
+	}
+
+	inst.endpointsMutex.Lock()
+	defer inst.endpointsMutex.Unlock()
+
+	inst.endpoints[id] = eps
+}
+
+func (inst *Instance) getEndpoints(id uint64) []string {
+	inst.endpointsMutex.Lock()
+	defer inst.endpointsMutex.Unlock()
+
+	return inst.endpoints[id]
+}
+
+func (inst *Instance) resetEndpoints() {
+	inst.endpointsMutex.Lock()
+	defer inst.endpointsMutex.Unlock()
+
+	inst.endpoints = make(map[uint64][]string)
+}
+
+func (inst *Instance) endpointsToString(id uint64) string {
+	eps := inst.getEndpoints(id)
+
+	if len(eps) == 0 {
+		return "unknown"
+	}
+
+	return strings.Join(eps, ", ")
+}
+
+func (inst *Instance) peerToString(id uint64) string {
+	eps := inst.getEndpoints(id)
+
+	if len(eps) == 0 {
+		return idToString(id)
+	}
+
+	return idToString(id) + peerIDSeparator + strings.Join(eps, peerEndpointSeparator)
+}
+
+// remembers the endpoints of a peer mentioned by another node, returns its id
+// other nodes may be stale or lying, so their tokens only fill in endpoints that aren't known yet
+func (inst *Instance) rememberPeer(p peerToken) uint64 {
+	if len(p.endpoints) == 0 || p.id == 0 {
+		return p.id
+	}
+
+	inst.endpointsMutex.Lock()
+	if _, ok := inst.endpoints[p.id]; !ok {
+		inst.endpoints[p.id] = p.endpoints
+	}
+	inst.endpointsMutex.Unlock()
+
+	return p.id
+}
+
+// remembers the endpoints a node advertises for itself in its own connect or netinfo, returns its id
+func (inst *Instance) rememberOwnPeer(p peerToken) uint64 {
+	inst.setEndpoints(p.id, p.endpoints)
+
+	return p.id
+}
+
+// returns all addresses this node can be reached at: IPv4 first, then IPv6, then hostname
+func discoverLocalEndpoints(p uint16) []string {
+	var v4, v6, loopback []string
+	port := strconv.FormatUint(uint64(p), 10)
+
+	nicAddrs, err := net.InterfaceAddrs()
+
+	if err == nil {
+		for _, nicAddr := range nicAddrs {
+			ip, ok := nicAddr.(*net.IPNet)
+
+			if !ok || ip.IP.IsLinkLocalUnicast() || ip.IP.IsMulticast() {
+				continue
+			}
+
+			ep := net.JoinHostPort(ip.IP.String(), port)
+
+			if ip.IP.IsLoopback() {
+				loopback = append(loopback, ep)
+			} else if ip.IP.To4() != nil {
+				v4 = append(v4, ep)
+			} else {
+				v6 = append(v6, ep)
+			}
+		}
+	}
+
+	rtn := append(v4, v6...)
+
+	if hostname, err := os.Hostname(); err == nil && len(hostname) > 0 {
+		rtn = append(rtn, net.JoinHostPort(hostname, port))
+	}
+
+	// no usable interface, only local connections will work
+	if len(v4)+len(v6) == 0 {
+		rtn = append(rtn, loopback...)
+	}
+
+	return rtn
+}
+
+// explicitly advertised address takes precedence over bind address, which takes precedence over discovered addresses
+func (inst *Instance) localEndpoints(p uint16, bind string, advertise string) []string {
+	port := strconv.FormatUint(uint64(p), 10)
+
+	if len(advertise) > 0 {
+		if _, _, err := net.SplitHostPort(advertise); err == nil {
+			return []string{advertise}
+		}
+
+		return []string{net.JoinHostPort(advertise, port)}
+	}
+
+	if ip := net.ParseIP(bind); ip != nil && !ip.IsUnspecified() {
+		return []string{net.JoinHostPort(bind, port)}
+	}
+
+	return inst.getTransport().LocalEndpoints(p)
+}
+
+// looks up the advertised host names once, so observed addresses can be checked without blocking on DNS
+func (inst *Instance) resolveAdvertisedEndpoints(l net.Listener, eps []string) {
+	ips := []net.IP{}
+
+	for _, ep := range eps {
+		host, _, err := net.SplitHostPort(ep)
+
+		if err != nil {
+			continue
+		}
+
+		addrs, err := net.LookupHost(host)
+
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+
+	inst.networkGlobalsMutex.Lock()
+	defer inst.networkGlobalsMutex.Unlock()
+
+	// the server may have been restarted in the meantime
+	if inst.server == l {
+		inst.advertisedIPs = ips
+	}
+}
+
+// warns the user if the address a remote node sees this node at isn't among the advertised ones
+func (inst *Instance) checkObservedAddress(observed string) {
+	observedIP := net.ParseIP(observed)
+
+	if observedIP == nil || observedIP.IsLoopback() {
+		return
+	}
+
+	inst.networkGlobalsMutex.Lock()
+	ips := inst.advertisedIPs
+	inst.networkGlobalsMutex.Unlock()
+
+	// still resolving
+	if ips == nil {
+		return
+	}
+
+	for _, ip := range ips {
+		if ip.Equal(observedIP) {
+			return
+		}
+	}
+
+	inst.log(fmt.Sprintf("Observed address %s doesn't match advertised endpoints %s", observed, inst.endpointsToString(inst.getNodeID())))
+	inst.userEvent(fmt.Sprintf("warning: the network sees you as %s, but you advertise %s - other nodes may be unable to connect to you, consider setting the advertised address",
+		observed, inst.endpointsToString(inst.getNodeID())))
+}
@@ -0,0 +1,166 @@
+package distrochya
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+type EventType int
+
+const (
+	ChatReceived    EventType = iota // User sent Text to the chat
+	UsersChanged                     // Users in the chat
+	ChatNameChanged                  // User is the name we chat as, empty when not in the chat
+	LeaderChanged                    // Leader is the new leader ID, 0 when there is none
+	StateChanged                     // State of the network
+	StatusChanged                    // something shown by Snapshot changed
+	Notice                           // Text for the user
+	Error                            // Text describing what went wrong
+	Log                              // Text at logical Time with Level and the log fields of Event
+)
+
+type LogLevel int32
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LogDebug || l > LogError {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+
+	return logLevelNames[l]
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(s, n) {
+			return LogLevel(i), nil
+		}
+	}
+
+	return LogInfo, fmt.Errorf("unknown log level \"%s\", use one of %s", s, strings.Join(logLevelNames, ", "))
+}
+
+type Event struct {
+	Type   EventType
+	Time   uint64
+	User   string
+	Text   string
+	Users  []string
+	Leader uint64
+	State  string
+
+	// log fields, peer fields are empty unless the entry is about a single connection
+	Level    LogLevel
+	NodeID   uint64
+	PeerID   uint64
+	Relation string
+	Message  string // type of the protocol message the entry is about
+}
+
+// handler is called synchronously from the instance's goroutines, possibly with locks held,
+// so it has to be safe for concurrent use and must not call back into the instance directly
+func (inst *Instance) emit(e Event) {
+	if inst.handler != nil {
+		inst.handler(e)
+	}
+}
+
+// entries below the level aren't emitted
+func (inst *Instance) SetLogLevel(l LogLevel) {
+	atomic.StoreInt32(&inst.logLevel, int32(l))
+}
+
+func (inst *Instance) LogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&inst.logLevel))
+}
+
+func (inst *Instance) isLogged(l LogLevel) bool {
+	return l >= inst.LogLevel()
+}
+
+// every entry except debug ones takes a tick of the logical clock, whether it is emitted or not
+func (inst *Instance) logEntry(e Event) {
+	if e.Level == LogDebug {
+		e.Time = inst.getTime()
+	} else {
+		e.Time = inst.advanceTime()
+		inst.trace(TraceEntry{Time: e.Time, Kind: TraceLog, PeerID: e.PeerID, Relation: e.Relation, Message: e.Message, Text: e.Text})
+	}
+
+	if !inst.isLogged(e.Level) {
+		return
+	}
+
+	e.Type = Log
+	e.NodeID = inst.getNodeID()
+	inst.emit(e)
+}
+
+func (inst *Instance) debugLog(m string) {
+	if inst.isLogged(LogDebug) {
+		inst.logEntry(Event{Level: LogDebug, Text: m})
+	}
+}
+
+func (inst *Instance) log(m string) {
+	inst.logEntry(Event{Level: LogInfo, Text: m})
+}
+
+func (inst *Instance) warnLog(m string) {
+	inst.logEntry(Event{Level: LogWarn, Text: m})
+}
+
+func (inst *Instance) errorLog(m string) {
+	inst.logEntry(Event{Level: LogError, Text: m})
+}
+
+// entry about the connection, message is the protocol message it concerns, may be empty
+func (n *Node) logAt(l LogLevel, message string, m string) {
+	if l == LogDebug && !n.inst.isLogged(LogDebug) {
+		return
+	}
+
+	r, id := n.relationAndID()
+	n.inst.logEntry(Event{Level: l, Text: m, PeerID: id, Relation: string(r), Message: message})
+}
+
+func (n *Node) log(message string, m string) {
+	n.logAt(LogInfo, message, m)
+}
+
+func (inst *Instance) userError(e string) {
+	inst.emit(Event{Type: Error, Text: e})
+}
+
+func (inst *Instance) userEvent(m string) {
+	inst.emit(Event{Type: Notice, Text: m})
+}
+
+func (inst *Instance) chatMessageReceived(u string, s string) {
+	inst.emit(Event{Type: ChatReceived, User: u, Text: s})
+}
+
+func (inst *Instance) updateUsers(us []string) {
+	inst.emit(Event{Type: UsersChanged, Users: us})
+}
+
+func (inst *Instance) updateStatus() {
+	inst.emit(Event{Type: StatusChanged})
+}
+
+func (inst *Instance) setConnectedName(n string) {
+	inst.emit(Event{Type: ChatNameChanged, User: n})
+}
+
+func (inst *Instance) resetConnectedName() {
+	inst.setConnectedName("")
+}
@@ -0,0 +1,57 @@
+package distrochya
+
+import (
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for _, l := range []LogLevel{LogDebug, LogInfo, LogWarn, LogError} {
+		if parsed, err := ParseLogLevel(l.String()); err != nil || parsed != l {
+			t.Errorf("%s parsed as %s, %v", l, parsed, err)
+		}
+	}
+
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
+
+func TestLogLevelFiltersEntries(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.SetLogLevel(LogWarn)
+
+	before := ti.getTime()
+	ti.debugLog("debug")
+	ti.log("info")
+	ti.warnLog("warn")
+	ti.errorLog("error")
+
+	entries := ti.events.ofType(Log)
+
+	if len(entries) != 2 || entries[0].Text != "warn" || entries[1].Text != "error" {
+		t.Fatalf("logged %v, want only warn and error", entries)
+	}
+
+	if entries[0].Level != LogWarn || entries[0].NodeID != testNodeID {
+		t.Errorf("warn entry %+v", entries[0])
+	}
+
+	// filtered entries still take their tick, so the logical time doesn't depend on verbosity
+	if now := ti.getTime(); now != before+3 {
+		t.Errorf("time %d, want %d", now, before+3)
+	}
+}
+
+func TestNodeLogFields(t *testing.T) {
+	ti := newTestInstance(t)
+	n, _ := ti.peer(t, next, testPeerID)
+
+	n.log(election, "about the peer")
+
+	entries := ti.events.ofType(Log)
+	e := entries[len(entries)-1]
+
+	if e.Text != "about the peer" || e.PeerID != testPeerID || e.Relation != string(next) || e.Message != election || e.NodeID != testNodeID {
+		t.Errorf("entry %+v", e)
+	}
+}
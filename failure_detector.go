@@ -0,0 +1,88 @@
+package distrochya
+
+import (
+	"math"
+	"time"
+)
+
+// phi accrual failure detection: arrivals of keepalive responses are compared with how regularly
+// they arrived so far, phi grows the longer the next one is overdue, phi 8 means roughly
+// a 1e-8 chance that the peer is still alive and only late
+
+const (
+	phiWindow     = 100 // inter-arrival times kept
+	phiMinSamples = 3   // phi stays 0 until this many inter-arrival times are known
+)
+
+type phiDetector struct {
+	intervals []float64 // seconds, ring buffer of the last phiWindow inter-arrival times
+	next      int
+	last      time.Time
+}
+
+func (d *phiDetector) heartbeat(now time.Time) {
+	if !d.last.IsZero() {
+		s := now.Sub(d.last).Seconds()
+
+		if len(d.intervals) < phiWindow {
+			d.intervals = append(d.intervals, s)
+		} else {
+			d.intervals[d.next] = s
+			d.next = (d.next + 1) % phiWindow
+		}
+	}
+
+	d.last = now
+}
+
+// minStd keeps a very regular peer from being declared dead because of a little jitter
+func (d *phiDetector) phi(now time.Time, minStd time.Duration) float64 {
+	if len(d.intervals) < phiMinSamples {
+		return 0
+	}
+
+	var mean, variance float64
+
+	for _, s := range d.intervals {
+		mean += s
+	}
+
+	mean /= float64(len(d.intervals))
+
+	for _, s := range d.intervals {
+		variance += (s - mean) * (s - mean)
+	}
+
+	std := math.Sqrt(variance / float64(len(d.intervals)))
+
+	if std < minStd.Seconds() {
+		std = minStd.Seconds()
+	}
+
+	// logistic approximation of the normal distribution
+	t := now.Sub(d.last).Seconds()
+	y := (t - mean) / std
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+
+	if t > mean {
+		// keeps phi finite for long overdue peers, about 323
+		if e == 0 {
+			e = math.SmallestNonzeroFloat64
+		}
+
+		return -math.Log10(e / (1 + e))
+	}
+
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// interval between alivechecks, at most half of the connection timeout
+func (c Config) keepaliveInterval() time.Duration {
+	d := time.Duration(c.KeepaliveIntervalMilliseconds) * time.Millisecond
+
+	if max := time.Duration(c.ConnectionTimeoutSeconds) * time.Second / 2; d > max {
+		return max
+	}
+
+	return d
+}
@@ -0,0 +1,103 @@
+package distrochya
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPhiDetector(t *testing.T) {
+	start := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	var d phiDetector
+
+	for i := 0; i < phiMinSamples; i++ {
+		d.heartbeat(start.Add(time.Duration(i) * time.Second))
+	}
+
+	if phi := d.phi(start.Add(time.Hour), 250*time.Millisecond); phi != 0 {
+		t.Errorf("phi %.1f with %d intervals, want 0", phi, phiMinSamples-1)
+	}
+
+	d.heartbeat(start.Add(phiMinSamples * time.Second))
+	last := d.last
+	previous := -1.0
+
+	for _, late := range []time.Duration{0, time.Second, 1500 * time.Millisecond, 2 * time.Second, 3 * time.Second, time.Hour} {
+		phi := d.phi(last.Add(late), 250*time.Millisecond)
+
+		if phi <= previous {
+			t.Errorf("phi %.2f after %s, not more than %.2f before", phi, late, previous)
+		}
+
+		previous = phi
+	}
+
+	if phi := d.phi(last.Add(time.Second), 250*time.Millisecond); phi > 1 {
+		t.Errorf("phi %.1f for a response that is on time", phi)
+	}
+
+	if phi := d.phi(last.Add(3*time.Second), 250*time.Millisecond); phi < DefaultConfig().FailureDetectorPhiThreshold {
+		t.Errorf("phi %.1f for a response 2 intervals late", phi)
+	}
+
+	if phi := d.phi(last.Add(time.Hour), 250*time.Millisecond); phi > 1000 {
+		t.Errorf("phi %.1f isn't finite", phi)
+	}
+}
+
+func TestKeepaliveRTTBySequence(t *testing.T) {
+	ti := newTestInstance(t)
+	n, p := ti.peer(t, next, testPeerID)
+
+	n.keepAlive()
+	first := p.expect(t, alivecheck)
+	ti.clock.advance(20 * time.Millisecond)
+	n.keepAlive()
+	second := p.expect(t, alivecheck)
+	ti.clock.advance(10 * time.Millisecond)
+
+	if len(first) != 1 || len(second) != 1 || first[0] == second[0] {
+		t.Fatalf("alivechecks %v and %v, want distinct sequence numbers", first, second)
+	}
+
+	// answers may come out of order, each is matched to its own alivecheck
+	n.processMessage(testMessage(1, aliveresponse, first[0]))
+
+	if rtt, _ := n.liveness(); rtt != 30*time.Millisecond {
+		t.Errorf("rtt %s, want 30ms", rtt)
+	}
+
+	n.processMessage(testMessage(2, aliveresponse, second[0]))
+
+	if rtt, _ := n.liveness(); rtt != 30*time.Millisecond-20*time.Millisecond/8 {
+		t.Errorf("smoothed rtt %s", rtt)
+	}
+
+	n.processMessage(testMessage(3, aliveresponse, second[0]))
+
+	if h := ti.Metrics().KeepaliveRTT; h.Counts[len(h.Counts)-1] != 2 {
+		t.Errorf("%d RTTs observed, a repeated answer was counted", h.Counts[len(h.Counts)-1])
+	}
+
+	if s := ti.Snapshot(); len(s.Peers) != 1 || s.Peers[0].RTT != 30*time.Millisecond-20*time.Millisecond/8 {
+		t.Errorf("snapshot peers %+v", s.Peers)
+	}
+}
+
+func TestSilentNextIsDeclaredDead(t *testing.T) {
+	ti := newTestInstance(t)
+	n, p := ti.peer(t, next, testPeerID)
+
+	for i := 0; i < 5; i++ {
+		ti.clock.advance(time.Second)
+		n.processMessage(testMessage(1, aliveresponse))
+	}
+
+	// half an interval late is normal jitter
+	ti.clock.advance(1500 * time.Millisecond)
+	n.keepAlive()
+	p.expect(t, alivecheck)
+
+	// fires the next keepalive, the peer has been silent for 3 intervals
+	ti.clock.advance(1500 * time.Millisecond)
+	p.expectClosed(t)
+}
@@ -0,0 +1,109 @@
+package distrochya
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// fault injection used to reproduce timeouts, half-open connections and slow peers without killing processes,
+// target of the calls is a relation (next, prev, leader, ...) or a node ID
+
+// connections matching the target, a relation name matches every connection with that relation
+func (inst *Instance) faultTargets(target string) []*Node {
+	inst.networkGlobalsMutex.Lock()
+	nodes := inst.nodes
+	inst.networkGlobalsMutex.Unlock()
+
+	if nodes == nil {
+		return nil
+	}
+
+	id, err := stringToID(strings.TrimPrefix(strings.ToLower(target), "0x"))
+	isID := err == nil
+
+	var rtn []*Node
+
+	for _, n := range nodes.toSlice() {
+		r, nid := n.relationAndID()
+
+		if string(r) == target || (isID && nid == id) {
+			rtn = append(rtn, n)
+		}
+	}
+
+	return rtn
+}
+
+func (inst *Instance) applyFault(target string, f func(n *Node) string) {
+	ns := inst.faultTargets(target)
+
+	if len(ns) == 0 {
+		inst.userError(fmt.Sprintf("no connection matches \"%s\"", target))
+		return
+	}
+
+	for _, n := range ns {
+		r, id := n.relationAndID()
+		result := f(n)
+
+		inst.log(fmt.Sprintf("Fault injected: %s, id=0x%X, r=%s", result, id, r))
+		inst.userEvent(fmt.Sprintf("%s: 0x%X (%s)", result, id, r))
+	}
+}
+
+// closes the connection as if it failed, the process keeps running
+func (inst *Instance) DropConnection(target string) {
+	inst.applyFault(target, func(n *Node) string {
+		n.disconnect()
+		return "connection dropped"
+	})
+}
+
+// messages from the target are processed d later, 0 removes the delay
+func (inst *Instance) DelayConnection(target string, d time.Duration) {
+	inst.applyFault(target, func(n *Node) string {
+		atomic.StoreInt64(&n.delay, int64(d))
+
+		if d <= 0 {
+			return "delay removed"
+		}
+
+		return fmt.Sprintf("delayed by %s", d)
+	})
+}
+
+// everything sent to and received from the target is silently discarded while the connection stays open
+func (inst *Instance) BlackholeConnection(target string, enabled bool) {
+	inst.applyFault(target, func(n *Node) string {
+		if enabled {
+			atomic.StoreUint32(&n.blackholed, 1)
+			return "blackholed"
+		}
+
+		atomic.StoreUint32(&n.blackholed, 0)
+		return "blackhole removed"
+	})
+}
+
+// paused node stops answering alivecheck, everything else works as usual
+func (inst *Instance) SetPaused(paused bool) {
+	if paused {
+		atomic.StoreUint32(&inst.paused, 1)
+	} else {
+		atomic.StoreUint32(&inst.paused, 0)
+	}
+}
+
+func (inst *Instance) IsPaused() bool {
+	return atomic.LoadUint32(&inst.paused) != 0
+}
+
+func (n *Node) isBlackholed() bool {
+	return atomic.LoadUint32(&n.blackholed) != 0
+}
+
+func (n *Node) getDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&n.delay))
+}
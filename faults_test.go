@@ -0,0 +1,110 @@
+package distrochya
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFaultTargets(t *testing.T) {
+	ti := newTestInstance(t)
+	nextNode, _ := ti.peer(t, next, testPeerID)
+	prevNode, _ := ti.peer(t, prev, 0x3000)
+
+	tests := []struct {
+		target string
+		want   *Node
+	}{
+		{"next", nextNode},
+		{"prev", prevNode},
+		{"3000", prevNode},
+		{"0x3000", prevNode},
+		{"0X2000", nextNode},
+		{"leader", nil},
+		{"0x4000", nil},
+	}
+
+	for _, tt := range tests {
+		ns := ti.faultTargets(tt.target)
+
+		if tt.want == nil {
+			if len(ns) != 0 {
+				t.Errorf("%s matched %d connections, want none", tt.target, len(ns))
+			}
+		} else if len(ns) != 1 || ns[0] != tt.want {
+			t.Errorf("%s matched %v, want only 0x%X", tt.target, ns, tt.want.id)
+		}
+	}
+}
+
+func TestDropConnection(t *testing.T) {
+	ti := newTestInstance(t)
+	_, p := ti.peer(t, next, testPeerID)
+
+	ti.DropConnection("next")
+	p.expectClosed(t)
+}
+
+func TestBlackholeConnection(t *testing.T) {
+	ti := newTestInstance(t)
+	n, p := ti.handledPeer(t, next, testPeerID)
+
+	ti.BlackholeConnection("next", true)
+
+	n.sendMessage(alivecheck)
+	p.send(t, alivecheck)
+	p.expectSilence(t)
+
+	ti.BlackholeConnection("next", false)
+
+	p.send(t, alivecheck)
+	p.expect(t, aliveresponse)
+}
+
+func TestDelayConnection(t *testing.T) {
+	ti := newTestInstance(t)
+
+	// the keepalive timer must not fire together with the delayed message
+	ti.tune(func(c *Config) { c.KeepaliveIntervalMilliseconds = 5000 })
+	_, p := ti.handledPeer(t, next, testPeerID)
+
+	ti.DelayConnection("next", time.Second)
+
+	// the handler sleeps on the clock before processing
+	delayed := func() bool {
+		ti.clock.lock.Lock()
+		defer ti.clock.lock.Unlock()
+
+		for _, tm := range ti.clock.timers {
+			if tm.at.Equal(ti.clock.now.Add(time.Second)) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	p.send(t, alivecheck)
+
+	waitFor(t, testReadWait, "delay", delayed)
+	p.expectSilence(t)
+
+	ti.clock.advance(time.Second)
+	p.expect(t, aliveresponse)
+}
+
+func TestPauseIgnoresAlivecheck(t *testing.T) {
+	ti := newTestInstance(t)
+	n, p := ti.peer(t, prev, testPeerID)
+
+	ti.SetPaused(true)
+
+	if !n.processMessage(testMessage(1, alivecheck)) {
+		t.Fatal("alivecheck rejected")
+	}
+
+	p.expectSilence(t)
+
+	ti.SetPaused(false)
+	n.processMessage(testMessage(1, alivecheck))
+	p.expect(t, aliveresponse)
+}
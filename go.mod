@@ -1,9 +1,13 @@
 module github.com/Silaedru/distrochya
 
-go 1.13
+go 1.18
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/jroimartin/gocui v0.4.0
+)
+
+require (
 	github.com/mattn/go-runewidth v0.0.6 // indirect
 	github.com/nsf/termbox-go v0.0.0-20190817171036-93860e161317 // indirect
 )
@@ -0,0 +1,471 @@
+package distrochya
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testNodeID     = 0x1000
+	testPeerID     = 0x2000
+	testReadWait   = 2 * time.Second
+	testSilentWait = 50 * time.Millisecond
+)
+
+// clock that only moves when a test advances it
+type manualClock struct {
+	lock   *sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	clock *manualClock
+	at    time.Time
+	f     func()
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{lock: &sync.Mutex{}, now: time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *manualClock) Sleep(d time.Duration) {
+	wake := make(chan struct{})
+	c.AfterFunc(d, func() { close(wake) })
+	<-wake
+}
+
+func (c *manualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := &manualTimer{c, c.now.Add(d), f}
+	c.timers = append(c.timers, t)
+
+	return t
+}
+
+func (t *manualTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	for i, o := range t.clock.timers {
+		if o == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// moves the time forward, timers that are due fire in their own goroutines
+func (c *manualClock) advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+
+	var due []*manualTimer
+	var rest []*manualTimer
+
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			rest = append(rest, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+
+	c.timers = rest
+	c.lock.Unlock()
+
+	for _, t := range due {
+		go t.f()
+	}
+}
+
+type eventRecorder struct {
+	lock   *sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) handle(e Event) {
+	r.lock.Lock()
+	r.events = append(r.events, e)
+	r.lock.Unlock()
+}
+
+func (r *eventRecorder) ofType(t EventType) []Event {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var rtn []Event
+
+	for _, e := range r.events {
+		if e.Type == t {
+			rtn = append(rtn, e)
+		}
+	}
+
+	return rtn
+}
+
+// instance on a memory network with a manual clock, ready to process messages without a server
+type testInstance struct {
+	*Instance
+	clock   *manualClock
+	network *MemoryNetwork
+	events  *eventRecorder
+	port    int
+}
+
+// other end of a connection of the tested instance
+type testPeer struct {
+	conn  net.Conn
+	lines chan string
+}
+
+func newTestInstance(t *testing.T) *testInstance {
+	events := &eventRecorder{lock: &sync.Mutex{}}
+	clock := newManualClock()
+	network := NewMemoryNetwork(1)
+	network.SetClock(clock)
+
+	inst := New(events.handle, DefaultConfig())
+	inst.SetClock(clock)
+	inst.SetTransport(network.Transport("local"))
+	inst.SetAnnounce(false)
+	inst.SetChatName("tester")
+	inst.initNode()
+	atomic.StoreUint64(&inst.nodeID, testNodeID)
+
+	return &testInstance{inst, clock, network, events, 1}
+}
+
+// changes tunables of the instance, connections made before keep the old values
+func (ti *testInstance) tune(f func(c *Config)) {
+	c := ti.Config()
+	f(&c)
+	ti.SetConfig(c)
+}
+
+// makes the instance look like it is running, listening on local:9999
+func (ti *testInstance) listen(t *testing.T) {
+	l, err := ti.network.Transport("local").Listen("local:9999")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ti.networkGlobalsMutex.Lock()
+	ti.server = l
+	ti.serverPort = 9999
+	ti.networkGlobalsMutex.Unlock()
+
+	ti.setEndpoints(ti.getNodeID(), []string{"local:9999"})
+
+	// connections to ourselves are opened with a challenge like the server would, then left alone
+	go func() {
+		for {
+			c, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			c.Write([]byte(testMessage(0, challenge, "self") + "\n"))
+		}
+	}()
+}
+
+// listener of another node at host:port, returned connections are peers of the tested instance
+func (ti *testInstance) remoteListener(t *testing.T, host string) (net.Listener, string) {
+	a := net.JoinHostPort(host, strconv.Itoa(ti.port))
+	ti.port++
+
+	l, err := ti.network.Transport(host).Listen(a)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return l, a
+}
+
+// listener of another node that opens every connection with a challenge, connections are accepted in the
+// background because the tested instance waits for the challenge when it dials
+type challengeListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (ti *testInstance) remoteNode(t *testing.T, host string) (net.Listener, string) {
+	l, a := ti.remoteListener(t, host)
+	cl := &challengeListener{l, make(chan net.Conn, 8)}
+
+	go func() {
+		defer close(cl.conns)
+
+		for {
+			c, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			c.Write([]byte(testMessage(0, challenge, host) + "\n"))
+			cl.conns <- c
+		}
+	}()
+
+	return cl, a
+}
+
+func (l *challengeListener) Accept() (net.Conn, error) {
+	c, ok := <-l.conns
+
+	if !ok {
+		return nil, errors.New("listener closed")
+	}
+
+	return c, nil
+}
+
+func acceptPeer(t *testing.T, l net.Listener) *testPeer {
+	c := make(chan net.Conn)
+
+	go func() {
+		conn, err := l.Accept()
+
+		if err != nil {
+			close(c)
+			return
+		}
+
+		c <- conn
+	}()
+
+	select {
+	case conn, ok := <-c:
+		if !ok {
+			t.Fatal("accept failed")
+		}
+
+		return newTestPeer(conn)
+	case <-time.After(testReadWait):
+		t.Fatal("nobody connected")
+	}
+
+	return nil
+}
+
+// connect params of the instance for a connection opened with challenge nonce
+func (ti *testInstance) connectParams(nonce string, r relation, user string) []string {
+	n := &Node{inst: ti.Instance, peerChallenge: nonce}
+	return n.connectMessage(r, user)
+}
+
+// identity params of the instance answering challenge nonce
+func (ti *testInstance) identityParams(nonce string) []string {
+	n := &Node{inst: ti.Instance, peerChallenge: nonce}
+	return n.identityMessage()
+}
+
+// another instance with the given id, its node id is testNodeID otherwise
+func newTestInstanceWithID(t *testing.T, id uint64) *testInstance {
+	ti := newTestInstance(t)
+	atomic.StoreUint64(&ti.nodeID, id)
+
+	return ti
+}
+
+// another instance with the given id which leads its network
+func newTestLeader(t *testing.T, id uint64) *testInstance {
+	l := newTestInstanceWithID(t, id)
+	l.updateLeaderID(id)
+	l.resetModeration(id)
+
+	return l
+}
+
+// as if other had proven its key to the instance
+func (ti *testInstance) knowKey(other *testInstance) {
+	ti.rememberKey(other.getNodeID(), other.identityKey().Public().(ed25519.PublicKey))
+}
+
+// connects a peer with the given relation and id to the tested instance
+func (ti *testInstance) peer(t *testing.T, r relation, id uint64) (*Node, *testPeer) {
+	l, a := ti.remoteListener(t, "remote")
+	defer l.Close()
+
+	c, err := ti.dial(a)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := acceptPeer(t, l)
+
+	n := ti.nodeFromConnection(c)
+	n.setRelation(r)
+	n.setID(id)
+	ti.addNode(n)
+
+	return n, p
+}
+
+// like peer, but messages of the peer are read by the connection handler of the tested instance
+func (ti *testInstance) handledPeer(t *testing.T, r relation, id uint64) (*Node, *testPeer) {
+	l, a := ti.remoteListener(t, "remote")
+	defer l.Close()
+
+	c, err := ti.dial(a)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := acceptPeer(t, l)
+
+	n := ti.nodeFromConnection(c)
+	n.setRelation(r)
+	n.setID(id)
+	go n.handleConnection()
+
+	waitFor(t, testReadWait, "connection handler", func() bool {
+		return len(ti.faultTargets(idToString(id))) > 0
+	})
+
+	return n, p
+}
+
+func newTestPeer(c net.Conn) *testPeer {
+	p := &testPeer{c, make(chan string, 64)}
+
+	go func() {
+		r := bufio.NewReader(c)
+
+		for {
+			line, err := r.ReadString('\n')
+
+			if err != nil {
+				close(p.lines)
+				return
+			}
+
+			p.lines <- strings.TrimSpace(line)
+		}
+	}()
+
+	return p
+}
+
+// returns the parameters of the next message, which has to be of type m
+func (p *testPeer) expect(t *testing.T, m string) []string {
+	t.Helper()
+
+	select {
+	case line, ok := <-p.lines:
+		if !ok {
+			t.Fatalf("expected %s, connection closed", m)
+		}
+
+		msg := strings.Split(line, sepchar)
+
+		if len(msg) < 3 || msg[0] != magic {
+			t.Fatalf("expected %s, got malformed %q", m, line)
+		}
+
+		if msg[2] != m {
+			t.Fatalf("expected %s, got %q", m, line)
+		}
+
+		return msg[3:]
+	case <-time.After(testReadWait):
+		t.Fatalf("expected %s, got nothing", m)
+	}
+
+	return nil
+}
+
+func (p *testPeer) expectSilence(t *testing.T) {
+	t.Helper()
+
+	select {
+	case line, ok := <-p.lines:
+		if ok {
+			t.Fatalf("expected nothing, got %q", line)
+		}
+	case <-time.After(testSilentWait):
+	}
+}
+
+func (p *testPeer) expectClosed(t *testing.T) {
+	t.Helper()
+
+	for {
+		select {
+		case _, ok := <-p.lines:
+			if !ok {
+				return
+			}
+		case <-time.After(testReadWait):
+			t.Fatal("connection wasn't closed")
+		}
+	}
+}
+
+func (p *testPeer) send(t *testing.T, m ...string) {
+	t.Helper()
+
+	if _, err := p.conn.Write([]byte(testMessage(1, m...) + "\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testMessage(time uint64, m ...string) string {
+	return strings.Join(append([]string{magic, strconv.FormatUint(time, 10)}, m...), sepchar)
+}
+
+func testPeerToken(id uint64, eps ...string) string {
+	if len(eps) == 0 {
+		return idToString(id)
+	}
+
+	return idToString(id) + peerIDSeparator + strings.Join(eps, peerEndpointSeparator)
+}
+
+// id of a peer token, 0 if it doesn't parse
+func peerID(s string) uint64 {
+	p, _ := parsePeer(s)
+	return p.id
+}
+
+// polls cond until it holds or the wait runs out
+func waitFor(t *testing.T, wait time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(wait)
+
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
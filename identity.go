@@ -0,0 +1,134 @@
+package distrochya
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// node ids change with every start, the identity key stays the same across restarts and its fingerprint
+// can be banned, both sides open every connection with a challenge, connect messages of the dialing side
+// and the identity answer of the accepting side carry the public key and a signature of the challenge
+// of the other side and the peer token, so neither can be replayed on another connection
+
+const fingerprintLength = 8 // bytes of the sha256 of the public key
+
+func keyFingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:fingerprintLength])
+}
+
+func (inst *Instance) identityKey() ed25519.PrivateKey {
+	inst.identityMutex.Lock()
+	defer inst.identityMutex.Unlock()
+
+	if inst.identity == nil {
+		_, inst.identity, _ = ed25519.GenerateKey(nil)
+	}
+
+	return inst.identity
+}
+
+func (inst *Instance) setIdentityKey(k ed25519.PrivateKey) {
+	inst.identityMutex.Lock()
+	inst.identity = k
+	inst.identityMutex.Unlock()
+}
+
+// fingerprint of the identity key, other users ban it with /ban key:<fingerprint>
+func (inst *Instance) Fingerprint() string {
+	return keyFingerprint(inst.identityKey().Public().(ed25519.PublicKey))
+}
+
+// public keys proven by other nodes, the first proof for a node id is kept
+func (inst *Instance) rememberKey(id uint64, pub ed25519.PublicKey) {
+	if id == 0 {
+		return
+	}
+
+	inst.identityMutex.Lock()
+	_, known := inst.nodeKeys[id]
+	if !known {
+		inst.nodeKeys[id] = pub
+	}
+	inst.identityMutex.Unlock()
+
+	if !known {
+		inst.applyPendingModeration(id)
+	}
+}
+
+func (inst *Instance) nodeKey(id uint64) ed25519.PublicKey {
+	inst.identityMutex.Lock()
+	defer inst.identityMutex.Unlock()
+
+	return inst.nodeKeys[id]
+}
+
+func (inst *Instance) resetNodeKeys() {
+	inst.identityMutex.Lock()
+	inst.nodeKeys = make(map[uint64]ed25519.PublicKey)
+	inst.identityMutex.Unlock()
+}
+
+func signedConnect(nonce string, token string) []byte {
+	return []byte(nonce + sepchar + token)
+}
+
+// nonce the accepting side opens a connection with
+func (inst *Instance) newChallenge() string {
+	return fmt.Sprintf("%016x", inst.randomUint64())
+}
+
+// returns connect message params for the connection of n, user is only used for r=follower
+func (n *Node) connectMessage(r relation, user string) []string {
+	return append([]string{connect, n.inst.peerToString(n.inst.getNodeID()), string(r), user}, n.proveKey()...)
+}
+
+// returns identity message params answering the challenge of the dialing side of the connection of n
+func (n *Node) identityMessage() []string {
+	return append([]string{identity, n.inst.peerToString(n.inst.getNodeID())}, n.proveKey()...)
+}
+
+// hex public key and signature of the challenge of the other side and our peer token
+func (n *Node) proveKey() []string {
+	k := n.inst.identityKey()
+	sig := ed25519.Sign(k, signedConnect(n.peerChallenge, n.inst.peerToString(n.inst.getNodeID())))
+
+	return []string{hex.EncodeToString(k.Public().(ed25519.PublicKey)), hex.EncodeToString(sig)}
+}
+
+// returns key if sig is its signature of nonce and token
+func verifyKey(nonce string, token string, key string, sig string) (ed25519.PublicKey, error) {
+	pub, err := hex.DecodeString(key)
+
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid key")
+	}
+
+	s, err := hex.DecodeString(sig)
+
+	if err != nil || !ed25519.Verify(pub, signedConnect(nonce, token), s) {
+		return nil, errors.New("invalid key signature")
+	}
+
+	return pub, nil
+}
+
+// the leader signs the moderation state, so no node on the way around the ring can change it
+func signedModeration(leader uint64, version uint64, entries []string) []byte {
+	return []byte(strings.Join(append([]string{idToString(leader), strconv.FormatUint(version, 10)}, entries...), sepchar))
+}
+
+func (inst *Instance) signModeration(version uint64, entries []string) string {
+	return hex.EncodeToString(ed25519.Sign(inst.identityKey(), signedModeration(inst.getNodeID(), version, entries)))
+}
+
+func verifyModeration(pub ed25519.PublicKey, m modStateMessage) bool {
+	sig, err := hex.DecodeString(m.sig)
+	return err == nil && ed25519.Verify(pub, signedModeration(m.leader, m.version, m.entries), sig)
+}
@@ -0,0 +1,32 @@
+package distrochya
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadIdentity(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.SetStateFile(filepath.Join(t.TempDir(), "state.json"))
+
+	if err := ti.LoadIdentity(); err != nil {
+		t.Fatalf("missing state file: %v", err)
+	}
+
+	ti.listen(t)
+	ti.peer(t, next, testPeerID)
+	ti.setEndpoints(testPeerID, []string{"remote:1"})
+	ti.saveState()
+
+	// a later start without --rejoin keeps the key
+	other := newTestInstance(t)
+	other.SetStateFile(ti.StateFile())
+
+	if err := other.LoadIdentity(); err != nil {
+		t.Fatal(err)
+	}
+
+	if f := other.Fingerprint(); f != ti.Fingerprint() {
+		t.Errorf("fingerprint %s after loading, want %s", f, ti.Fingerprint())
+	}
+}
@@ -0,0 +1,242 @@
+// Package distrochya implements the ring, leader election and chat of a distrochya node,
+// the command line application in cmd/distrochya is one of its frontends.
+package distrochya
+
+import (
+	"crypto/ed25519"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// a single node with everything it owns, several instances can run in one process
+type Instance struct {
+	handler func(Event)
+
+	transportMutex *sync.Mutex
+	transport      Transport
+	clockMutex     *sync.Mutex
+	clock          Clock
+	randomMutex    *sync.Mutex
+	random         *rand.Rand
+	configMutex    *sync.Mutex
+	config         Config
+
+	logicalClock
+
+	// network
+	networkGlobalsMutex *sync.Mutex
+	networkStateMutex   *sync.Mutex
+	server              net.Listener
+	joinCancel          chan struct{} // closed by Disconnect to stop a running join
+	joinWake            *waiter       // of the join waiting to retry, woken with joinCancel
+	joinAttempt         uint32        // atomic, attempt of the running join, 0 when not joining
+	serverPort          uint16
+	serverBind          string   // outbound connections are made from this address too
+	advertisedIPs       []net.IP // own endpoints resolved at server start, nil until resolved
+	networkState        string
+	nodeID              uint64
+	twiceNextNodeID     uint64
+	nodes               *nodeSyncLinkedList
+	ringBroken          uint32 // atomic, not guarded by mutex
+
+	// used when joining without explicit addresses, e.g. when rejoining
+	defaultAddressMutex      *sync.Mutex
+	defaultBindAddress       string
+	defaultAdvertisedAddress string
+
+	joinRetryMutex        *sync.Mutex
+	joinRetryAttempts     int
+	joinRetryInitialDelay time.Duration
+	joinRetryMaxDelay     time.Duration
+
+	// election and chat
+	leaderID                 uint64
+	oldLeaderID              uint64
+	chatParticipation        uint32
+	chatNameMutex            *sync.Mutex
+	chatName                 string
+	leaderElectionMutex      *sync.Mutex
+	leaderElectionTimer      Timer
+	electionParticipated     uint32
+	electionStartTriggerFlag uint32
+
+	chatConnectionsLock *sync.Mutex
+	chatConnections     map[*Node]string
+
+	// discovery
+	networkInfoMutex   *sync.Mutex
+	networkID          uint64
+	networkName        string
+	defaultNetworkName string
+	announceEnabled    uint32 // atomic, not guarded by mutex
+	discoveryMutex     *sync.Mutex
+	discoveryConn      *net.UDPConn // nil while not listening for announcements
+	discoveredNetworks map[uint64]*DiscoveredNetwork
+
+	endpointsMutex *sync.Mutex
+	endpoints      map[uint64][]string
+
+	// moderation
+	moderationMutex   *sync.Mutex
+	moderationVersion uint64
+	creatorID         uint64
+	operators         map[uint64]bool
+	bannedIDs         map[uint64]bool
+	bannedNicks       map[string]bool
+	mutedIDs          map[uint64]bool
+	mutedNicks        map[string]bool
+	bannedKeys        map[string]bool // by key fingerprint
+	mutedKeys         map[string]bool
+	moderationLeader  uint64           // signed the current state
+	moderationSig     string           // hex signature of the leader
+	pendingModeration *modStateMessage // newer state signed by a leader whose key isn't known yet
+
+	identityMutex *sync.Mutex
+	identity      ed25519.PrivateKey
+	nodeKeys      map[uint64]ed25519.PublicKey // proven in connect or identity messages
+
+	// relay client side
+	relayAddressMutex *sync.Mutex
+	relayAddress      string
+
+	// relay server side
+	relayServerEnabled uint32 // atomic, not guarded by mutex
+	relayMutex         *sync.Mutex
+	relayClients       map[uint64]*Node
+	pendingRelays      map[string]net.Conn
+
+	// persisted state
+	stateFileMutex    *sync.Mutex
+	stateFile         string
+	stateSavePending  uint32 // atomic, not guarded by mutex
+	expectedNetworkID uint64 // atomic, network we are rejoining
+
+	// fault injection
+	paused uint32 // atomic, not guarded by mutex
+
+	logLevel int32 // atomic, not guarded by mutex
+
+	traceMutex   *sync.Mutex
+	traceEntries []TraceEntry
+	traceStart   int
+
+	metrics metrics
+
+	ringWalksMutex *sync.Mutex
+	ringWalks      map[string]chan ringwalkMessage // walks started by this node by token
+}
+
+// events of the instance are passed to handler, which may be nil
+func New(handler func(Event), config Config) *Instance {
+	return &Instance{
+		handler:        handler,
+		transportMutex: &sync.Mutex{},
+		transport:      TCPTransport{},
+		clockMutex:     &sync.Mutex{},
+		clock:          SystemClock{},
+		randomMutex:    &sync.Mutex{},
+		random:         rand.New(cryptoSource{}),
+		configMutex:    &sync.Mutex{},
+		config:         config,
+		logicalClock:   logicalClock{timeLock: &sync.Mutex{}},
+
+		networkGlobalsMutex: &sync.Mutex{},
+		networkStateMutex:   &sync.Mutex{},
+		networkState:        noNetwork,
+		defaultAddressMutex: &sync.Mutex{},
+
+		joinRetryMutex:        &sync.Mutex{},
+		joinRetryAttempts:     5,
+		joinRetryInitialDelay: 500 * time.Millisecond,
+		joinRetryMaxDelay:     10 * time.Second,
+
+		chatParticipation:   1,
+		chatNameMutex:       &sync.Mutex{},
+		chatName:            "User",
+		leaderElectionMutex: &sync.Mutex{},
+		chatConnectionsLock: &sync.Mutex{},
+		chatConnections:     make(map[*Node]string),
+
+		networkInfoMutex:   &sync.Mutex{},
+		announceEnabled:    1,
+		discoveryMutex:     &sync.Mutex{},
+		discoveredNetworks: make(map[uint64]*DiscoveredNetwork),
+
+		endpointsMutex: &sync.Mutex{},
+		endpoints:      make(map[uint64][]string),
+
+		moderationMutex: &sync.Mutex{},
+		operators:       make(map[uint64]bool),
+		bannedIDs:       make(map[uint64]bool),
+		bannedNicks:     make(map[string]bool),
+		mutedIDs:        make(map[uint64]bool),
+		mutedNicks:      make(map[string]bool),
+		bannedKeys:      make(map[string]bool),
+		mutedKeys:       make(map[string]bool),
+		identityMutex:   &sync.Mutex{},
+		nodeKeys:        make(map[uint64]ed25519.PublicKey),
+
+		relayAddressMutex: &sync.Mutex{},
+		relayMutex:        &sync.Mutex{},
+		relayClients:      make(map[uint64]*Node),
+		pendingRelays:     make(map[string]net.Conn),
+
+		stateFileMutex: &sync.Mutex{},
+
+		logLevel: int32(LogInfo),
+
+		traceMutex: &sync.Mutex{},
+
+		metrics: newMetrics(),
+
+		ringWalksMutex: &sync.Mutex{},
+		ringWalks:      make(map[string]chan ringwalkMessage),
+	}
+}
+
+type PeerInfo struct {
+	ID        uint64
+	Relation  string
+	Endpoints []string
+	Key       string        // fingerprint of the identity key, empty if the peer didn't prove one
+	RTT       time.Duration // smoothed keepalive RTT, 0 if the peer isn't checked
+	Phi       float64       // suspicion of the failure detector, 0 until enough keepalives were answered
+}
+
+// consistent view of the instance for status displays
+type Snapshot struct {
+	LogicalTime     uint64
+	State           string
+	JoinAttempt     int // 0 unless connecting
+	NodeID          uint64
+	TwiceNextNodeID uint64
+	LeaderID        uint64
+	Peers           []PeerInfo
+}
+
+func (inst *Instance) Snapshot() Snapshot {
+	inst.networkGlobalsMutex.Lock()
+	defer inst.networkGlobalsMutex.Unlock()
+
+	s := Snapshot{inst.getTime(), inst.NetworkState(), inst.JoinAttempt(), inst.getNodeID(), inst.getTwiceNextNodeID(), inst.LeaderID(), nil}
+
+	if inst.nodes != nil {
+		for _, n := range inst.nodes.toSlice() {
+			n.lock.Lock()
+			id, r := n.id, n.r
+			n.lock.Unlock()
+
+			rtt, phi := n.liveness()
+			s.Peers = append(s.Peers, PeerInfo{id, string(r), inst.getEndpoints(id), n.keyFingerprint(), rtt, phi})
+		}
+	}
+
+	return s
+}
+
+// advertised endpoints of a node, empty if not known
+func (inst *Instance) Endpoints(id uint64) []string {
+	return inst.getEndpoints(id)
+}
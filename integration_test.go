@@ -0,0 +1,254 @@
+package distrochya
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const loopbackWait = 30 * time.Second
+
+type loopbackNode struct {
+	*Instance
+	events *eventRecorder
+}
+
+// starts a network on 127.0.0.1 and joins count-1 more nodes to it
+func startLoopbackNetwork(t *testing.T, count int) []*loopbackNode {
+	var nodes []*loopbackNode
+	dir := t.TempDir()
+
+	// short waits keep the loopback tests fast
+	config := DefaultConfig()
+	config.LeaderElectionMinimumWaitSeconds = 0
+	config.LeaderElectionMaximumWaitSeconds = 2
+	config.RingRepairTimeoutSeconds = 1
+
+	for i := 0; i < count; i++ {
+		events := &eventRecorder{lock: &sync.Mutex{}}
+		inst := New(events.handle, config)
+		inst.SetAnnounce(false)
+		inst.SetStateFile(filepath.Join(dir, fmt.Sprintf("state%d.json", i)))
+		inst.SetChatName(fmt.Sprintf("user%d", i))
+
+		if i == 0 {
+			inst.Start(0, "127.0.0.1", "")
+		} else if !inst.Join(nodes[0].Endpoints(nodes[0].Snapshot().NodeID), 0, "127.0.0.1", "") {
+			t.Fatalf("node %d failed to join", i)
+		}
+
+		if !inst.IsRunning() {
+			t.Fatalf("node %d isn't running", i)
+		}
+
+		nodes = append(nodes, &loopbackNode{inst, events})
+
+		waitFor(t, loopbackWait, fmt.Sprintf("ring of %d nodes", len(nodes)), func() bool {
+			return checkRing(nodes) == nil
+		})
+	}
+
+	return nodes
+}
+
+func stopLoopbackNetwork(nodes []*loopbackNode) {
+	for _, n := range nodes {
+		if n.IsRunning() {
+			n.Disconnect()
+		}
+	}
+}
+
+// every node has one next and one prev, following next visits all of them and they agree on one leader
+func checkRing(nodes []*loopbackNode) error {
+	snapshots := make(map[uint64]Snapshot)
+
+	for _, n := range nodes {
+		s := n.Snapshot()
+		snapshots[s.NodeID] = s
+	}
+
+	if len(nodes) == 1 {
+		s := snapshots[nodes[0].Snapshot().NodeID]
+
+		if s.State != singleNode || s.LeaderID != s.NodeID {
+			return fmt.Errorf("single node in state %q with leader 0x%X", s.State, s.LeaderID)
+		}
+
+		return nil
+	}
+
+	nexts := make(map[uint64]uint64)
+	var leaderID uint64
+
+	for id, s := range snapshots {
+		if s.State != ring {
+			return fmt.Errorf("0x%X in state %q", id, s.State)
+		}
+
+		var ns, ps []uint64
+
+		for _, p := range s.Peers {
+			if p.Relation == string(next) {
+				ns = append(ns, p.ID)
+			} else if p.Relation == string(prev) {
+				ps = append(ps, p.ID)
+			}
+		}
+
+		if len(ns) != 1 || len(ps) != 1 {
+			return fmt.Errorf("0x%X has %d next and %d prev nodes", id, len(ns), len(ps))
+		}
+
+		nexts[id] = ns[0]
+
+		if leaderID == 0 {
+			leaderID = s.LeaderID
+		}
+
+		if s.LeaderID == 0 || s.LeaderID != leaderID {
+			return fmt.Errorf("0x%X has leader 0x%X, others 0x%X", id, s.LeaderID, leaderID)
+		}
+	}
+
+	if _, ok := snapshots[leaderID]; !ok {
+		return fmt.Errorf("leader 0x%X isn't in the ring", leaderID)
+	}
+
+	visited := make(map[uint64]bool)
+	id := nodes[0].Snapshot().NodeID
+
+	for !visited[id] {
+		visited[id] = true
+		id = nexts[id]
+	}
+
+	if len(visited) != len(nodes) {
+		return fmt.Errorf("ring closes after %d of %d nodes", len(visited), len(nodes))
+	}
+
+	return nil
+}
+
+func TestLoopbackRingAndChat(t *testing.T) {
+	nodes := startLoopbackNetwork(t, 3)
+	defer stopLoopbackNetwork(nodes)
+
+	for _, n := range nodes {
+		n := n
+		waitFor(t, loopbackWait, "users of "+n.ChatName(), func() bool {
+			e := n.events.ofType(UsersChanged)
+			return len(e) > 0 && len(e[len(e)-1].Users) == len(nodes)
+		})
+	}
+
+	nodes[2].SendChat("hello;there")
+
+	for _, n := range nodes {
+		n := n
+		waitFor(t, loopbackWait, "chat message at "+n.ChatName(), func() bool {
+			e := n.events.ofType(ChatReceived)
+			return len(e) == 1 && e[0].User == "user2" && e[0].Text == "hello;there"
+		})
+	}
+}
+
+func TestLoopbackLeaderFailure(t *testing.T) {
+	nodes := startLoopbackNetwork(t, 4)
+	defer stopLoopbackNetwork(nodes)
+
+	var rest []*loopbackNode
+	leaderID := nodes[0].LeaderID()
+
+	for _, n := range nodes {
+		if n.Snapshot().NodeID == leaderID {
+			n.Disconnect()
+		} else {
+			rest = append(rest, n)
+		}
+	}
+
+	waitFor(t, loopbackWait, "ring repair and election", func() bool {
+		return checkRing(rest) == nil
+	})
+
+	if rest[0].LeaderID() == leaderID {
+		t.Error("dead leader still leads")
+	}
+}
+
+func TestLoopbackModerationReachesEveryNode(t *testing.T) {
+	nodes := startLoopbackNetwork(t, 4)
+	defer stopLoopbackNetwork(nodes)
+
+	leaderID := nodes[0].LeaderID()
+
+	for _, n := range nodes {
+		if n.Snapshot().NodeID == leaderID {
+			n.Moderate(ModBan, "mallory")
+		}
+	}
+
+	// every node checks the signature of the leader before it applies the state
+	for _, n := range nodes {
+		n := n
+		waitFor(t, loopbackWait, "ban at "+n.ChatName(), func() bool {
+			return n.isBanned(0, "mallory", "")
+		})
+	}
+}
+
+func TestLoopbackConcurrentUse(t *testing.T) {
+	nodes := startLoopbackNetwork(t, 3)
+	defer stopLoopbackNetwork(nodes)
+
+	wg := &sync.WaitGroup{}
+	stop := make(chan struct{})
+
+	for _, n := range nodes {
+		n := n
+		wg.Add(3)
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < n.Config().ChatRateLimitBurst/2; i++ {
+				n.SendChat(fmt.Sprintf("message %d", i))
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				s := n.Snapshot()
+				n.Endpoints(s.NodeID)
+				n.NetworkInfo()
+				n.ModerationSummary()
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			n.LeaveChat()
+			n.JoinChat()
+		}()
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	waitFor(t, loopbackWait, "ring after concurrent use", func() bool {
+		return checkRing(nodes) == nil
+	})
+}
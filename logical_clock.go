@@ -1,25 +1,27 @@
-package main
+package distrochya
 
 import "sync"
 
-var currentTime uint64 = 0
-var timeLock = &sync.Mutex{}
+type logicalClock struct {
+	currentTime uint64
+	timeLock    *sync.Mutex
+}
 
-func advanceTime() uint64 {
-	timeLock.Lock()
+func (c *logicalClock) advanceTime() uint64 {
+	c.timeLock.Lock()
 
-	currentTime++
-	rtn := currentTime
+	c.currentTime++
+	rtn := c.currentTime
 
-	timeLock.Unlock()
+	c.timeLock.Unlock()
 
 	return rtn
 }
 
-func updateTime(t uint64) uint64 {
-	timeLock.Lock()
+func (c *logicalClock) updateTime(t uint64) uint64 {
+	c.timeLock.Lock()
 
-	time := currentTime
+	time := c.currentTime
 
 	if t > time {
 		time = t
@@ -27,27 +29,27 @@ func updateTime(t uint64) uint64 {
 
 	time++
 
-	currentTime = time
+	c.currentTime = time
 
-	timeLock.Unlock()
+	c.timeLock.Unlock()
 
 	return time
 }
 
-func resetTime() {
-	timeLock.Lock()
+func (c *logicalClock) resetTime() {
+	c.timeLock.Lock()
 
-	currentTime = 0
+	c.currentTime = 0
 
-	timeLock.Unlock()
+	c.timeLock.Unlock()
 }
 
-func getTime() uint64 {
-	timeLock.Lock()
+func (c *logicalClock) getTime() uint64 {
+	c.timeLock.Lock()
 
-	rtn := currentTime
+	rtn := c.currentTime
 
-	timeLock.Unlock()
+	c.timeLock.Unlock()
 
 	return rtn
 }
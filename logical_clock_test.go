@@ -0,0 +1,102 @@
+package distrochya
+
+import (
+	"sync"
+	"testing"
+)
+
+func newTestLogicalClock(t uint64) *logicalClock {
+	return &logicalClock{t, &sync.Mutex{}}
+}
+
+func TestLogicalClockAdvance(t *testing.T) {
+	c := newTestLogicalClock(0)
+
+	for i := uint64(1); i <= 3; i++ {
+		if got := c.advanceTime(); got != i {
+			t.Errorf("advance returned %d, want %d", got, i)
+		}
+	}
+
+	if got := c.getTime(); got != 3 {
+		t.Errorf("time %d, want 3", got)
+	}
+}
+
+func TestLogicalClockUpdate(t *testing.T) {
+	tests := []struct {
+		local    uint64
+		received uint64
+		want     uint64
+	}{
+		{0, 0, 1},
+		{0, 10, 11},
+		{10, 0, 11},
+		{10, 10, 11},
+		{10, 11, 12},
+		{^uint64(0) - 1, 5, ^uint64(0)},
+	}
+
+	for _, tt := range tests {
+		c := newTestLogicalClock(tt.local)
+
+		if got := c.updateTime(tt.received); got != tt.want {
+			t.Errorf("local=%d received=%d: %d, want %d", tt.local, tt.received, got, tt.want)
+		}
+
+		if got := c.getTime(); got != tt.want {
+			t.Errorf("local=%d received=%d: stored %d, want %d", tt.local, tt.received, got, tt.want)
+		}
+	}
+}
+
+func TestLogicalClockReset(t *testing.T) {
+	c := newTestLogicalClock(42)
+	c.resetTime()
+
+	if got := c.getTime(); got != 0 {
+		t.Errorf("time %d after reset", got)
+	}
+}
+
+func TestLogicalClockConcurrentTimesAreUnique(t *testing.T) {
+	const goroutines = 16
+	const perGoroutine = 500
+
+	c := newTestLogicalClock(0)
+	times := make(chan uint64, goroutines*perGoroutine)
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < perGoroutine; j++ {
+				if j%2 == 0 {
+					times <- c.advanceTime()
+				} else {
+					times <- c.updateTime(1)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(times)
+
+	seen := make(map[uint64]bool)
+
+	for tm := range times {
+		if seen[tm] {
+			t.Fatalf("time %d handed out twice", tm)
+		}
+
+		seen[tm] = true
+	}
+
+	if got := c.getTime(); got != goroutines*perGoroutine {
+		t.Errorf("final time %d, want %d", got, goroutines*perGoroutine)
+	}
+}
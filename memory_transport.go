@@ -0,0 +1,716 @@
+package distrochya
+
+import (
+	"bytes"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const memoryFirstPort = 10000
+
+// faults injected on the link between two hosts of a MemoryNetwork, applied to every write
+type LinkConfig struct {
+	Latency     time.Duration // one-way delay
+	Jitter      time.Duration // random extra delay up to Jitter
+	DropRate    float64       // probability the write is lost
+	ReorderRate float64       // probability the write may overtake writes sent before it
+}
+
+// in-process network for tests, hosts are plain names and addresses are host:port
+type MemoryNetwork struct {
+	lock        *sync.Mutex
+	clock       Clock
+	clocks      map[string]Clock // of single hosts, clock is used for the others
+	seed        int64
+	rands       map[string]*rand.Rand // faults of the links from a host are drawn from its own source
+	listeners   map[string]*memoryListener
+	nextPort    map[string]int
+	defaultLink LinkConfig
+	links       map[[2]string]LinkConfig
+	partitioned map[[2]string]bool
+}
+
+type memoryTransport struct {
+	network *MemoryNetwork
+	host    string
+}
+
+type memoryAddr string
+
+type memoryError struct {
+	msg     string
+	timeout bool
+}
+
+// data waiting to be read on one side of a connection
+type memoryPipe struct {
+	clock    Clock
+	lock     *sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	eof      bool // other side closed and everything it wrote was delivered
+	closed   bool // this side closed
+	deadline time.Time
+	timer    Timer
+	reader   *waiter
+}
+
+type memorySegment struct {
+	at   time.Time
+	data []byte
+}
+
+// one direction of a connection, delivers segments to dst once their time comes
+type memoryLink struct {
+	network *MemoryNetwork
+	from    string
+	to      string
+	dst     *memoryPipe
+	clock   Clock
+	lock    *sync.Mutex
+	cond    *sync.Cond
+	queue   []memorySegment
+	last    time.Time
+	closed  bool
+	eofAt   time.Time // zero if the close got lost
+	wake    *waiter
+}
+
+type memoryConn struct {
+	local         memoryAddr
+	remote        memoryAddr
+	in            *memoryPipe
+	out           *memoryLink
+	lock          *sync.Mutex
+	writeDeadline time.Time
+	closed        bool
+}
+
+type memoryListener struct {
+	network  *MemoryNetwork
+	addr     memoryAddr
+	lock     *sync.Mutex
+	cond     *sync.Cond
+	pending  []*memoryConn
+	closed   bool
+	acceptor *waiter
+}
+
+func NewMemoryNetwork(seed int64) *MemoryNetwork {
+	return &MemoryNetwork{
+		lock:        &sync.Mutex{},
+		clock:       SystemClock{},
+		clocks:      make(map[string]Clock),
+		seed:        seed,
+		rands:       make(map[string]*rand.Rand),
+		listeners:   make(map[string]*memoryListener),
+		nextPort:    make(map[string]int),
+		links:       make(map[[2]string]LinkConfig),
+		partitioned: make(map[[2]string]bool),
+	}
+}
+
+func hostPair(a string, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+
+	return [2]string{a, b}
+}
+
+// transport of a single host, give every instance its own host
+func (m *MemoryNetwork) Transport(host string) Transport {
+	return &memoryTransport{m, host}
+}
+
+// has to be called before any connection is made, deadlines and latencies are measured by c
+func (m *MemoryNetwork) SetClock(c Clock) {
+	m.lock.Lock()
+	m.clock = c
+	m.lock.Unlock()
+}
+
+// clock of the instance running on host, its connections are timed by it
+func (m *MemoryNetwork) SetHostClock(host string, c Clock) {
+	m.lock.Lock()
+	m.clocks[host] = c
+	m.lock.Unlock()
+}
+
+func (m *MemoryNetwork) hostClock(host string) Clock {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.clockOf(host)
+}
+
+// m.lock has to be held
+func (m *MemoryNetwork) clockOf(host string) Clock {
+	if c, ok := m.clocks[host]; ok {
+		return c
+	}
+
+	return m.clock
+}
+
+// m.lock has to be held
+func (m *MemoryNetwork) hostRand(host string) *rand.Rand {
+	r := m.rands[host]
+
+	if r == nil {
+		h := fnv.New64a()
+		h.Write([]byte(host))
+		r = rand.New(rand.NewSource(m.seed ^ int64(h.Sum64())))
+		m.rands[host] = r
+	}
+
+	return r
+}
+
+func (m *MemoryNetwork) SetDefaultLink(c LinkConfig) {
+	m.lock.Lock()
+	m.defaultLink = c
+	m.lock.Unlock()
+}
+
+// applies in both directions
+func (m *MemoryNetwork) SetLink(a string, b string, c LinkConfig) {
+	m.lock.Lock()
+	m.links[hostPair(a, b)] = c
+	m.lock.Unlock()
+}
+
+// hosts can't connect to each other and everything sent between them is lost until healed
+func (m *MemoryNetwork) Partition(a string, b string) {
+	m.lock.Lock()
+	m.partitioned[hostPair(a, b)] = true
+	m.lock.Unlock()
+}
+
+func (m *MemoryNetwork) Heal(a string, b string) {
+	m.lock.Lock()
+	delete(m.partitioned, hostPair(a, b))
+	m.lock.Unlock()
+}
+
+func (m *MemoryNetwork) HealAll() {
+	m.lock.Lock()
+	m.partitioned = make(map[[2]string]bool)
+	m.lock.Unlock()
+}
+
+func (m *MemoryNetwork) isPartitioned(a string, b string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.partitioned[hostPair(a, b)]
+}
+
+func (m *MemoryNetwork) linkConfig(from string, to string) LinkConfig {
+	if c, ok := m.links[hostPair(from, to)]; ok {
+		return c
+	}
+
+	return m.defaultLink
+}
+
+func (m *MemoryNetwork) delay(from string, c LinkConfig) time.Duration {
+	d := c.Latency
+
+	if c.Jitter > 0 {
+		d += time.Duration(m.hostRand(from).Int63n(int64(c.Jitter)))
+	}
+
+	return d
+}
+
+// returns delivery time of a write, zero time if the write is lost
+func (m *MemoryNetwork) schedule(from string, to string, now time.Time, last time.Time) time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.partitioned[hostPair(from, to)] {
+		return time.Time{}
+	}
+
+	c := m.linkConfig(from, to)
+
+	r := m.hostRand(from)
+
+	if c.DropRate > 0 && r.Float64() < c.DropRate {
+		return time.Time{}
+	}
+
+	at := now.Add(m.delay(from, c))
+
+	if at.Before(last) && !(c.ReorderRate > 0 && r.Float64() < c.ReorderRate) {
+		at = last
+	}
+
+	return at
+}
+
+// returns the time the other side notices a close, it never overtakes data and is only lost to partitions
+func (m *MemoryNetwork) scheduleClose(from string, to string, now time.Time, last time.Time) time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.partitioned[hostPair(from, to)] {
+		return time.Time{}
+	}
+
+	at := now.Add(m.delay(from, m.linkConfig(from, to)))
+
+	if at.Before(last) {
+		at = last
+	}
+
+	return at
+}
+
+// connecting takes a round trip, except within a host
+func (m *MemoryNetwork) dialDelay(from string, to string) time.Duration {
+	if from == to {
+		return 0
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	c := m.linkConfig(from, to)
+	return m.delay(from, c) + m.delay(from, c)
+}
+
+func (m *MemoryNetwork) allocatePort(host string) int {
+	if m.nextPort[host] == 0 {
+		m.nextPort[host] = memoryFirstPort
+	}
+
+	for {
+		p := m.nextPort[host]
+		m.nextPort[host]++
+
+		if m.listeners[net.JoinHostPort(host, strconv.Itoa(p))] == nil {
+			return p
+		}
+	}
+}
+
+func (t *memoryTransport) Listen(address string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if host != "" && host != t.host && host != "0.0.0.0" && host != "::" {
+		return nil, &memoryError{"listen " + address + ": cannot assign requested address", false}
+	}
+
+	p, err := strconv.Atoi(port)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+
+	if p == 0 {
+		p = t.network.allocatePort(t.host)
+	}
+
+	a := net.JoinHostPort(t.host, strconv.Itoa(p))
+
+	if t.network.listeners[a] != nil {
+		return nil, &memoryError{"listen " + a + ": address already in use", false}
+	}
+
+	l := &memoryListener{network: t.network, addr: memoryAddr(a), lock: &sync.Mutex{}, acceptor: newWaiter(t.network.clockOf(t.host))}
+	l.cond = sync.NewCond(l.lock)
+	t.network.listeners[a] = l
+
+	return l, nil
+}
+
+func (t *memoryTransport) Dial(bind string, address string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if host == "localhost" || host == "127.0.0.1" || host == "::1" {
+		host = t.host
+	}
+
+	if t.network.isPartitioned(t.host, host) {
+		return nil, &memoryError{"dial " + address + ": i/o timeout", true}
+	}
+
+	if d := t.network.dialDelay(t.host, host); d > 0 {
+		t.network.hostClock(t.host).Sleep(d)
+	}
+
+	t.network.lock.Lock()
+	l := t.network.listeners[net.JoinHostPort(host, port)]
+	local := memoryAddr(net.JoinHostPort(t.host, strconv.Itoa(t.network.allocatePort(t.host))))
+	t.network.lock.Unlock()
+
+	if l == nil {
+		return nil, &memoryError{"dial " + address + ": connection refused", false}
+	}
+
+	dialer := newMemoryPipe(t.network.hostClock(t.host))
+	acceptor := newMemoryPipe(t.network.hostClock(host))
+
+	c := &memoryConn{local, l.addr, dialer, newMemoryLink(t.network, t.host, host, dialer.clock, acceptor), &sync.Mutex{}, time.Time{}, false}
+	ac := &memoryConn{l.addr, local, acceptor, newMemoryLink(t.network, host, t.host, acceptor.clock, dialer), &sync.Mutex{}, time.Time{}, false}
+
+	if !l.enqueue(ac) {
+		c.Close()
+		return nil, &memoryError{"dial " + address + ": connection refused", false}
+	}
+
+	return c, nil
+}
+
+func (t *memoryTransport) LocalEndpoints(port uint16) []string {
+	return []string{net.JoinHostPort(t.host, strconv.FormatUint(uint64(port), 10))}
+}
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
+
+func (e *memoryError) Error() string {
+	return e.msg
+}
+
+func (e *memoryError) Timeout() bool {
+	return e.timeout
+}
+
+func (e *memoryError) Temporary() bool {
+	return e.timeout
+}
+
+func newMemoryPipe(clock Clock) *memoryPipe {
+	p := &memoryPipe{clock: clock, lock: &sync.Mutex{}, reader: newWaiter(clock)}
+	p.cond = sync.NewCond(p.lock)
+	return p
+}
+
+func (p *memoryPipe) read(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for {
+		if p.closed {
+			return 0, &memoryError{"use of closed connection", false}
+		}
+
+		if p.buf.Len() > 0 {
+			return p.buf.Read(b)
+		}
+
+		if p.eof {
+			return 0, io.EOF
+		}
+
+		if !p.deadline.IsZero() && !p.clock.Now().Before(p.deadline) {
+			return 0, &memoryError{"read: i/o timeout", true}
+		}
+
+		p.reader.block(nothingPending)
+		p.cond.Wait()
+	}
+}
+
+func (p *memoryPipe) write(b []byte) {
+	p.lock.Lock()
+	if !p.closed {
+		p.buf.Write(b)
+	}
+	p.wakeReader()
+	p.lock.Unlock()
+}
+
+func (p *memoryPipe) setEOF() {
+	p.lock.Lock()
+	p.eof = true
+	p.wakeReader()
+	p.lock.Unlock()
+}
+
+func (p *memoryPipe) close() {
+	p.lock.Lock()
+	p.closed = true
+	p.buf.Reset()
+	p.wakeReader()
+	p.lock.Unlock()
+}
+
+// p.lock has to be held
+func (p *memoryPipe) wakeReader() {
+	p.reader.wake()
+	p.cond.Broadcast()
+}
+
+func (p *memoryPipe) setDeadline(t time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.deadline = t
+
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+
+	// wake up readers once the deadline passes
+	if !t.IsZero() {
+		p.timer = p.clock.AfterFunc(t.Sub(p.clock.Now()), func() {
+			p.lock.Lock()
+			p.wakeReader()
+			p.lock.Unlock()
+		})
+	}
+
+	p.wakeReader()
+}
+
+// clock is the one of the sending host
+func newMemoryLink(m *MemoryNetwork, from string, to string, clock Clock, dst *memoryPipe) *memoryLink {
+	l := &memoryLink{network: m, from: from, to: to, dst: dst, clock: clock, lock: &sync.Mutex{}, wake: newWaiter(clock)}
+	l.cond = sync.NewCond(l.lock)
+	spawn(clock, l.run)
+	return l
+}
+
+func (l *memoryLink) send(b []byte) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return
+	}
+
+	at := l.network.schedule(l.from, l.to, l.clock.Now(), l.last)
+
+	if at.IsZero() {
+		return
+	}
+
+	if at.After(l.last) {
+		l.last = at
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+
+	i := len(l.queue)
+	for i > 0 && l.queue[i-1].at.After(at) {
+		i--
+	}
+
+	l.queue = append(l.queue, memorySegment{})
+	copy(l.queue[i+1:], l.queue[i:])
+	l.queue[i] = memorySegment{at, data}
+
+	l.wake.wake()
+	l.cond.Broadcast()
+}
+
+// everything sent before closing is still delivered
+func (l *memoryLink) close() {
+	l.lock.Lock()
+	if !l.closed {
+		l.closed = true
+		l.eofAt = l.network.scheduleClose(l.from, l.to, l.clock.Now(), l.last)
+	}
+	l.wake.wake()
+	l.lock.Unlock()
+
+	l.cond.Broadcast()
+}
+
+func (l *memoryLink) run() {
+	for {
+		l.lock.Lock()
+
+		for len(l.queue) == 0 && !l.closed {
+			l.wake.block(nothingPending)
+			l.cond.Wait()
+		}
+
+		if len(l.queue) == 0 {
+			eofAt := l.eofAt
+			l.lock.Unlock()
+
+			// the other side has to time out
+			if eofAt.IsZero() {
+				return
+			}
+
+			if wait := eofAt.Sub(l.clock.Now()); wait > 0 {
+				l.clock.Sleep(wait)
+			}
+
+			l.dst.setEOF()
+			return
+		}
+
+		if wait := l.queue[0].at.Sub(l.clock.Now()); wait > 0 {
+			l.lock.Unlock()
+			l.clock.Sleep(wait)
+			continue
+		}
+
+		s := l.queue[0]
+		l.queue = l.queue[1:]
+		l.lock.Unlock()
+
+		// partition started while the data was on its way
+		if !l.network.isPartitioned(l.from, l.to) {
+			l.dst.write(s.data)
+		}
+	}
+}
+
+func (c *memoryConn) Read(b []byte) (int, error) {
+	return c.in.read(b)
+}
+
+func (c *memoryConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	closed, deadline := c.closed, c.writeDeadline
+	c.lock.Unlock()
+
+	if closed {
+		return 0, &memoryError{"use of closed connection", false}
+	}
+
+	if !deadline.IsZero() && !c.in.clock.Now().Before(deadline) {
+		return 0, &memoryError{"write: i/o timeout", true}
+	}
+
+	c.out.send(b)
+	return len(b), nil
+}
+
+func (c *memoryConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+	c.in.close()
+	c.out.close()
+
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.writeDeadline = t
+	c.lock.Unlock()
+
+	return nil
+}
+
+// returns false if the listener is closed
+func (l *memoryListener) enqueue(c *memoryConn) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return false
+	}
+
+	l.pending = append(l.pending, c)
+	l.acceptor.wake()
+	l.cond.Broadcast()
+
+	return true
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for len(l.pending) == 0 && !l.closed {
+		l.acceptor.block(nothingPending)
+		l.cond.Wait()
+	}
+
+	if l.closed {
+		return nil, &memoryError{"accept " + string(l.addr) + ": use of closed network connection", false}
+	}
+
+	c := l.pending[0]
+	l.pending = l.pending[1:]
+
+	return c, nil
+}
+
+func (l *memoryListener) Close() error {
+	l.network.lock.Lock()
+	if l.network.listeners[string(l.addr)] == l {
+		delete(l.network.listeners, string(l.addr))
+	}
+	l.network.lock.Unlock()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return nil
+	}
+
+	l.closed = true
+
+	for _, c := range l.pending {
+		c.Close()
+	}
+
+	l.pending = nil
+	l.acceptor.wake()
+	l.cond.Broadcast()
+
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
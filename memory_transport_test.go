@@ -0,0 +1,137 @@
+package distrochya
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func memoryPair(t *testing.T, m *MemoryNetwork) (net.Conn, *testPeer) {
+	l, err := m.Transport("b").Listen("b:1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	c, err := m.Transport("a").Dial("", "b:1", time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, acceptPeer(t, l)
+}
+
+func TestMemoryTransportDeliversInOrder(t *testing.T) {
+	m := NewMemoryNetwork(1)
+	m.SetDefaultLink(LinkConfig{Latency: time.Millisecond, Jitter: 3 * time.Millisecond})
+	c, p := memoryPair(t, m)
+
+	for i := 0; i < 50; i++ {
+		c.Write([]byte(strconv.Itoa(i) + "\n"))
+	}
+
+	c.Close()
+
+	for i := 0; i < 50; i++ {
+		select {
+		case line := <-p.lines:
+			if line != strconv.Itoa(i) {
+				t.Fatalf("got %q, want %d", line, i)
+			}
+		case <-time.After(testReadWait):
+			t.Fatalf("line %d not delivered", i)
+		}
+	}
+
+	// close is seen only after the data
+	if _, ok := <-p.lines; ok {
+		t.Error("data after close")
+	}
+}
+
+func TestMemoryTransportAddresses(t *testing.T) {
+	m := NewMemoryNetwork(1)
+	a := m.Transport("a")
+
+	if _, err := a.Dial("", "b:1", time.Second); err == nil {
+		t.Error("dialed a host nobody listens on")
+	}
+
+	if _, err := a.Listen("b:1"); err == nil {
+		t.Error("listened on another host")
+	}
+
+	l, err := a.Listen(":0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	if _, err := a.Listen(l.Addr().String()); err == nil {
+		t.Error("listened twice on the same address")
+	}
+
+	if eps := a.LocalEndpoints(listenerPort(l)); len(eps) != 1 || eps[0] != l.Addr().String() {
+		t.Errorf("local endpoints %v, want %s", eps, l.Addr())
+	}
+
+	c, err := a.Dial("", "localhost:"+strconv.Itoa(int(listenerPort(l))), time.Second)
+
+	if err != nil {
+		t.Fatalf("localhost isn't the own host: %s", err.Error())
+	}
+
+	c.Close()
+}
+
+func TestMemoryTransportPartition(t *testing.T) {
+	m := NewMemoryNetwork(1)
+	c, p := memoryPair(t, m)
+
+	m.Partition("a", "b")
+	c.Write([]byte("lost\n"))
+	p.expectSilence(t)
+
+	if _, err := m.Transport("a").Dial("", "b:1", time.Second); err == nil {
+		t.Error("dialed across a partition")
+	}
+
+	m.Heal("a", "b")
+	c.Write([]byte("delivered\n"))
+
+	select {
+	case line := <-p.lines:
+		if line != "delivered" {
+			t.Errorf("got %q after heal", line)
+		}
+	case <-time.After(testReadWait):
+		t.Error("nothing delivered after heal")
+	}
+}
+
+func TestMemoryTransportDeadline(t *testing.T) {
+	m := NewMemoryNetwork(1)
+	c, _ := memoryPair(t, m)
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := c.Read(make([]byte, 1))
+
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("read returned %v, want a timeout", err)
+	}
+
+	c.SetReadDeadline(time.Time{})
+	c.Close()
+
+	if _, err := c.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Errorf("read from own closed connection returned %v", err)
+	}
+}
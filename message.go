@@ -0,0 +1,431 @@
+package distrochya
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errNotMessage = errors.New("not a distrochya message")
+
+// message which doesn't carry what its type requires
+type malformedMessageError struct {
+	kind   string
+	reason string
+}
+
+func (e *malformedMessageError) Error() string {
+	return fmt.Sprintf("malformed %s message: %s", e.kind, e.reason)
+}
+
+// peer as carried by messages: id@endpoint,endpoint
+type peerToken struct {
+	id        uint64
+	endpoints []string
+}
+
+func parsePeer(s string) (peerToken, error) {
+	parts := strings.SplitN(s, peerIDSeparator, 2)
+	id, err := stringToID(parts[0])
+
+	if err != nil {
+		return peerToken{}, err
+	}
+
+	p := peerToken{id: id}
+
+	if len(parts) == 2 && len(parts[1]) > 0 {
+		p.endpoints = strings.Split(parts[1], peerEndpointSeparator)
+	}
+
+	return p, nil
+}
+
+func (p peerToken) String() string {
+	if len(p.endpoints) == 0 {
+		return idToString(p.id)
+	}
+
+	return idToString(p.id) + peerIDSeparator + strings.Join(p.endpoints, peerEndpointSeparator)
+}
+
+// decoded message, body holds one of the message types below
+type message struct {
+	time uint64
+	kind string
+	body interface{}
+}
+
+type challengeMessage struct {
+	nonce string
+}
+
+type identityMessage struct {
+	peer  peerToken
+	token string // peer as sent, it is signed
+	pub   string // hex public key
+	sig   string // hex signature of our challenge and token
+}
+
+type connectMessage struct {
+	peer  peerToken
+	token string // peer as sent, it is signed
+	r     relation
+	user  string // only for r=follower
+	pub   string // hex public key, empty for peers without one
+	sig   string // hex signature of the challenge of the connection and token
+	key   string // fingerprint of pub, set once sig is verified
+}
+
+type netinfoMessage struct {
+	node         peerToken
+	next         peerToken
+	leader       peerToken
+	twiceNext    peerToken
+	observedAddr string // optional
+	hasNetwork   bool
+	networkID    uint64
+	networkName  string
+}
+
+type closeringMessage struct {
+	sender peerToken
+}
+
+type electionMessage struct {
+	candidateID uint64
+}
+
+type electedMessage struct {
+	leader peerToken
+}
+
+type userlistMessage struct {
+	users []string
+}
+
+type chatMessage struct {
+	user string
+	text string
+}
+
+type chatSendMessage struct {
+	text string
+}
+
+type nextinfoMessage struct {
+	next peerToken
+}
+
+// seq is 0 if the peer doesn't number its keepalives
+type aliveCheckMessage struct {
+	seq uint64
+}
+
+type aliveResponseMessage struct {
+	seq uint64
+}
+
+type relayRegisterMessage struct {
+	peer peerToken
+}
+
+type relayRequestMessage struct {
+	targetID uint64
+}
+
+type relayConnectMessage struct {
+	token string
+}
+
+type relayAcceptMessage struct {
+	token string
+}
+
+type relayOKMessage struct{}
+
+type announceMessage struct {
+	networkID   uint64
+	networkName string
+	peer        peerToken
+}
+
+type modCommandMessage struct {
+	action string
+	target string
+}
+
+type modStateMessage struct {
+	version uint64
+	leader  uint64 // signed it
+	sig     string // hex signature of leader, version and entries
+	entries []string
+}
+
+type modNoticeMessage struct {
+	action string
+	text   string
+}
+
+type ringwalkMessage struct {
+	token  string
+	status string
+	origin peerToken
+	nodes  []RingNode
+}
+
+// message of a type this node doesn't know, ignored
+type unknownMessage struct{}
+
+type messageDecoder struct {
+	kind   string
+	params []string
+	err    error
+}
+
+func (d *messageDecoder) fail(reason string) {
+	if d.err == nil {
+		d.err = &malformedMessageError{d.kind, reason}
+	}
+}
+
+func (d *messageDecoder) require(n int) bool {
+	if len(d.params) < n {
+		d.fail(fmt.Sprintf("%d parameters, need %d", len(d.params), n))
+		return false
+	}
+
+	return true
+}
+
+func (d *messageDecoder) peer(i int, what string) peerToken {
+	p, err := parsePeer(d.params[i])
+
+	if err != nil {
+		d.fail(fmt.Sprintf("invalid %s %q", what, d.params[i]))
+	}
+
+	return p
+}
+
+func (d *messageDecoder) id(i int, what string) uint64 {
+	id, err := stringToID(d.params[i])
+
+	if err != nil {
+		d.fail(fmt.Sprintf("invalid %s %q", what, d.params[i]))
+	}
+
+	return id
+}
+
+// parses a single line without touching any state, the body of the result is one of the message types
+func decodeMessage(m string) (message, error) {
+	msg := strings.Split(m, sepchar)
+
+	if len(msg) < 3 || msg[0] != magic {
+		return message{}, errNotMessage
+	}
+
+	d := &messageDecoder{kind: msg[2], params: msg[3:]}
+	t, err := strconv.ParseUint(msg[1], 10, 64)
+
+	if err != nil {
+		d.fail(fmt.Sprintf("invalid timestamp %q", msg[1]))
+		return message{}, d.err
+	}
+
+	var body interface{}
+	params := d.params
+
+	switch d.kind {
+	case connect:
+		if !d.require(2) {
+			break
+		}
+
+		c := connectMessage{peer: d.peer(0, "peer"), token: params[0], r: relation(params[1])}
+
+		switch c.r {
+		case none, next, prev:
+		case follower:
+			if len(params) < 3 || len(params[2]) == 0 {
+				d.fail("follower connection without a user name")
+			} else {
+				c.user = params[2]
+			}
+		default:
+			d.fail(fmt.Sprintf("invalid relation %q", params[1]))
+		}
+
+		// the signature can only be checked against the challenge of the connection
+		if len(params) >= 5 && len(params[3]) > 0 {
+			c.pub, c.sig = params[3], params[4]
+		}
+
+		body = c
+
+	case challenge:
+		if d.require(1) {
+			body = challengeMessage{params[0]}
+		}
+
+	case identity:
+		if d.require(3) {
+			body = identityMessage{d.peer(0, "peer"), params[0], params[1], params[2]}
+		}
+
+	case netinfo:
+		if !d.require(4) {
+			break
+		}
+
+		ni := netinfoMessage{
+			node:      d.peer(0, "node peer"),
+			next:      d.peer(1, "next peer"),
+			leader:    d.peer(2, "leader peer"),
+			twiceNext: d.peer(3, "twice next peer"),
+		}
+
+		if len(params) > 4 {
+			ni.observedAddr = params[4]
+		}
+
+		if len(params) > 6 {
+			ni.hasNetwork = true
+			ni.networkID = d.id(5, "network id")
+			ni.networkName = params[6]
+		}
+
+		body = ni
+
+	case closering:
+		if d.require(1) {
+			body = closeringMessage{d.peer(0, "sender peer")}
+		}
+
+	case election:
+		if d.require(1) {
+			body = electionMessage{d.id(0, "candidate id")}
+		}
+
+	case elected:
+		if d.require(1) {
+			body = electedMessage{d.peer(0, "leader peer")}
+		}
+
+	case userlist:
+		body = userlistMessage{params}
+
+	case chatmessage:
+		if d.require(1) {
+			body = chatMessage{params[0], strings.Join(params[1:], sepchar)}
+		}
+
+	case chatmessagesend:
+		body = chatSendMessage{strings.Join(params, sepchar)}
+
+	case nextinfo:
+		if d.require(1) {
+			body = nextinfoMessage{d.peer(0, "next peer")}
+		}
+
+	case alivecheck:
+		if len(params) > 0 {
+			body = aliveCheckMessage{d.id(0, "sequence number")}
+		} else {
+			body = aliveCheckMessage{}
+		}
+
+	case aliveresponse:
+		if len(params) > 0 {
+			body = aliveResponseMessage{d.id(0, "sequence number")}
+		} else {
+			body = aliveResponseMessage{}
+		}
+
+	case relayregister:
+		if d.require(1) {
+			body = relayRegisterMessage{d.peer(0, "peer")}
+		}
+
+	case relayrequest:
+		if d.require(1) {
+			body = relayRequestMessage{d.id(0, "target id")}
+		}
+
+	case relayconnect:
+		if d.require(1) {
+			body = relayConnectMessage{params[0]}
+		}
+
+	case relayaccept:
+		if d.require(1) {
+			body = relayAcceptMessage{params[0]}
+		}
+
+	case relayok:
+		body = relayOKMessage{}
+
+	case announce:
+		if d.require(3) {
+			body = announceMessage{d.id(0, "network id"), params[1], d.peer(2, "peer")}
+		}
+
+	case modcommand:
+		if d.require(2) {
+			body = modCommandMessage{params[0], params[1]}
+		}
+
+	case modstate:
+		if !d.require(3) {
+			break
+		}
+
+		version, err := strconv.ParseUint(params[0], 10, 64)
+
+		if err != nil {
+			d.fail(fmt.Sprintf("invalid version %q", params[0]))
+		}
+
+		body = modStateMessage{version, d.id(1, "leader id"), params[2], params[3:]}
+
+	case modnotice:
+		if d.require(2) {
+			body = modNoticeMessage{params[0], params[1]}
+		}
+
+	case ringwalk:
+		if !d.require(4) {
+			break
+		}
+
+		w := ringwalkMessage{token: params[0], status: params[1], origin: d.peer(2, "origin peer")}
+
+		if len(w.token) == 0 || len(w.status) == 0 {
+			d.fail("empty token or status")
+		}
+
+		for _, p := range params[3:] {
+			rn, err := parseRingNode(p)
+
+			if err != nil {
+				d.fail(fmt.Sprintf("invalid node %q", p))
+				break
+			}
+
+			w.nodes = append(w.nodes, rn)
+		}
+
+		body = w
+
+	default:
+		body = unknownMessage{}
+	}
+
+	if d.err != nil {
+		return message{}, d.err
+	}
+
+	return message{t, d.kind, body}, nil
+}
@@ -0,0 +1,227 @@
+package distrochya
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	peer := peerToken{testPeerID, []string{"a:1", "b:2"}}
+
+	tests := []struct {
+		msg  string
+		want interface{}
+	}{
+		{testMessage(7, connect, peer.String(), string(none)), connectMessage{peer: peer, token: peer.String(), r: none}},
+		{testMessage(7, connect, peer.String(), string(follower), "bob"), connectMessage{peer: peer, token: peer.String(), r: follower, user: "bob"}},
+		{testMessage(7, challenge, "abc"), challengeMessage{"abc"}},
+		{testMessage(7, identity, peer.String(), "k", "s"), identityMessage{peer, peer.String(), "k", "s"}},
+		{testMessage(7, netinfo, "1", "2", "3", "4"), netinfoMessage{node: peerToken{id: 1}, next: peerToken{id: 2}, leader: peerToken{id: 3}, twiceNext: peerToken{id: 4}}},
+		{testMessage(7, netinfo, "1", "2", "3", "4", "10.0.0.1", "ff", "lobby"), netinfoMessage{peerToken{id: 1}, peerToken{id: 2}, peerToken{id: 3}, peerToken{id: 4}, "10.0.0.1", true, 0xff, "lobby"}},
+		{testMessage(7, closering, peer.String()), closeringMessage{peer}},
+		{testMessage(7, election, "abc"), electionMessage{0xabc}},
+		{testMessage(7, elected, peer.String()), electedMessage{peer}},
+		{testMessage(7, userlist, "a", "b"), userlistMessage{[]string{"a", "b"}}},
+		{testMessage(7, userlist), userlistMessage{[]string{}}},
+		{testMessage(7, chatmessage, "bob", "hi", "there"), chatMessage{"bob", "hi;there"}},
+		{testMessage(7, chatmessage, "bob"), chatMessage{"bob", ""}},
+		{testMessage(7, chatmessagesend, "hi", "there"), chatSendMessage{"hi;there"}},
+		{testMessage(7, nextinfo, peer.String()), nextinfoMessage{peer}},
+		{testMessage(7, alivecheck), aliveCheckMessage{}},
+		{testMessage(7, alivecheck, "1f"), aliveCheckMessage{0x1f}},
+		{testMessage(7, aliveresponse), aliveResponseMessage{}},
+		{testMessage(7, aliveresponse, "1f", "extra"), aliveResponseMessage{0x1f}},
+		{testMessage(7, relayregister, peer.String()), relayRegisterMessage{peer}},
+		{testMessage(7, relayrequest, "2000"), relayRequestMessage{testPeerID}},
+		{testMessage(7, relayconnect, "tok"), relayConnectMessage{"tok"}},
+		{testMessage(7, relayaccept, "tok"), relayAcceptMessage{"tok"}},
+		{testMessage(7, relayok), relayOKMessage{}},
+		{testMessage(7, announce, "ff", "lobby", peer.String()), announceMessage{0xff, "lobby", peer}},
+		{testMessage(7, modcommand, ModKick, "bob"), modCommandMessage{ModKick, "bob"}},
+		{testMessage(7, modstate, "3", "1000", "ab", "a", "b"), modStateMessage{3, testNodeID, "ab", []string{"a", "b"}}},
+		{testMessage(7, modnotice, modNoticeInfo, "ok"), modNoticeMessage{modNoticeInfo, "ok"}},
+		{testMessage(7, ringwalk, "tok", walkInProgress, peer.String(), "a,b,c,d,e"), ringwalkMessage{"tok", walkInProgress, peer, []RingNode{{0xa, 0xb, 0xc, 0xd, 0xe}}}},
+		{testMessage(7, "nosuchmessage", "x"), unknownMessage{}},
+	}
+
+	for _, tt := range tests {
+		msg, err := decodeMessage(tt.msg)
+
+		if err != nil {
+			t.Errorf("%q: %v", tt.msg, err)
+			continue
+		}
+
+		if msg.time != 7 {
+			t.Errorf("%q: time %d, want 7", tt.msg, msg.time)
+		}
+
+		if !reflect.DeepEqual(msg.body, tt.want) {
+			t.Errorf("%q: decoded %#v, want %#v", tt.msg, msg.body, tt.want)
+		}
+	}
+}
+
+func TestDecodeMessageErrors(t *testing.T) {
+	if _, err := decodeMessage("hello"); err != errNotMessage {
+		t.Errorf("non-protocol line gave %v", err)
+	}
+
+	if _, err := decodeMessage(testMessage(1, ringwalk, "tok", walkInProgress, "2000", "a,b")); err == nil {
+		t.Error("ringwalk with a short node accepted")
+	}
+
+	if _, err := decodeMessage(testMessage(1, aliveresponse, "extra")); err == nil {
+		t.Error("aliveresponse with an invalid sequence number accepted")
+	}
+
+	_, err := decodeMessage(testMessage(1, netinfo, "1"))
+	var malformed *malformedMessageError
+
+	if !errors.As(err, &malformed) || malformed.kind != netinfo {
+		t.Errorf("short netinfo gave %v", err)
+	}
+}
+
+func TestConnectKey(t *testing.T) {
+	ti := newTestInstance(t)
+	params := ti.connectParams("abc", follower, "bob")
+
+	m, err := decodeMessage(testMessage(1, params...))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := m.body.(connectMessage)
+
+	if pub, err := verifyKey("abc", c.token, c.pub, c.sig); err != nil || keyFingerprint(pub) != ti.Fingerprint() || c.user != "bob" {
+		t.Errorf("decoded %+v verified as %x, %v, want key %s", c, pub, err, ti.Fingerprint())
+	}
+
+	// the signature covers the challenge, it can't be replayed on another connection
+	if _, err := verifyKey("abd", c.token, c.pub, c.sig); err == nil {
+		t.Error("signature of another challenge accepted")
+	}
+
+	// and the peer token, it can't be reused for another node id
+	if _, err := verifyKey("abc", testPeerToken(testPeerID), c.pub, c.sig); err == nil {
+		t.Error("signature of another peer accepted")
+	}
+}
+
+func TestParsePeer(t *testing.T) {
+	tests := []struct {
+		s    string
+		want peerToken
+	}{
+		{"2000", peerToken{id: testPeerID}},
+		{"2000@", peerToken{id: testPeerID}},
+		{"2000@a:1", peerToken{testPeerID, []string{"a:1"}}},
+		{"2000@a:1,relay:b:2", peerToken{testPeerID, []string{"a:1", "relay:b:2"}}},
+	}
+
+	for _, tt := range tests {
+		p, err := parsePeer(tt.s)
+
+		if err != nil || !reflect.DeepEqual(p, tt.want) {
+			t.Errorf("parsePeer(%q) = %v, %v, want %v", tt.s, p, err, tt.want)
+		}
+	}
+
+	for _, s := range []string{"", "@a:1", "xyz@a:1", "-1"} {
+		if _, err := parsePeer(s); err == nil {
+			t.Errorf("parsePeer(%q) accepted", s)
+		}
+	}
+}
+
+func addMessageSeeds(f *testing.F) {
+	peer := testPeerToken(testPeerID, "a:1", "b:2")
+
+	for _, m := range [][]string{
+		{connect, peer, string(none)},
+		{connect, peer, string(follower), "bob"},
+		{connect, peer},
+		{netinfo, peer, peer, "0", peer, "10.0.0.1", "ff", "lobby"},
+		{netinfo, peer, peer},
+		{closering, peer},
+		{election, "abc"},
+		{elected, peer},
+		{userlist, "a", "b"},
+		{chatmessage, "bob", "hi"},
+		{chatmessagesend, "hi"},
+		{nextinfo, peer},
+		{alivecheck},
+		{aliveresponse, "1"},
+		{relayregister, peer},
+		{relayrequest, "2000"},
+		{announce, "ff", "lobby", peer},
+		{modcommand, ModKick, "bob"},
+		{challenge, "abc"},
+		{identity, peer, "k", "s"},
+		{modstate, "1", "1000", "ab", "x"},
+		{modnotice, modNoticeInfo, "ok"},
+		{ringwalk, "tok", walkInProgress, peer, "a,b,c,d,e", "b,c,a,0,a"},
+	} {
+		f.Add(testMessage(1, m...))
+	}
+
+	f.Add("")
+	f.Add(magic + ";;;")
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	addMessageSeeds(f)
+
+	f.Fuzz(func(t *testing.T, m string) {
+		msg, err := decodeMessage(m)
+		var malformed *malformedMessageError
+
+		if err != nil {
+			if err != errNotMessage && !errors.As(err, &malformed) {
+				t.Fatalf("%q: unexpected error type %T", m, err)
+			}
+
+			return
+		}
+
+		if msg.body == nil {
+			t.Fatalf("%q: decoded without a body", m)
+		}
+	})
+}
+
+func FuzzParsePeer(f *testing.F) {
+	f.Add("2000@a:1,b:2")
+	f.Add("2000")
+
+	f.Fuzz(func(t *testing.T, s string) {
+		p, err := parsePeer(s)
+
+		if err != nil {
+			return
+		}
+
+		again, err := parsePeer(p.String())
+
+		if err != nil || !reflect.DeepEqual(again, p) {
+			t.Fatalf("%q: %v doesn't round trip: %v, %v", s, p, again, err)
+		}
+	})
+}
+
+// the handlers have to survive anything a peer sends
+func FuzzProcessMessage(f *testing.F) {
+	addMessageSeeds(f)
+
+	f.Fuzz(func(t *testing.T, m string) {
+		ti := newTestInstance(t)
+		n, p := ti.peer(t, next, testPeerID)
+		defer p.conn.Close()
+		defer n.disconnect()
+
+		n.processMessage(m)
+	})
+}
@@ -0,0 +1,165 @@
+package distrochya
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds of the keepalive RTT histogram buckets
+var keepaliveRTTBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// counters of the instance, updated as messages are sent and handled
+type metrics struct {
+	lock             *sync.Mutex
+	messagesSent     map[string]uint64
+	messagesReceived map[string]uint64
+	rttCounts        []uint64 // per bucket, the last one counts RTTs over all bounds
+	rttSum           time.Duration
+	leaderChangedAt  time.Time
+
+	electionsStarted    uint64 // atomic
+	electionsWon        uint64 // atomic
+	ringRepairs         uint64 // atomic
+	closeringHops       uint64 // atomic
+	chatMessagesRelayed uint64 // atomic
+	leaderChanges       uint64 // atomic
+	outboundDropped     uint64 // atomic
+	slowPeerDisconnects uint64 // atomic
+}
+
+func newMetrics() metrics {
+	return metrics{
+		lock:             &sync.Mutex{},
+		messagesSent:     make(map[string]uint64),
+		messagesReceived: make(map[string]uint64),
+		rttCounts:        make([]uint64, len(keepaliveRTTBuckets)+1),
+	}
+}
+
+// RTTs of answered alivechecks, Counts are cumulative like Prometheus buckets,
+// Counts[i] is the number of RTTs up to Buckets[i] and the last one is the number of all RTTs
+type RTTHistogram struct {
+	Buckets []time.Duration
+	Counts  []uint64
+	Sum     time.Duration
+}
+
+// consistent copy of the metrics of the instance
+type Metrics struct {
+	NodesByRelation     map[string]int
+	MessagesSent        map[string]uint64 // by message type
+	MessagesReceived    map[string]uint64 // by message type, unknown types are counted as "unknown"
+	ElectionsStarted    uint64
+	ElectionsWon        uint64
+	RingRepairs         uint64
+	CloseringHops       uint64 // closering messages handled by this node
+	ChatMessagesRelayed uint64 // chat messages broadcast by this node as the leader
+	KeepaliveRTT        RTTHistogram
+	LeaderChanges       uint64
+	SinceLeaderChange   time.Duration // 0 if the leader never changed
+	OutboundDropped     uint64        // messages to slow followers dropped because their queue was full
+	SlowPeerDisconnects uint64        // connections closed because their queue was full
+}
+
+func (inst *Instance) Metrics() Metrics {
+	m := Metrics{NodesByRelation: make(map[string]int), MessagesSent: make(map[string]uint64), MessagesReceived: make(map[string]uint64)}
+
+	// every relation is present so that gauges don't disappear when there is no such connection
+	for _, r := range []relation{none, next, prev, leader, follower, relay, relayClient} {
+		m.NodesByRelation[string(r)] = 0
+	}
+
+	inst.networkGlobalsMutex.Lock()
+
+	if inst.nodes != nil {
+		for _, n := range inst.nodes.toSlice() {
+			r, _ := n.relationAndID()
+			m.NodesByRelation[string(r)]++
+		}
+	}
+
+	inst.networkGlobalsMutex.Unlock()
+
+	inst.metrics.lock.Lock()
+
+	for k, v := range inst.metrics.messagesSent {
+		m.MessagesSent[k] = v
+	}
+
+	for k, v := range inst.metrics.messagesReceived {
+		m.MessagesReceived[k] = v
+	}
+
+	m.KeepaliveRTT.Buckets = append([]time.Duration(nil), keepaliveRTTBuckets...)
+	m.KeepaliveRTT.Sum = inst.metrics.rttSum
+	var total uint64
+
+	for _, c := range inst.metrics.rttCounts {
+		total += c
+		m.KeepaliveRTT.Counts = append(m.KeepaliveRTT.Counts, total)
+	}
+
+	leaderChangedAt := inst.metrics.leaderChangedAt
+	inst.metrics.lock.Unlock()
+
+	if !leaderChangedAt.IsZero() {
+		m.SinceLeaderChange = inst.getClock().Now().Sub(leaderChangedAt)
+	}
+
+	m.ElectionsStarted = atomic.LoadUint64(&inst.metrics.electionsStarted)
+	m.ElectionsWon = atomic.LoadUint64(&inst.metrics.electionsWon)
+	m.RingRepairs = atomic.LoadUint64(&inst.metrics.ringRepairs)
+	m.CloseringHops = atomic.LoadUint64(&inst.metrics.closeringHops)
+	m.ChatMessagesRelayed = atomic.LoadUint64(&inst.metrics.chatMessagesRelayed)
+	m.LeaderChanges = atomic.LoadUint64(&inst.metrics.leaderChanges)
+	m.OutboundDropped = atomic.LoadUint64(&inst.metrics.outboundDropped)
+	m.SlowPeerDisconnects = atomic.LoadUint64(&inst.metrics.slowPeerDisconnects)
+
+	return m
+}
+
+func (inst *Instance) countMessageSent(kind string) {
+	inst.metrics.lock.Lock()
+	inst.metrics.messagesSent[kind]++
+	inst.metrics.lock.Unlock()
+}
+
+func (inst *Instance) countMessageReceived(kind string) {
+	inst.metrics.lock.Lock()
+	inst.metrics.messagesReceived[kind]++
+	inst.metrics.lock.Unlock()
+}
+
+func (inst *Instance) observeKeepaliveRTT(rtt time.Duration) {
+	i := 0
+
+	for i < len(keepaliveRTTBuckets) && rtt > keepaliveRTTBuckets[i] {
+		i++
+	}
+
+	inst.metrics.lock.Lock()
+	inst.metrics.rttCounts[i]++
+	inst.metrics.rttSum += rtt
+	inst.metrics.lock.Unlock()
+}
+
+func (inst *Instance) countLeaderChange() {
+	atomic.AddUint64(&inst.metrics.leaderChanges, 1)
+
+	inst.metrics.lock.Lock()
+	inst.metrics.leaderChangedAt = inst.getClock().Now()
+	inst.metrics.lock.Unlock()
+}
@@ -0,0 +1,51 @@
+package distrochya
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetricsCountMessages(t *testing.T) {
+	ti := newTestInstance(t)
+	n, p := ti.peer(t, next, testPeerID)
+
+	n.keepAlive()
+	p.expect(t, alivecheck)
+	ti.clock.advance(30 * time.Millisecond)
+
+	n.processMessage(testMessage(1, aliveresponse))
+	n.processMessage(testMessage(2, "nosuchmessage"))
+	n.processMessage(testMessage(3, aliveresponse)) // doesn't answer anything, no RTT
+
+	m := ti.Metrics()
+
+	if m.MessagesSent[alivecheck] != 1 || m.MessagesReceived[aliveresponse] != 2 || m.MessagesReceived["unknown"] != 1 {
+		t.Errorf("sent %v, received %v", m.MessagesSent, m.MessagesReceived)
+	}
+
+	if c, ok := m.NodesByRelation[string(prev)]; m.NodesByRelation[string(next)] != 1 || !ok || c != 0 {
+		t.Errorf("nodes %v", m.NodesByRelation)
+	}
+
+	h := m.KeepaliveRTT
+
+	// 30ms falls into the 50ms bucket
+	if h.Counts[3] != 0 || h.Counts[4] != 1 || h.Counts[len(h.Counts)-1] != 1 || h.Sum != 30*time.Millisecond {
+		t.Errorf("rtt buckets %v, counts %v, sum %s", h.Buckets, h.Counts, h.Sum)
+	}
+}
+
+func TestMetricsSinceLeaderChange(t *testing.T) {
+	ti := newTestInstance(t)
+
+	if m := ti.Metrics(); m.LeaderChanges != 0 || m.SinceLeaderChange != 0 {
+		t.Errorf("leader changed before anything happened: %+v", m)
+	}
+
+	ti.countLeaderChange()
+	ti.clock.advance(5 * time.Second)
+
+	if m := ti.Metrics(); m.LeaderChanges != 1 || m.SinceLeaderChange != 5*time.Second {
+		t.Errorf("%d changes, %s since the last one", m.LeaderChanges, m.SinceLeaderChange)
+	}
+}
@@ -0,0 +1,488 @@
+package distrochya
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// moderation actions, see Moderate
+	ModKick   = "kick"
+	ModBan    = "ban"
+	ModUnban  = "unban"
+	ModMute   = "mute"
+	ModUnmute = "unmute"
+	ModOp     = "op"
+	ModDeop   = "deop"
+
+	// moderation notices (modnotice action param)
+	modNoticeInfo  = "info"
+	modNoticeError = "error"
+
+	// moderation state entries (kind:value)
+	modEntryCreator    = "creator"
+	modEntryOperator   = "op"
+	modEntryBannedID   = "banid"
+	modEntryBannedNick = "bannick"
+	modEntryMutedID    = "muteid"
+	modEntryMutedNick  = "mutenick"
+	modEntryBannedKey  = "bankey"
+	modEntryMutedKey   = "mutekey"
+
+	// moderation target prefix of key fingerprints
+	keyTargetPrefix = "key:"
+)
+
+func (inst *Instance) resetModeration(creator uint64) {
+	inst.moderationMutex.Lock()
+	defer inst.moderationMutex.Unlock()
+
+	inst.creatorID = creator
+	inst.operators = make(map[uint64]bool)
+	inst.bannedIDs = make(map[uint64]bool)
+	inst.bannedNicks = make(map[string]bool)
+	inst.mutedIDs = make(map[uint64]bool)
+	inst.mutedNicks = make(map[string]bool)
+	inst.bannedKeys = make(map[string]bool)
+	inst.mutedKeys = make(map[string]bool)
+	inst.moderationLeader = 0
+	inst.moderationSig = ""
+	inst.pendingModeration = nil
+
+	if creator != 0 {
+		inst.moderationVersion = inst.advanceTime()
+	} else {
+		inst.moderationVersion = 0
+	}
+}
+
+func (inst *Instance) isOperator(id uint64) bool {
+	inst.moderationMutex.Lock()
+	defer inst.moderationMutex.Unlock()
+
+	return id != 0 && (id == inst.creatorID || inst.operators[id])
+}
+
+func (inst *Instance) isBanned(id uint64, nick string, key string) bool {
+	inst.moderationMutex.Lock()
+	defer inst.moderationMutex.Unlock()
+
+	return inst.bannedIDs[id] || (len(nick) > 0 && inst.bannedNicks[nick]) || (len(key) > 0 && inst.bannedKeys[key])
+}
+
+// once a key is banned a node could evade the ban by leaving its key out of connect
+func (inst *Instance) requiresKey() bool {
+	inst.moderationMutex.Lock()
+	defer inst.moderationMutex.Unlock()
+
+	return len(inst.bannedKeys) > 0
+}
+
+func (inst *Instance) isMuted(id uint64, nick string, key string) bool {
+	inst.moderationMutex.Lock()
+	defer inst.moderationMutex.Unlock()
+
+	return inst.mutedIDs[id] || (len(nick) > 0 && inst.mutedNicks[nick]) || (len(key) > 0 && inst.mutedKeys[key])
+}
+
+// returns modstate message params, the leader signs its own state, everybody else passes on the signature of the leader
+func (inst *Instance) moderationStateMessage() []string {
+	inst.moderationMutex.Lock()
+	defer inst.moderationMutex.Unlock()
+
+	var entries []string
+
+	if inst.creatorID != 0 {
+		entries = append(entries, modEntryCreator+":"+idToString(inst.creatorID))
+	}
+	entries = append(entries, idEntries(modEntryOperator, inst.operators)...)
+	entries = append(entries, idEntries(modEntryBannedID, inst.bannedIDs)...)
+	entries = append(entries, nameEntries(modEntryBannedNick, inst.bannedNicks)...)
+	entries = append(entries, idEntries(modEntryMutedID, inst.mutedIDs)...)
+	entries = append(entries, nameEntries(modEntryMutedNick, inst.mutedNicks)...)
+	entries = append(entries, nameEntries(modEntryBannedKey, inst.bannedKeys)...)
+	entries = append(entries, nameEntries(modEntryMutedKey, inst.mutedKeys)...)
+
+	leader, sig := inst.moderationLeader, inst.moderationSig
+
+	if id := inst.getNodeID(); id != 0 && id == inst.LeaderID() {
+		leader, sig = id, inst.signModeration(inst.moderationVersion, entries)
+	}
+
+	return append([]string{modstate, fmt.Sprintf("%d", inst.moderationVersion), idToString(leader), sig}, entries...)
+}
+
+// entries are sorted, every node has to serialize the state exactly like the leader which signed it
+func idEntries(kind string, ids map[uint64]bool) []string {
+	var rtn []string
+
+	for id := range ids {
+		rtn = append(rtn, kind+":"+idToString(id))
+	}
+	sort.Strings(rtn)
+
+	return rtn
+}
+
+func nameEntries(kind string, names map[string]bool) []string {
+	var rtn []string
+
+	for name := range names {
+		rtn = append(rtn, kind+":"+name)
+	}
+	sort.Strings(rtn)
+
+	return rtn
+}
+
+type moderationUpdate int
+
+const (
+	moderationIgnored moderationUpdate = iota
+	moderationApplied
+	moderationPending // newer, but the key of the leader which signed it isn't known yet
+)
+
+// applies a received state if it is newer than the local one and signed by the current leader
+func (inst *Instance) updateModerationState(m modStateMessage) moderationUpdate {
+	if m.leader == 0 || m.leader != inst.LeaderID() {
+		inst.debugLog(fmt.Sprintf("MODSTATE signed by 0x%X, which is not the leader", m.leader))
+		return moderationIgnored
+	}
+
+	pub := inst.nodeKey(m.leader)
+
+	inst.moderationMutex.Lock()
+	defer inst.moderationMutex.Unlock()
+
+	if m.version <= inst.moderationVersion {
+		return moderationIgnored
+	}
+
+	if pub == nil {
+		if inst.pendingModeration != nil && m.version <= inst.pendingModeration.version {
+			return moderationIgnored
+		}
+
+		inst.pendingModeration = &m
+		return moderationPending
+	}
+
+	if !verifyModeration(pub, m) {
+		inst.warnLog(fmt.Sprintf("MODSTATE version %d has an invalid signature of leader 0x%X", m.version, m.leader))
+		return moderationIgnored
+	}
+
+	newCreatorID := uint64(0)
+	newOperators := make(map[uint64]bool)
+	newBannedIDs := make(map[uint64]bool)
+	newBannedNicks := make(map[string]bool)
+	newMutedIDs := make(map[uint64]bool)
+	newMutedNicks := make(map[string]bool)
+	newBannedKeys := make(map[string]bool)
+	newMutedKeys := make(map[string]bool)
+
+	for _, e := range m.entries {
+		kv := strings.SplitN(e, ":", 2)
+
+		if len(kv) != 2 {
+			inst.debugLog("MODSTATE invalid entry " + e)
+			continue
+		}
+
+		switch kv[0] {
+		case modEntryBannedNick:
+			newBannedNicks[kv[1]] = true
+		case modEntryMutedNick:
+			newMutedNicks[kv[1]] = true
+		case modEntryBannedKey:
+			newBannedKeys[kv[1]] = true
+		case modEntryMutedKey:
+			newMutedKeys[kv[1]] = true
+		default:
+			id, err := stringToID(kv[1])
+
+			if err != nil {
+				inst.debugLog("MODSTATE invalid entry id " + e)
+				continue
+			}
+
+			switch kv[0] {
+			case modEntryCreator:
+				newCreatorID = id
+			case modEntryOperator:
+				newOperators[id] = true
+			case modEntryBannedID:
+				newBannedIDs[id] = true
+			case modEntryMutedID:
+				newMutedIDs[id] = true
+			}
+		}
+	}
+
+	inst.moderationVersion = m.version
+	inst.moderationLeader = m.leader
+	inst.moderationSig = m.sig
+	inst.creatorID = newCreatorID
+	inst.operators = newOperators
+	inst.bannedIDs = newBannedIDs
+	inst.bannedNicks = newBannedNicks
+	inst.mutedIDs = newMutedIDs
+	inst.mutedNicks = newMutedNicks
+	inst.bannedKeys = newBannedKeys
+	inst.mutedKeys = newMutedKeys
+
+	if inst.pendingModeration != nil && inst.pendingModeration.version <= m.version {
+		inst.pendingModeration = nil
+	}
+
+	return moderationApplied
+}
+
+// the pending state was passed on when it arrived, it only has to be applied now
+func (inst *Instance) applyPendingModeration(leader uint64) {
+	inst.moderationMutex.Lock()
+	m := inst.pendingModeration
+	if m == nil || m.leader != leader {
+		inst.moderationMutex.Unlock()
+		return
+	}
+	inst.pendingModeration = nil
+	inst.moderationMutex.Unlock()
+
+	if inst.updateModerationState(*m) == moderationApplied {
+		inst.log(fmt.Sprintf("Applied moderation state version %d once the key of leader 0x%X was proven", m.version, leader))
+	}
+}
+
+func (inst *Instance) replicateModeration() {
+	nextNode := inst.findNodeByRelation(next)
+
+	if nextNode != nil {
+		inst.log(fmt.Sprintf("Sending modstate, target_id=0x%X", nextNode.id))
+		nextNode.sendMessage(inst.moderationStateMessage()...)
+	}
+}
+
+// target is either a nickname, a hex node ID prefixed with 0x or a key fingerprint prefixed with key:,
+// returns the node ID, the nickname and the fingerprint of which only one is set
+func parseModerationTarget(t string) (uint64, string, string) {
+	if strings.HasPrefix(t, "0x") || strings.HasPrefix(t, "0X") {
+		id, err := stringToID(t[2:])
+
+		if err == nil {
+			return id, "", ""
+		}
+	}
+
+	if strings.HasPrefix(t, keyTargetPrefix) && len(t) > len(keyTargetPrefix) {
+		return 0, "", strings.ToLower(t[len(keyTargetPrefix):])
+	}
+
+	return 0, t, ""
+}
+
+func (inst *Instance) kickFollower(n *Node, action string, reason string) {
+	inst.removeChatConnection(n)
+	n.sendMessage(modnotice, action, reason)
+
+	n.lock.Lock()
+	n.setRelation(none)
+	n.lock.Unlock()
+	n.disconnectAfterSending()
+
+	inst.log(fmt.Sprintf("Follower removed (id=0x%X, action=%s), broadcasting updated userlist", n.id, action))
+
+	msg := []string{userlist}
+	msg = append(msg, inst.getConnectedNames()[:]...)
+	inst.broadcastToFollowers(msg[:]...)
+}
+
+// executed by the leader, returns a message for the issuer
+func (inst *Instance) applyModeration(senderID uint64, action string, target string) (string, error) {
+	if action == ModOp || action == ModDeop {
+		inst.moderationMutex.Lock()
+		isCreator := senderID == inst.creatorID
+		inst.moderationMutex.Unlock()
+
+		if !isCreator {
+			return "", errors.New("only the network creator can grant or revoke operator role")
+		}
+	} else if !inst.isOperator(senderID) {
+		return "", errors.New("you are not an operator")
+	}
+
+	id, nick, key := parseModerationTarget(target)
+	targetNode := inst.findChatConnection(id, nick, key)
+
+	if targetNode != nil && id == 0 && (action == ModOp || action == ModDeop) {
+		targetNode.lock.Lock()
+		id = targetNode.id
+		targetNode.lock.Unlock()
+	}
+
+	inst.log(fmt.Sprintf("Applying moderation: sender_id=0x%X, action=%s, target=%s", senderID, action, target))
+
+	inst.moderationMutex.Lock()
+	switch action {
+	case ModKick:
+		inst.moderationMutex.Unlock()
+
+		if targetNode == nil {
+			return "", fmt.Errorf("no such user \"%s\"", target)
+		}
+
+		inst.kickFollower(targetNode, ModKick, "you have been kicked from the chat")
+		return fmt.Sprintf("%s has been kicked", target), nil
+
+	case ModBan:
+		if id != 0 {
+			inst.bannedIDs[id] = true
+		} else if len(key) > 0 {
+			inst.bannedKeys[key] = true
+		} else {
+			inst.bannedNicks[nick] = true
+		}
+
+	case ModUnban:
+		delete(inst.bannedIDs, id)
+		delete(inst.bannedNicks, nick)
+		delete(inst.bannedKeys, key)
+
+	case ModMute:
+		if id != 0 {
+			inst.mutedIDs[id] = true
+		} else if len(key) > 0 {
+			inst.mutedKeys[key] = true
+		} else {
+			inst.mutedNicks[nick] = true
+		}
+
+	case ModUnmute:
+		delete(inst.mutedIDs, id)
+		delete(inst.mutedNicks, nick)
+		delete(inst.mutedKeys, key)
+
+	case ModOp:
+		if id == 0 {
+			inst.moderationMutex.Unlock()
+			return "", fmt.Errorf("no such user \"%s\"", target)
+		}
+		inst.operators[id] = true
+
+	case ModDeop:
+		if id == 0 {
+			inst.moderationMutex.Unlock()
+			return "", fmt.Errorf("no such user \"%s\"", target)
+		}
+		delete(inst.operators, id)
+
+	default:
+		inst.moderationMutex.Unlock()
+		return "", fmt.Errorf("unknown moderation action \"%s\"", action)
+	}
+
+	inst.moderationVersion = inst.advanceTime()
+	inst.moderationMutex.Unlock()
+
+	inst.replicateModeration()
+
+	if targetNode != nil {
+		switch action {
+		case ModBan:
+			inst.kickFollower(targetNode, ModBan, "you have been banned from the chat")
+		case ModMute:
+			targetNode.sendMessage(modnotice, ModMute, "you have been muted")
+		case ModUnmute:
+			targetNode.sendMessage(modnotice, ModUnmute, "you are no longer muted")
+		}
+	}
+
+	return fmt.Sprintf("%s applied to %s", action, target), nil
+}
+
+// called by the user
+func (inst *Instance) Moderate(action string, target string) {
+	if !inst.IsRunning() {
+		inst.userError("you are not connected to any network")
+		return
+	}
+
+	if inst.LeaderID() == inst.getNodeID() {
+		result, err := inst.applyModeration(inst.getNodeID(), action, target)
+
+		if err != nil {
+			inst.userError(err.Error())
+		} else {
+			inst.userEvent(result)
+		}
+		return
+	}
+
+	leaderNode := inst.findNodeByRelation(leader)
+
+	if leaderNode == nil {
+		inst.userError("cannot moderate because you are not connected to the leader")
+		return
+	}
+
+	inst.log(fmt.Sprintf("Sending modcommand, target_id=0x%X, action=%s", leaderNode.id, action))
+	leaderNode.sendMessage(modcommand, action, target)
+}
+
+func (inst *Instance) handleModerationNotice(n *Node, action string, text string) {
+	r, id := n.relationAndID()
+
+	switch action {
+	case ModKick, ModBan:
+		// only the leader removes followers and only the node we are joining through refuses our connect,
+		// the joining node doesn't know the id of that node before netinfo
+		if r == leader {
+			inst.userError(text)
+			inst.LeaveChat()
+		} else if r == prev && id == 0 && inst.NetworkState() == connecting {
+			inst.userError(text)
+			inst.spawn(inst.Disconnect)
+		} else {
+			inst.warnLog(fmt.Sprintf("Ignoring modnotice %s from 0x%X (r=%s)", action, id, r))
+		}
+	case modNoticeError:
+		inst.userError(text)
+	default:
+		inst.userEvent(text)
+	}
+}
+
+func (inst *Instance) ModerationSummary() string {
+	inst.moderationMutex.Lock()
+	defer inst.moderationMutex.Unlock()
+
+	var ops, bans, mutes []string
+
+	for id := range inst.operators {
+		ops = append(ops, fmt.Sprintf("0x%X", id))
+	}
+	for id := range inst.bannedIDs {
+		bans = append(bans, fmt.Sprintf("0x%X", id))
+	}
+	for nick := range inst.bannedNicks {
+		bans = append(bans, nick)
+	}
+	for key := range inst.bannedKeys {
+		bans = append(bans, keyTargetPrefix+key)
+	}
+	for id := range inst.mutedIDs {
+		mutes = append(mutes, fmt.Sprintf("0x%X", id))
+	}
+	for nick := range inst.mutedNicks {
+		mutes = append(mutes, nick)
+	}
+	for key := range inst.mutedKeys {
+		mutes = append(mutes, keyTargetPrefix+key)
+	}
+
+	return fmt.Sprintf("Creator: 0x%X\nOperators: %s\nBanned: %s\nMuted: %s", inst.creatorID,
+		strings.Join(ops, ", "), strings.Join(bans, ", "), strings.Join(mutes, ", "))
+}
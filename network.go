@@ -1,13 +1,10 @@
-package main
+package distrochya
 
 import (
-	"bytes"
-	"encoding/binary"
+	"bufio"
 	"fmt"
-	"math/rand"
 	"net"
 	"strconv"
-	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -16,142 +13,233 @@ type relation string
 
 const (
 	// node relations
-	none     = relation("none")
-	next     = relation("next")
-	prev     = relation("prev")
-	leader   = relation("leader")
-	follower = relation("follower")
+	none        = relation("none")
+	next        = relation("next")
+	prev        = relation("prev")
+	leader      = relation("leader")
+	follower    = relation("follower")
+	relay       = relation("relay")       // our relay (node behind NAT side)
+	relayClient = relation("relayclient") // node behind NAT (relay side)
 
 	// messages
 	// magic;message;params\n
 	sepchar         = ";"
-	magic           = "DISTROCHYA-R1"
-	connect         = "connect"     // params=id;requested_relation;params
-	netinfo         = "netinfo"     // params=node_id;next_id;leader_id
-	closering       = "closering"   // params=sender_id
+	magic           = "DISTROCHYA-R3"
+	challenge       = "challenge"   // params=nonce, first message of both sides of every connection
+	identity        = "identity"    // params=peer;key;signature of nonce;peer, answers the challenge of the dialing side
+	connect         = "connect"     // params=peer;requested_relation;[user];[key;signature of nonce;peer]
+	netinfo         = "netinfo"     // params=node_peer;next_peer;leader_peer;twice_next_peer;observed_addr;network_id;network_name
+	closering       = "closering"   // params=sender_peer
 	election        = "election"    // params=candidate_id
-	elected         = "elected"     // params=leader_id
+	elected         = "elected"     // params=leader_peer
 	userlist        = "userlist"    // params=[users]
 	chatmessage     = "chatmessage" // params=user;message
 	chatmessagesend = "chmsgsend"   // params=message
-	nextinfo        = "nextinfo"    // params=next_id
-	alivecheck      = "alivecheck"  // no params
-	aliveresponse   = "aliveresp"   // no params
+	nextinfo        = "nextinfo"    // params=next_peer
+	alivecheck      = "alivecheck"  // params=[seq]
+	aliveresponse   = "aliveresp"   // params=[seq] of the answered alivecheck
+	relayregister   = "relayreg"    // params=peer
+	relayrequest    = "relayto"     // params=target_id
+	relayconnect    = "relayconn"   // params=token
+	relayaccept     = "relayacc"    // params=token
+	relayok         = "relayok"     // no params
+	announce        = "announce"    // params=network_id;network_name;peer (UDP multicast)
+	modcommand      = "modcmd"      // params=action;target
+	modstate        = "modstate"    // params=version;leader_id;signature of leader_id;version;[entries];[entries]
+	modnotice       = "modnotice"   // params=action;text
+	ringwalk        = "ringwalk"    // params=token;status;origin_peer;[id,next_id,prev_id,leader_id,twice_next_id]
 
 	// network states
 	noNetwork  = "No Network"
+	connecting = "Connecting"
 	singleNode = "Single Node"
 	ring       = "Ring"
-
-	// other
-	ringRepairTimeoutSeconds         = 3
-	sendMessageTimeoutSeconds        = 3
-	leaderElectionTimeoutSeconds     = 5
-	leaderElectionMinimumWaitSeconds = 3
-	leaderElectionMaximumWaitSeconds = 15
-	connectionTimeoutSeconds         = 20
-	connectionTimeoutGraceSeconds    = 5
 )
 
-var networkGlobalsMutex = &sync.Mutex{}
-var networkStateMutex = &sync.Mutex{}
+// tunables of an instance, see DefaultConfig
+type Config struct {
+	RingRepairTimeoutSeconds         int
+	SendMessageTimeoutSeconds        int
+	DialTimeoutSeconds               int
+	LeaderElectionTimeoutSeconds     int
+	LeaderElectionMinimumWaitSeconds int
+	LeaderElectionMaximumWaitSeconds int
+	ConnectionTimeoutSeconds         int
+	ConnectionTimeoutGraceSeconds    int
+	MaxMessageLength                 int
+	ChatRateLimitPerSecond           int
+	ChatRateLimitBurst               int
+	ControlRateLimitPerSecond        int
+	ControlRateLimitBurst            int
+	OutboundQueueLength              int    // messages waiting to be written per connection
+	SlowFollowerPolicy               string // SlowFollowerDisconnect or SlowFollowerDrop
+	KeepaliveIntervalMilliseconds    int    // the failure detector needs several answers per connection timeout to beat it
+	FailureDetectorPhiThreshold      float64
+	DiscoveryAddress                 string // multicast group of network announcements
+	DiscoveryIntervalSeconds         int
+	MaxTraceEntries                  int // how many of the latest trace entries are kept
+}
 
-var server net.Listener
-var networkState = noNetwork
-var nodeID uint64
-var twiceNextNodeID uint64
-var nodes *nodeSyncLinkedList
+func DefaultConfig() Config {
+	return Config{
+		RingRepairTimeoutSeconds:         3,
+		SendMessageTimeoutSeconds:        3,
+		DialTimeoutSeconds:               5,
+		LeaderElectionTimeoutSeconds:     5,
+		LeaderElectionMinimumWaitSeconds: 3,
+		LeaderElectionMaximumWaitSeconds: 15,
+		ConnectionTimeoutSeconds:         20,
+		ConnectionTimeoutGraceSeconds:    5,
+		MaxMessageLength:                 4096,
+		ChatRateLimitPerSecond:           5,
+		ChatRateLimitBurst:               10,
+		ControlRateLimitPerSecond:        50,
+		ControlRateLimitBurst:            100,
+		OutboundQueueLength:              256,
+		SlowFollowerPolicy:               SlowFollowerDisconnect,
+		KeepaliveIntervalMilliseconds:    1000,
+		FailureDetectorPhiThreshold:      8.0,
+		DiscoveryAddress:                 "239.255.77.77:9777",
+		DiscoveryIntervalSeconds:         5,
+		MaxTraceEntries:                  10000,
+	}
+}
 
-var ringBroken uint32 = 0 // atomic, not guarded by mutex
+// tunables are meant to be set before the instance starts or joins a network,
+// connections that already exist may keep using the old values
+func (inst *Instance) SetConfig(c Config) {
+	inst.configMutex.Lock()
+	inst.config = c
+	inst.configMutex.Unlock()
+}
 
-func updateNetworkState(s string) {
-	networkStateMutex.Lock()
-	defer networkStateMutex.Unlock()
-	log("Network state changed to " + s)
-	networkState = s
+func (inst *Instance) Config() Config {
+	inst.configMutex.Lock()
+	defer inst.configMutex.Unlock()
 
+	return inst.config
+}
+
+func (inst *Instance) updateNetworkState(s string) {
+	inst.networkStateMutex.Lock()
+	inst.log("Network state changed to " + s)
+	inst.networkState = s
+	inst.emit(Event{Type: StateChanged, State: s})
+	inst.networkStateMutex.Unlock()
+
+	// taking the leader role connects to ourselves and waits for the challenge, the state can't stay locked
 	if s == singleNode {
-		log("NETWORK STATE CHANGED TO SINGLE NODE, ASSUMING LEADER ROLE")
-		handleNewLeader(nodeID)
-		updateTwiceNextNodeID(0)
+		inst.log("NETWORK STATE CHANGED TO SINGLE NODE, ASSUMING LEADER ROLE")
+		inst.handleNewLeader(inst.getNodeID())
+		inst.updateTwiceNextNodeID(0)
 	}
 }
 
-func getNetworkState() string {
-	networkStateMutex.Lock()
+func (inst *Instance) SetDefaultAddresses(bind string, advertise string) {
+	inst.defaultAddressMutex.Lock()
+	inst.defaultBindAddress = bind
+	inst.defaultAdvertisedAddress = advertise
+	inst.defaultAddressMutex.Unlock()
+}
 
-	rtn := networkState
+func (inst *Instance) DefaultAddresses() (string, string) {
+	inst.defaultAddressMutex.Lock()
+	defer inst.defaultAddressMutex.Unlock()
 
-	networkStateMutex.Unlock()
-	return rtn
+	return inst.defaultBindAddress, inst.defaultAdvertisedAddress
 }
 
-func updateTwiceNextNodeID(id uint64) {
-	atomic.StoreUint64(&twiceNextNodeID, id)
+func (inst *Instance) SetJoinRetryPolicy(attempts int, initial time.Duration, max time.Duration) {
+	inst.joinRetryMutex.Lock()
+	inst.joinRetryAttempts = attempts
+	inst.joinRetryInitialDelay = initial
+	inst.joinRetryMaxDelay = max
+	inst.joinRetryMutex.Unlock()
 }
 
-func getTwiceNextNodeID() uint64 {
-	return atomic.LoadUint64(&twiceNextNodeID)
+func (inst *Instance) JoinRetryAttempts() int {
+	inst.joinRetryMutex.Lock()
+	defer inst.joinRetryMutex.Unlock()
+
+	return inst.joinRetryAttempts
 }
 
-func resetNode() {
-	networkGlobalsMutex.Lock()
-	defer networkGlobalsMutex.Unlock()
+func (inst *Instance) JoinRetryDelays() (time.Duration, time.Duration) {
+	inst.joinRetryMutex.Lock()
+	defer inst.joinRetryMutex.Unlock()
 
-	server = nil
-	nodeID = 0
-	updateTwiceNextNodeID(0)
-	updateLeaderID(0)
-	resetChatConnections()
-	updateUsers(nil)
-	resetConnectedName()
+	return inst.joinRetryInitialDelay, inst.joinRetryMaxDelay
+}
 
-	connectedNodes := nodes.toSlice()
+func (inst *Instance) NetworkState() string {
+	inst.networkStateMutex.Lock()
 
-	for _, node := range connectedNodes {
-		node.disconnect()
-	}
+	rtn := inst.networkState
 
-	nodes = nil
-	updateNetworkState(noNetwork)
+	inst.networkStateMutex.Unlock()
+	return rtn
 }
 
-func initNode(ip uint32, p uint16) {
-	networkGlobalsMutex.Lock()
-	defer networkGlobalsMutex.Unlock()
+func (inst *Instance) updateTwiceNextNodeID(id uint64) {
+	atomic.StoreUint64(&inst.twiceNextNodeID, id)
+}
 
-	resetTime()
-	updateUsers(nil)
+func (inst *Instance) getTwiceNextNodeID() uint64 {
+	return atomic.LoadUint64(&inst.twiceNextNodeID)
+}
 
-	nodeID = createNodeID(ip, p, uint16(rand.Uint32()))
-	updateTwiceNextNodeID(0)
-	nodes = newNodeSyncLinkedList()
+func (inst *Instance) getNodeID() uint64 {
+	return atomic.LoadUint64(&inst.nodeID)
 }
 
-func getIp() uint32 {
-	nicAddrs, err := net.InterfaceAddrs()
+func (inst *Instance) resetNode() {
+	inst.networkGlobalsMutex.Lock()
+	defer inst.networkGlobalsMutex.Unlock()
 
-	if err == nil {
-		for _, nicAddr := range nicAddrs {
-			ip, ok := nicAddr.(*net.IPNet)
-			ipv4 := ip.IP.To4()
+	inst.server = nil
+	inst.serverPort = 0
 
-			if ok && !ip.IP.IsLoopback() && ipv4 != nil {
-				var rtn uint32
-				binary.Read(bytes.NewBuffer(ipv4), binary.BigEndian, &rtn)
-				return rtn
-			}
-		}
+	if inst.joinCancel != nil {
+		close(inst.joinCancel)
+		inst.joinWake.wake()
+		inst.joinCancel = nil
+		inst.joinWake = nil
+	}
+	inst.serverBind = ""
+	inst.advertisedIPs = nil
+	atomic.StoreUint64(&inst.nodeID, 0)
+	inst.updateTwiceNextNodeID(0)
+	inst.updateLeaderID(0)
+	inst.resetChatConnections()
+	inst.updateUsers(nil)
+	inst.resetConnectedName()
+	inst.resetModeration(0)
+	inst.resetEndpoints()
+	inst.resetNodeKeys()
+	inst.resetRelays()
+	inst.setNetworkInfo(0, "")
+
+	connectedNodes := inst.nodes.toSlice()
+
+	for _, node := range connectedNodes {
+		node.disconnect()
 	}
 
-	return 0xFFFFFFFF
+	inst.nodes = nil
+	inst.updateNetworkState(noNetwork)
 }
 
-func idToEndpoint(id uint64) string {
-	port := (id & 0x00000000FFFF0000) >> 16
-	ip := (id & 0xFFFFFFFF00000000) >> 32
+func (inst *Instance) initNode() {
+	inst.networkGlobalsMutex.Lock()
+	defer inst.networkGlobalsMutex.Unlock()
 
-	return fmt.Sprintf("%d.%d.%d.%d:%d", (ip>>24)&0xFF, (ip>>16)&0xFF, (ip>>8)&0xFF, ip&0xFF, port)
+	inst.resetTime()
+	inst.updateUsers(nil)
+	inst.resetEndpoints()
+
+	atomic.StoreUint64(&inst.nodeID, inst.createNodeID())
+	inst.updateTwiceNextNodeID(0)
+	inst.nodes = newNodeSyncLinkedList()
 }
 
 func idToString(id uint64) string {
@@ -162,22 +250,22 @@ func stringToID(s string) (uint64, error) {
 	return strconv.ParseUint(s, 16, 64)
 }
 
-func isNetworkRunning() bool {
-	networkGlobalsMutex.Lock()
-	defer networkGlobalsMutex.Unlock()
+func (inst *Instance) IsRunning() bool {
+	inst.networkGlobalsMutex.Lock()
+	defer inst.networkGlobalsMutex.Unlock()
 
-	return server != nil
+	return inst.server != nil
 }
 
-func broadcastToFollowers(m ...string) {
-	networkGlobalsMutex.Lock()
-	defer networkGlobalsMutex.Unlock()
+func (inst *Instance) broadcastToFollowers(m ...string) {
+	inst.networkGlobalsMutex.Lock()
+	defer inst.networkGlobalsMutex.Unlock()
 
-	if nodes != nil {
-		nodes.lock.Lock()
-		defer nodes.lock.Unlock()
+	if inst.nodes != nil {
+		inst.nodes.lock.Lock()
+		defer inst.nodes.lock.Unlock()
 
-		cn := nodes.head
+		cn := inst.nodes.head
 
 		for cn != nil {
 			cn.data.lock.Lock()
@@ -191,211 +279,372 @@ func broadcastToFollowers(m ...string) {
 	}
 }
 
-func closeRing(oldNextNodeID uint64) {
-	if atomic.LoadUint32(&ringBroken) == 1 {
+func (inst *Instance) closeRing(oldNextNodeID uint64) {
+	if atomic.LoadUint32(&inst.ringBroken) == 1 {
 		return
 	}
 
-	if !isNetworkRunning() {
+	if !inst.IsRunning() {
 		return
 	}
 
-	prevNode := findNodeByRelation(prev)
+	prevNode := inst.findNodeByRelation(prev)
 
 	if prevNode == nil {
-		updateNetworkState(singleNode)
+		inst.updateNetworkState(singleNode)
 	} else {
 		prevNode.lock.Lock()
 
 		if prevNode.id == oldNextNodeID {
 			prevNode.lock.Unlock()
-			updateNetworkState(singleNode)
+			inst.updateNetworkState(singleNode)
 		} else {
-			atomic.StoreUint32(&ringBroken, 1)
+			atomic.StoreUint32(&inst.ringBroken, 1)
+			atomic.AddUint64(&inst.metrics.ringRepairs, 1)
 			prevNode.lock.Unlock()
 
-			twiceNextNodeID := getTwiceNextNodeID()
-			twiceNextNode := connectToNode(idToEndpoint(twiceNextNodeID))
+			twiceNextNodeID := inst.getTwiceNextNodeID()
+			twiceNextNode := inst.connectToNodeID(twiceNextNodeID)
 
 			if twiceNextNode != nil {
 				twiceNextNode.lock.Lock()
-				twiceNextNode.id = twiceNextNodeID
+				twiceNextNode.setID(twiceNextNodeID)
 			} else {
-				log("Connection to twice next node failed")
+				inst.warnLog("Connection to twice next node failed")
 				prevNode.lock.Lock()
 			}
 
-			go func() {
+			inst.spawn(func() {
 				if twiceNextNode == nil {
-					for atomic.LoadUint32(&ringBroken) == 1 && prevNode.connected {
+					for atomic.LoadUint32(&inst.ringBroken) == 1 && prevNode.connected {
 						prevNode.lock.Unlock()
-						log("Broken ring detected with failure to connect to twiceNextNode")
-						log(fmt.Sprintf("Sending closering: target_id=0x%X, sender_id=0x%X", prevNode.id, nodeID))
-						prevNode.sendMessage(closering, idToString(nodeID))
-						time.Sleep(ringRepairTimeoutSeconds * time.Second)
+						inst.warnLog("Broken ring detected with failure to connect to twiceNextNode")
+						inst.log(fmt.Sprintf("Sending closering: target_id=0x%X, sender_id=0x%X", prevNode.id, inst.getNodeID()))
+						prevNode.sendMessage(closering, inst.peerToString(inst.getNodeID()))
+						inst.getClock().Sleep(time.Duration(inst.Config().RingRepairTimeoutSeconds) * time.Second)
 						prevNode.lock.Lock()
 					}
 					prevNode.lock.Unlock()
 				} else {
-					for atomic.LoadUint32(&ringBroken) == 1 && twiceNextNode.connected {
+					for atomic.LoadUint32(&inst.ringBroken) == 1 && twiceNextNode.connected {
 						twiceNextNode.lock.Unlock()
-						log("Broken ring detected with successful connection to twiceNextNode")
-						log(fmt.Sprintf("Sending closering: target_id=0x%X, sender_id=0x%X", twiceNextNodeID, nodeID))
-						twiceNextNode.sendMessage(closering, idToString(nodeID))
-						time.Sleep(ringRepairTimeoutSeconds * time.Second)
+						inst.log("Broken ring detected with successful connection to twiceNextNode")
+						inst.log(fmt.Sprintf("Sending closering: target_id=0x%X, sender_id=0x%X", twiceNextNodeID, inst.getNodeID()))
+						twiceNextNode.sendMessage(closering, inst.peerToString(inst.getNodeID()))
+						inst.getClock().Sleep(time.Duration(inst.Config().RingRepairTimeoutSeconds) * time.Second)
 						twiceNextNode.lock.Lock()
 					}
 					twiceNextNode.lock.Unlock()
 				}
-			}()
+			})
 		}
 	}
 }
 
-func findNodeByRelation(r relation) *Node {
-	networkGlobalsMutex.Lock()
+func (inst *Instance) findNodeByRelation(r relation) *Node {
+	inst.networkGlobalsMutex.Lock()
 
 	var rtn *Node
-	if nodes != nil {
-		rtn = nodes.findSingleByRelation(r)
+	if inst.nodes != nil {
+		rtn = inst.nodes.findSingleByRelation(r)
 	}
 
-	networkGlobalsMutex.Unlock()
+	inst.networkGlobalsMutex.Unlock()
 
 	return rtn
 }
 
-func findNodeByRelationExcludingID(r relation, id uint64) *Node {
-	networkGlobalsMutex.Lock()
+func (inst *Instance) findNodeByRelationExcludingID(r relation, id uint64) *Node {
+	inst.networkGlobalsMutex.Lock()
 
 	var rtn *Node
-	if nodes != nil {
-		rtn = nodes.findSingleByRelationExcludingID(r, id)
+	if inst.nodes != nil {
+		rtn = inst.nodes.findSingleByRelationExcludingID(r, id)
 	}
 
-	networkGlobalsMutex.Unlock()
+	inst.networkGlobalsMutex.Unlock()
 
 	return rtn
 }
 
-func removeNode(n *Node) {
-	networkGlobalsMutex.Lock()
-	defer networkGlobalsMutex.Unlock()
+func (inst *Instance) removeNode(n *Node) {
+	inst.networkGlobalsMutex.Lock()
+	defer inst.networkGlobalsMutex.Unlock()
 
-	if nodes != nil {
-		nodes.remove(n)
+	if inst.nodes != nil {
+		inst.nodes.remove(n)
 	}
 }
 
-func addNode(n *Node) {
-	networkGlobalsMutex.Lock()
-	defer networkGlobalsMutex.Unlock()
+func (inst *Instance) addNode(n *Node) {
+	inst.networkGlobalsMutex.Lock()
+	defer inst.networkGlobalsMutex.Unlock()
 
-	if nodes != nil {
-		nodes.add(n)
+	if inst.nodes != nil {
+		inst.nodes.add(n)
 	}
 }
 
-func createNodeID(i uint32, p uint16, f uint16) uint64 {
-	return uint64(i)<<32 | uint64(p)<<16 | uint64(f)
+// node IDs are opaque, addresses are advertised separately (see endpoints.go)
+func (inst *Instance) createNodeID() uint64 {
+	id := inst.randomUint64()
+
+	for id == 0 {
+		id = inst.randomUint64()
+	}
+
+	return id
 }
 
-func disconnect() {
-	defer updateStatus()
+func (inst *Instance) Disconnect() {
+	defer inst.updateStatus()
 
-	networkGlobalsMutex.Lock()
-	if server == nil {
-		userError("not connected to any network")
-		networkGlobalsMutex.Unlock()
+	inst.networkGlobalsMutex.Lock()
+	if inst.server == nil {
+		inst.userError("not connected to any network")
+		inst.networkGlobalsMutex.Unlock()
 		return
 	}
-	networkGlobalsMutex.Unlock()
+	inst.networkGlobalsMutex.Unlock()
 
-	server.Close()
-	resetNode()
+	inst.server.Close()
+	inst.resetNode()
 
-	userEvent("disconnected")
-	log("Server stopped")
+	inst.userEvent("disconnected")
+	inst.log("Server stopped")
 }
 
-func startServer(p uint16, newNetwork bool, resultChan chan bool) {
-	l, err := net.Listen("tcp4", fmt.Sprintf(":%d", p))
+func (inst *Instance) startServer(p uint16, bind string, advertise string, newNetwork bool, started func(ok bool)) {
+	l, err := inst.getTransport().Listen(net.JoinHostPort(bind, strconv.FormatUint(uint64(p), 10)))
 
 	if err != nil {
-		userError(err.Error())
-		resultChan <- false
+		inst.userError(err.Error())
+		started(false)
 		return
 	}
 
-	resultChan <- true
+	// port 0 means any free port
+	p = listenerPort(l)
+	eps := inst.localEndpoints(p, bind, advertise)
+
+	if relayAddr := inst.RelayAddress(); len(relayAddr) > 0 {
+		eps = append([]string{relayEndpointPrefix + relayAddr}, eps...)
+	}
+
+	inst.setEndpoints(inst.getNodeID(), eps)
+
+	inst.networkGlobalsMutex.Lock()
+	inst.server = l
+	inst.serverPort = p
+	inst.serverBind = bind
+	inst.networkGlobalsMutex.Unlock()
 
-	networkGlobalsMutex.Lock()
-	server = l
-	networkGlobalsMutex.Unlock()
+	// waits for DNS rather than for other goroutines, so a simulation clock doesn't wait for it
+	go inst.resolveAdvertisedEndpoints(l, eps)
 
-	log(fmt.Sprintf("Server started, listening on port %d. nodeID=0x%X", p, nodeID))
-	userEvent(fmt.Sprintf("listening on port %d", p))
+	// dialing a node waits for its challenge, so connections have to be accepted before we may connect to ourselves
+	inst.spawn(func() { inst.acceptConnections(l) })
+
+	inst.registerWithRelay()
+	started(true)
+
+	inst.log(fmt.Sprintf("Server started, listening on port %d. nodeID=0x%X, endpoints=%s", p, inst.getNodeID(), inst.endpointsToString(inst.getNodeID())))
+	inst.userEvent(fmt.Sprintf("listening on port %d", p))
 
 	if newNetwork {
-		updateNetworkState(singleNode)
+		inst.updateNetworkState(singleNode)
 	}
 
-	// incoming connections
-	for server != nil {
-		c, err := server.Accept()
+	inst.spawn(func() { inst.announceNetwork(l) })
+}
+
+// runs the server and waits until it is listening, returns false if it couldn't start
+func (inst *Instance) runServer(p uint16, bind string, advertise string, newNetwork bool) bool {
+	resultChan := make(chan bool)
+	w := newWaiter(inst.getClock())
+
+	inst.spawn(func() {
+		inst.startServer(p, bind, advertise, newNetwork, func(ok bool) {
+			resultChan <- ok
+			w.wake()
+		})
+	})
+
+	w.block(nothingPending)
+	return <-resultChan
+}
+
+// incoming connections
+func (inst *Instance) acceptConnections(l net.Listener) {
+	for {
+		c, err := l.Accept()
 
 		if err != nil {
-			debugLog("Server error: " + err.Error())
+			inst.debugLog("Server error: " + err.Error())
 			return
 		}
 
-		n := nodeFromConnection(c)
-		go n.handleConnection()
+		n := inst.acceptNode(c, bufio.NewReaderSize(c, inst.Config().MaxMessageLength))
+		inst.spawn(n.handleConnection)
 	}
 }
 
-func startNetwork(p uint16) {
-	defer updateStatus()
+func (inst *Instance) Start(p uint16, bind string, advertise string) {
+	defer inst.updateStatus()
 
-	if isNetworkRunning() {
-		userError("already connected")
+	if inst.IsRunning() {
+		inst.userError("already connected")
 		return
 	}
 
-	serverStartResultChan := make(chan bool)
+	inst.initNode()
+	inst.resetModeration(inst.getNodeID())
+	inst.setNetworkInfo(inst.createNodeID(), inst.DefaultNetworkName())
 
-	initNode(getIp(), p)
-	go startServer(p, true, serverStartResultChan)
+	if !inst.runServer(p, bind, advertise, true) {
+		inst.resetNode()
+	}
+}
 
-	if !<-serverStartResultChan {
-		resetNode()
+// exponential backoff with equal jitter, attempt is 1-based
+func (inst *Instance) joinRetryDelay(attempt int) time.Duration {
+	initial, max := inst.JoinRetryDelays()
+	delay := initial
+
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
 	}
+
+	if delay < 2 {
+		return delay
+	}
+
+	return delay/2 + time.Duration(inst.randomInt63n(int64(delay/2)))
 }
 
-func joinNetwork(a string, p uint16) {
-	if isNetworkRunning() {
-		userError("already connected")
-		return
+// seeds are tried in order, the whole list is retried with backoff; returns false if the remote network couldn't be reached
+// attempt of the running join, 0 when not joining
+func (inst *Instance) JoinAttempt() int {
+	return int(atomic.LoadUint32(&inst.joinAttempt))
+}
+
+func joinCancelled(cancel chan struct{}) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+		return false
 	}
+}
 
-	serverStartResultChan := make(chan bool)
+// returns false if the join was cancelled before d passed
+func (inst *Instance) waitToRetry(cancel chan struct{}, wake *waiter, d time.Duration) bool {
+	retry := make(chan struct{})
+	t := inst.getClock().AfterFunc(d, func() {
+		close(retry)
+		wake.wake()
+	})
+
+	wake.block(func() bool { return joinCancelled(cancel) || joinCancelled(retry) })
+
+	select {
+	case <-retry:
+		return true
+	case <-cancel:
+		t.Stop()
+		return false
+	}
+}
 
-	initNode(getIp(), p)
-	go startServer(p, false, serverStartResultChan)
+func (inst *Instance) Join(seeds []string, p uint16, bind string, advertise string) bool {
+	if inst.IsRunning() {
+		inst.userError("already connected")
+		return false
+	}
 
-	if <-serverStartResultChan {
-		node := connectToNode(a)
+	if len(seeds) == 0 {
+		inst.userError("no address to connect to")
+		return false
+	}
 
-		if node == nil {
-			disconnect()
-			userError("Failed to connect to the remote network")
-			return
+	inst.initNode()
+	inst.resetModeration(0)
+
+	if !inst.runServer(p, bind, advertise, false) {
+		inst.resetNode()
+		return false
+	}
+
+	cancel := make(chan struct{})
+	wake := newWaiter(inst.getClock())
+
+	inst.networkGlobalsMutex.Lock()
+	inst.joinCancel = cancel
+	inst.joinWake = wake
+	inst.networkGlobalsMutex.Unlock()
+
+	defer atomic.StoreUint32(&inst.joinAttempt, 0)
+
+	attempts := inst.JoinRetryAttempts()
+	inst.updateNetworkState(connecting)
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		atomic.StoreUint32(&inst.joinAttempt, uint32(attempt))
+		inst.updateStatus()
+
+		if attempt > 1 {
+			inst.userEvent(fmt.Sprintf("connecting (attempt %d of %d)", attempt, attempts))
 		}
-		node.r = prev
 
-		log(fmt.Sprintf("Sending connect message: address=%s, my_id=0x%X, r=%s", a, nodeID, none))
-		node.sendMessage(connect, idToString(nodeID), string(none))
-	} else {
-		resetNode()
+		for _, a := range seeds {
+			c, err := inst.dial(a)
+
+			if err != nil {
+				inst.warnLog(fmt.Sprintf("Connection to %s failed (attempt %d): %s", a, attempt, err.Error()))
+				continue
+			}
+
+			// disconnected while connecting
+			if joinCancelled(cancel) {
+				c.Close()
+				return false
+			}
+
+			node, err := inst.openNode(c, bufio.NewReaderSize(c, inst.Config().MaxMessageLength))
+
+			if err != nil {
+				c.Close()
+				inst.warnLog(fmt.Sprintf("Connection to %s failed (attempt %d): %s", a, attempt, err.Error()))
+				continue
+			}
+
+			node.setRelation(prev)
+			inst.spawn(node.handleConnection)
+
+			inst.log(fmt.Sprintf("Sending connect message: address=%s, my_id=0x%X, r=%s", a, inst.getNodeID(), none))
+			node.sendMessage(node.connectMessage(none, "")...)
+			return true
+		}
+
+		if joinCancelled(cancel) {
+			return false
+		}
+
+		if attempt < attempts {
+			delay := inst.joinRetryDelay(attempt)
+			inst.log(fmt.Sprintf("Retrying connection in %s", delay))
+
+			if !inst.waitToRetry(cancel, wake, delay) {
+				return false
+			}
+		}
 	}
+
+	inst.Disconnect()
+	inst.userError("Failed to connect to the remote network")
+	return false
 }
@@ -0,0 +1,211 @@
+package distrochya
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCloseRingWithoutPrev(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.listen(t)
+	ti.updateNetworkState(ring)
+
+	ti.closeRing(0x3000)
+
+	if s := ti.NetworkState(); s != singleNode {
+		t.Errorf("state %q, want %q", s, singleNode)
+	}
+}
+
+func TestCloseRingOfTwo(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.listen(t)
+	ti.updateNetworkState(ring)
+	ti.peer(t, prev, 0x3000)
+
+	// the lost next was our prev as well
+	ti.closeRing(0x3000)
+
+	if s := ti.NetworkState(); s != singleNode {
+		t.Errorf("state %q, want %q", s, singleNode)
+	}
+}
+
+func TestCloseRingThroughTwiceNext(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.listen(t)
+	ti.updateNetworkState(ring)
+	_, prevPeer := ti.peer(t, prev, 0x5000)
+	l, a := ti.remoteNode(t, "third")
+	defer l.Close()
+
+	ti.setEndpoints(0x4000, []string{a})
+	ti.updateTwiceNextNodeID(0x4000)
+
+	ti.closeRing(0x3000)
+
+	p := acceptPeer(t, l)
+	p.expect(t, challenge)
+
+	if id := peerID(p.expect(t, closering)[0]); id != testNodeID {
+		t.Errorf("closering sender 0x%X, want own id", id)
+	}
+
+	prevPeer.expectSilence(t)
+
+	// resent until the ring is closed
+	ti.clock.advance(time.Duration(ti.Config().RingRepairTimeoutSeconds) * time.Second)
+	p.expect(t, closering)
+
+	atomic.StoreUint32(&ti.ringBroken, 0)
+	ti.clock.advance(time.Duration(ti.Config().RingRepairTimeoutSeconds) * time.Second)
+	p.expectSilence(t)
+}
+
+func TestCloseRingThroughPrev(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.listen(t)
+	ti.updateNetworkState(ring)
+	_, prevPeer := ti.peer(t, prev, 0x5000)
+	ti.updateTwiceNextNodeID(0x4000)
+
+	// twice next has no known address
+	ti.closeRing(0x3000)
+
+	if id := peerID(prevPeer.expect(t, closering)[0]); id != testNodeID {
+		t.Errorf("closering sender 0x%X, want own id", id)
+	}
+
+	if atomic.LoadUint32(&ti.ringBroken) != 1 {
+		t.Error("ring not marked as broken")
+	}
+
+	// already being repaired
+	ti.closeRing(0x3000)
+	prevPeer.expectSilence(t)
+
+	atomic.StoreUint32(&ti.ringBroken, 0)
+	ti.clock.advance(time.Duration(ti.Config().RingRepairTimeoutSeconds) * time.Second)
+}
+
+func TestJoinRetryDelay(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.SetJoinRetryPolicy(5, 100*time.Millisecond, time.Second)
+
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{10, time.Second},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if d := ti.joinRetryDelay(tt.attempt); d < tt.max/2 || d >= tt.max {
+				t.Errorf("attempt %d: delay %s outside [%s, %s)", tt.attempt, d, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestCheckObservedAddress(t *testing.T) {
+	ti := newTestInstance(t)
+
+	// not resolved yet, nothing to compare against
+	ti.checkObservedAddress("192.0.2.1")
+
+	ti.advertisedIPs = []net.IP{net.ParseIP("192.0.2.1")}
+	ti.checkObservedAddress("192.0.2.1")
+
+	if e := ti.events.ofType(Notice); len(e) != 0 {
+		t.Errorf("warned about an advertised address: %v", e)
+	}
+
+	ti.checkObservedAddress("192.0.2.2")
+
+	if e := ti.events.ofType(Notice); len(e) != 1 {
+		t.Errorf("notices %v, want a warning about the observed address", e)
+	}
+}
+
+func TestTCPDialFromBindAddress(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	c, err := TCPTransport{}.Dial("127.0.0.1", l.Addr().String(), time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if ip := c.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("dialed from %s, want the bind address", ip)
+	}
+}
+
+func TestDiscoveredNetworksExpire(t *testing.T) {
+	ti := newTestInstance(t)
+
+	ti.processAnnouncement(ti.formatMessage(announce, idToString(0x7000), "lobby", testPeerToken(0x3000, "x:1")))
+
+	if n := ti.DiscoveredNetworks(); len(n) != 1 || n[0].Name != "lobby" || n[0].LastSeen != ti.clock.Now() {
+		t.Fatalf("discovered %+v", n)
+	}
+
+	ti.clock.advance(time.Duration(discoveryExpirationIntervals*ti.Config().DiscoveryIntervalSeconds+1) * time.Second)
+
+	if n := ti.DiscoveredNetworks(); len(n) != 0 {
+		t.Errorf("discovered %+v after it wasn't announced for a while", n)
+	}
+}
+
+func TestDisconnectStopsJoinBackoff(t *testing.T) {
+	ti := newTestInstance(t)
+	done := make(chan bool)
+
+	go func() {
+		done <- ti.Join([]string{"nowhere:1"}, 0, "", "")
+	}()
+
+	waitFor(t, testReadWait, "retry backoff", func() bool {
+		for _, e := range ti.events.ofType(Log) {
+			if strings.HasPrefix(e.Text, "Retrying connection") {
+				return true
+			}
+		}
+
+		return false
+	})
+
+	if s := ti.Snapshot(); s.State != connecting || s.JoinAttempt != 1 {
+		t.Errorf("state %q, attempt %d", s.State, s.JoinAttempt)
+	}
+
+	ti.Disconnect()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("join succeeded")
+		}
+	case <-time.After(testReadWait):
+		t.Fatal("join still waiting after disconnect")
+	}
+
+	if a := ti.JoinAttempt(); a != 0 {
+		t.Errorf("attempt %d after the join stopped", a)
+	}
+}
@@ -1,11 +1,11 @@
-package main
+package distrochya
 
 import (
 	"bufio"
-	"bytes"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"net"
-	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -13,41 +13,102 @@ import (
 )
 
 type Node struct {
+	inst       *Instance
 	id         uint64
 	r          relation
 	connection net.Conn
+	reader     *bufio.Reader // of connection, may hold data read before the node was created
 	connected  bool
 	lock       *sync.Mutex
-	kat        *time.Timer
+	kat        Timer
 	katLock    *sync.Mutex
+	chatRate   *tokenBucket
+	ctrlRate   *tokenBucket
+	detached   bool
+	infoLock   *sync.Mutex // guards id and r for readers that don't hold lock
+	delay      int64       // atomic, injected delay of received messages in ns
+	blackholed uint32      // atomic, injected loss of all messages
+	key        string      // fingerprint of the identity key proven in connect, guarded by infoLock
+
+	challenge     string // nonce we opened the connection with
+	peerChallenge string // nonce the other side opened the connection with, signed in our connect or identity
+
+	aliveSeq     uint64               // of the last sent alivecheck
+	alivePending map[uint64]time.Time // send times of unanswered alivechecks by seq
+	rtt          time.Duration        // smoothed keepalive RTT, 0 until measured
+	detector     phiDetector
+
+	outbox      chan outboundMessage // drained by writeLoop
+	stopWriting chan struct{}        // closed once the writer has to stop
+	stopOnce    *sync.Once
+	writerDone  chan struct{} // closed when writeLoop returns
+	writerWake  *waiter       // woken by everything handed to writeLoop
 }
 
+// closes the connection right away, messages still in the queue are discarded
 func (n *Node) disconnect() {
-	n.connection.SetDeadline(time.Now())
+	n.stopWriter()
+	n.connection.SetDeadline(n.inst.getClock().Now())
 	n.connection.Close()
 }
 
-func (n *Node) sendMessage(m ...string) {
-	msg := fmt.Sprintf("%s%s%d", magic, sepchar, advanceTime())
+// stops processing messages from the connection without closing it, used when handing the connection over
+func (n *Node) detach() {
+	n.lock.Lock()
+	n.detached = true
+	n.lock.Unlock()
+
+	// nothing may be written by the node once the connection belongs to someone else
+	n.stopWriter()
+	<-n.writerDone
+}
+
+func (inst *Instance) formatMessage(m ...string) string {
+	msg, _ := inst.stampMessage(m...)
+	return msg
+}
+
+// formatted message and the logical time it carries
+func (inst *Instance) stampMessage(m ...string) (string, uint64) {
+	t := inst.advanceTime()
+	msg := fmt.Sprintf("%s%s%d", magic, sepchar, t)
 
 	for _, s := range m {
 		msg += sepchar + s
 	}
 
-	debugLog("SEND: ==" + msg + "== (" + idToString(n.id) + ")")
-	n.connection.SetWriteDeadline(time.Now().Add(sendMessageTimeoutSeconds * time.Second))
-	_, err := n.connection.Write([]byte(msg + "\n"))
+	return msg + "\n", t
+}
+
+// queues the message for the writer of the connection, never blocks
+func (n *Node) sendMessage(m ...string) {
+	msg, t := n.inst.stampMessage(m...)
+
+	if n.isBlackholed() {
+		n.traceMessage(TraceSend, t, t, m, "blackholed")
+		n.logAt(LogDebug, m[0], "BLACKHOLED SEND: =="+strings.TrimSpace(msg)+"==")
+		return
+	}
+
+	if n.writerStopped() {
+		n.traceMessage(TraceSend, t, t, m, "connection closed")
+		n.logAt(LogDebug, m[0], "SEND ON CLOSED CONNECTION: =="+strings.TrimSpace(msg)+"==")
+		return
+	}
 
-	if err != nil {
-		debugLog(fmt.Sprintf("WRITE ERR: 0x%X: %s", n.id, err.Error()))
-		n.disconnect()
+	select {
+	case n.outbox <- outboundMessage{kind: m[0], data: []byte(msg)}:
+		n.writerWake.wake()
+		n.traceMessage(TraceSend, t, t, m, "")
+		n.logAt(LogDebug, m[0], "SEND: =="+strings.TrimSpace(msg)+"==")
+		n.inst.countMessageSent(m[0])
+	default:
+		n.handleFullOutbox(m, t)
 	}
-	var zeroTime time.Time
-	n.connection.SetWriteDeadline(zeroTime)
 }
 
 func (n *Node) handleDisconnect() {
-	defer updateStatus()
+	defer n.inst.updateStatus()
 
 	n.lock.Lock()
 	n.connected = false
@@ -60,154 +121,344 @@ func (n *Node) handleDisconnect() {
 
 	n.lock.Unlock()
 
-	removeNode(n)
+	n.stopWriter()
+	n.inst.removeNode(n)
 
 	if r == next {
-		closeRing(id)
-
-		if id == getLeaderID() || id == getOldLeaderID() {
-			if getNetworkState() == ring {
-				log("Detected leader node disconnect from r=next")
-				updateLeaderID(0)
-				setElectionStartTriggerFlag()
-				log("Election start trigger flag set")
+		n.inst.closeRing(id)
+
+		if id == n.inst.LeaderID() || id == n.inst.getOldLeaderID() {
+			if n.inst.NetworkState() == ring {
+				n.log("", "Detected leader node disconnect from r=next")
+				n.inst.updateLeaderID(0)
+				n.inst.setElectionStartTriggerFlag()
+				n.log("", "Election start trigger flag set")
 			}
 		}
+	} else if r == prev {
+		// the ring repair waits for its closering to come around through prev, without next and prev it never does
+		if atomic.LoadUint32(&n.inst.ringBroken) == 1 && n.inst.findNodeByRelation(next) == nil && n.inst.findNodeByRelation(prev) == nil {
+			n.logAt(LogWarn, "", "Prev lost while repairing the ring, falling back to single node")
+			atomic.StoreUint32(&n.inst.ringBroken, 0)
+			n.inst.updateNetworkState(singleNode)
+		}
 	} else if r == leader {
-		if getNetworkState() == ring {
-			log("Leader lost!")
-			updateLeaderID(0)
+		if n.inst.NetworkState() == ring {
+			n.logAt(LogWarn, "", "Leader lost!")
+			n.inst.updateLeaderID(0)
 		}
 	} else if r == follower {
-		removeChatConnection(n)
-		log(fmt.Sprintf("Follower lost (id=0x%X), broadcasting updated userlist", n.id))
+		n.inst.removeChatConnection(n)
+		n.log("", fmt.Sprintf("Follower lost (id=0x%X), broadcasting updated userlist", n.id))
 
 		msg := []string{userlist}
-		msg = append(msg, getConnectedNames()[:]...)
-		broadcastToFollowers(msg[:]...)
+		msg = append(msg, n.inst.getConnectedNames()[:]...)
+		n.inst.broadcastToFollowers(msg[:]...)
+	} else if r == relayClient {
+		n.inst.removeRelayClient(n)
+		n.log("", fmt.Sprintf("Relay client lost (id=0x%X)", id))
+	} else if r == relay {
+		n.logAt(LogWarn, "", "Connection to relay lost")
+		n.inst.userError("connection to relay lost, other nodes may be unable to connect to you")
+
+		n.inst.getClock().AfterFunc(time.Duration(n.inst.Config().DialTimeoutSeconds)*time.Second, func() {
+			if n.inst.IsRunning() {
+				n.inst.registerWithRelay()
+			}
+		})
 	}
 }
 
-func (n *Node) processConnectMessage(params []string) {
+func (n *Node) processConnectMessage(c connectMessage) {
 	n.lock.Lock()
 	defer n.lock.Unlock()
 
 	if n.r == none {
-		n.r = next
+		if n.inst.isBanned(n.id, "", c.key) {
+			n.log(connect, fmt.Sprintf("Refusing connection from banned node, id=0x%X", n.id))
+			n.sendMessage(modnotice, ModBan, "you are banned from this network")
+			n.disconnectAfterSending()
+			return
+		}
 
-		oldNext := findNodeByRelationExcludingID(next, n.id)
+		if len(c.key) == 0 && n.inst.requiresKey() {
+			n.log(connect, fmt.Sprintf("Refusing connection without identity key, id=0x%X", n.id))
+			n.sendMessage(modnotice, ModBan, "this network only accepts nodes with an identity key")
+			n.disconnectAfterSending()
+			return
+		}
+
+		n.setRelation(next)
+
+		oldNext := n.inst.findNodeByRelationExcludingID(next, n.id)
+		observedAddr, _, _ := net.SplitHostPort(n.connection.RemoteAddr().String())
+		netID, netName := n.inst.NetworkInfo()
 
 		if oldNext == nil {
-			log(fmt.Sprintf("New connection with r=none (id=0x%X), sending netinfo my_id=0x%X, next_id=0x%X (no existing nextnode found), leader_id=0x%X, twice_next_node_id=0x%X", n.id, nodeID, nodeID, getLeaderID(), n.id))
-			n.sendMessage(netinfo, idToString(nodeID), idToString(nodeID), idToString(getLeaderID()), idToString(n.id))
-			updateNetworkState(ring)
-			updateTwiceNextNodeID(nodeID)
+			n.log(connect, fmt.Sprintf("New connection with r=none (id=0x%X), sending netinfo my_id=0x%X, next_id=0x%X (no existing nextnode found), leader_id=0x%X, twice_next_node_id=0x%X", n.id, n.inst.getNodeID(), n.inst.getNodeID(), n.inst.LeaderID(), n.id))
+			n.sendMessage(netinfo, n.inst.peerToString(n.inst.getNodeID()), n.inst.peerToString(n.inst.getNodeID()), n.inst.peerToString(n.inst.LeaderID()), n.inst.peerToString(n.id), observedAddr, idToString(netID), netName)
+			n.inst.updateNetworkState(ring)
+			n.inst.updateTwiceNextNodeID(n.inst.getNodeID())
 		} else {
-			log(fmt.Sprintf("New next connection while in ring, closing oldNext; old_next_id=0x%X, new_next_id=0x%X", oldNext.id, n.id))
-			oldTwiceNextNodeID := getTwiceNextNodeID()
+			n.log(connect, fmt.Sprintf("New next connection while in ring, closing oldNext; old_next_id=0x%X, new_next_id=0x%X", oldNext.id, n.id))
+			oldTwiceNextNodeID := n.inst.getTwiceNextNodeID()
 			oldNext.lock.Lock()
-			oldNext.r = none
-			updateTwiceNextNodeID(oldNext.id)
+			oldNext.setRelation(none)
+			n.inst.updateTwiceNextNodeID(oldNext.id)
 			oldNext.lock.Unlock()
 			oldNext.disconnect()
 
-			log(fmt.Sprintf("New connection with r=none (id=0x%X), sending netinfo my_id=0x%X, next_id=0x%X, leader_id=0x%X, twice_next_node_id=0x%X", n.id, nodeID, oldNext.id, getLeaderID(), oldTwiceNextNodeID))
-			n.sendMessage(netinfo, idToString(nodeID), idToString(oldNext.id), idToString(getLeaderID()), idToString(oldTwiceNextNodeID))
+			n.log(connect, fmt.Sprintf("New connection with r=none (id=0x%X), sending netinfo my_id=0x%X, next_id=0x%X, leader_id=0x%X, twice_next_node_id=0x%X", n.id, n.inst.getNodeID(), oldNext.id, n.inst.LeaderID(), oldTwiceNextNodeID))
+			n.sendMessage(netinfo, n.inst.peerToString(n.inst.getNodeID()), n.inst.peerToString(oldNext.id), n.inst.peerToString(n.inst.LeaderID()), n.inst.peerToString(oldTwiceNextNodeID), observedAddr, idToString(netID), netName)
 		}
 
-		prevNode := findNodeByRelation(prev)
+		n.inst.scheduleStateSave()
+
+		n.log(connect, fmt.Sprintf("Sending modstate to new next, target_id=0x%X", n.id))
+		n.sendMessage(n.inst.moderationStateMessage()...)
+
+		prevNode := n.inst.findNodeByRelation(prev)
 
 		if prevNode != nil {
 			prevNode.lock.Lock()
-			log(fmt.Sprintf("New next connection, sending nextinfo to my prev, target_id=0x%X, next_id=0x%X", prevNode.id, n.id))
+			n.log(connect, fmt.Sprintf("New next connection, sending nextinfo to my prev, target_id=0x%X, next_id=0x%X", prevNode.id, n.id))
 			prevNode.lock.Unlock()
-			prevNode.sendMessage(nextinfo, idToString(n.id))
+			prevNode.sendMessage(nextinfo, n.inst.peerToString(n.id))
 		}
 	} else if n.r == prev {
 	} else if n.r == next {
-		atomic.StoreUint32(&ringBroken, 0)
+		atomic.StoreUint32(&n.inst.ringBroken, 0)
 
-		log("Ring repaired (side missing next)")
+		n.log(connect, "Ring repaired (side missing next)")
 
-		prevNode := findNodeByRelation(prev)
+		prevNode := n.inst.findNodeByRelation(prev)
 		if prevNode == nil {
-			panic("ring repaired (side missing next) without having prevNode")
+			n.logAt(LogWarn, connect, "Ring repaired (side missing next) without having prevNode, not sending nextinfo")
+		} else {
+			n.log(connect, fmt.Sprintf("Ring repaired (new next), sending nextinfo to my prev, target_id=0x%X, next_id=0x%X", prevNode.id, n.id))
+			prevNode.sendMessage(nextinfo, n.inst.peerToString(n.id))
 		}
-		log(fmt.Sprintf("Ring repaired (new next), sending nextinfo to my prev, target_id=0x%X, next_id=0x%X", prevNode.id, n.id))
-		prevNode.sendMessage(nextinfo, idToString(n.id))
 
-		if isElectionStartTriggerFlagSet() {
-			log("Detected set election start trigger - starting leader election")
-			resetElectionStartTriggerFlag()
-			startElectionTimer(0)
+		if n.inst.isElectionStartTriggerFlagSet() {
+			n.log(connect, "Detected set election start trigger - starting leader election")
+			n.inst.resetElectionStartTriggerFlag()
+			n.inst.startElectionTimer(0)
 		}
 	} else if n.r == follower {
-		addChatConnection(n, params[0])
-		log(fmt.Sprintf("New connection with r=follower (id=0x%X), broadcasting updated userlist", n.id))
+		if n.inst.isBanned(n.id, c.user, c.key) {
+			n.log(connect, fmt.Sprintf("Refusing follower connection from banned user (id=0x%X, user=%s)", n.id, c.user))
+			n.sendMessage(modnotice, ModBan, "you are banned from this chat")
+			n.setRelation(none)
+			n.disconnectAfterSending()
+			return
+		}
+
+		if len(c.key) == 0 && n.inst.requiresKey() {
+			n.log(connect, fmt.Sprintf("Refusing follower connection without identity key (id=0x%X, user=%s)", n.id, c.user))
+			n.sendMessage(modnotice, ModBan, "this chat only accepts users with an identity key")
+			n.setRelation(none)
+			n.disconnectAfterSending()
+			return
+		}
+
+		n.inst.addChatConnection(n, c.user)
+		n.log(connect, fmt.Sprintf("New connection with r=follower (id=0x%X), broadcasting updated userlist", n.id))
 
 		msg := []string{userlist}
-		msg = append(msg, getConnectedNames()[:]...)
+		msg = append(msg, n.inst.getConnectedNames()[:]...)
 		n.lock.Unlock()
-		broadcastToFollowers(msg[:]...)
+		n.inst.broadcastToFollowers(msg[:]...)
 		n.lock.Lock()
-	} else {
-		panic("invalid connection request")
 	}
 }
 
 func (n *Node) handleConnection() {
 	var zeroTime time.Time
 
-	addNode(n)
+	n.inst.addNode(n)
 
-	log(fmt.Sprintf("New connection (%s -> %s)", n.connection.LocalAddr().String(), n.connection.RemoteAddr().String()))
+	n.log("", fmt.Sprintf("New connection (%s -> %s)", n.connection.LocalAddr().String(), n.connection.RemoteAddr().String()))
 
-	r := bufio.NewReader(n.connection)
+	config := n.inst.Config()
+	r := n.reader
 
 	n.resetKeepAliveTimer()
 
 	for n.connected {
-		updateStatus()
+		n.inst.updateStatus()
 
-		n.connection.SetReadDeadline(time.Now().Add((connectionTimeoutSeconds + connectionTimeoutGraceSeconds) * time.Second))
-		data, err := r.ReadString('\n')
+		n.connection.SetReadDeadline(n.inst.getClock().Now().Add(time.Duration(config.ConnectionTimeoutSeconds+config.ConnectionTimeoutGraceSeconds) * time.Second))
+		line, err := r.ReadSlice('\n')
 		n.connection.SetReadDeadline(zeroTime)
 
+		if err == bufio.ErrBufferFull {
+			n.logAt(LogWarn, "", fmt.Sprintf("Message from client 0x%X exceeds %d bytes, disconnecting", n.id, config.MaxMessageLength))
+			n.disconnect()
+			n.handleDisconnect()
+			return
+		}
+
 		if err != nil {
-			log(fmt.Sprintf("Client 0x%X disconnected, r=%s", n.id, n.r))
-			debugLog(fmt.Sprintf("READ ERR: 0x%X: %s", n.id, err.Error()))
+			n.log("", fmt.Sprintf("Client 0x%X disconnected, r=%s", n.id, n.r))
+			n.logAt(LogDebug, "", "READ ERR: "+err.Error())
 
 			n.handleDisconnect()
 			return
 		}
-		data = strings.TrimSpace(data)
+		data := strings.TrimSpace(string(line))
+
+		if n.isBlackholed() {
+			n.logAt(LogDebug, "", "BLACKHOLED RECV: =="+data+"==")
+			continue
+		}
+
+		if d := n.getDelay(); d > 0 {
+			n.inst.getClock().Sleep(d)
+		}
+
+		if !n.allowMessage(data) {
+			n.disconnect()
+			n.logAt(LogWarn, "", fmt.Sprintf("Client 0x%X exceeded rate limit, disconnecting", n.id))
+			continue
+		}
 
 		if !n.processMessage(data) {
 			n.disconnect()
-			log(fmt.Sprintf("Invalid message from client 0x%X, disconnecting", n.id))
-			log("IMSG: " + data)
+			n.logAt(LogWarn, "", fmt.Sprintf("Invalid message from client 0x%X, disconnecting", n.id))
+			n.logAt(LogWarn, "", "IMSG: "+data)
 		}
 
-		debugLog("RECV: ==" + data + "== (" + idToString(n.id) + ")")
+		n.lock.Lock()
+		detached := n.detached
+		n.lock.Unlock()
+
+		if detached {
+			n.lock.Lock()
+			n.connected = false
+			if n.kat != nil {
+				n.kat.Stop()
+			}
+			n.lock.Unlock()
+
+			n.inst.removeNode(n)
+			return
+		}
+
+		n.logAt(LogDebug, "", "RECV: =="+data+"==")
 	}
 
 	n.handleDisconnect()
 }
 
+// forwarded around the ring, a burst of them is the ring doing its job rather than a flood
+var ringMessages = map[string]bool{closering: true, election: true, elected: true, nextinfo: true, modstate: true, ringwalk: true}
+
+// returns false if the message exceeds the rate limit of this connection, broadcasts of the leader
+// and ring messages from the neighbours are never limited
+func (n *Node) allowMessage(m string) bool {
+	msg := strings.SplitN(m, sepchar, 4)
+
+	if len(msg) < 3 {
+		return n.ctrlRate.take()
+	}
+
+	if r, _ := n.relationAndID(); r == leader || ((r == prev || r == next) && ringMessages[msg[2]]) {
+		return true
+	}
+
+	if msg[2] == chatmessagesend {
+		return n.chatRate.take()
+	}
+
+	return n.ctrlRate.take()
+}
+
+// only the latest alivechecks wait for an answer, older ones are forgotten
+const maxPendingAliveChecks = 16
+
 func (n *Node) keepAlive() {
 	n.lock.Lock()
 
-	if n.connected && (n.r == next || n.r == leader) {
+	if n.connected && (n.r == next || n.r == leader || n.r == relay) {
+		now := n.inst.getClock().Now()
+
+		// the read deadline in handleConnection stays as the fallback for peers without enough samples
+		if n.r == next || n.r == leader {
+			config := n.inst.Config()
+
+			if phi := n.detector.phi(now, config.keepaliveInterval()/4); phi > config.FailureDetectorPhiThreshold {
+				n.lock.Unlock()
+				n.logAt(LogWarn, alivecheck, fmt.Sprintf("No aliveresponse from 0x%X for %s (phi %.1f), declaring it dead", n.id, now.Sub(n.detector.last).Round(time.Millisecond), phi))
+				n.disconnect()
+				return
+			}
+		}
+
+		if n.alivePending == nil {
+			n.alivePending = make(map[uint64]time.Time)
+		}
+
+		n.aliveSeq++
+		seq := n.aliveSeq
+		n.alivePending[seq] = now
+		delete(n.alivePending, seq-maxPendingAliveChecks)
 		n.lock.Unlock()
-		log(fmt.Sprintf("Sending alivecheck (PING), target_id=0x%X", n.id))
-		n.sendMessage(alivecheck)
+
+		n.logAt(LogDebug, alivecheck, fmt.Sprintf("Sending alivecheck (PING), target_id=0x%X, seq=%d", n.id, seq))
+		n.sendMessage(alivecheck, idToString(seq))
 	} else {
+		// samples from an earlier relation would make the peer look overdue once it is checked again
+		n.detector = phiDetector{}
 		n.lock.Unlock()
 	}
 
 	n.resetKeepAliveTimer()
 }
 
+// matches the response to its alivecheck, a response without seq answers the latest one
+func (n *Node) handleAliveResponse(seq uint64) {
+	now := n.inst.getClock().Now()
+
+	n.lock.Lock()
+
+	if seq == 0 {
+		seq = n.aliveSeq
+	}
+
+	sent, ok := n.alivePending[seq]
+	delete(n.alivePending, seq)
+	n.detector.heartbeat(now)
+	var rtt time.Duration
+
+	if ok {
+		rtt = now.Sub(sent)
+
+		if n.rtt == 0 {
+			n.rtt = rtt
+		} else {
+			n.rtt += (rtt - n.rtt) / 8
+		}
+	}
+
+	n.lock.Unlock()
+
+	if !ok {
+		n.logAt(LogDebug, aliveresponse, fmt.Sprintf("aliveresponse seq=%d doesn't answer a pending alivecheck", seq))
+		return
+	}
+
+	n.logAt(LogDebug, aliveresponse, fmt.Sprintf("Keepalive RTT of 0x%X is %s, seq=%d", n.id, rtt, seq))
+	n.inst.observeKeepaliveRTT(rtt)
+}
+
+// smoothed keepalive RTT and the current suspicion level of the peer
+func (n *Node) liveness() (time.Duration, float64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.rtt, n.detector.phi(n.inst.getClock().Now(), n.inst.Config().keepaliveInterval()/4)
+}
+
 func (n *Node) resetKeepAliveTimer() {
 	n.lock.Lock()
 	defer n.lock.Unlock()
@@ -219,288 +470,519 @@ func (n *Node) resetKeepAliveTimer() {
 	}
 
 	if n.connected {
-		n.kat = time.AfterFunc(connectionTimeoutSeconds/2*time.Second, n.keepAlive)
+		n.kat = n.inst.getClock().AfterFunc(n.inst.Config().keepaliveInterval(), n.keepAlive)
 	}
 }
 
 // returns false on failure
 func (n *Node) processMessage(m string) bool {
-	msg := strings.Split(m, sepchar)
+	msg, err := decodeMessage(m)
 
-	if len(msg) < 3 || msg[0] != magic {
+	if err != nil {
+		n.logAt(LogDebug, "", "processMessage: "+err.Error())
 		return false
-	} else {
-		recvdTime, err := strconv.ParseUint(msg[1], 10, 64)
+	}
 
-		if err != nil {
-			debugLog("processMessage timestamp parse failure")
-			return false
-		}
+	if _, ok := msg.body.(unknownMessage); ok {
+		n.inst.countMessageReceived("unknown")
+	} else {
+		n.inst.countMessageReceived(msg.kind)
+	}
 
-		messageTime := updateTime(recvdTime)
-		parseStartIx := 3
+	messageTime := n.inst.updateTime(msg.time)
+	params := strings.Split(m, sepchar)[2:]
 
-		switch msg[2] {
+	// sender of connect and netinfo may be known only once the message is handled
+	if _, id := n.relationAndID(); id != 0 {
+		n.traceMessage(TraceReceive, messageTime, msg.time, params, "")
+	} else {
+		defer n.traceMessage(TraceReceive, messageTime, msg.time, params, "")
+	}
 
-		// node would like to connect
-		case connect:
-			id, err := stringToID(msg[parseStartIx])
-			if err != nil {
-				debugLog("CONNECT id err")
-				return false
-			}
+	switch body := msg.body.(type) {
 
-			n.lock.Lock()
-			n.id = id
-			n.r = relation(msg[parseStartIx+1])
-			n.lock.Unlock()
+	// node would like to connect
+	case connectMessage:
+		var pub ed25519.PublicKey
 
-			log(fmt.Sprintf("[%d] Received connect message: remote_id=0x%X, r=%s", messageTime, n.id, n.r))
-			n.processConnectMessage(msg[parseStartIx+2:])
+		if len(body.pub) > 0 {
+			var err error
+			pub, err = verifyKey(n.challenge, body.token, body.pub, body.sig)
 
-		case netinfo:
-			remoteNodeID, err := stringToID(msg[parseStartIx])
 			if err != nil {
-				debugLog("NETINFO remoteNodeID err")
+				n.logAt(LogWarn, msg.kind, "Refusing connect: "+err.Error())
 				return false
 			}
 
-			nextID, err := stringToID(msg[parseStartIx+1])
-			if err != nil {
-				debugLog("NETINFO nextID err")
-				return false
-			}
+			body.key = keyFingerprint(pub)
+		}
 
-			remoteLeaderID, err := stringToID(msg[parseStartIx+2])
-			if err != nil {
-				debugLog("NETINFO remoteLeaderID err")
-				return false
-			}
+		id := n.inst.rememberOwnPeer(body.peer)
 
-			remoteTwiceNextNodeID, err := stringToID(msg[parseStartIx+3])
-			if err != nil {
-				debugLog("NETINFO remoteTwiceNextNodeID err")
-				return false
-			}
+		if pub != nil {
+			n.inst.rememberKey(id, pub)
+		}
 
-			n.lock.Lock()
-			n.id = remoteNodeID
-			n.lock.Unlock()
+		n.lock.Lock()
+		n.setID(id)
+		n.setRelation(body.r)
+		n.setKey(body.key)
+		n.lock.Unlock()
 
-			updateTwiceNextNodeID(remoteTwiceNextNodeID)
+		n.log(msg.kind, fmt.Sprintf("[%d] Received connect message: remote_id=0x%X, r=%s, key=%s", messageTime, n.id, n.r, body.key))
+		n.processConnectMessage(body)
 
-			log(fmt.Sprintf("[%d] Received netinfo: remote_id=0x%X, next_id=0x%X, leader_id=0x%X, twice_next_node_id=0x%X", messageTime, remoteNodeID, nextID, remoteLeaderID, remoteTwiceNextNodeID))
+	case netinfoMessage:
+		remoteNodeID := n.inst.rememberOwnPeer(body.node)
+		nextID := n.inst.rememberPeer(body.next)
+		remoteLeaderID := n.inst.rememberPeer(body.leader)
+		remoteTwiceNextNodeID := n.inst.rememberPeer(body.twiceNext)
 
-			log(fmt.Sprintf("Attempting to connect to remote node, id=0x%X", remoteNodeID))
-			nextNode := connectToNode(idToEndpoint(nextID))
-			if nextNode == nil {
-				log(fmt.Sprintf("Connection to remote node failed!, id=0x%X", remoteNodeID))
-				log("Will now attempt to close the ring")
-				closeRing(nextID)
-			} else {
-				nextNode.lock.Lock()
-				nextNode.r = next
-				nextNode.id = nextID
-				nextNode.lock.Unlock()
-				log(fmt.Sprintf("Connection to remote node was successful, id=0x%X", nextID))
-
-				// notify the next node who we are
-				log(fmt.Sprintf("Sending connect message: target_id=0x%X, my_id=0x%X, r=%s", nextNode.id, nodeID, prev))
-				nextNode.sendMessage(connect, strconv.FormatUint(nodeID, 16), string(prev))
-
-				// if we have connected to somebody we have a ring
-				updateNetworkState(ring)
-			}
+		n.lock.Lock()
+		n.setID(remoteNodeID)
+		n.lock.Unlock()
 
-			// in case there was a leader in the network
-			if remoteLeaderID != 0 {
-				handleNewLeader(remoteLeaderID)
-			}
+		n.inst.updateTwiceNextNodeID(remoteTwiceNextNodeID)
 
-		case closering:
-			senderID, err := stringToID(msg[parseStartIx])
-			if err != nil {
-				debugLog("CLOSERING sender id failure")
-				return false
-			}
+		if len(body.observedAddr) > 0 {
+			n.inst.checkObservedAddress(body.observedAddr)
+		}
 
-			log(fmt.Sprintf("[%d] Received closering: from_id=0x%X, sender_id=0x%X", messageTime, n.id, senderID))
-			prevNode := findNodeByRelation(prev)
+		if body.hasNetwork {
+			n.inst.setNetworkInfo(body.networkID, body.networkName)
+			n.inst.checkExpectedNetworkID(body.networkID)
+			n.log(msg.kind, fmt.Sprintf("Joined network %s (0x%X)", body.networkName, body.networkID))
+		}
 
-			if prevNode != nil {
-				if senderID != nodeID {
-					log(fmt.Sprintf("Forwarding closering (from time %d): target_id=0x%X, sender_id=0x%X", messageTime, prevNode.id, senderID))
-					prevNode.sendMessage(closering, msg[parseStartIx])
-				} else {
-					atomic.StoreUint32(&ringBroken, 0)
-					log(fmt.Sprintf("Closering propagation stopped (from time %d): target_id=0x%X == sender_id=0x%X", messageTime, prevNode.id, senderID))
-				}
-			} else {
-				log(fmt.Sprintf("[%d] Received closering without having a prevNode! from_id=0x%X, sender_id=0x%X", messageTime, n.id, senderID))
-				log(fmt.Sprintf("Sending connect message: target_id=0x%X, my_id=0x%X, r=%s", senderID, nodeID, next))
+		n.log(msg.kind, fmt.Sprintf("[%d] Received netinfo: remote_id=0x%X, next_id=0x%X, leader_id=0x%X, twice_next_node_id=0x%X", messageTime, remoteNodeID, nextID, remoteLeaderID, remoteTwiceNextNodeID))
 
-				if n.r == none {
-					prevNode = n
-				} else {
-					prevNode = connectToNode(idToEndpoint(senderID))
-				}
+		n.log(msg.kind, fmt.Sprintf("Attempting to connect to remote node, id=0x%X", remoteNodeID))
+		nextNode := n.inst.connectToNodeID(nextID)
+		if nextNode == nil {
+			n.logAt(LogWarn, msg.kind, fmt.Sprintf("Connection to remote node failed!, id=0x%X", remoteNodeID))
+			n.log(msg.kind, "Will now attempt to close the ring")
+			n.inst.closeRing(nextID)
+		} else {
+			nextNode.lock.Lock()
+			nextNode.setRelation(next)
+			nextNode.setID(nextID)
+			nextNode.lock.Unlock()
+			n.log(msg.kind, fmt.Sprintf("Connection to remote node was successful, id=0x%X", nextID))
+
+			// notify the next node who we are
+			n.log(msg.kind, fmt.Sprintf("Sending connect message: target_id=0x%X, my_id=0x%X, r=%s", nextNode.id, n.inst.getNodeID(), prev))
+			nextNode.sendMessage(nextNode.connectMessage(prev, "")...)
+
+			// if we have connected to somebody we have a ring
+			n.inst.updateNetworkState(ring)
+		}
 
-				if prevNode == nil {
-					log(fmt.Sprintf("Connection to remote node failed!, id=0x%X", senderID))
-					return false
-				}
+		// in case there was a leader in the network
+		if remoteLeaderID != 0 {
+			n.inst.handleNewLeader(remoteLeaderID)
+		}
 
-				prevNode.lock.Lock()
-				prevNode.r = prev
-				prevNode.id = senderID
-				prevNode.lock.Unlock()
-				prevNode.sendMessage(connect, idToString(nodeID), string(next))
-				log("Ring repaired (side missing prev)")
+		n.inst.scheduleStateSave()
 
-				nextNode := findNodeByRelation(next)
-				if nextNode == nil {
-					panic("ring repaired (side missing prev) without having nextNode")
-				}
-				log(fmt.Sprintf("Ring repaired, sending nextinfo to my new prev, target_id=0x%X, next_id=0x%X", prevNode.id, nextNode.id))
-				prevNode.sendMessage(nextinfo, idToString(nextNode.id))
+	case closeringMessage:
+		senderID := n.inst.rememberPeer(body.sender)
+
+		n.log(msg.kind, fmt.Sprintf("[%d] Received closering: from_id=0x%X, sender_id=0x%X", messageTime, n.id, senderID))
+		atomic.AddUint64(&n.inst.metrics.closeringHops, 1)
+		prevNode := n.inst.findNodeByRelation(prev)
+
+		if prevNode != nil {
+			if senderID != n.inst.getNodeID() {
+				n.log(msg.kind, fmt.Sprintf("Forwarding closering (from time %d): target_id=0x%X, sender_id=0x%X", messageTime, prevNode.id, senderID))
+				prevNode.sendMessage(closering, body.sender.String())
+			} else {
+				atomic.StoreUint32(&n.inst.ringBroken, 0)
+				n.log(msg.kind, fmt.Sprintf("Closering propagation stopped (from time %d): target_id=0x%X == sender_id=0x%X", messageTime, prevNode.id, senderID))
 			}
+		} else {
+			n.log(msg.kind, fmt.Sprintf("[%d] Received closering without having a prevNode! from_id=0x%X, sender_id=0x%X", messageTime, n.id, senderID))
+			n.log(msg.kind, fmt.Sprintf("Sending connect message: target_id=0x%X, my_id=0x%X, r=%s", senderID, n.inst.getNodeID(), next))
 
-		case election:
-			candidateID, err := stringToID(msg[parseStartIx])
+			if n.r == none {
+				prevNode = n
+			} else {
+				prevNode = n.inst.connectToNodeID(senderID)
+			}
 
-			if err != nil {
-				debugLog("ELECTION candidate id failure")
+			if prevNode == nil {
+				n.logAt(LogWarn, msg.kind, fmt.Sprintf("Connection to remote node failed!, id=0x%X", senderID))
 				return false
 			}
 
-			if getLeaderID() != 0 {
-				log("New election detected, removing currently elected leader")
-				updateLeaderID(0)
+			prevNode.lock.Lock()
+			prevNode.setRelation(prev)
+			prevNode.setID(senderID)
+			prevNode.lock.Unlock()
+			prevNode.sendMessage(prevNode.connectMessage(next, "")...)
+			n.log(msg.kind, "Ring repaired (side missing prev)")
+
+			nextNode := n.inst.findNodeByRelation(next)
+			if nextNode == nil {
+				n.logAt(LogWarn, msg.kind, "Ring repaired (side missing prev) without having nextNode, not sending nextinfo")
+				break
 			}
+			n.log(msg.kind, fmt.Sprintf("Ring repaired, sending nextinfo to my new prev, target_id=0x%X, next_id=0x%X", prevNode.id, nextNode.id))
+			prevNode.sendMessage(nextinfo, n.inst.peerToString(nextNode.id))
+		}
 
-			log(fmt.Sprintf("[%d] Received election, from_id=0x%X, candidate_id=0x%X", messageTime, n.id, candidateID))
+	case electionMessage:
+		candidateID := body.candidateID
 
-			nextNode := findNodeByRelation(next)
+		if n.inst.LeaderID() != 0 {
+			n.log(msg.kind, "New election detected, removing currently elected leader")
+			n.inst.updateLeaderID(0)
+		}
 
-			if nextNode == nil {
-				log(fmt.Sprintf("[%d] No nextnode to forward election to! Discarding.", messageTime))
+		n.log(msg.kind, fmt.Sprintf("[%d] Received election, from_id=0x%X, candidate_id=0x%X", messageTime, n.id, candidateID))
+
+		nextNode := n.inst.findNodeByRelation(next)
+
+		if nextNode == nil {
+			n.log(msg.kind, fmt.Sprintf("[%d] No nextnode to forward election to! Discarding.", messageTime))
+		} else {
+			if candidateID == n.inst.getNodeID() {
+				n.log(msg.kind, fmt.Sprintf("[%d] This node has been elected as a new leader! (candidate_id == my_id)", messageTime))
+				atomic.AddUint64(&n.inst.metrics.electionsWon, 1)
+
+				n.log(msg.kind, fmt.Sprintf("[%d] Sending elected to target_id=0x%X", messageTime, nextNode.id))
+				nextNode.sendMessage(elected, n.inst.peerToString(n.inst.getNodeID()))
+				n.inst.handleNewLeader(n.inst.getNodeID())
+			} else if candidateID > n.inst.getNodeID() {
+				n.log(msg.kind, fmt.Sprintf("[%d] Forwarding election (candidate_id > my_id), target_id=0x%X, candidate_id=0x%X", messageTime, nextNode.id, candidateID))
+				n.inst.setElectionParticipated()
+
+				nextNode.sendMessage(election, idToString(candidateID))
 			} else {
-				if candidateID == nodeID {
-					log(fmt.Sprintf("[%d] This node has been elected as a new leader! (candidate_id == my_id)", messageTime))
-
-					log(fmt.Sprintf("[%d] Sending elected to target_id=0x%X", messageTime, nextNode.id))
-					nextNode.sendMessage(elected, idToString(nodeID))
-					handleNewLeader(nodeID)
-				} else if candidateID > nodeID {
-					log(fmt.Sprintf("[%d] Forwarding election (candidate_id > my_id), target_id=0x%X, candidate_id=0x%X", messageTime, nextNode.id, candidateID))
-					setElectionParticipated()
-
-					nextNode.sendMessage(election, idToString(candidateID))
-				} else {
-					log(fmt.Sprintf("[%d] Discarding election (candidate_id < my_id)", messageTime))
-
-					if !hasElectionParticipated() {
-						setElectionParticipated()
-						log(fmt.Sprintf("[%d] Sending election, target_id=0x%X, candidate_id=0x%X", messageTime, nextNode.id, nodeID))
-						nextNode.sendMessage(election, idToString(nodeID))
-					}
+				n.log(msg.kind, fmt.Sprintf("[%d] Discarding election (candidate_id < my_id)", messageTime))
+
+				if !n.inst.hasElectionParticipated() {
+					n.inst.setElectionParticipated()
+					n.log(msg.kind, fmt.Sprintf("[%d] Sending election, target_id=0x%X, candidate_id=0x%X", messageTime, nextNode.id, n.inst.getNodeID()))
+					atomic.AddUint64(&n.inst.metrics.electionsStarted, 1)
+					nextNode.sendMessage(election, idToString(n.inst.getNodeID()))
 				}
 			}
-			resetElectionTimer()
+		}
+		n.inst.resetElectionTimer()
 
-		case elected:
-			newLeaderID, err := stringToID(msg[parseStartIx])
+	case electedMessage:
+		newLeaderID := n.inst.rememberPeer(body.leader)
 
-			if err != nil {
-				debugLog("ELECTED new leader id failure")
-				return false
-			}
-			log(fmt.Sprintf("[%d] Received elected, from_id=0x%X, leader_id=0x%X", messageTime, n.id, newLeaderID))
+		n.log(msg.kind, fmt.Sprintf("[%d] Received elected, from_id=0x%X, leader_id=0x%X", messageTime, n.id, newLeaderID))
 
-			if newLeaderID != nodeID {
-				nextNode := findNodeByRelation(next)
-
-				if nextNode != nil {
-					log(fmt.Sprintf("[%d] Forwarding elected, target_id=0x%X, leader_id=0x%X", messageTime, nextNode.id, newLeaderID))
-					nextNode.sendMessage(elected, idToString(newLeaderID))
-				} else {
-					log(fmt.Sprintf("[%d] No next node fo forward elected to.", messageTime))
-				}
+		if newLeaderID != n.inst.getNodeID() {
+			nextNode := n.inst.findNodeByRelation(next)
 
-				handleNewLeader(newLeaderID)
+			if nextNode != nil {
+				n.log(msg.kind, fmt.Sprintf("[%d] Forwarding elected, target_id=0x%X, leader_id=0x%X", messageTime, nextNode.id, newLeaderID))
+				nextNode.sendMessage(elected, n.inst.peerToString(newLeaderID))
 			} else {
-				log(fmt.Sprintf("[%d] Received elected with leader_id == my_id, stopping propagation, from_id=0x%X, leader_id=0x%X", messageTime, n.id, newLeaderID))
+				n.log(msg.kind, fmt.Sprintf("[%d] No next node fo forward elected to.", messageTime))
 			}
 
-		case chatmessagesend:
-			log(fmt.Sprintf("[%d] Received chatmessagesend, from_id=0x%X", messageTime, n.id))
+			n.inst.handleNewLeader(newLeaderID)
+		} else {
+			n.log(msg.kind, fmt.Sprintf("[%d] Received elected with leader_id == my_id, stopping propagation, from_id=0x%X, leader_id=0x%X", messageTime, n.id, newLeaderID))
+		}
+
+	case chatSendMessage:
+		n.log(msg.kind, fmt.Sprintf("[%d] Received chatmessagesend, from_id=0x%X", messageTime, n.id))
+
+		user := n.inst.getUsername(n)
 
-			user := getUsername(n)
+		if len(user) == 0 {
+			n.log(msg.kind, fmt.Sprintf("Discarding chatmessagesend from a node not participating in chat, from_id=0x%X", n.id))
+			break
+		}
 
-			chatmsg := []string{chatmessage, user}
-			chatmsg = append(chatmsg, msg[parseStartIx:]...)
+		if n.inst.isMuted(n.id, user, n.keyFingerprint()) {
+			n.log(msg.kind, fmt.Sprintf("Discarding chatmessagesend from muted user, from_id=0x%X", n.id))
+			n.sendMessage(modnotice, modNoticeError, "you are muted and cannot send messages")
+			break
+		}
 
-			log(fmt.Sprintf("Broadcasting chatmessagesend received at %d, from_id=0x%X", messageTime, n.id))
-			broadcastToFollowers(chatmsg[:]...)
+		n.log(msg.kind, fmt.Sprintf("Broadcasting chatmessagesend received at %d, from_id=0x%X", messageTime, n.id))
+		n.inst.broadcastToFollowers(chatmessage, user, body.text)
+		atomic.AddUint64(&n.inst.metrics.chatMessagesRelayed, 1)
 
-		case chatmessage:
-			log(fmt.Sprintf("[%d] Received chatmessage, from_id=0x%X", messageTime, n.id))
-			user := msg[parseStartIx]
-			var chatmsg bytes.Buffer
+	case chatMessage:
+		n.log(msg.kind, fmt.Sprintf("[%d] Received chatmessage, from_id=0x%X", messageTime, n.id))
+		n.inst.chatMessageReceived(body.user, body.text)
 
-			for i := parseStartIx + 1; i < len(msg); i++ {
-				chatmsg.WriteString(msg[i])
+	case userlistMessage:
+		n.log(msg.kind, fmt.Sprintf("[%d] Received userlist, from_id=0x%X", messageTime, n.id))
+		n.inst.updateUsers(body.users)
 
-				if i+1 < len(msg) {
-					chatmsg.WriteString(sepchar)
-				}
-			}
+	case nextinfoMessage:
+		newTwiceNextNodeID := n.inst.rememberPeer(body.next)
 
-			chatMessageReceived(user, chatmsg.String())
+		n.log(msg.kind, fmt.Sprintf("[%d] Received nextinfo, from_id=0x%X, twice_next_node_id=0x%X", messageTime, n.id, newTwiceNextNodeID))
+		n.inst.updateTwiceNextNodeID(newTwiceNextNodeID)
+		n.inst.scheduleStateSave()
 
-		case userlist:
-			log(fmt.Sprintf("[%d] Received userlist, from_id=0x%X", messageTime, n.id))
-			users := msg[parseStartIx:]
-			updateUsers(users)
+	case ringwalkMessage:
+		n.log(msg.kind, fmt.Sprintf("[%d] Received ringwalk, from_id=0x%X, token=%s, status=%s, nodes=%d", messageTime, n.id, body.token, body.status, len(body.nodes)))
+		n.handleRingWalk(body)
 
-		case nextinfo:
-			newTwiceNextNodeID, err := stringToID(msg[parseStartIx])
+	case aliveCheckMessage:
+		n.logAt(LogDebug, msg.kind, fmt.Sprintf("[%d] Received alivecheck (PING), from_id=0x%X, seq=%d", messageTime, n.id, body.seq))
 
-			if err != nil {
-				debugLog("NEXTINFO new twice next node id failure")
-				return false
-			}
-			log(fmt.Sprintf("[%d] Received nextinfo, from_id=0x%X, twice_next_node_id=0x%X", messageTime, n.id, newTwiceNextNodeID))
-			updateTwiceNextNodeID(newTwiceNextNodeID)
+		if n.inst.IsPaused() {
+			n.log(msg.kind, "Paused, not answering alivecheck")
+			break
+		}
+
+		n.logAt(LogDebug, msg.kind, fmt.Sprintf("Sending aliveresponse (PONG) (alivecheck from %d), target_id=0x%X", messageTime, n.id))
 
-		case alivecheck:
-			log(fmt.Sprintf("[%d] Received alivecheck (PING), from_id=0x%X", messageTime, n.id))
-			log(fmt.Sprintf("Sending aliveresponse (PONG) (alivecheck from %d), target_id=0x%X", messageTime, n.id))
+		if body.seq == 0 {
 			n.sendMessage(aliveresponse)
+		} else {
+			n.sendMessage(aliveresponse, idToString(body.seq))
+		}
+
+	case aliveResponseMessage:
+		n.logAt(LogDebug, msg.kind, fmt.Sprintf("[%d] Received aliveresponse (PONG), from_id=0x%X, seq=%d", messageTime, n.id, body.seq))
+		n.handleAliveResponse(body.seq)
+
+	case relayRegisterMessage:
+		n.log(msg.kind, fmt.Sprintf("[%d] Received relay registration", messageTime))
+
+		if !n.inst.handleRelayRegister(n, body.peer) {
+			return false
+		}
+
+	case relayRequestMessage:
+		n.log(msg.kind, fmt.Sprintf("[%d] Received relay request", messageTime))
+
+		if !n.inst.handleRelayRequest(n, body.targetID) {
+			return false
+		}
+
+	case relayAcceptMessage:
+		n.log(msg.kind, fmt.Sprintf("[%d] Received relay accept", messageTime))
+
+		if !n.inst.handleRelayAccept(n, body.token) {
+			return false
+		}
+
+	case relayConnectMessage:
+		n.log(msg.kind, fmt.Sprintf("[%d] Received relay connect request, token=%s", messageTime, body.token))
+		n.inst.spawn(func() { n.inst.handleRelayConnect(body.token) })
+
+	case relayOKMessage:
+		n.log(msg.kind, fmt.Sprintf("[%d] Registered with relay", messageTime))
+
+	// the accepting side answers the challenge of the dialing side with its key, the dialing side
+	// read ours before it created the node
+	case challengeMessage:
+		if len(n.challenge) == 0 || len(n.peerChallenge) > 0 {
+			n.logAt(LogDebug, msg.kind, fmt.Sprintf("[%d] Ignoring challenge on an open connection", messageTime))
+			break
+		}
+
+		n.peerChallenge = body.nonce
+		n.sendMessage(n.identityMessage()...)
+
+	// accepting side proves its key
+	case identityMessage:
+		pub, err := verifyKey(n.challenge, body.token, body.pub, body.sig)
+
+		if err != nil {
+			n.logAt(LogWarn, msg.kind, "Refusing identity: "+err.Error())
+			return false
+		}
+
+		id := n.inst.rememberOwnPeer(body.peer)
+		n.inst.rememberKey(id, pub)
 
-		case aliveresponse:
-			log(fmt.Sprintf("[%d] Received aliveresponse (PONG), from_id=0x%X", messageTime, n.id))
+		n.lock.Lock()
+		n.setKey(keyFingerprint(pub))
+		n.lock.Unlock()
+
+		n.logAt(LogDebug, msg.kind, fmt.Sprintf("[%d] Received identity, remote_id=0x%X, key=%s", messageTime, id, keyFingerprint(pub)))
+
+	case modCommandMessage:
+		n.log(msg.kind, fmt.Sprintf("[%d] Received modcommand, from_id=0x%X, action=%s", messageTime, n.id, body.action))
+
+		if n.inst.LeaderID() != n.inst.getNodeID() {
+			n.sendMessage(modnotice, modNoticeError, "moderation commands can only be handled by the leader")
+			break
+		}
+
+		result, err := n.inst.applyModeration(n.id, body.action, body.target)
+
+		if err != nil {
+			n.sendMessage(modnotice, modNoticeError, err.Error())
+		} else {
+			n.sendMessage(modnotice, modNoticeInfo, result)
 		}
 
+	case modStateMessage:
+		n.log(msg.kind, fmt.Sprintf("[%d] Received modstate, from_id=0x%X, version=%d", messageTime, n.id, body.version))
+
+		// moderation state travels around the ring, only prev and the leader itself may change it
+		if r, id := n.relationAndID(); r != prev && (id == 0 || id != n.inst.LeaderID()) {
+			n.logAt(LogWarn, msg.kind, fmt.Sprintf("Ignoring modstate from 0x%X (r=%s), it is neither prev nor the leader", id, r))
+			break
+		}
+
+		switch n.inst.updateModerationState(body) {
+		case moderationApplied:
+			n.inst.replicateModeration()
+
+		// nodes further along the ring may know the key of the leader, it is passed on as signed
+		case moderationPending:
+			if nextNode := n.inst.findNodeByRelation(next); nextNode != nil {
+				nextNode.sendMessage(params...)
+			}
+		}
+
+	case modNoticeMessage:
+		n.log(msg.kind, fmt.Sprintf("[%d] Received modnotice, from_id=0x%X, action=%s", messageTime, n.id, body.action))
+		n.inst.handleModerationNotice(n, body.action, body.text)
 	}
 
 	return true
 }
 
-func nodeFromConnection(c net.Conn) *Node {
-	return &Node{0, none, c, true, &sync.Mutex{}, nil, &sync.Mutex{}}
+func (inst *Instance) nodeFromConnection(c net.Conn) *Node {
+	return inst.nodeFromReader(c, bufio.NewReaderSize(c, inst.Config().MaxMessageLength))
+}
+
+// r reads from c and may already hold data that arrived before the node was created
+func (inst *Instance) nodeFromReader(c net.Conn, r *bufio.Reader) *Node {
+	config := inst.Config()
+	n := &Node{inst, 0, none, c, r, true, &sync.Mutex{}, nil, &sync.Mutex{},
+		newTokenBucket(inst.getClock(), float64(config.ChatRateLimitPerSecond), float64(config.ChatRateLimitBurst)),
+		newTokenBucket(inst.getClock(), float64(config.ControlRateLimitPerSecond), float64(config.ControlRateLimitBurst)), false, &sync.Mutex{}, 0, 0, "", "", "", 0, nil, 0, phiDetector{},
+		newOutbox(config.OutboundQueueLength), make(chan struct{}), &sync.Once{}, make(chan struct{}), newWaiter(inst.getClock())}
+
+	inst.spawn(n.writeLoop)
+
+	return n
+}
+
+// both sides open every connection with a challenge, the connect of the dialing side signs ours
+func (inst *Instance) acceptNode(c net.Conn, r *bufio.Reader) *Node {
+	n := inst.nodeFromReader(c, r)
+	n.challenge = inst.newChallenge()
+	n.sendMessage(challenge, n.challenge)
+
+	return n
+}
+
+// reads the challenge of a dialed connection before the node takes it over, then sends ours
+func (inst *Instance) openNode(c net.Conn, r *bufio.Reader) (*Node, error) {
+	m, err := inst.readRawMessage(c, r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := decodeMessage(m)
+	ch, ok := msg.body.(challengeMessage)
+
+	if err != nil || !ok {
+		return nil, errors.New("connection wasn't opened with a challenge")
+	}
+
+	n := inst.nodeFromReader(c, r)
+	n.peerChallenge = ch.nonce
+	n.challenge = inst.newChallenge()
+	n.sendMessage(challenge, n.challenge)
+
+	return n, nil
+}
+
+// id and r are changed under lock, infoLock lets the node list read them without it
+func (n *Node) setID(id uint64) {
+	n.infoLock.Lock()
+	n.id = id
+	n.infoLock.Unlock()
+}
+
+func (n *Node) setKey(k string) {
+	n.infoLock.Lock()
+	n.key = k
+	n.infoLock.Unlock()
+}
+
+func (n *Node) keyFingerprint() string {
+	n.infoLock.Lock()
+	defer n.infoLock.Unlock()
+
+	return n.key
+}
+
+func (n *Node) setRelation(r relation) {
+	n.infoLock.Lock()
+	n.r = r
+	n.infoLock.Unlock()
 }
 
-func connectToNode(a string) *Node {
-	c, err := net.Dial("tcp4", a)
+func (n *Node) relationAndID() (relation, uint64) {
+	n.infoLock.Lock()
+	defer n.infoLock.Unlock()
+
+	return n.r, n.id
+}
+
+func (inst *Instance) connectToNode(a string) *Node {
+	c, err := inst.dial(a)
+
+	if err != nil {
+		inst.userError(err.Error())
+		return nil
+	}
+
+	n, err := inst.openNode(c, bufio.NewReaderSize(c, inst.Config().MaxMessageLength))
 
 	if err != nil {
-		userError(err.Error())
+		c.Close()
+		inst.userError(err.Error())
 		return nil
 	}
 
-	n := nodeFromConnection(c)
-	go n.handleConnection()
+	inst.spawn(n.handleConnection)
 
 	return n
 }
+
+// tries all routes to the node in order
+func (inst *Instance) connectToNodeID(id uint64) *Node {
+	routes := inst.routeToNode(id)
+
+	if len(routes) == 0 {
+		inst.userError(fmt.Sprintf("no known address of node 0x%X", id))
+		return nil
+	}
+
+	for _, rt := range routes {
+		c, r, err := inst.dialRoute(rt)
+
+		if err != nil {
+			inst.warnLog(fmt.Sprintf("Connection to node 0x%X via %s failed: %s", id, rt.address, err.Error()))
+			continue
+		}
+
+		n, err := inst.openNode(c, r)
+
+		if err != nil {
+			c.Close()
+			inst.warnLog(fmt.Sprintf("Connection to node 0x%X via %s failed: %s", id, rt.address, err.Error()))
+			continue
+		}
+
+		inst.spawn(n.handleConnection)
+
+		return n
+	}
+
+	inst.userError(fmt.Sprintf("unable to connect to node 0x%X", id))
+	return nil
+}
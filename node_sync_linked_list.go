@@ -1,4 +1,4 @@
-package main
+package distrochya
 
 import "sync"
 
@@ -62,7 +62,7 @@ func (l *nodeSyncLinkedList) findSingleByRelation(r relation) *Node {
 	cn := l.head
 
 	for cn != nil {
-		if cn.data.r == r {
+		if cr, _ := cn.data.relationAndID(); cr == r {
 			return cn.data
 		}
 
@@ -79,7 +79,7 @@ func (l *nodeSyncLinkedList) findSingleByRelationExcludingID(r relation, id uint
 	cn := l.head
 
 	for cn != nil {
-		if cn.data.r == r && cn.data.id != id {
+		if cr, cid := cn.data.relationAndID(); cr == r && cid != id {
 			return cn.data
 		}
 
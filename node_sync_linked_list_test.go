@@ -0,0 +1,134 @@
+package distrochya
+
+import (
+	"sync"
+	"testing"
+)
+
+func testNodes(rs ...relation) []*Node {
+	var ns []*Node
+
+	for i, r := range rs {
+		ns = append(ns, &Node{id: uint64(i + 1), r: r, lock: &sync.Mutex{}, infoLock: &sync.Mutex{}})
+	}
+
+	return ns
+}
+
+func TestNodeSyncLinkedListAddAndRemove(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove []int
+		want   []int
+	}{
+		{"nothing", nil, []int{2, 1, 0}},
+		{"head", []int{2}, []int{1, 0}},
+		{"middle", []int{1}, []int{2, 0}},
+		{"tail", []int{0}, []int{2, 1}},
+		{"all", []int{0, 1, 2}, nil},
+		{"twice", []int{1, 1}, []int{2, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := testNodes(next, prev, follower)
+			l := newNodeSyncLinkedList()
+
+			for _, n := range ns {
+				l.add(n)
+			}
+
+			for _, i := range tt.remove {
+				l.remove(ns[i])
+			}
+
+			got := l.toSlice()
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("%d nodes left, want %d", len(got), len(tt.want))
+			}
+
+			for i, w := range tt.want {
+				if got[i] != ns[w] {
+					t.Errorf("node %d is 0x%X, want 0x%X", i, got[i].id, ns[w].id)
+				}
+			}
+		})
+	}
+}
+
+func TestNodeSyncLinkedListRemoveFromEmpty(t *testing.T) {
+	l := newNodeSyncLinkedList()
+	l.remove(testNodes(next)[0])
+
+	if len(l.toSlice()) != 0 || l.size != 0 {
+		t.Error("empty list changed")
+	}
+}
+
+func TestNodeSyncLinkedListFind(t *testing.T) {
+	ns := testNodes(next, follower, follower, prev)
+	l := newNodeSyncLinkedList()
+
+	for _, n := range ns {
+		l.add(n)
+	}
+
+	if n := l.findSingleByRelation(prev); n != ns[3] {
+		t.Errorf("prev is %v", n)
+	}
+
+	if n := l.findSingleByRelation(leader); n != nil {
+		t.Errorf("found leader %v", n)
+	}
+
+	// most recently added first
+	if n := l.findSingleByRelation(follower); n != ns[2] {
+		t.Errorf("follower is 0x%X, want 0x%X", n.id, ns[2].id)
+	}
+
+	if n := l.findSingleByRelationExcludingID(follower, ns[2].id); n != ns[1] {
+		t.Errorf("other follower is %v", n)
+	}
+
+	if n := l.findSingleByRelationExcludingID(next, ns[0].id); n != nil {
+		t.Errorf("found excluded next %v", n)
+	}
+}
+
+func TestNodeSyncLinkedListConcurrent(t *testing.T) {
+	const goroutines = 8
+	const perGoroutine = 200
+
+	l := newNodeSyncLinkedList()
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			var ns []*Node
+
+			for j := 0; j < perGoroutine; j++ {
+				n := testNodes(follower)[0]
+				ns = append(ns, n)
+				l.add(n)
+				l.findSingleByRelation(next)
+				l.toSlice()
+			}
+
+			// every other node stays
+			for j := 0; j < perGoroutine; j += 2 {
+				l.remove(ns[j])
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if got := len(l.toSlice()); got != goroutines*perGoroutine/2 {
+		t.Errorf("%d nodes left, want %d", got, goroutines*perGoroutine/2)
+	}
+}
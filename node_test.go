@@ -0,0 +1,1019 @@
+package distrochya
+
+import (
+	"bufio"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestProcessMessageRejectsMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+	}{
+		{"empty", ""},
+		{"header only", magic},
+		{"missing type", magic + sepchar + "1"},
+		{"wrong magic", "DISTROCHYA-R1;1;" + alivecheck},
+		{"negative time", magic + ";-1;" + alivecheck},
+		{"non-numeric time", magic + ";now;" + alivecheck},
+		{"connect without params", testMessage(1, connect)},
+		{"connect without relation", testMessage(1, connect, testPeerToken(testPeerID))},
+		{"connect with bad id", testMessage(1, connect, "xyz", string(none))},
+		{"connect with bad relation", testMessage(1, connect, testPeerToken(testPeerID), "sideways")},
+		{"connect as leader", testMessage(1, connect, testPeerToken(testPeerID), string(leader))},
+		{"connect as follower without name", testMessage(1, connect, testPeerToken(testPeerID), string(follower))},
+		{"netinfo without params", testMessage(1, netinfo)},
+		{"short netinfo", testMessage(1, netinfo, "1", "1", "0")},
+		{"netinfo with bad network id", testMessage(1, netinfo, "1", "1", "0", "1", "10.0.0.1", "xyz", "lobby")},
+		{"netinfo with bad node", testMessage(1, netinfo, "xyz", "1", "0", "1")},
+		{"netinfo with bad next", testMessage(1, netinfo, "1", "xyz", "0", "1")},
+		{"netinfo with bad leader", testMessage(1, netinfo, "1", "1", "xyz", "1")},
+		{"netinfo with bad twice next", testMessage(1, netinfo, "1", "1", "0", "xyz")},
+		{"closering without sender", testMessage(1, closering)},
+		{"closering with bad sender", testMessage(1, closering, "xyz")},
+		{"election without candidate", testMessage(1, election)},
+		{"election with bad candidate", testMessage(1, election, "xyz")},
+		{"election with endpoints", testMessage(1, election, testPeerToken(1, "a:1"))},
+		{"elected without leader", testMessage(1, elected)},
+		{"elected with bad leader", testMessage(1, elected, "xyz")},
+		{"chatmessage without user", testMessage(1, chatmessage)},
+		{"nextinfo without peer", testMessage(1, nextinfo)},
+		{"nextinfo with bad peer", testMessage(1, nextinfo, "xyz")},
+		{"relayreg without peer", testMessage(1, relayregister)},
+		{"relayto without target", testMessage(1, relayrequest)},
+		{"relayacc without token", testMessage(1, relayaccept)},
+		{"relayconn without token", testMessage(1, relayconnect)},
+		{"modcmd without target", testMessage(1, modcommand, ModKick)},
+		{"modstate without version", testMessage(1, modstate)},
+		{"modstate with bad version", testMessage(1, modstate, "x")},
+		{"modnotice without text", testMessage(1, modnotice, modNoticeInfo)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := newTestInstance(t)
+			n, p := ti.peer(t, none, testPeerID)
+
+			if n.processMessage(tt.msg) {
+				t.Errorf("%q accepted", tt.msg)
+			}
+
+			p.expectSilence(t)
+		})
+	}
+}
+
+func TestProcessMessageIgnoresUnknownType(t *testing.T) {
+	ti := newTestInstance(t)
+	n, p := ti.peer(t, next, testPeerID)
+
+	if !n.processMessage(testMessage(1, "nosuchmessage", "x")) {
+		t.Error("unknown message type rejected")
+	}
+
+	p.expectSilence(t)
+}
+
+func TestProcessMessageUpdatesLogicalTime(t *testing.T) {
+	tests := []struct {
+		local    uint64
+		received uint64
+		want     uint64
+	}{
+		{0, 0, 1},
+		{0, 100, 101},
+		{200, 100, 201},
+		{100, 100, 101},
+	}
+
+	for _, tt := range tests {
+		ti := newTestInstance(t)
+		n, _ := ti.peer(t, next, testPeerID)
+		ti.currentTime = tt.local
+
+		n.processMessage(testMessage(tt.received, nextinfo, testPeerToken(0x3000)))
+
+		// received time is merged first, the log line of the message advances the clock once more
+		if got := ti.getTime(); got != tt.want+1 {
+			t.Errorf("local=%d received=%d: time %d, want %d", tt.local, tt.received, got, tt.want+1)
+		}
+	}
+}
+
+func TestAlivecheckIsAnswered(t *testing.T) {
+	ti := newTestInstance(t)
+	n, p := ti.peer(t, prev, testPeerID)
+
+	if !n.processMessage(testMessage(1, alivecheck)) {
+		t.Fatal("alivecheck rejected")
+	}
+
+	if params := p.expect(t, aliveresponse); len(params) != 0 {
+		t.Errorf("answer to an alivecheck without seq has params %v", params)
+	}
+
+	n.processMessage(testMessage(1, alivecheck, "1f"))
+
+	if params := p.expect(t, aliveresponse); len(params) != 1 || params[0] != "1f" {
+		t.Errorf("answer to alivecheck 1f has params %v", params)
+	}
+
+	if !n.processMessage(testMessage(1, aliveresponse)) {
+		t.Fatal("aliveresp rejected")
+	}
+
+	p.expectSilence(t)
+}
+
+func TestConnectFromNewNode(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.listen(t)
+	ti.updateNetworkState(singleNode)
+	n, p := ti.peer(t, none, 0)
+
+	if !n.processMessage(testMessage(1, connect, testPeerToken(testPeerID, "remote:9999"), string(none))) {
+		t.Fatal("connect rejected")
+	}
+
+	info := p.expect(t, netinfo)
+
+	if len(info) < 7 {
+		t.Fatalf("netinfo too short: %v", info)
+	}
+
+	self := testPeerToken(testNodeID, "local:9999")
+
+	if info[0] != self || info[1] != self {
+		t.Errorf("netinfo node and next %q %q, want %q", info[0], info[1], self)
+	}
+
+	if info[3] != testPeerToken(testPeerID, "remote:9999") {
+		t.Errorf("netinfo twice next %q, want the new node", info[3])
+	}
+
+	p.expect(t, modstate)
+
+	if n.r != next || n.id != testPeerID {
+		t.Errorf("new node is %s 0x%X, want next 0x%X", n.r, n.id, uint64(testPeerID))
+	}
+
+	if s := ti.NetworkState(); s != ring {
+		t.Errorf("state %q, want %q", s, ring)
+	}
+
+	if id := ti.getTwiceNextNodeID(); id != testNodeID {
+		t.Errorf("twice next 0x%X, want own id", id)
+	}
+
+	if eps := ti.getEndpoints(testPeerID); !reflect.DeepEqual(eps, []string{"remote:9999"}) {
+		t.Errorf("endpoints of the new node %v", eps)
+	}
+}
+
+func TestConnectReplacesNextAndNotifiesPrev(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.listen(t)
+	ti.updateNetworkState(ring)
+	ti.updateTwiceNextNodeID(0x4000)
+
+	oldNext, oldNextPeer := ti.peer(t, next, 0x3000)
+	_, prevPeer := ti.peer(t, prev, 0x5000)
+	n, p := ti.peer(t, none, 0)
+
+	if !n.processMessage(testMessage(1, connect, testPeerToken(testPeerID), string(none))) {
+		t.Fatal("connect rejected")
+	}
+
+	info := p.expect(t, netinfo)
+
+	if info[1] != idToString(0x3000) || info[3] != idToString(0x4000) {
+		t.Errorf("netinfo next %q and twice next %q, want the old next and its next", info[1], info[3])
+	}
+
+	p.expect(t, modstate)
+
+	if oldNext.r != none {
+		t.Errorf("old next still has relation %s", oldNext.r)
+	}
+
+	if _, ok := <-oldNextPeer.lines; ok {
+		t.Error("old next got a message instead of being disconnected")
+	}
+
+	if id, _ := stringToID(prevPeer.expect(t, nextinfo)[0]); id != testPeerID {
+		t.Errorf("prev told next is 0x%X, want 0x%X", id, uint64(testPeerID))
+	}
+
+	if id := ti.getTwiceNextNodeID(); id != 0x3000 {
+		t.Errorf("twice next 0x%X, want the old next", id)
+	}
+}
+
+func TestConnectFromBannedNode(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.listen(t)
+	ti.resetModeration(testNodeID)
+	ti.applyModeration(testNodeID, ModBan, "0x"+idToString(testPeerID))
+	n, p := ti.peer(t, none, 0)
+
+	n.processMessage(testMessage(1, connect, testPeerToken(testPeerID), string(none)))
+
+	if notice := p.expect(t, modnotice); notice[0] != ModBan {
+		t.Errorf("notice %v, want a ban", notice)
+	}
+
+	// the connection is closed once the notice is written
+	p.expectClosed(t)
+
+	if n.r != none {
+		t.Errorf("banned node got relation %s", n.r)
+	}
+}
+
+func TestConnectFromBannedKey(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.listen(t)
+	ti.resetModeration(testNodeID)
+
+	joining := newTestInstance(t)
+	ti.applyModeration(testNodeID, ModBan, keyTargetPrefix+joining.Fingerprint())
+	n, p := ti.peer(t, none, 0)
+	n.challenge = "abc"
+
+	n.processMessage(testMessage(1, joining.connectParams("abc", none, "")...))
+
+	if notice := p.expect(t, modnotice); notice[0] != ModBan {
+		t.Errorf("notice %v, want a ban", notice)
+	}
+
+	if s := ti.moderationStateMessage(); !reflect.DeepEqual(s[4:], []string{modEntryCreator + ":" + idToString(testNodeID), modEntryBannedKey + ":" + joining.Fingerprint()}) {
+		t.Errorf("modstate %v doesn't replicate the key ban", s)
+	}
+}
+
+func TestReplayedConnectRefused(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.listen(t)
+	ti.resetModeration(testNodeID)
+
+	joining := newTestInstance(t)
+	n, _ := ti.peer(t, none, 0)
+	n.challenge = "abc"
+
+	// signed for the challenge of another connection
+	if n.processMessage(testMessage(1, joining.connectParams("abd", none, "")...)) {
+		t.Error("replayed connect accepted")
+	}
+
+	if _, id := n.relationAndID(); id != 0 {
+		t.Errorf("replayed connect set node id 0x%X", id)
+	}
+}
+
+func TestConnectWithoutKeyRefusedOnceKeysAreBanned(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.listen(t)
+	ti.resetModeration(testNodeID)
+
+	n, p := ti.peer(t, none, 0)
+
+	if !n.processMessage(testMessage(1, connect, testPeerToken(testPeerID), string(none))) {
+		t.Fatal("connect without key rejected")
+	}
+
+	if p.expect(t, netinfo) == nil {
+		t.Error("no netinfo for a connect without key")
+	}
+
+	ti.applyModeration(testNodeID, ModBan, keyTargetPrefix+newTestInstance(t).Fingerprint())
+	n, p = ti.peer(t, none, 0)
+	n.processMessage(testMessage(1, connect, testPeerToken(0x5000), string(none)))
+
+	if notice := p.expect(t, modnotice); notice[0] != ModBan {
+		t.Errorf("notice %v, want a ban", notice)
+	}
+}
+
+func TestChallengeAnsweredWithIdentity(t *testing.T) {
+	ti := newTestInstance(t)
+	n, p := ti.peer(t, none, 0)
+	n.challenge = "abc"
+
+	if !n.processMessage(testMessage(1, challenge, "xyz")) {
+		t.Fatal("challenge rejected")
+	}
+
+	params := p.expect(t, identity)
+
+	if pub, err := verifyKey("xyz", params[0], params[1], params[2]); err != nil || keyFingerprint(pub) != ti.Fingerprint() {
+		t.Errorf("identity %v verified as %x, %v", params, pub, err)
+	}
+}
+
+func TestIdentityProvesKeyOfAcceptingSide(t *testing.T) {
+	ti := newTestInstance(t)
+	n, _ := ti.peer(t, next, testPeerID)
+	n.challenge = "abc"
+
+	accepting := newTestInstanceWithID(t, testPeerID)
+
+	// signed for the challenge of another connection
+	if n.processMessage(testMessage(1, accepting.identityParams("abd")...)) {
+		t.Error("replayed identity accepted")
+	}
+
+	if !n.processMessage(testMessage(1, accepting.identityParams("abc")...)) {
+		t.Fatal("identity rejected")
+	}
+
+	if pub := ti.nodeKey(testPeerID); keyFingerprint(pub) != accepting.Fingerprint() {
+		t.Errorf("key of 0x%X is %x, want %s", uint64(testPeerID), pub, accepting.Fingerprint())
+	}
+
+	if n.key != accepting.Fingerprint() {
+		t.Errorf("node key %s, want %s", n.key, accepting.Fingerprint())
+	}
+}
+
+func TestConnectAsNextRepairsRing(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.listen(t)
+	ti.updateNetworkState(ring)
+	ti.ringBroken = 1
+
+	_, prevPeer := ti.peer(t, prev, 0x5000)
+	n, _ := ti.peer(t, none, 0)
+
+	if !n.processMessage(testMessage(1, connect, testPeerToken(testPeerID), string(next))) {
+		t.Fatal("connect rejected")
+	}
+
+	if ti.ringBroken != 0 {
+		t.Error("ring still marked as broken")
+	}
+
+	if id, _ := stringToID(prevPeer.expect(t, nextinfo)[0]); id != testPeerID {
+		t.Errorf("prev told next is 0x%X, want 0x%X", id, uint64(testPeerID))
+	}
+}
+
+func TestPrevLostDuringRingRepair(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.listen(t)
+	ti.updateNetworkState(ring)
+	ti.ringBroken = 1
+	n, _ := ti.peer(t, prev, testPeerID)
+
+	n.handleDisconnect()
+
+	if s := ti.NetworkState(); s != singleNode || ti.ringBroken != 0 {
+		t.Errorf("state %q, ring broken %d after losing both neighbours", s, ti.ringBroken)
+	}
+}
+
+func TestConnectAsNextWithoutPrev(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.listen(t)
+	ti.updateNetworkState(ring)
+	n, p := ti.peer(t, none, 0)
+
+	if !n.processMessage(testMessage(1, connect, testPeerToken(testPeerID), string(next))) {
+		t.Fatal("connect rejected")
+	}
+
+	p.expectSilence(t)
+}
+
+func TestConnectAsFollower(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.listen(t)
+	ti.resetModeration(testNodeID)
+	n, p := ti.peer(t, none, 0)
+
+	if !n.processMessage(testMessage(1, connect, testPeerToken(testPeerID), string(follower), "alice")) {
+		t.Fatal("connect rejected")
+	}
+
+	if users := p.expect(t, userlist); !reflect.DeepEqual(users, []string{"alice"}) {
+		t.Errorf("userlist %v, want [alice]", users)
+	}
+
+	if u := ti.getUsername(n); u != "alice" {
+		t.Errorf("follower is %q, want alice", u)
+	}
+}
+
+func TestNetinfoConnectsToNext(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.listen(t)
+	ti.LeaveChat()
+	n, _ := ti.peer(t, prev, 0)
+	l, a := ti.remoteNode(t, "third")
+	defer l.Close()
+
+	msg := testMessage(5, netinfo, testPeerToken(testPeerID), testPeerToken(0x3000, a), "0", testPeerToken(0x4000),
+		"10.0.0.1", idToString(0x77), "lobby")
+
+	if !n.processMessage(msg) {
+		t.Fatal("netinfo rejected")
+	}
+
+	nextPeer := acceptPeer(t, l)
+	nextPeer.expect(t, challenge)
+	c := nextPeer.expect(t, connect)
+
+	if id := peerID(c[0]); id != testNodeID || c[1] != string(prev) {
+		t.Errorf("connect to next %v, want own id as prev", c)
+	}
+
+	if n.id != testPeerID {
+		t.Errorf("remote id 0x%X, want 0x%X", n.id, uint64(testPeerID))
+	}
+
+	if s := ti.NetworkState(); s != ring {
+		t.Errorf("state %q, want %q", s, ring)
+	}
+
+	if id := ti.getTwiceNextNodeID(); id != 0x4000 {
+		t.Errorf("twice next 0x%X, want 0x4000", id)
+	}
+
+	if id, name := ti.NetworkInfo(); id != 0x77 || name != "lobby" {
+		t.Errorf("network 0x%X %q, want 0x77 lobby", id, name)
+	}
+
+	// the connection handler adds the node on its own
+	waitFor(t, testReadWait, "next node", func() bool {
+		next := ti.findNodeByRelation(next)
+		return next != nil && next.id == 0x3000
+	})
+}
+
+func TestClosering(t *testing.T) {
+	t.Run("forwarded to prev", func(t *testing.T) {
+		ti := newTestInstance(t)
+		n, _ := ti.peer(t, next, testPeerID)
+		_, prevPeer := ti.peer(t, prev, 0x5000)
+
+		if !n.processMessage(testMessage(1, closering, testPeerToken(0x3000, "x:1"))) {
+			t.Fatal("closering rejected")
+		}
+
+		if sender := prevPeer.expect(t, closering); sender[0] != testPeerToken(0x3000, "x:1") {
+			t.Errorf("forwarded sender %v", sender)
+		}
+	})
+
+	t.Run("stops at sender", func(t *testing.T) {
+		ti := newTestInstance(t)
+		ti.ringBroken = 1
+		n, _ := ti.peer(t, next, testPeerID)
+		_, prevPeer := ti.peer(t, prev, 0x5000)
+
+		if !n.processMessage(testMessage(1, closering, idToString(testNodeID))) {
+			t.Fatal("closering rejected")
+		}
+
+		prevPeer.expectSilence(t)
+
+		if ti.ringBroken != 0 {
+			t.Error("ring still marked as broken")
+		}
+	})
+
+	t.Run("repairs side missing prev", func(t *testing.T) {
+		ti := newTestInstance(t)
+		ti.peer(t, next, 0x3000)
+		n, p := ti.peer(t, none, 0)
+
+		if !n.processMessage(testMessage(1, closering, idToString(testPeerID))) {
+			t.Fatal("closering rejected")
+		}
+
+		c := p.expect(t, connect)
+
+		if id, _ := stringToID(c[0]); id != testNodeID || c[1] != string(next) {
+			t.Errorf("connect %v, want own id as next", c)
+		}
+
+		if id, _ := stringToID(p.expect(t, nextinfo)[0]); id != 0x3000 {
+			t.Errorf("new prev told next is 0x%X, want 0x3000", id)
+		}
+
+		if n.r != prev || n.id != testPeerID {
+			t.Errorf("sender is %s 0x%X, want prev", n.r, n.id)
+		}
+	})
+
+	t.Run("repairs side missing prev without next", func(t *testing.T) {
+		ti := newTestInstance(t)
+		n, p := ti.peer(t, none, 0)
+
+		if !n.processMessage(testMessage(1, closering, idToString(testPeerID))) {
+			t.Fatal("closering rejected")
+		}
+
+		p.expect(t, connect)
+		p.expectSilence(t)
+	})
+}
+
+func TestElection(t *testing.T) {
+	tests := []struct {
+		name         string
+		candidate    uint64
+		participated bool
+		want         string
+		wantID       uint64
+	}{
+		{"higher candidate is forwarded", 0x9000, false, election, 0x9000},
+		{"lower candidate is replaced", 0x10, false, election, testNodeID},
+		{"lower candidate is dropped after participating", 0x10, true, "", 0},
+		{"own candidate wins", testNodeID, true, elected, testNodeID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := newTestInstance(t)
+			ti.LeaveChat()
+			n, _ := ti.peer(t, prev, testPeerID)
+			_, nextPeer := ti.peer(t, next, 0x3000)
+
+			if tt.participated {
+				ti.setElectionParticipated()
+			}
+
+			if !n.processMessage(testMessage(1, election, idToString(tt.candidate))) {
+				t.Fatal("election rejected")
+			}
+
+			if len(tt.want) == 0 {
+				nextPeer.expectSilence(t)
+				return
+			}
+
+			if id := peerID(nextPeer.expect(t, tt.want)[0]); id != tt.wantID {
+				t.Errorf("sent 0x%X, want 0x%X", id, tt.wantID)
+			}
+
+			if tt.want == elected && ti.LeaderID() != testNodeID {
+				t.Errorf("leader 0x%X, want own id", ti.LeaderID())
+			}
+		})
+	}
+}
+
+func TestElectionClearsLeader(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.LeaveChat()
+	ti.updateLeaderID(0x3000)
+	n, _ := ti.peer(t, prev, testPeerID)
+
+	if !n.processMessage(testMessage(1, election, idToString(0x9000))) {
+		t.Fatal("election rejected")
+	}
+
+	if ti.LeaderID() != 0 {
+		t.Errorf("leader 0x%X kept during election", ti.LeaderID())
+	}
+}
+
+func TestElected(t *testing.T) {
+	t.Run("forwarded", func(t *testing.T) {
+		ti := newTestInstance(t)
+		ti.LeaveChat()
+		n, _ := ti.peer(t, prev, testPeerID)
+		_, nextPeer := ti.peer(t, next, 0x3000)
+
+		if !n.processMessage(testMessage(1, elected, testPeerToken(0x9000, "x:1"))) {
+			t.Fatal("elected rejected")
+		}
+
+		if leader := nextPeer.expect(t, elected); leader[0] != testPeerToken(0x9000, "x:1") {
+			t.Errorf("forwarded %v", leader)
+		}
+
+		if ti.LeaderID() != 0x9000 {
+			t.Errorf("leader 0x%X, want 0x9000", ti.LeaderID())
+		}
+	})
+
+	t.Run("stops at leader", func(t *testing.T) {
+		ti := newTestInstance(t)
+		n, _ := ti.peer(t, prev, testPeerID)
+		_, nextPeer := ti.peer(t, next, 0x3000)
+
+		if !n.processMessage(testMessage(1, elected, idToString(testNodeID))) {
+			t.Fatal("elected rejected")
+		}
+
+		nextPeer.expectSilence(t)
+	})
+}
+
+func TestChatMessages(t *testing.T) {
+	t.Run("received", func(t *testing.T) {
+		ti := newTestInstance(t)
+		n, _ := ti.peer(t, leader, testPeerID)
+
+		if !n.processMessage(testMessage(1, chatmessage, "alice", "hello", "world")) {
+			t.Fatal("chatmessage rejected")
+		}
+
+		e := ti.events.ofType(ChatReceived)
+
+		if len(e) != 1 || e[0].User != "alice" || e[0].Text != "hello"+sepchar+"world" {
+			t.Errorf("chat events %v", e)
+		}
+	})
+
+	t.Run("broadcast by leader", func(t *testing.T) {
+		ti := newTestInstance(t)
+		n, p := ti.peer(t, follower, testPeerID)
+		ti.addChatConnection(n, "alice")
+
+		if !n.processMessage(testMessage(1, chatmessagesend, "hi")) {
+			t.Fatal("chmsgsend rejected")
+		}
+
+		if m := p.expect(t, chatmessage); !reflect.DeepEqual(m, []string{"alice", "hi"}) {
+			t.Errorf("broadcast %v", m)
+		}
+	})
+
+	t.Run("dropped from non participant", func(t *testing.T) {
+		ti := newTestInstance(t)
+		n, p := ti.peer(t, follower, testPeerID)
+
+		if !n.processMessage(testMessage(1, chatmessagesend, "hi")) {
+			t.Fatal("chmsgsend rejected")
+		}
+
+		p.expectSilence(t)
+	})
+
+	t.Run("dropped from muted user", func(t *testing.T) {
+		ti := newTestInstance(t)
+		ti.resetModeration(testNodeID)
+		n, p := ti.peer(t, follower, testPeerID)
+		ti.addChatConnection(n, "alice")
+		ti.applyModeration(testNodeID, ModMute, "alice")
+
+		if notice := p.expect(t, modnotice); notice[0] != ModMute {
+			t.Errorf("notice %v, want a mute", notice)
+		}
+
+		n.processMessage(testMessage(1, chatmessagesend, "hi"))
+
+		if notice := p.expect(t, modnotice); notice[0] != modNoticeError {
+			t.Errorf("notice %v, want an error", notice)
+		}
+
+		p.expectSilence(t)
+	})
+
+	t.Run("userlist", func(t *testing.T) {
+		ti := newTestInstance(t)
+		n, _ := ti.peer(t, leader, testPeerID)
+
+		if !n.processMessage(testMessage(1, userlist, "alice", "bob")) {
+			t.Fatal("userlist rejected")
+		}
+
+		e := ti.events.ofType(UsersChanged)
+
+		if len(e) == 0 || !reflect.DeepEqual(e[len(e)-1].Users, []string{"alice", "bob"}) {
+			t.Errorf("users events %v", e)
+		}
+	})
+}
+
+func TestNextinfo(t *testing.T) {
+	ti := newTestInstance(t)
+	n, _ := ti.peer(t, next, testPeerID)
+
+	if !n.processMessage(testMessage(1, nextinfo, testPeerToken(0x3000, "x:1"))) {
+		t.Fatal("nextinfo rejected")
+	}
+
+	if id := ti.getTwiceNextNodeID(); id != 0x3000 {
+		t.Errorf("twice next 0x%X, want 0x3000", id)
+	}
+
+	if eps := ti.getEndpoints(0x3000); !reflect.DeepEqual(eps, []string{"x:1"}) {
+		t.Errorf("endpoints %v", eps)
+	}
+}
+
+func TestThirdPartyEndpointsDontReplaceKnownOnes(t *testing.T) {
+	ti := newTestInstance(t)
+	n, _ := ti.peer(t, next, testPeerID)
+	ti.setEndpoints(0x3000, []string{"x:1"})
+
+	if !n.processMessage(testMessage(1, nextinfo, testPeerToken(0x3000, "evil:1"))) {
+		t.Fatal("nextinfo rejected")
+	}
+
+	if eps := ti.getEndpoints(0x3000); !reflect.DeepEqual(eps, []string{"x:1"}) {
+		t.Errorf("endpoints %v, want the known ones", eps)
+	}
+}
+
+func TestRelayConfirmationKeepsFollowingData(t *testing.T) {
+	ti := newTestInstance(t)
+	l, a := ti.remoteListener(t, "relay")
+	defer l.Close()
+
+	c, err := ti.dial(a)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	remote, err := l.Accept()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	// the relay opens the connection with its own challenge
+	remote.Write([]byte(ti.formatMessage(challenge, "relay") + ti.formatMessage(relayok) + ti.formatMessage(alivecheck, "7")))
+
+	r := bufio.NewReaderSize(c, ti.Config().MaxMessageLength)
+
+	if err := ti.awaitRelayConfirmation(c, r); err != nil {
+		t.Fatal(err)
+	}
+
+	// the message sent right after the confirmation reaches the node
+	line, err := r.ReadString('\n')
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := decodeMessage(strings.TrimSpace(line)); err != nil || msg.kind != alivecheck {
+		t.Errorf("next message %q, want the alivecheck", line)
+	}
+}
+
+func TestRelayRegistrationIsKept(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.SetRelayServer(true)
+	first, p := ti.peer(t, none, 0)
+	second, _ := ti.peer(t, none, 0)
+	register := testMessage(1, relayregister, testPeerToken(0x3000, "x:1"))
+
+	if !first.processMessage(register) {
+		t.Fatal("relayreg rejected")
+	}
+
+	p.expect(t, relayok)
+
+	if second.processMessage(register) {
+		t.Error("registration of a registered id from another connection accepted")
+	}
+
+	first.handleDisconnect()
+
+	if !second.processMessage(register) {
+		t.Error("registration refused after the first connection was lost")
+	}
+}
+
+func TestModerationMessages(t *testing.T) {
+	t.Run("command to non leader", func(t *testing.T) {
+		ti := newTestInstance(t)
+		n, p := ti.peer(t, follower, testPeerID)
+
+		if !n.processMessage(testMessage(1, modcommand, ModKick, "alice")) {
+			t.Fatal("modcmd rejected")
+		}
+
+		if notice := p.expect(t, modnotice); notice[0] != modNoticeError {
+			t.Errorf("notice %v, want an error", notice)
+		}
+	})
+
+	t.Run("command from non operator", func(t *testing.T) {
+		ti := newTestInstance(t)
+		ti.resetModeration(testNodeID)
+		ti.updateLeaderID(testNodeID)
+		n, p := ti.peer(t, follower, testPeerID)
+
+		if !n.processMessage(testMessage(1, modcommand, ModBan, "alice")) {
+			t.Fatal("modcmd rejected")
+		}
+
+		if notice := p.expect(t, modnotice); notice[0] != modNoticeError {
+			t.Errorf("notice %v, want an error", notice)
+		}
+
+		if ti.isBanned(0, "alice", "") {
+			t.Error("non operator banned a user")
+		}
+	})
+
+	t.Run("newer state is applied", func(t *testing.T) {
+		ti := newTestInstance(t)
+		n, _ := ti.peer(t, prev, 0x3000)
+
+		l := newTestLeader(t, testPeerID)
+		ti.updateLeaderID(testPeerID)
+		ti.knowKey(l)
+		l.applyModeration(testPeerID, ModBan, "mallory")
+		msg := l.moderationStateMessage()
+
+		if !n.processMessage(testMessage(1, msg...)) {
+			t.Fatal("modstate rejected")
+		}
+
+		if !ti.isBanned(0, "mallory", "") {
+			t.Error("ban from modstate not applied")
+		}
+
+		version, _ := strconv.ParseUint(msg[1], 10, 64)
+		older := l.moderationStateMessage()
+		older[1] = strconv.FormatUint(version-1, 10)
+
+		if !n.processMessage(testMessage(1, older...)) {
+			t.Fatal("older modstate rejected")
+		}
+
+		if !ti.isBanned(0, "mallory", "") {
+			t.Error("older modstate overwrote newer one")
+		}
+	})
+
+	t.Run("state from non neighbour is ignored", func(t *testing.T) {
+		ti := newTestInstance(t)
+		l := newTestLeader(t, 0x3000)
+		ti.updateLeaderID(0x3000)
+		ti.knowKey(l)
+		l.applyModeration(0x3000, ModBan, "alice")
+		n, _ := ti.peer(t, follower, testPeerID)
+
+		if !n.processMessage(testMessage(1, l.moderationStateMessage()...)) {
+			t.Fatal("modstate rejected")
+		}
+
+		if ti.isBanned(0, "alice", "") {
+			t.Error("modstate from a follower applied")
+		}
+	})
+
+	t.Run("state from leader is applied", func(t *testing.T) {
+		ti := newTestInstance(t)
+		l := newTestLeader(t, testPeerID)
+		ti.updateLeaderID(testPeerID)
+		ti.knowKey(l)
+		l.applyModeration(testPeerID, ModBan, "alice")
+		n, _ := ti.peer(t, follower, testPeerID)
+
+		n.processMessage(testMessage(1, l.moderationStateMessage()...))
+
+		if !ti.isBanned(0, "alice", "") {
+			t.Error("modstate from the leader not applied")
+		}
+	})
+
+	t.Run("state changed on the way is ignored", func(t *testing.T) {
+		ti := newTestInstance(t)
+		n, _ := ti.peer(t, prev, 0x3000)
+
+		l := newTestLeader(t, testPeerID)
+		ti.updateLeaderID(testPeerID)
+		ti.knowKey(l)
+		l.applyModeration(testPeerID, ModBan, "mallory")
+		msg := l.moderationStateMessage()
+		msg[len(msg)-1] = modEntryBannedNick + ":alice"
+
+		n.processMessage(testMessage(1, msg...))
+
+		if ti.isBanned(0, "alice", "") {
+			t.Error("modstate with a broken signature applied")
+		}
+	})
+
+	t.Run("state not signed by the leader is ignored", func(t *testing.T) {
+		ti := newTestInstance(t)
+		n, _ := ti.peer(t, prev, 0x3000)
+		ti.updateLeaderID(testPeerID)
+
+		// prev signs a state of its own
+		other := newTestLeader(t, 0x3000)
+		other.applyModeration(0x3000, ModBan, "alice")
+		ti.knowKey(other)
+
+		n.processMessage(testMessage(1, other.moderationStateMessage()...))
+
+		if ti.isBanned(0, "alice", "") {
+			t.Error("modstate signed by a non leader applied")
+		}
+	})
+
+	t.Run("state is passed on until the key of the leader is known", func(t *testing.T) {
+		ti := newTestInstance(t)
+		n, _ := ti.peer(t, prev, 0x3000)
+		_, nextPeer := ti.peer(t, next, 0x4000)
+
+		l := newTestLeader(t, testPeerID)
+		l.applyModeration(testPeerID, ModBan, "mallory")
+		ti.updateLeaderID(testPeerID)
+		msg := l.moderationStateMessage()
+
+		n.processMessage(testMessage(1, msg...))
+
+		if ti.isBanned(0, "mallory", "") {
+			t.Error("modstate applied without the key of the leader")
+		}
+
+		if params := nextPeer.expect(t, modstate); !reflect.DeepEqual(params, msg[1:]) {
+			t.Errorf("passed on %v, want %v", params, msg[1:])
+		}
+
+		ti.knowKey(l)
+
+		if !ti.isBanned(0, "mallory", "") {
+			t.Error("pending modstate not applied once the key of the leader was known")
+		}
+	})
+
+	t.Run("kick from non leader is ignored", func(t *testing.T) {
+		ti := newTestInstance(t)
+		n, _ := ti.peer(t, next, testPeerID)
+
+		if !n.processMessage(testMessage(1, modnotice, ModKick, "bye")) {
+			t.Fatal("modnotice rejected")
+		}
+
+		if e := ti.events.ofType(Error); len(e) != 0 {
+			t.Errorf("kick from next handled: %v", e)
+		}
+	})
+
+	t.Run("kick from leader leaves the chat", func(t *testing.T) {
+		ti := newTestInstance(t)
+		n, _ := ti.peer(t, leader, testPeerID)
+
+		n.processMessage(testMessage(1, modnotice, ModKick, "bye"))
+
+		if e := ti.events.ofType(Error); len(e) != 1 || e[0].Text != "bye" {
+			t.Errorf("error events %v", e)
+		}
+	})
+}
+
+func TestAllowMessageSeparatesChatFromControl(t *testing.T) {
+	ti := newTestInstance(t)
+	n, _ := ti.peer(t, follower, testPeerID)
+
+	for i := 0; i < ti.Config().ChatRateLimitBurst; i++ {
+		if !n.allowMessage(testMessage(1, chatmessagesend, "x")) {
+			t.Fatalf("chat message %d refused within burst", i)
+		}
+	}
+
+	if n.allowMessage(testMessage(1, chatmessagesend, "x")) {
+		t.Error("chat message over burst allowed")
+	}
+
+	if !n.allowMessage(testMessage(1, alivecheck)) {
+		t.Error("control message refused because of chat limit")
+	}
+
+	ti.clock.advance(1e9)
+
+	if !n.allowMessage(testMessage(1, chatmessagesend, "x")) {
+		t.Error("chat limit didn't refill")
+	}
+}
+
+func TestAllowMessageExemptsLeaderAndRing(t *testing.T) {
+	ti := newTestInstance(t)
+	fromLeader, _ := ti.peer(t, leader, testPeerID)
+	fromPrev, _ := ti.peer(t, prev, 0x3000)
+
+	for i := 0; i <= ti.Config().ControlRateLimitBurst; i++ {
+		if !fromLeader.allowMessage(testMessage(1, chatmessage, "bob", "x")) {
+			t.Fatalf("chatmessage %d from the leader refused", i)
+		}
+
+		if !fromPrev.allowMessage(testMessage(1, election, "abc")) {
+			t.Fatalf("election %d from prev refused", i)
+		}
+	}
+
+	for i := 0; i < ti.Config().ControlRateLimitBurst; i++ {
+		fromPrev.allowMessage(testMessage(1, alivecheck))
+	}
+
+	if fromPrev.allowMessage(testMessage(1, alivecheck)) {
+		t.Error("alivecheck from prev over burst allowed")
+	}
+}
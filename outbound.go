@@ -0,0 +1,110 @@
+package distrochya
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// what happens to a follower whose outbound queue is full, other connections are always disconnected
+// because the ring can't lose messages silently
+const (
+	SlowFollowerDisconnect = "disconnect"
+	SlowFollowerDrop       = "drop"
+)
+
+// formatted message waiting for the writer, close asks the writer to close the connection once it gets to it
+type outboundMessage struct {
+	kind  string
+	data  []byte
+	close bool
+}
+
+func newOutbox(size int) chan outboundMessage {
+	if size < 1 {
+		size = 1
+	}
+
+	return make(chan outboundMessage, size)
+}
+
+// writes queued messages in order until stopped, a failed write closes the connection
+func (n *Node) writeLoop() {
+	defer close(n.writerDone)
+
+	for {
+		n.writerWake.block(n.writerPending)
+
+		select {
+		case <-n.stopWriting:
+			return
+		case o := <-n.outbox:
+			// stopping wins over messages queued before it
+			select {
+			case <-n.stopWriting:
+				return
+			default:
+			}
+
+			if o.close {
+				n.disconnect()
+				return
+			}
+
+			n.connection.SetWriteDeadline(n.inst.getClock().Now().Add(time.Duration(n.inst.Config().SendMessageTimeoutSeconds) * time.Second))
+			_, err := n.connection.Write(o.data)
+			n.connection.SetWriteDeadline(time.Time{})
+
+			if err != nil {
+				n.logAt(LogWarn, o.kind, "WRITE ERR: "+err.Error())
+				n.disconnect()
+				return
+			}
+		}
+	}
+}
+
+func (n *Node) writerPending() bool {
+	return len(n.outbox) > 0 || n.writerStopped()
+}
+
+func (n *Node) stopWriter() {
+	n.stopOnce.Do(func() { close(n.stopWriting) })
+	n.writerWake.wake()
+}
+
+func (n *Node) writerStopped() bool {
+	select {
+	case <-n.stopWriting:
+		return true
+	default:
+		return false
+	}
+}
+
+// closes the connection after everything queued so far is written, used for messages like bans
+// which have to reach the peer before it is dropped
+func (n *Node) disconnectAfterSending() {
+	select {
+	case n.outbox <- outboundMessage{close: true}:
+		n.writerWake.wake()
+	default:
+		n.disconnect()
+	}
+}
+
+func (n *Node) handleFullOutbox(m []string, t uint64) {
+	r, id := n.relationAndID()
+
+	if r == follower && n.inst.Config().SlowFollowerPolicy == SlowFollowerDrop {
+		n.traceMessage(TraceSend, t, t, m, "queue full, dropped")
+		n.logAt(LogWarn, m[0], fmt.Sprintf("Outbound queue of 0x%X is full, dropping %s", id, m[0]))
+		atomic.AddUint64(&n.inst.metrics.outboundDropped, 1)
+		return
+	}
+
+	n.traceMessage(TraceSend, t, t, m, "queue full, disconnecting")
+	n.logAt(LogWarn, m[0], fmt.Sprintf("Outbound queue of 0x%X is full, disconnecting a slow peer", id))
+	atomic.AddUint64(&n.inst.metrics.slowPeerDisconnects, 1)
+	n.disconnect()
+}
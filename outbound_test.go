@@ -0,0 +1,145 @@
+package distrochya
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connection of a peer which doesn't read, writes block until released or closed
+type stalledConn struct {
+	net.Conn
+	release chan struct{}
+	closed  chan struct{}
+	once    *sync.Once
+}
+
+func newStalledConn() (*stalledConn, net.Conn) {
+	a, b := net.Pipe()
+	return &stalledConn{a, make(chan struct{}), make(chan struct{}), &sync.Once{}}, b
+}
+
+func (c *stalledConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.release:
+		return c.Conn.Write(b)
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *stalledConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// deadlines of the manual clock are in the past for net.Pipe
+func (c *stalledConn) SetDeadline(t time.Time) error      { return nil }
+func (c *stalledConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *stalledConn) SetReadDeadline(t time.Time) error  { return nil }
+
+func TestFullOutboundQueue(t *testing.T) {
+	tests := []struct {
+		r          relation
+		policy     string
+		disconnect bool
+	}{
+		{follower, SlowFollowerDisconnect, true},
+		{follower, SlowFollowerDrop, false},
+		{next, SlowFollowerDrop, true}, // the ring can't lose messages
+	}
+
+	for _, tt := range tests {
+		ti := newTestInstance(t)
+		ti.tune(func(c *Config) {
+			c.OutboundQueueLength = 2
+			c.SlowFollowerPolicy = tt.policy
+		})
+		c, _ := newStalledConn()
+		n := ti.nodeFromConnection(c)
+		n.setRelation(tt.r)
+
+		done := make(chan struct{})
+
+		go func() {
+			for i := 0; i < 10; i++ {
+				n.sendMessage(chatmessage, "bob", "hi")
+			}
+
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(testReadWait):
+			t.Fatalf("%s, %s: sending to a stalled peer blocked", tt.r, tt.policy)
+		}
+
+		m := ti.Metrics()
+
+		if n.writerStopped() != tt.disconnect || (m.SlowPeerDisconnects == 1) != tt.disconnect {
+			t.Errorf("%s, %s: disconnected %v, %d slow peer disconnects", tt.r, tt.policy, n.writerStopped(), m.SlowPeerDisconnects)
+		}
+
+		if !tt.disconnect && m.OutboundDropped < 7 {
+			t.Errorf("%s, %s: %d messages dropped, the queue holds at most 3", tt.r, tt.policy, m.OutboundDropped)
+		}
+
+		c.Close()
+	}
+}
+
+func TestDroppedMessagesKeepOrder(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.tune(func(c *Config) {
+		c.OutboundQueueLength = 4
+		c.SlowFollowerPolicy = SlowFollowerDrop
+	})
+	c, other := newStalledConn()
+	p := newTestPeer(other)
+	n := ti.nodeFromConnection(c)
+	n.setRelation(follower)
+
+	for _, text := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		n.sendMessage(chatmessage, "bob", text)
+	}
+
+	close(c.release)
+	dropped := int(ti.Metrics().OutboundDropped)
+	previous := ""
+
+	for i := 0; i < 8-dropped; i++ {
+		text := p.expect(t, chatmessage)[1]
+
+		if text <= previous {
+			t.Errorf("%q written after %q", text, previous)
+		}
+
+		previous = text
+	}
+
+	p.expectSilence(t)
+	c.Close()
+}
+
+func TestBroadcastSkipsStalledFollower(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.tune(func(c *Config) { c.OutboundQueueLength = 4 })
+	_, healthy := ti.peer(t, follower, testPeerID)
+	c, _ := newStalledConn()
+	stalled := ti.nodeFromConnection(c)
+	stalled.setRelation(follower)
+	stalled.setID(0x5000)
+	ti.addNode(stalled)
+
+	// a blocked broadcast would leave the healthy follower waiting
+	for i := 0; i < 20; i++ {
+		ti.broadcastToFollowers(chatmessage, "bob", "hi")
+		healthy.expect(t, chatmessage)
+	}
+
+	if !stalled.writerStopped() {
+		t.Error("stalled follower wasn't disconnected")
+	}
+}
@@ -0,0 +1,40 @@
+package distrochya
+
+import (
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens   float64
+	capacity float64
+	rate     float64 // tokens per second
+	last     time.Time
+	clock    Clock
+	lock     *sync.Mutex
+}
+
+func newTokenBucket(clock Clock, rate float64, capacity float64) *tokenBucket {
+	return &tokenBucket{capacity, capacity, rate, clock.Now(), clock, &sync.Mutex{}}
+}
+
+// returns false if there are no tokens left
+func (b *tokenBucket) take() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.clock.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
@@ -0,0 +1,44 @@
+package distrochya
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	c := newManualClock()
+	b := newTokenBucket(c, 2, 3)
+
+	for i := 0; i < 3; i++ {
+		if !b.take() {
+			t.Fatalf("token %d refused within capacity", i)
+		}
+	}
+
+	if b.take() {
+		t.Fatal("token over capacity allowed")
+	}
+
+	c.advance(500 * time.Millisecond)
+
+	if !b.take() {
+		t.Fatal("token not refilled after half a second at 2/s")
+	}
+
+	if b.take() {
+		t.Fatal("refilled more than the rate allows")
+	}
+
+	// never more than the capacity, however long it was idle
+	c.advance(time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if !b.take() {
+			t.Fatalf("token %d refused after refill", i)
+		}
+	}
+
+	if b.take() {
+		t.Fatal("refilled over capacity")
+	}
+}
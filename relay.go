@@ -0,0 +1,308 @@
+package distrochya
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// endpoint of a node that can only be reached through a relay: relay/<relay address>
+const relayEndpointPrefix = "relay/"
+
+// a way to reach a node, either directly or through a relay
+type route struct {
+	address string
+	target  uint64 // id of the node behind the relay, 0 for direct routes
+}
+
+func (inst *Instance) SetRelayAddress(a string) {
+	inst.relayAddressMutex.Lock()
+	inst.relayAddress = a
+	inst.relayAddressMutex.Unlock()
+}
+
+func (inst *Instance) RelayAddress() string {
+	inst.relayAddressMutex.Lock()
+	rtn := inst.relayAddress
+	inst.relayAddressMutex.Unlock()
+
+	return rtn
+}
+
+func (inst *Instance) SetRelayServer(enabled bool) {
+	if enabled {
+		atomic.StoreUint32(&inst.relayServerEnabled, 1)
+	} else {
+		atomic.StoreUint32(&inst.relayServerEnabled, 0)
+	}
+}
+
+func (inst *Instance) IsRelayServer() bool {
+	return atomic.LoadUint32(&inst.relayServerEnabled) != 0
+}
+
+func (inst *Instance) resetRelays() {
+	inst.relayMutex.Lock()
+	defer inst.relayMutex.Unlock()
+
+	inst.relayClients = make(map[uint64]*Node)
+
+	for _, c := range inst.pendingRelays {
+		c.Close()
+	}
+	inst.pendingRelays = make(map[string]net.Conn)
+}
+
+// replaces plain endpoint lookup, knows which nodes must be reached through a relay
+func (inst *Instance) routeToNode(id uint64) []route {
+	var rtn []route
+
+	for _, ep := range inst.getEndpoints(id) {
+		if strings.HasPrefix(ep, relayEndpointPrefix) {
+			rtn = append(rtn, route{strings.TrimPrefix(ep, relayEndpointPrefix), id})
+		} else {
+			rtn = append(rtn, route{ep, 0})
+		}
+	}
+
+	return rtn
+}
+
+// the returned reader has to be handed to the node together with the connection
+func (inst *Instance) dialRoute(rt route) (net.Conn, *bufio.Reader, error) {
+	c, err := inst.dial(rt.address)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := bufio.NewReaderSize(c, inst.Config().MaxMessageLength)
+
+	if rt.target == 0 {
+		return c, r, nil
+	}
+
+	if _, err := c.Write([]byte(inst.formatMessage(relayrequest, idToString(rt.target)))); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+
+	if err := inst.awaitRelayConfirmation(c, r); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+
+	return c, r, nil
+}
+
+// reads a single message from r, whatever it buffered past the message stays in r for the node
+func (inst *Instance) readRawMessage(c net.Conn, r *bufio.Reader) (string, error) {
+	c.SetReadDeadline(inst.getClock().Now().Add(time.Duration(inst.Config().DialTimeoutSeconds) * 2 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+
+	line, err := r.ReadSlice('\n')
+
+	if err == bufio.ErrBufferFull {
+		return "", errors.New("message too long")
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(line)), nil
+}
+
+// the relay opens the connection with its own challenge, the node on the other side sends another after relayok
+func (inst *Instance) awaitRelayConfirmation(c net.Conn, r *bufio.Reader) error {
+	for {
+		m, err := inst.readRawMessage(c, r)
+
+		if err != nil {
+			return err
+		}
+
+		msg, err := decodeMessage(m)
+
+		if err == nil && msg.kind == challenge {
+			continue
+		}
+
+		if err != nil || msg.kind != relayok {
+			return errors.New("relay refused the connection")
+		}
+
+		return nil
+	}
+}
+
+func (inst *Instance) registerWithRelay() {
+	a := inst.RelayAddress()
+
+	if len(a) == 0 {
+		return
+	}
+
+	relayNode := inst.connectToNode(a)
+
+	if relayNode == nil {
+		inst.userError("unable to connect to relay " + a)
+		return
+	}
+
+	relayNode.lock.Lock()
+	relayNode.setRelation(relay)
+	relayNode.lock.Unlock()
+
+	inst.log(fmt.Sprintf("Sending relay registration, relay=%s, my_id=0x%X", a, inst.getNodeID()))
+	relayNode.sendMessage(relayregister, inst.peerToString(inst.getNodeID()))
+}
+
+// relay server: node behind NAT keeps this connection open so it can be asked to connect back
+func (inst *Instance) handleRelayRegister(n *Node, p peerToken) bool {
+	if !inst.IsRelayServer() {
+		return false
+	}
+
+	// the first registration keeps the id until its connection is lost, nobody else may take over its traffic
+	inst.relayMutex.Lock()
+	if existing := inst.relayClients[p.id]; existing != nil && existing != n {
+		inst.relayMutex.Unlock()
+		inst.warnLog(fmt.Sprintf("Refusing relay registration of 0x%X, it is already registered from another connection", p.id))
+		return false
+	}
+	inst.relayClients[p.id] = n
+	inst.relayMutex.Unlock()
+
+	id := inst.rememberOwnPeer(p)
+
+	n.lock.Lock()
+	n.setID(id)
+	n.setRelation(relayClient)
+	n.lock.Unlock()
+
+	inst.log(fmt.Sprintf("Registered relay client, id=0x%X", id))
+	n.sendMessage(relayok)
+
+	return true
+}
+
+func (inst *Instance) removeRelayClient(n *Node) {
+	inst.relayMutex.Lock()
+	defer inst.relayMutex.Unlock()
+
+	if inst.relayClients[n.id] == n {
+		delete(inst.relayClients, n.id)
+	}
+}
+
+// relay server: someone wants to reach a registered node
+func (inst *Instance) handleRelayRequest(n *Node, targetID uint64) bool {
+	if !inst.IsRelayServer() {
+		return false
+	}
+
+	inst.relayMutex.Lock()
+	target := inst.relayClients[targetID]
+
+	if target == nil {
+		inst.relayMutex.Unlock()
+		inst.warnLog(fmt.Sprintf("Relay request for unknown node 0x%X", targetID))
+		return false
+	}
+
+	token := randomToken()
+	inst.pendingRelays[token] = n.connection
+	inst.relayMutex.Unlock()
+
+	n.detach()
+
+	inst.log(fmt.Sprintf("Relaying connection to 0x%X, asking it to connect back, token=%s", targetID, token))
+	target.sendMessage(relayconnect, token)
+
+	inst.getClock().AfterFunc(time.Duration(inst.Config().DialTimeoutSeconds)*2*time.Second, func() {
+		inst.relayMutex.Lock()
+		c := inst.pendingRelays[token]
+		delete(inst.pendingRelays, token)
+		inst.relayMutex.Unlock()
+
+		if c != nil {
+			inst.log(fmt.Sprintf("Relayed node 0x%X didn't connect back in time, token=%s", targetID, token))
+			c.Close()
+		}
+	})
+
+	return true
+}
+
+// relay server: node behind NAT connected back, both connections get spliced together
+func (inst *Instance) handleRelayAccept(n *Node, token string) bool {
+	inst.relayMutex.Lock()
+	c := inst.pendingRelays[token]
+	delete(inst.pendingRelays, token)
+	inst.relayMutex.Unlock()
+
+	if c == nil {
+		inst.warnLog("Relay accept with unknown token " + token)
+		return false
+	}
+
+	n.detach()
+
+	confirmation := []byte(inst.formatMessage(relayok))
+	c.Write(confirmation)
+	n.connection.Write(confirmation)
+
+	inst.log(fmt.Sprintf("Relaying connection %s <-> %s", c.RemoteAddr().String(), n.connection.RemoteAddr().String()))
+	inst.spawn(func() { inst.splice(c, n.connection) })
+
+	return true
+}
+
+func (inst *Instance) splice(a net.Conn, b net.Conn) {
+	inst.spawn(func() {
+		io.Copy(a, b)
+		a.Close()
+		b.Close()
+	})
+
+	io.Copy(b, a)
+	a.Close()
+	b.Close()
+}
+
+// relay client: relay asks us to connect back because somebody wants to reach us
+func (inst *Instance) handleRelayConnect(token string) {
+	a := inst.RelayAddress()
+
+	c, err := inst.dial(a)
+
+	if err != nil {
+		inst.warnLog(fmt.Sprintf("Connecting back to relay %s failed: %s", a, err.Error()))
+		return
+	}
+
+	if _, err := c.Write([]byte(inst.formatMessage(relayaccept, token))); err != nil {
+		c.Close()
+		return
+	}
+
+	r := bufio.NewReaderSize(c, inst.Config().MaxMessageLength)
+
+	if err := inst.awaitRelayConfirmation(c, r); err != nil {
+		inst.warnLog(fmt.Sprintf("Relay %s refused connection: %s", a, err.Error()))
+		c.Close()
+		return
+	}
+
+	inst.log(fmt.Sprintf("New relayed connection through %s", a))
+
+	// the relayed node dialed us, so we are the accepting side
+	n := inst.acceptNode(c, r)
+	inst.spawn(n.handleConnection)
+}
@@ -0,0 +1,317 @@
+package distrochya
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// status of a ring walk, anything but walkInProgress means the walk was sent back to its origin early
+const (
+	walkInProgress = "walk"
+	walkNoNext     = "nonext"
+	walkLoop       = "loop"
+	walkTooLong    = "toolong"
+)
+
+var walkEndReasons = map[string]string{
+	walkNoNext:  "the walk reached a node without next",
+	walkLoop:    "the walk reached a loop which doesn't lead back to this node",
+	walkTooLong: "the ring has too many nodes for a single message",
+}
+
+// view of a single node collected by a ring walk, 0 where the node doesn't know the ID
+type RingNode struct {
+	ID        uint64
+	Next      uint64
+	Prev      uint64
+	Leader    uint64
+	TwiceNext uint64
+}
+
+// inconsistency found by a ring walk, NodeID is 0 if it isn't about a single node
+type RingProblem struct {
+	NodeID uint64
+	Text   string
+}
+
+// ring as seen by the nodes on it, in the order of the walk starting with this node
+type RingWalk struct {
+	Nodes    []RingNode
+	Closed   bool // the walk came back to this node through next
+	Problems []RingProblem
+}
+
+func formatRingNode(rn RingNode) string {
+	ids := []uint64{rn.ID, rn.Next, rn.Prev, rn.Leader, rn.TwiceNext}
+	s := make([]string, len(ids))
+
+	for i, id := range ids {
+		s[i] = idToString(id)
+	}
+
+	return strings.Join(s, ",")
+}
+
+func parseRingNode(s string) (RingNode, error) {
+	parts := strings.Split(s, ",")
+
+	if len(parts) != 5 {
+		return RingNode{}, fmt.Errorf("%d fields, need 5", len(parts))
+	}
+
+	var ids [5]uint64
+
+	for i, p := range parts {
+		id, err := stringToID(p)
+
+		if err != nil {
+			return RingNode{}, err
+		}
+
+		ids[i] = id
+	}
+
+	return RingNode{ids[0], ids[1], ids[2], ids[3], ids[4]}, nil
+}
+
+func (inst *Instance) ringNode() RingNode {
+	rn := RingNode{ID: inst.getNodeID(), Leader: inst.LeaderID(), TwiceNext: inst.getTwiceNextNodeID()}
+
+	if n := inst.findNodeByRelation(next); n != nil {
+		_, rn.Next = n.relationAndID()
+	}
+
+	if n := inst.findNodeByRelation(prev); n != nil {
+		_, rn.Prev = n.relationAndID()
+	}
+
+	return rn
+}
+
+func ringWalkParams(w ringwalkMessage) []string {
+	params := []string{ringwalk, w.token, w.status, w.origin.String()}
+
+	for _, rn := range w.nodes {
+		params = append(params, formatRingNode(rn))
+	}
+
+	return params
+}
+
+// sends a ringwalk around the ring and waits for it to come back, the nodes on the way add their view of the ring
+func (inst *Instance) WalkRing(timeout time.Duration) RingWalk {
+	self := inst.ringNode()
+	nextNode := inst.findNodeByRelation(next)
+
+	if nextNode == nil {
+		if inst.NetworkState() == singleNode {
+			return analyzeRing([]RingNode{self}, true, "")
+		}
+
+		return analyzeRing([]RingNode{self}, false, "this node has no next")
+	}
+
+	token := randomToken()
+	done := make(chan ringwalkMessage, 1)
+
+	inst.ringWalksMutex.Lock()
+	inst.ringWalks[token] = done
+	inst.ringWalksMutex.Unlock()
+
+	defer func() {
+		inst.ringWalksMutex.Lock()
+		delete(inst.ringWalks, token)
+		inst.ringWalksMutex.Unlock()
+	}()
+
+	timedOut := make(chan struct{})
+	timer := inst.getClock().AfterFunc(timeout, func() { close(timedOut) })
+	defer timer.Stop()
+
+	w := ringwalkMessage{token, walkInProgress, peerToken{self.ID, inst.getEndpoints(self.ID)}, []RingNode{self}}
+	inst.log(fmt.Sprintf("Sending ringwalk, target_id=0x%X, token=%s", self.Next, token))
+	nextNode.sendMessage(ringWalkParams(w)...)
+
+	select {
+	case w = <-done:
+	case <-timedOut:
+		return analyzeRing([]RingNode{self}, false, fmt.Sprintf("the walk didn't come back within %s", timeout))
+	}
+
+	if w.status == walkInProgress {
+		return analyzeRing(w.nodes, true, "")
+	}
+
+	reason, ok := walkEndReasons[w.status]
+
+	if !ok {
+		reason = "the walk ended early: " + w.status
+	}
+
+	return analyzeRing(w.nodes, false, reason)
+}
+
+func (n *Node) handleRingWalk(w ringwalkMessage) {
+	inst := n.inst
+	self := inst.ringNode()
+
+	if len(w.nodes) > 0 && w.nodes[0].ID == self.ID {
+		inst.ringWalksMutex.Lock()
+		done := inst.ringWalks[w.token]
+		inst.ringWalksMutex.Unlock()
+
+		if done == nil {
+			n.log(ringwalk, fmt.Sprintf("Discarding ringwalk nobody waits for, token=%s", w.token))
+			return
+		}
+
+		select {
+		case done <- w:
+		default:
+		}
+
+		return
+	}
+
+	for _, rn := range w.nodes {
+		if rn.ID == self.ID {
+			inst.endRingWalk(w, walkLoop)
+			return
+		}
+	}
+
+	w.nodes = append(w.nodes, self)
+
+	// leaves room for the magic and the timestamp
+	if len(strings.Join(ringWalkParams(w), sepchar))+64 > inst.Config().MaxMessageLength {
+		w.nodes = w.nodes[:len(w.nodes)-1]
+		inst.endRingWalk(w, walkTooLong)
+		return
+	}
+
+	nextNode := inst.findNodeByRelation(next)
+
+	if nextNode == nil {
+		inst.endRingWalk(w, walkNoNext)
+		return
+	}
+
+	n.log(ringwalk, fmt.Sprintf("Forwarding ringwalk, target_id=0x%X, token=%s", self.Next, w.token))
+	nextNode.sendMessage(ringWalkParams(w)...)
+}
+
+// sends the walk straight back to its origin, which can't be reached through next
+func (inst *Instance) endRingWalk(w ringwalkMessage, status string) {
+	originID := inst.rememberPeer(w.origin)
+	inst.warnLog(fmt.Sprintf("Ending ringwalk early (%s), sending it back to origin_id=0x%X", status, originID))
+
+	c := inst.connectToNodeID(originID)
+
+	if c == nil {
+		return
+	}
+
+	w.status = status
+	c.sendMessage(ringWalkParams(w)...)
+	c.disconnectAfterSending()
+}
+
+// looks for inconsistencies between views of neighbouring nodes
+func analyzeRing(nodes []RingNode, closed bool, reason string) RingWalk {
+	w := RingWalk{Nodes: nodes, Closed: closed}
+	problem := func(id uint64, format string, a ...interface{}) {
+		w.Problems = append(w.Problems, RingProblem{id, fmt.Sprintf(format, a...)})
+	}
+
+	if !closed {
+		problem(0, "ring isn't closed: %s", reason)
+	}
+
+	// a single node without neighbours is a complete ring
+	if closed && len(nodes) == 1 && nodes[0].Next == 0 {
+		if nodes[0].Leader != nodes[0].ID {
+			problem(nodes[0].ID, "single node isn't its own leader (leader 0x%X)", nodes[0].Leader)
+		}
+
+		return w
+	}
+
+	// the node after i, if the walk knows it
+	after := func(i int, d int) (RingNode, bool) {
+		if i+d < len(nodes) {
+			return nodes[i+d], true
+		}
+
+		if closed {
+			return nodes[(i+d)%len(nodes)], true
+		}
+
+		return RingNode{}, false
+	}
+
+	leaders := make(map[uint64]int)
+
+	for i, rn := range nodes {
+		if rn.Prev == 0 {
+			problem(rn.ID, "0x%X has no prev", rn.ID)
+		}
+
+		if rn.Next == 0 {
+			problem(rn.ID, "0x%X has no next", rn.ID)
+		}
+
+		if nxt, ok := after(i, 1); ok {
+			if nxt.ID != rn.Next {
+				problem(rn.ID, "0x%X has next 0x%X, but the walk continued to 0x%X", rn.ID, rn.Next, nxt.ID)
+			} else if nxt.Prev != rn.ID && nxt.Prev != 0 {
+				problem(nxt.ID, "0x%X has prev 0x%X, but 0x%X has it as next", nxt.ID, nxt.Prev, rn.ID)
+			}
+		}
+
+		if twice, ok := after(i, 2); ok && twice.ID != rn.TwiceNext {
+			problem(rn.ID, "0x%X has twice next 0x%X, but the ring continues with 0x%X", rn.ID, rn.TwiceNext, twice.ID)
+		}
+
+		if rn.Leader == 0 {
+			problem(rn.ID, "0x%X has no leader", rn.ID)
+		} else {
+			leaders[rn.Leader]++
+		}
+	}
+
+	var ids []uint64
+
+	for id := range leaders {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if len(ids) > 1 {
+		var views []string
+
+		for _, id := range ids {
+			views = append(views, fmt.Sprintf("0x%X (%d nodes)", id, leaders[id]))
+		}
+
+		problem(0, "nodes disagree on the leader: %s", strings.Join(views, ", "))
+	}
+
+	if closed {
+		for _, id := range ids {
+			found := false
+
+			for _, rn := range nodes {
+				found = found || rn.ID == id
+			}
+
+			if !found {
+				problem(0, "leader 0x%X isn't on the ring", id)
+			}
+		}
+	}
+
+	return w
+}
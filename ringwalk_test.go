@@ -0,0 +1,112 @@
+package distrochya
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnalyzeRing(t *testing.T) {
+	a, b, c := uint64(0xA), uint64(0xB), uint64(0xC)
+
+	consistent := []RingNode{{a, b, c, c, c}, {b, c, a, c, a}, {c, a, b, c, b}}
+
+	if w := analyzeRing(consistent, true, ""); len(w.Problems) != 0 {
+		t.Errorf("consistent ring has problems %v", w.Problems)
+	}
+
+	if w := analyzeRing([]RingNode{{a, 0, 0, a, 0}}, true, ""); len(w.Problems) != 0 {
+		t.Errorf("single node has problems %v", w.Problems)
+	}
+
+	tests := []struct {
+		nodes  []RingNode
+		closed bool
+		want   []string
+	}{
+		// B thinks its prev is C
+		{[]RingNode{{a, b, c, c, c}, {b, c, c, c, a}, {c, a, b, c, b}}, true, []string{"0xB has prev 0xC, but 0xA has it as next"}},
+		// C still follows the old leader
+		{[]RingNode{{a, b, c, c, c}, {b, c, a, c, a}, {c, a, b, 0xD, b}}, true, []string{"disagree on the leader: 0xC (2 nodes), 0xD (1 nodes)", "leader 0xD isn't on the ring"}},
+		{[]RingNode{{a, b, c, c, c}, {b, c, a, 0, a}}, false, []string{"ring isn't closed: lost", "0xB has no leader"}},
+		{[]RingNode{{a, b, 0, c, b}, {b, c, a, c, a}, {c, 0, b, c, 0}}, false, []string{"ring isn't closed", "0xA has no prev", "0xA has twice next 0xB, but the ring continues with 0xC", "0xC has no next"}},
+	}
+
+	for i, tt := range tests {
+		w := analyzeRing(tt.nodes, tt.closed, "lost")
+		var got []string
+
+		for _, p := range w.Problems {
+			got = append(got, p.Text)
+		}
+
+		if len(got) != len(tt.want) {
+			t.Errorf("%d: problems %q, want %q", i, got, tt.want)
+			continue
+		}
+
+		for j := range got {
+			if !strings.Contains(got[j], tt.want[j]) {
+				t.Errorf("%d: problem %q, want %q", i, got[j], tt.want[j])
+			}
+		}
+	}
+}
+
+// a node without next sends the walk straight back to the node which started it
+func TestRingWalkReturnsToOrigin(t *testing.T) {
+	ti := newTestInstance(t)
+	n, _ := ti.peer(t, prev, testPeerID)
+	ti.updateLeaderID(testPeerID)
+
+	l, a := ti.remoteNode(t, "origin")
+	defer l.Close()
+
+	origin := RingNode{ID: testPeerID, Next: testNodeID, Leader: testPeerID}
+	w := ringwalkMessage{"tok", walkInProgress, peerToken{testPeerID, []string{a}}, []RingNode{origin}}
+
+	go n.processMessage(testMessage(1, ringWalkParams(w)...))
+
+	p := acceptPeer(t, l)
+	defer p.conn.Close()
+	p.expect(t, challenge)
+
+	params := p.expect(t, ringwalk)
+
+	if len(params) != 5 || params[0] != "tok" || params[1] != walkNoNext {
+		t.Fatalf("walk came back as %q", params)
+	}
+
+	if rn, err := parseRingNode(params[4]); err != nil || rn != (RingNode{testNodeID, 0, testPeerID, testPeerID, 0}) {
+		t.Errorf("this node added %+v, %v", rn, err)
+	}
+}
+
+func TestLoopbackRingWalk(t *testing.T) {
+	nodes := startLoopbackNetwork(t, 3)
+	defer stopLoopbackNetwork(nodes)
+
+	w := nodes[1].WalkRing(loopbackWait)
+
+	if !w.Closed || len(w.Nodes) != 3 || len(w.Problems) != 0 {
+		t.Fatalf("walk %+v", w)
+	}
+
+	if w.Nodes[0].ID != nodes[1].Snapshot().NodeID {
+		t.Errorf("walk starts at 0x%X", w.Nodes[0].ID)
+	}
+
+	for i, rn := range w.Nodes {
+		if rn.Next != w.Nodes[(i+1)%3].ID {
+			t.Errorf("walk didn't follow next: %+v", w.Nodes)
+		}
+	}
+
+	// nobody answers a walk from a single node, it is complete right away
+	single := startLoopbackNetwork(t, 1)
+	defer stopLoopbackNetwork(single)
+
+	if w := single[0].WalkRing(time.Second); !w.Closed || len(w.Nodes) != 1 {
+		t.Errorf("walk of a single node %+v", w)
+	}
+}
@@ -0,0 +1,256 @@
+package sim
+
+import (
+	"github.com/Silaedru/distrochya"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// virtual time, it only moves when the simulation advances it and only once every goroutine the clock knows
+// of is blocked; instances report their goroutines as ready or blocked, timers due at the same time fire in
+// seeded order
+type Clock struct {
+	lock   *sync.Mutex
+	idle   *sync.Cond // broadcast whenever ready drops to zero
+	now    time.Time
+	timers []*timer
+	seq    uint64
+	rand   *rand.Rand // orders timers set through the clock itself rather than an instance view
+	ready  int        // goroutines which may still do something at the current time
+}
+
+// clock of a single instance, the order of its timers is drawn from its own source so that instances
+// setting timers at the same time don't depend on each other
+type instanceClock struct {
+	clock *Clock
+	lock  *sync.Mutex
+	rand  *rand.Rand
+}
+
+type timer struct {
+	clock  *Clock
+	at     time.Time
+	order  int64
+	seq    uint64
+	f      func()
+	wake   chan struct{}
+	active bool
+}
+
+func NewClock(start time.Time, seed int64) *Clock {
+	c := &Clock{lock: &sync.Mutex{}, now: start, rand: rand.New(rand.NewSource(seed))}
+	c.idle = sync.NewCond(c.lock)
+	return c
+}
+
+func (c *Clock) instance(seed int64) *instanceClock {
+	return &instanceClock{c, &sync.Mutex{}, rand.New(rand.NewSource(seed))}
+}
+
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *Clock) Sleep(d time.Duration) {
+	c.sleep(d, c.order())
+}
+
+func (c *Clock) AfterFunc(d time.Duration, f func()) distrochya.Timer {
+	return c.add(d, f, c.order())
+}
+
+func (c *Clock) Ready() {
+	c.lock.Lock()
+	c.ready++
+	c.lock.Unlock()
+}
+
+func (c *Clock) Blocked() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.ready--
+
+	if c.ready < 0 {
+		panic("sim: more goroutines blocked than were ready")
+	}
+
+	if c.ready == 0 {
+		c.idle.Broadcast()
+	}
+}
+
+// runs f in a new goroutine which counts as ready until f returns
+func (c *Clock) spawn(f func()) {
+	c.Ready()
+
+	go func() {
+		defer c.Blocked()
+		f()
+	}()
+}
+
+func (c *Clock) order() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.rand.Int63()
+}
+
+// the caller is blocked until the timer wakes it up
+func (c *Clock) sleep(d time.Duration, order int64) {
+	if d <= 0 {
+		return
+	}
+
+	t := c.add(d, nil, order)
+	c.Blocked()
+	<-t.wake
+}
+
+func (c *Clock) add(d time.Duration, f func(), order int64) *timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if d < 0 {
+		d = 0
+	}
+
+	c.seq++
+	t := &timer{c, c.now.Add(d), order, c.seq, f, make(chan struct{}), true}
+
+	i := len(c.timers)
+	for i > 0 && t.before(c.timers[i-1]) {
+		i--
+	}
+
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+
+	return t
+}
+
+func (ic *instanceClock) Now() time.Time {
+	return ic.clock.Now()
+}
+
+func (ic *instanceClock) Sleep(d time.Duration) {
+	ic.clock.sleep(d, ic.order())
+}
+
+func (ic *instanceClock) AfterFunc(d time.Duration, f func()) distrochya.Timer {
+	return ic.clock.add(d, f, ic.order())
+}
+
+func (ic *instanceClock) Ready() {
+	ic.clock.Ready()
+}
+
+func (ic *instanceClock) Blocked() {
+	ic.clock.Blocked()
+}
+
+func (ic *instanceClock) order() int64 {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	return ic.rand.Int63()
+}
+
+func (t *timer) before(o *timer) bool {
+	if !t.at.Equal(o.at) {
+		return t.at.Before(o.at)
+	}
+
+	if t.order != o.order {
+		return t.order < o.order
+	}
+
+	return t.seq < o.seq
+}
+
+func (t *timer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	if !t.active {
+		return false
+	}
+
+	t.active = false
+
+	for i, o := range t.clock.timers {
+		if o == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			break
+		}
+	}
+
+	return true
+}
+
+// waits until every goroutine is blocked, on a timer or on work that only a timer can hand it
+func (c *Clock) settle() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for c.ready > 0 {
+		c.idle.Wait()
+	}
+}
+
+// fires the earliest timer due no later than limit, returns false if there is none
+func (c *Clock) step(limit time.Time) bool {
+	c.lock.Lock()
+
+	if len(c.timers) == 0 || c.timers[0].at.After(limit) {
+		c.lock.Unlock()
+		return false
+	}
+
+	t := c.timers[0]
+	c.timers = c.timers[1:]
+	t.active = false
+
+	if t.at.After(c.now) {
+		c.now = t.at
+	}
+
+	// the sleeper or the callback is ready before the clock can settle again
+	c.ready++
+	c.lock.Unlock()
+
+	if t.f == nil {
+		close(t.wake)
+		return true
+	}
+
+	go func() {
+		defer c.Blocked()
+		t.f()
+	}()
+
+	return true
+}
+
+// moves the time forward by d, letting everything settle after each timer
+func (c *Clock) Advance(d time.Duration) {
+	limit := c.Now().Add(d)
+
+	c.settle()
+
+	for c.step(limit) {
+		c.settle()
+	}
+
+	c.lock.Lock()
+	if c.now.Before(limit) {
+		c.now = limit
+	}
+	c.lock.Unlock()
+}
@@ -0,0 +1,129 @@
+package sim
+
+import (
+	"fmt"
+	"github.com/Silaedru/distrochya"
+	"io"
+	"time"
+)
+
+const (
+	scenarioNodes     = 5
+	convergeTimeLimit = 3 * time.Minute
+)
+
+type Scenario struct {
+	Name        string
+	Description string
+	Run         func(s *Simulation) error
+}
+
+var Scenarios = []Scenario{
+	{"join", "nodes join one by one, the ring has to hold after every join", scenarioJoin},
+	{"kill-leader", "the leader dies, the rest repairs the ring and elects a new leader", scenarioKillLeader},
+	{"kill-adjacent", "two neighbouring nodes die at once", scenarioKillAdjacent},
+	{"kill-follower", "a node which isn't the leader dies", scenarioKillFollower},
+	{"partition", "one node is cut off from the rest, both sides have to end up as networks of their own", scenarioPartition},
+}
+
+func FindScenario(name string) *Scenario {
+	for i := range Scenarios {
+		if Scenarios[i].Name == name {
+			return &Scenarios[i]
+		}
+	}
+
+	return nil
+}
+
+// runs a scenario with a fresh simulation of nodes using config, steps go to out and the protocol log
+// to log if not nil
+func RunScenario(sc *Scenario, seed int64, config distrochya.Config, out io.Writer, log io.Writer) error {
+	s := New(seed, config, out)
+	s.SetLog(log)
+	defer s.Stop()
+
+	s.printf("scenario %s, seed %d", sc.Name, seed)
+	return sc.Run(s)
+}
+
+// joins n nodes, checking the invariants after every join
+func (s *Simulation) joinNodes(n int) error {
+	for i := 0; i < n; i++ {
+		s.AddNode()
+
+		if err := s.Converge(convergeTimeLimit); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scenarioJoin(s *Simulation) error {
+	return s.joinNodes(scenarioNodes)
+}
+
+func scenarioKillLeader(s *Simulation) error {
+	if err := s.joinNodes(scenarioNodes); err != nil {
+		return err
+	}
+
+	l := s.Leader(s.Alive()[0])
+
+	if l == nil {
+		return fmt.Errorf("no leader to kill (seed %d)", s.seed)
+	}
+
+	s.Kill(l)
+	return s.Converge(convergeTimeLimit)
+}
+
+func scenarioKillAdjacent(s *Simulation) error {
+	if err := s.joinNodes(scenarioNodes); err != nil {
+		return err
+	}
+
+	live := s.Alive()
+	a := live[s.rand.Intn(len(live))]
+	b := s.Peer(a, "next")
+
+	if b == nil {
+		return fmt.Errorf("%s has no next node (seed %d)", a.Host, s.seed)
+	}
+
+	s.Kill(a, b)
+	return s.Converge(convergeTimeLimit)
+}
+
+func scenarioKillFollower(s *Simulation) error {
+	if err := s.joinNodes(scenarioNodes); err != nil {
+		return err
+	}
+
+	var followers []*Node
+	l := s.Leader(s.Alive()[0])
+
+	for _, n := range s.Alive() {
+		if n != l {
+			followers = append(followers, n)
+		}
+	}
+
+	s.Kill(followers[s.rand.Intn(len(followers))])
+	return s.Converge(convergeTimeLimit)
+}
+
+func scenarioPartition(s *Simulation) error {
+	if err := s.joinNodes(scenarioNodes); err != nil {
+		return err
+	}
+
+	live := s.Alive()
+	i := s.rand.Intn(len(live))
+	cut := live[i]
+	rest := append(append([]*Node{}, live[:i]...), live[i+1:]...)
+
+	s.Partition([]*Node{cut}, rest)
+	return s.Converge(convergeTimeLimit, []*Node{cut}, rest)
+}
@@ -0,0 +1,42 @@
+package sim
+
+import (
+	"bytes"
+	"github.com/Silaedru/distrochya"
+	"testing"
+)
+
+var scenarioSeeds = []int64{1, 2, 3}
+
+func TestScenarios(t *testing.T) {
+	for _, sc := range Scenarios {
+		sc := sc
+
+		for _, seed := range scenarioSeeds {
+			var out bytes.Buffer
+
+			if err := RunScenario(&sc, seed, distrochya.DefaultConfig(), &out, nil); err != nil {
+				t.Errorf("%s, seed %d: %s\n%s", sc.Name, seed, err.Error(), out.String())
+			}
+		}
+	}
+}
+
+func TestScenarioIsReproducible(t *testing.T) {
+	var first bytes.Buffer
+	var second bytes.Buffer
+
+	sc := FindScenario("kill-leader")
+
+	if err := RunScenario(sc, 7, distrochya.DefaultConfig(), &first, nil); err != nil {
+		t.Fatalf("first run: %s\n%s", err.Error(), first.String())
+	}
+
+	if err := RunScenario(sc, 7, distrochya.DefaultConfig(), &second, nil); err != nil {
+		t.Fatalf("second run: %s\n%s", err.Error(), second.String())
+	}
+
+	if first.String() != second.String() {
+		t.Errorf("runs with the same seed differ:\n%s\n---\n%s", first.String(), second.String())
+	}
+}
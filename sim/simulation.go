@@ -0,0 +1,411 @@
+// Package sim runs scripted scenarios against several distrochya instances on an in-memory network
+// with virtual time and checks the ring invariants after every step.
+//
+// Node IDs, election waits, link latencies and timer ordering are all drawn from the seed, so a failing
+// scenario can be replayed with the same seed. Every node draws from a source of its own. The instances
+// report each goroutine they start and each wait for another goroutine to the virtual clock, which only
+// moves the time once none of them is ready. Goroutines that are ready at the same instant still run
+// concurrently. A run can therefore differ only in the order in which a single node handles events of one
+// instant, such as messages arriving on two connections at once.
+package sim
+
+import (
+	"fmt"
+	"github.com/Silaedru/distrochya"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	simulationPort       = 9999
+	convergeCheckSeconds = 1
+)
+
+var simulationStart = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type Node struct {
+	Host     string
+	Instance *distrochya.Instance
+	alive    bool
+}
+
+type Simulation struct {
+	seed    int64
+	rand    *rand.Rand
+	clock   *Clock
+	network *distrochya.MemoryNetwork
+	nodes   []*Node
+	config  distrochya.Config // of every added node
+	out     io.Writer         // steps and their results
+
+	logLock *sync.Mutex
+	log     io.Writer // protocol log of all nodes, may be nil
+}
+
+func New(seed int64, config distrochya.Config, out io.Writer) *Simulation {
+	r := rand.New(rand.NewSource(seed))
+
+	s := &Simulation{
+		seed:    seed,
+		rand:    r,
+		clock:   NewClock(simulationStart, r.Int63()),
+		network: distrochya.NewMemoryNetwork(r.Int63()),
+		config:  config,
+		out:     out,
+		logLock: &sync.Mutex{},
+	}
+
+	s.network.SetClock(s.clock)
+	s.network.SetDefaultLink(distrochya.LinkConfig{Latency: time.Millisecond, Jitter: 5 * time.Millisecond})
+
+	return s
+}
+
+// protocol log of every node is written to w, prefixed by the node's host
+func (s *Simulation) SetLog(w io.Writer) {
+	s.logLock.Lock()
+	s.log = w
+	s.logLock.Unlock()
+}
+
+func (s *Simulation) Network() *distrochya.MemoryNetwork {
+	return s.network
+}
+
+func (s *Simulation) Clock() *Clock {
+	return s.clock
+}
+
+func (s *Simulation) printf(format string, a ...interface{}) {
+	elapsed := s.clock.Now().Sub(simulationStart)
+	fmt.Fprintf(s.out, "[%8.3fs] %s\n", elapsed.Seconds(), fmt.Sprintf(format, a...))
+}
+
+func (s *Simulation) handler(host string) func(distrochya.Event) {
+	return func(e distrochya.Event) {
+		var line string
+
+		switch e.Type {
+		case distrochya.Log:
+			line = fmt.Sprintf("(%8d) %s", e.Time, e.Text)
+		case distrochya.Error:
+			line = "error: " + e.Text
+		case distrochya.Notice:
+			line = e.Text
+		default:
+			return
+		}
+
+		s.logLock.Lock()
+		if s.log != nil {
+			fmt.Fprintf(s.log, "%-4s %s\n", host, line)
+		}
+		s.logLock.Unlock()
+	}
+}
+
+// runs f, advancing the time until it returns
+func (s *Simulation) do(f func()) {
+	done := make(chan struct{})
+
+	s.clock.spawn(func() {
+		f()
+		close(done)
+	})
+
+	for {
+		s.clock.settle()
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		s.clock.Advance(convergeCheckSeconds * time.Second)
+	}
+}
+
+// adds a node which starts a new network if there is no live node, otherwise it joins a random live node
+func (s *Simulation) AddNode() *Node {
+	host := fmt.Sprintf("n%d", len(s.nodes))
+	inst := distrochya.New(s.handler(host), s.config)
+
+	clock := s.clock.instance(s.rand.Int63())
+	s.network.SetHostClock(host, clock)
+
+	inst.SetClock(clock)
+	inst.SetTransport(s.network.Transport(host))
+	inst.SetSeed(s.rand.Int63())
+	inst.SetAnnounce(false)
+
+	n := &Node{host, inst, true}
+	live := s.Alive()
+	s.nodes = append(s.nodes, n)
+
+	if len(live) == 0 {
+		s.printf("%s starts a new network", host)
+		s.do(func() { inst.Start(simulationPort, "", "") })
+		return n
+	}
+
+	seed := live[s.rand.Intn(len(live))]
+	s.printf("%s joins through %s", host, seed.Host)
+	s.do(func() { inst.Join([]string{s.address(seed)}, simulationPort, "", "") })
+
+	return n
+}
+
+func (s *Simulation) address(n *Node) string {
+	return fmt.Sprintf("%s:%d", n.Host, simulationPort)
+}
+
+// stops the node, its connections are closed as if the process died
+func (s *Simulation) Kill(ns ...*Node) {
+	for _, n := range ns {
+		s.printf("%s killed", n.Host)
+		n.alive = false
+	}
+
+	s.do(func() {
+		for _, n := range ns {
+			n.Instance.Disconnect()
+		}
+	})
+}
+
+// disconnects the nodes which are still alive without reporting it, so that a finished simulation
+// doesn't leave goroutines behind for the next one to wait for
+func (s *Simulation) Stop() {
+	live := s.Alive()
+
+	for _, n := range live {
+		n.alive = false
+	}
+
+	s.do(func() {
+		for _, n := range live {
+			n.Instance.Disconnect()
+		}
+	})
+}
+
+// nodes of different groups can't reach each other until healed
+func (s *Simulation) Partition(groups ...[]*Node) {
+	var names []string
+
+	for i, g := range groups {
+		names = append(names, "{"+hostsToString(g)+"}")
+
+		for _, o := range groups[i+1:] {
+			for _, a := range g {
+				for _, b := range o {
+					s.network.Partition(a.Host, b.Host)
+				}
+			}
+		}
+	}
+
+	s.printf("partition %s", strings.Join(names, " "))
+}
+
+func (s *Simulation) HealAll() {
+	s.printf("partitions healed")
+	s.network.HealAll()
+}
+
+func (s *Simulation) Run(d time.Duration) {
+	s.clock.Advance(d)
+}
+
+func (s *Simulation) Nodes() []*Node {
+	return s.nodes
+}
+
+func (s *Simulation) Alive() []*Node {
+	var rtn []*Node
+
+	for _, n := range s.nodes {
+		if n.alive {
+			rtn = append(rtn, n)
+		}
+	}
+
+	return rtn
+}
+
+func (s *Simulation) byID(id uint64) *Node {
+	for _, n := range s.nodes {
+		if n.alive && n.Instance.Snapshot().NodeID == id {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// node at the given relation of n, nil if there is none or it isn't a live node
+func (s *Simulation) Peer(n *Node, relation string) *Node {
+	for _, p := range n.Instance.Snapshot().Peers {
+		if p.Relation == relation {
+			return s.byID(p.ID)
+		}
+	}
+
+	return nil
+}
+
+// leader as seen by n
+func (s *Simulation) Leader(n *Node) *Node {
+	return s.byID(n.Instance.Snapshot().LeaderID)
+}
+
+// advances the time until every group forms a network of its own satisfying the invariants, fails after limit
+func (s *Simulation) Converge(limit time.Duration, groups ...[]*Node) error {
+	if len(groups) == 0 {
+		groups = [][]*Node{s.Alive()}
+	}
+
+	var violations []string
+	start := s.clock.Now()
+
+	for {
+		violations = nil
+
+		for _, g := range groups {
+			violations = append(violations, s.CheckInvariants(g)...)
+		}
+
+		if len(violations) == 0 {
+			s.printf("invariants hold after %s", s.clock.Now().Sub(start))
+			return nil
+		}
+
+		if s.clock.Now().Sub(start) >= limit {
+			break
+		}
+
+		s.clock.Advance(convergeCheckSeconds * time.Second)
+	}
+
+	for _, v := range violations {
+		s.printf("violated: %s", v)
+	}
+
+	return fmt.Errorf("invariants don't hold after %s (seed %d): %s", limit, s.seed, strings.Join(violations, "; "))
+}
+
+// a group of one is a single node network leading itself, a larger group is a closed ring of exactly its
+// members where every node has one next and one prev and all of them agree on a single leader among them
+func (s *Simulation) CheckInvariants(group []*Node) []string {
+	var violations []string
+
+	snapshots := make(map[*Node]distrochya.Snapshot)
+	ids := make(map[uint64]*Node)
+
+	for _, n := range group {
+		snapshot := n.Instance.Snapshot()
+		snapshots[n] = snapshot
+		ids[snapshot.NodeID] = n
+	}
+
+	if len(group) == 1 {
+		n := group[0]
+
+		if snapshots[n].State != "Single Node" {
+			violations = append(violations, fmt.Sprintf("%s is alone but in state %q", n.Host, snapshots[n].State))
+		}
+
+		if snapshots[n].LeaderID != snapshots[n].NodeID {
+			violations = append(violations, fmt.Sprintf("%s is alone but doesn't lead itself", n.Host))
+		}
+
+		return violations
+	}
+
+	nexts := make(map[*Node]*Node)
+	prevs := make(map[*Node]*Node)
+	leaders := make(map[uint64]bool)
+	selfLeaders := 0
+
+	for _, n := range group {
+		snapshot := snapshots[n]
+
+		if snapshot.State != "Ring" {
+			violations = append(violations, fmt.Sprintf("%s is in state %q", n.Host, snapshot.State))
+		}
+
+		for _, r := range []string{"next", "prev"} {
+			var found []uint64
+
+			for _, p := range snapshot.Peers {
+				if p.Relation == r {
+					found = append(found, p.ID)
+				}
+			}
+
+			if len(found) != 1 {
+				violations = append(violations, fmt.Sprintf("%s has %d %s nodes", n.Host, len(found), r))
+				continue
+			}
+
+			peer := ids[found[0]]
+
+			if peer == nil {
+				violations = append(violations, fmt.Sprintf("%s has %s 0x%X outside of {%s}", n.Host, r, found[0], hostsToString(group)))
+			} else if r == "next" {
+				nexts[n] = peer
+			} else {
+				prevs[n] = peer
+			}
+		}
+
+		leaders[snapshot.LeaderID] = true
+
+		if snapshot.LeaderID == snapshot.NodeID {
+			selfLeaders++
+		}
+	}
+
+	if len(leaders) != 1 {
+		violations = append(violations, fmt.Sprintf("{%s} disagree on the leader (%d different)", hostsToString(group), len(leaders)))
+	} else if selfLeaders != 1 {
+		violations = append(violations, fmt.Sprintf("{%s} have %d leaders", hostsToString(group), selfLeaders))
+	}
+
+	for a, b := range nexts {
+		if prevs[b] != a {
+			violations = append(violations, fmt.Sprintf("%s has next %s but its prev isn't %s", a.Host, b.Host, a.Host))
+		}
+	}
+
+	// walk the ring from the first node
+	visited := make(map[*Node]bool)
+	n := group[0]
+
+	for n != nil && !visited[n] {
+		visited[n] = true
+		n = nexts[n]
+	}
+
+	if n != group[0] || len(visited) != len(group) {
+		violations = append(violations, fmt.Sprintf("ring of {%s} isn't closed, %d nodes reachable from %s", hostsToString(group), len(visited), group[0].Host))
+	}
+
+	sort.Strings(violations)
+	return violations
+}
+
+func hostsToString(ns []*Node) string {
+	var hosts []string
+
+	for _, n := range ns {
+		hosts = append(hosts, n.Host)
+	}
+
+	return strings.Join(hosts, ",")
+}
@@ -0,0 +1,243 @@
+package distrochya
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	stateFileName             = "state.json"
+	stateSaveDelaySeconds     = 1
+	stateMaxPersistedPeers    = 16
+	stateFilePermissions      = 0600
+	stateDirectoryPermissions = 0700
+)
+
+type persistedPeer struct {
+	ID        string   `json:"id"`
+	Endpoints []string `json:"endpoints"`
+}
+
+type persistedState struct {
+	NetworkID   string          `json:"network_id"`
+	NetworkName string          `json:"network_name"`
+	Nickname    string          `json:"nickname"`
+	Port        uint16          `json:"port"`
+	Peers       []persistedPeer `json:"peers"`
+	Key         string          `json:"key,omitempty"` // seed of the identity key
+}
+
+func (inst *Instance) SetStateFile(p string) {
+	inst.stateFileMutex.Lock()
+	inst.stateFile = p
+	inst.stateFileMutex.Unlock()
+}
+
+func (inst *Instance) StateFile() string {
+	inst.stateFileMutex.Lock()
+	rtn := inst.stateFile
+	inst.stateFileMutex.Unlock()
+
+	if len(rtn) == 0 {
+		dir, err := os.UserConfigDir()
+
+		if err != nil {
+			dir = "."
+		}
+
+		rtn = filepath.Join(dir, "distrochya", stateFileName)
+	}
+
+	return rtn
+}
+
+// saves the state shortly, so bursts of changes result in a single write
+func (inst *Instance) scheduleStateSave() {
+	if !atomic.CompareAndSwapUint32(&inst.stateSavePending, 0, 1) {
+		return
+	}
+
+	inst.getClock().AfterFunc(stateSaveDelaySeconds*time.Second, func() {
+		atomic.StoreUint32(&inst.stateSavePending, 0)
+		inst.saveState()
+	})
+}
+
+// peers we are directly connected to go first, they are the most likely to be still around
+func (inst *Instance) collectPersistedPeers() []persistedPeer {
+	var ids []uint64
+
+	for _, r := range []relation{next, prev, leader} {
+		if n := inst.findNodeByRelation(r); n != nil {
+			n.lock.Lock()
+			ids = append(ids, n.id)
+			n.lock.Unlock()
+		}
+	}
+
+	ids = append(ids, inst.getTwiceNextNodeID(), inst.LeaderID())
+
+	inst.endpointsMutex.Lock()
+	for id := range inst.endpoints {
+		ids = append(ids, id)
+	}
+	inst.endpointsMutex.Unlock()
+
+	seen := make(map[uint64]bool)
+	var rtn []persistedPeer
+
+	for _, id := range ids {
+		if id == 0 || id == inst.getNodeID() || seen[id] || len(rtn) >= stateMaxPersistedPeers {
+			continue
+		}
+		seen[id] = true
+
+		var eps []string
+
+		for _, ep := range inst.getEndpoints(id) {
+			if !strings.HasPrefix(ep, relayEndpointPrefix) {
+				eps = append(eps, ep)
+			}
+		}
+
+		if len(eps) > 0 {
+			rtn = append(rtn, persistedPeer{idToString(id), eps})
+		}
+	}
+
+	return rtn
+}
+
+func (inst *Instance) saveState() {
+	if !inst.IsRunning() {
+		return
+	}
+
+	netID, netName := inst.NetworkInfo()
+	peers := inst.collectPersistedPeers()
+
+	// nothing worth remembering, keep the previous state
+	if len(peers) == 0 {
+		return
+	}
+
+	inst.networkGlobalsMutex.Lock()
+	port := inst.serverPort
+	inst.networkGlobalsMutex.Unlock()
+
+	b, err := json.MarshalIndent(persistedState{idToString(netID), netName, inst.ChatName(), port, peers, hex.EncodeToString(inst.identityKey().Seed())}, "", "  ")
+
+	if err != nil {
+		inst.errorLog("Failed to serialize state: " + err.Error())
+		return
+	}
+
+	p := inst.StateFile()
+
+	if err := os.MkdirAll(filepath.Dir(p), stateDirectoryPermissions); err != nil {
+		inst.errorLog("Failed to save state: " + err.Error())
+		return
+	}
+
+	// write and rename so a crash doesn't leave a truncated file behind
+	if err := ioutil.WriteFile(p+".tmp", b, stateFilePermissions); err != nil {
+		inst.errorLog("Failed to save state: " + err.Error())
+		return
+	}
+
+	if err := os.Rename(p+".tmp", p); err != nil {
+		inst.errorLog("Failed to save state: " + err.Error())
+		return
+	}
+
+	inst.debugLog("State saved to " + p)
+}
+
+func (inst *Instance) loadState() (*persistedState, error) {
+	b, err := ioutil.ReadFile(inst.StateFile())
+
+	if err != nil {
+		return nil, err
+	}
+
+	var s persistedState
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (inst *Instance) restoreIdentityKey(s *persistedState) {
+	if seed, err := hex.DecodeString(s.Key); err == nil && len(seed) == ed25519.SeedSize {
+		inst.setIdentityKey(ed25519.NewKeyFromSeed(seed))
+	}
+}
+
+// takes the identity key of earlier runs from the state file, so bans by its fingerprint outlive restarts;
+// without a state file a new key is generated and saved with the state, has to be called before starting or joining
+func (inst *Instance) LoadIdentity() error {
+	s, err := inst.loadState()
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	inst.restoreIdentityKey(s)
+	return nil
+}
+
+func (inst *Instance) checkExpectedNetworkID(id uint64) {
+	expected := atomic.SwapUint64(&inst.expectedNetworkID, 0)
+
+	if expected != 0 && expected != id {
+		inst.userEvent(fmt.Sprintf("warning: rejoined a different network (0x%X) than before (0x%X)", id, expected))
+	}
+}
+
+// tries the persisted peers in order until one of them lets us in
+func (inst *Instance) Rejoin() {
+	s, err := inst.loadState()
+
+	if err != nil {
+		inst.userError("unable to rejoin: " + err.Error())
+		return
+	}
+
+	if len(s.Nickname) > 0 {
+		inst.SetChatName(s.Nickname)
+	}
+
+	inst.restoreIdentityKey(s)
+
+	if id, err := stringToID(s.NetworkID); err == nil {
+		atomic.StoreUint64(&inst.expectedNetworkID, id)
+	}
+
+	inst.userEvent(fmt.Sprintf("rejoining %s as %s", s.NetworkName, inst.ChatName()))
+	bind, advertise := inst.DefaultAddresses()
+
+	var seeds []string
+
+	for _, peer := range s.Peers {
+		seeds = append(seeds, peer.Endpoints...)
+	}
+
+	if !inst.Join(seeds, s.Port, bind, advertise) {
+		atomic.StoreUint64(&inst.expectedNetworkID, 0)
+		inst.userError("unable to rejoin: none of the known peers is reachable")
+	}
+}
@@ -0,0 +1,82 @@
+package distrochya
+
+import (
+	"strings"
+	"time"
+)
+
+// kinds of trace entries
+const (
+	TraceSend    = "send"
+	TraceReceive = "recv"
+	TraceLog     = "log"
+)
+
+// protocol event of the node, Time is the logical time at which it happened,
+// so traces of several nodes can be merged into a single causally ordered timeline
+type TraceEntry struct {
+	Time     uint64
+	Wall     time.Time
+	NodeID   uint64
+	Kind     string
+	PeerID   uint64
+	Relation string
+	Message  string // type of the protocol message
+	SentAt   uint64 // for received messages, logical time of the send on the peer
+	Params   string // parameters of the message
+	Text     string // log entry, or why a message wasn't delivered
+}
+
+func (inst *Instance) trace(e TraceEntry) {
+	e.Wall = inst.getClock().Now()
+	e.NodeID = inst.getNodeID()
+
+	max := inst.Config().MaxTraceEntries
+
+	inst.traceMutex.Lock()
+	defer inst.traceMutex.Unlock()
+
+	if max <= 0 {
+		return
+	}
+
+	if len(inst.traceEntries) < max {
+		inst.traceEntries = append(inst.traceEntries, e)
+		return
+	}
+
+	inst.traceEntries[inst.traceStart] = e
+	inst.traceStart = (inst.traceStart + 1) % len(inst.traceEntries)
+}
+
+// recorded entries, oldest first
+func (inst *Instance) Trace() []TraceEntry {
+	inst.traceMutex.Lock()
+	defer inst.traceMutex.Unlock()
+
+	rtn := make([]TraceEntry, 0, len(inst.traceEntries))
+	rtn = append(rtn, inst.traceEntries[inst.traceStart:]...)
+	rtn = append(rtn, inst.traceEntries[:inst.traceStart]...)
+
+	return rtn
+}
+
+func (inst *Instance) ClearTrace() {
+	inst.traceMutex.Lock()
+	defer inst.traceMutex.Unlock()
+
+	inst.traceEntries = nil
+	inst.traceStart = 0
+}
+
+func (n *Node) traceMessage(kind string, time uint64, sentAt uint64, m []string, text string) {
+	r, id := n.relationAndID()
+	e := TraceEntry{Time: time, Kind: kind, PeerID: id, Relation: string(r), SentAt: sentAt, Text: text}
+
+	if len(m) > 0 {
+		e.Message = m[0]
+		e.Params = strings.Join(m[1:], sepchar)
+	}
+
+	n.inst.trace(e)
+}
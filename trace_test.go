@@ -0,0 +1,63 @@
+package distrochya
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTraceRecordsMessages(t *testing.T) {
+	ti := newTestInstance(t)
+	n, p := ti.peer(t, next, testPeerID)
+	ti.currentTime = 10
+
+	n.processMessage(testMessage(20, nextinfo, testPeerToken(0x3000)))
+	n.sendMessage(alivecheck, "x")
+	p.expect(t, alivecheck)
+
+	var recv, send, logged []TraceEntry
+
+	for _, e := range ti.Trace() {
+		switch e.Kind {
+		case TraceReceive:
+			recv = append(recv, e)
+		case TraceSend:
+			send = append(send, e)
+		case TraceLog:
+			logged = append(logged, e)
+		}
+	}
+
+	if len(recv) != 1 || recv[0].Time != 21 || recv[0].SentAt != 20 || recv[0].Message != nextinfo || recv[0].PeerID != testPeerID || recv[0].Relation != string(next) || recv[0].NodeID != testNodeID {
+		t.Errorf("received %+v", recv)
+	}
+
+	if len(send) != 1 || send[0].Time <= 21 || send[0].SentAt != send[0].Time || send[0].Message != alivecheck || send[0].Params != "x" {
+		t.Errorf("sent %+v", send)
+	}
+
+	// the log entry of the received message comes between the receive and the send
+	if len(logged) != 1 || logged[0].Time <= 21 || logged[0].Time >= send[0].Time || logged[0].Message != nextinfo {
+		t.Errorf("logged %+v", logged)
+	}
+}
+
+func TestTraceKeepsLatestEntries(t *testing.T) {
+	ti := newTestInstance(t)
+	ti.tune(func(c *Config) { c.MaxTraceEntries = 3 })
+
+	for i := 0; i < 5; i++ {
+		ti.log(fmt.Sprintf("entry %d", i))
+	}
+
+	entries := ti.Trace()
+
+	if len(entries) != 3 || entries[0].Text != "entry 2" || entries[2].Text != "entry 4" {
+		t.Fatalf("trace %+v, want the last 3 entries", entries)
+	}
+
+	ti.ClearTrace()
+
+	if len(ti.Trace()) != 0 {
+		t.Error("trace not cleared")
+	}
+}
@@ -0,0 +1,70 @@
+package distrochya
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// how nodes reach each other, connections carry the same byte stream whatever the transport is
+type Transport interface {
+	Listen(address string) (net.Listener, error)
+	// local is the bind address outbound connections should be made from, empty or unspecified for any
+	Dial(local string, address string, timeout time.Duration) (net.Conn, error)
+	// addresses a listener on port can be reached at, used when neither bind nor advertised address is given
+	LocalEndpoints(port uint16) []string
+}
+
+type TCPTransport struct {
+}
+
+func (TCPTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func (TCPTransport) Dial(local string, address string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+
+	if ip := net.ParseIP(local); ip != nil && !ip.IsUnspecified() {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	return d.Dial("tcp", address)
+}
+
+func (TCPTransport) LocalEndpoints(port uint16) []string {
+	return discoverLocalEndpoints(port)
+}
+
+// has to be called before the instance starts or joins a network
+func (inst *Instance) SetTransport(t Transport) {
+	inst.transportMutex.Lock()
+	inst.transport = t
+	inst.transportMutex.Unlock()
+}
+
+func (inst *Instance) getTransport() Transport {
+	inst.transportMutex.Lock()
+	defer inst.transportMutex.Unlock()
+
+	return inst.transport
+}
+
+func (inst *Instance) dial(address string) (net.Conn, error) {
+	inst.networkGlobalsMutex.Lock()
+	bind := inst.serverBind
+	inst.networkGlobalsMutex.Unlock()
+
+	return inst.getTransport().Dial(bind, address, time.Duration(inst.Config().DialTimeoutSeconds)*time.Second)
+}
+
+func listenerPort(l net.Listener) uint16 {
+	_, port, err := net.SplitHostPort(l.Addr().String())
+
+	if err != nil {
+		return 0
+	}
+
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return uint16(p)
+}